@@ -0,0 +1,39 @@
+package cmd
+
+import "strings"
+
+// hasFlag reports whether a bare flag such as --dry-run is present
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == name {
+			return true
+		}
+	}
+	return false
+}
+
+// flagValue returns the value of "--name value" or "--name=value", or "" if absent
+func flagValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+	return ""
+}
+
+// flagValues returns every value of a flag that may be repeated
+func flagValues(args []string, name string) []string {
+	var values []string
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			values = append(values, args[i+1])
+		} else if strings.HasPrefix(arg, name+"=") {
+			values = append(values, strings.TrimPrefix(arg, name+"="))
+		}
+	}
+	return values
+}
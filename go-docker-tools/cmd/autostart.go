@@ -1,15 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 
 	"github.com/FabulaNox/go-docker-tools/config"
 	"github.com/FabulaNox/go-docker-tools/internal"
+	"github.com/docker/docker/api/types"
 )
 
-// AutostartCommand starts containers marked for autostart in config or by label.
+// AutostartCommand starts containers marked for autostart in config or by label,
+// or every container of a compose project with --project. Containers start after
+// their dependencies, waiting for each dependency's readiness gate to pass.
 func AutostartCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
 	dryRun := false
 	for _, arg := range args {
@@ -25,25 +29,88 @@ func AutostartCommand(conf *config.Config, dockerHelper *internal.DockerHelper,
 		internal.RunHook(conf.HookScript, "autostart_failed")
 		os.Exit(21)
 	}
-	count := 0
-	for _, c := range containers {
-		if c.Labels["autostart"] == "true" {
-			if dryRun {
-				logger.Printf("[DRY-RUN] Would start container: %s", c.Names[0])
-				fmt.Printf("[DRY-RUN] Would start container: %s\n", c.Names[0])
-				count++
-				continue
+	// --project starts a whole compose project; otherwise the autostart label selects
+	project := flagValue(args, "--project")
+	var selected []types.Container
+	for _, e := range internal.EntriesFromContainers(containers) {
+		if (project != "" && internal.InProject(e, project)) || (project == "" && e.Labels["autostart"] == "true") {
+			selected = append(selected, e.Container)
+		}
+	}
+	// Full specs, so host ports can be checked before starting
+	ordered, err := internal.StartupOrder(internal.CaptureState(dockerHelper, selected, logger).Containers)
+	if err != nil {
+		msg := "[ERROR] Cannot order autostart containers: " + err.Error()
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+		internal.RunHook(conf.HookScript, "autostart_failed")
+		os.Exit(21)
+	}
+	policy := flagValue(args, "--port-policy")
+	if policy == "" {
+		policy = conf.PortConflictPolicy
+	}
+	ports, err := internal.NewPortGuard(dockerHelper, policy)
+	if err != nil {
+		msg := "[ERROR] Cannot check host ports: " + err.Error()
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.RunHook(conf.HookScript, "autostart_failed")
+		os.Exit(21)
+	}
+	if ports.Policy == internal.PortPolicyRemap {
+		// Existing containers are started as they are, never re-created
+		msg := "[WARN] autostart does not re-create containers to remap ports; port conflicts fail instead. Use restore to remap."
+		logger.Print(msg)
+		fmt.Println(msg)
+		ports.Policy = internal.PortPolicyFail
+	}
+	if dryRun {
+		for _, e := range ordered {
+			for _, c := range ports.Conflicts(e) {
+				fmt.Printf("[DRY-RUN] %s: %s (port policy %s)\n", e.Name(), c, ports.Policy)
 			}
-			err := dockerHelper.StartContainerByID(c.ID)
-			if err != nil {
-				logger.Printf("Failed to start container %s: %v", c.Names[0], err)
-				continue
+			gate, err := internal.ParseReadinessGate(e)
+			switch {
+			case err != nil:
+				fmt.Printf("[DRY-RUN] Would start container: %s (%v)\n", e.Name(), err)
+			case gate != nil:
+				fmt.Printf("[DRY-RUN] Would start container: %s, then wait up to %s for %s\n", e.Name(), gate.Timeout, gate)
+			default:
+				fmt.Printf("[DRY-RUN] Would start container: %s\n", e.Name())
 			}
-			logger.Printf("Started container: %s", c.Names[0])
-			fmt.Printf("[NOTIFY] Started container: %s\n", c.Names[0])
-			count++
+			logger.Printf("[DRY-RUN] Would start container: %s", e.Name())
 		}
+		fmt.Printf("[NOTIFY] Autostart would start %d containers: %s\n", len(ordered), internal.ProjectSummary(ordered))
+		internal.RunHook(conf.HookScript, "post_autostart")
+		return
 	}
-	fmt.Printf("[NOTIFY] Autostarted %d containers.\n", count)
+	count, failed, skipped := 0, 0, 0
+	internal.StartInOrder(context.Background(), dockerHelper, ordered, internal.StartupDeps(ordered), ports, logger, func(r internal.StartResult) {
+		switch {
+		case internal.IsPortSkip(r.Err):
+			skipped++
+			msg := fmt.Sprintf("[WARN] Skipped container %s: %v", r.Container, r.Err)
+			logger.Print(msg)
+			fmt.Println(msg)
+			internal.SendSlackNotification(msg)
+		case r.Err != nil:
+			failed++
+			msg := fmt.Sprintf("[ERROR] Failed to start container %s: %v", r.Container, r.Err)
+			logger.Print(msg)
+			fmt.Println(msg)
+			internal.SendSlackNotification(msg)
+		case r.Gate != nil:
+			count++
+			logger.Printf("Started container: %s (%s ready after %s)", r.Container, r.Gate, r.Waited)
+			fmt.Printf("[NOTIFY] Started container: %s (%s ready after %s)\n", r.Container, r.Gate, r.Waited)
+		default:
+			count++
+			logger.Printf("Started container: %s", r.Container)
+			fmt.Printf("[NOTIFY] Started container: %s\n", r.Container)
+		}
+	})
+	fmt.Printf("[NOTIFY] Autostarted %d containers (%d failed, %d skipped): %s\n", count, failed, skipped, internal.ProjectSummary(ordered))
 	internal.RunHook(conf.HookScript, "post_autostart")
 }
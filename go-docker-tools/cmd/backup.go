@@ -4,18 +4,38 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/FabulaNox/go-docker-tools/config"
 	"github.com/FabulaNox/go-docker-tools/internal"
 )
 
+// BackupCommand backs up volumes, or runs a named job with --job <name>
 func BackupCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "cat", "extract":
+			BackupBrowseCommand(conf, logger, args)
+			return
+		case "find":
+			BackupFindCommand(conf, logger, args)
+			return
+		case "index":
+			BackupIndexCommand(conf, logger, args)
+			return
+		}
+	}
 	dryRun := false
 	for _, arg := range args {
 		if arg == "--dry-run" {
 			dryRun = true
 		}
 	}
+	if jobName := flagValue(args, "--job"); jobName != "" {
+		runBackupJob(conf, dockerHelper, logger, jobName, dryRun)
+		return
+	}
 	lock := internal.NewLockfileHelper(conf.BackupDir + ".lock")
 	if !lock.TryLock() {
 		logger.Println("Another backup is in progress.")
@@ -46,3 +66,50 @@ func BackupCommand(conf *config.Config, dockerHelper *internal.DockerHelper, log
 	internal.SendSlackNotification("[NOTIFY] Backup completed successfully.")
 	internal.RunHook(conf.HookScript, "post_backup")
 }
+
+// runBackupJob runs one named job from the BACKUP_JOBS config section
+func runBackupJob(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, jobName string, dryRun bool) {
+	job := conf.FindBackupJob(jobName)
+	if job == nil {
+		fmt.Println("[ERROR] Unknown backup job:", jobName)
+		os.Exit(12)
+	}
+	if err := os.MkdirAll(conf.StateDir, 0755); err != nil {
+		logger.Println("Failed to create state dir:", err)
+	}
+	lock := internal.NewLockfileHelper(filepath.Join(conf.StateDir, "job_"+job.Name+".lock"))
+	if !lock.TryLock() {
+		logger.Printf("Backup job %s is already running.", job.Name)
+		internal.SendSlackNotification("[ERROR] Backup job " + job.Name + " is already running.")
+		internal.RunHook(conf.HookScript, "backup_locked")
+		os.Exit(10)
+	}
+	defer lock.Unlock()
+
+	if dryRun {
+		plan, err := internal.PlanBackupJob(*job, dockerHelper)
+		if err != nil {
+			fmt.Println("[ERROR] Failed to resolve job:", err)
+			os.Exit(11)
+		}
+		fmt.Printf("[DRY-RUN] Job %s would back up volumes: %s\n", job.Name, strings.Join(plan.Volumes, ", "))
+		fmt.Printf("[DRY-RUN] Consistency: %s, affected containers: %d\n", job.Consistency, len(plan.Containers))
+		return
+	}
+	internal.RunHook(conf.HookScript, "pre_backup")
+	msg := fmt.Sprintf("[NOTIFY] Starting backup job %s...", job.Name)
+	fmt.Println(msg)
+	internal.SendSlackNotification(msg)
+	result, err := internal.RunBackupJob(conf, dockerHelper, logger, *job)
+	if err != nil {
+		logger.Printf("Backup job %s failed: %v", job.Name, err)
+		internal.SendSlackNotification("[ERROR] Backup job " + job.Name + " failed: " + err.Error())
+		internal.RunHook(conf.HookScript, "backup_failed")
+		os.Exit(11)
+	}
+	msg = fmt.Sprintf("[NOTIFY] Backup job %s completed: %s (%d volumes)", job.Name, result.Archive, len(result.Volumes))
+	logger.Println(msg)
+	fmt.Println(msg)
+	internal.SendSlackNotification(msg)
+	internal.RunHook(conf.HookScript, "post_backup")
+}
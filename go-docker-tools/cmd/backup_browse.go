@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// resolveArchive accepts a path or the file name of an archive known to the snapshot catalog
+func resolveArchive(conf *config.Config, logger *log.Logger, name string) string {
+	if _, err := os.Stat(name); err == nil {
+		return name
+	}
+	catalog, err := internal.RefreshSnapshotCatalog(conf, logger, false)
+	if err == nil {
+		for _, e := range catalog.Entries {
+			if filepath.Base(e.Path) == name {
+				return e.Path
+			}
+		}
+	}
+	fmt.Println("[ERROR] Archive not found:", name)
+	os.Exit(13)
+	return ""
+}
+
+// archiveKeyFromArgs loads --key-file, falling back to the key of the job that wrote the archive
+func archiveKeyFromArgs(conf *config.Config, archive string, args []string) *internal.EncryptionKey {
+	if keyFile := flagValue(args, "--key-file"); keyFile != "" {
+		key, err := internal.LoadEncryptionKey(keyFile)
+		if err != nil {
+			fmt.Println("[ERROR] Failed to read key file:", err)
+			os.Exit(13)
+		}
+		return key
+	}
+	return internal.ArchiveKey(conf, archive)
+}
+
+// positionalArgs drops flags (and their values) from args
+func positionalArgs(args []string, valueFlags ...string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) > 1 && arg[0] == '-' {
+			for _, f := range valueFlags {
+				if arg == f {
+					i++
+					break
+				}
+			}
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// BackupBrowseCommand implements backup ls, cat and extract; it only reads archives
+func BackupBrowseCommand(conf *config.Config, logger *log.Logger, args []string) {
+	pos := positionalArgs(args, "--to", "--key-file")
+	usage := "Usage: go-docker-tools backup ls <archive> [path] | cat <archive> <file> | extract <archive> <path> --to <dir>"
+	if len(pos) < 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	archive := resolveArchive(conf, logger, pos[1])
+	key := archiveKeyFromArgs(conf, archive, args)
+	switch pos[0] {
+	case "ls":
+		prefix := ""
+		if len(pos) > 2 {
+			prefix = pos[2]
+		}
+		files, err := internal.ListArchive(archive, key, prefix)
+		if err != nil {
+			fmt.Println("[ERROR] Failed to read archive:", err)
+			os.Exit(14)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, f := range files {
+			name := f.DisplayPath()
+			if f.Type == "symlink" {
+				name += " -> " + f.LinkName
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", f.Mode, f.Size, f.ModTime.Format("2006-01-02 15:04:05"), name)
+		}
+		w.Flush()
+	case "cat":
+		if len(pos) < 3 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		if err := internal.CatArchiveFile(archive, key, pos[2], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]", err)
+			os.Exit(14)
+		}
+	case "extract":
+		dest := flagValue(args, "--to")
+		if len(pos) < 3 || dest == "" {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		n, err := internal.ExtractArchivePath(archive, key, pos[2], dest)
+		if err != nil {
+			logger.Printf("Extract of %s from %s failed: %v", pos[2], archive, err)
+			fmt.Println("[ERROR] Extract failed:", err)
+			os.Exit(14)
+		}
+		if n == 0 {
+			fmt.Printf("[ERROR] %s not found in %s\n", pos[2], archive)
+			os.Exit(14)
+		}
+		logger.Printf("[USER] Extracted %s from %s to %s (%d entries)", pos[2], archive, dest, n)
+		fmt.Printf("[NOTIFY] Extracted %d entries to %s\n", n, dest)
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+}
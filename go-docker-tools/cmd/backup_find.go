@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// BackupFindCommand lists which backups hold which version of files matching a glob
+func BackupFindCommand(conf *config.Config, logger *log.Logger, args []string) {
+	pos := positionalArgs(args, "--volume")
+	if len(pos) < 2 {
+		fmt.Println("Usage: go-docker-tools backup find <glob> [--volume <name>]")
+		os.Exit(1)
+	}
+	pattern := pos[1]
+	volumeFilter := flagValue(args, "--volume")
+	catalog, err := internal.RefreshSnapshotCatalog(conf, logger, false)
+	if err != nil {
+		fmt.Println("[ERROR] Failed to index backups:", err)
+		os.Exit(1)
+	}
+	matches, unindexed := internal.FindInArchives(conf, catalog, pattern, logger)
+	sort.SliceStable(matches, func(i, j int) bool {
+		pi, pj := matches[i].File.DisplayPath(), matches[j].File.DisplayPath()
+		if pi != pj {
+			return pi < pj
+		}
+		return matches[i].Archive.Timestamp.Before(matches[j].Archive.Timestamp)
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tSIZE\tMTIME\tBACKUP TIME\tARCHIVE")
+	count := 0
+	last := ""
+	for _, m := range matches {
+		if volumeFilter != "" && m.File.Volume != volumeFilter {
+			continue
+		}
+		name := m.File.DisplayPath()
+		if name == last {
+			name = "  \""
+		} else {
+			last = name
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", name, m.File.Size, m.File.ModTime.Format("2006-01-02 15:04:05"),
+			m.Archive.Timestamp.Format("2006-01-02 15:04:05"), m.Archive.Path)
+		count++
+	}
+	w.Flush()
+	fmt.Printf("%d matches.\n", count)
+	if len(unindexed) > 0 {
+		fmt.Printf("[WARN] %d archives have no readable file index and were not searched. Run 'backup index' to build them.\n", len(unindexed))
+	}
+}
+
+// BackupIndexCommand builds file indexes for archives that lack one (all archives with --rebuild)
+func BackupIndexCommand(conf *config.Config, logger *log.Logger, args []string) {
+	rebuild := hasFlag(args, "--rebuild")
+	catalog, err := internal.RefreshSnapshotCatalog(conf, logger, false)
+	if err != nil {
+		fmt.Println("[ERROR] Failed to index backups:", err)
+		os.Exit(1)
+	}
+	built, failed := 0, 0
+	for _, e := range catalog.Entries {
+		key := internal.ArchiveKey(conf, e.Path)
+		if !rebuild {
+			if index, err := internal.LoadArchiveIndex(e.Path, key); err == nil && index != nil {
+				continue
+			}
+		}
+		n, err := internal.BuildArchiveIndex(e.Path, key)
+		if err != nil {
+			logger.Printf("[WARN] Failed to index %s: %v", e.Path, err)
+			fmt.Printf("[WARN] Failed to index %s: %v\n", e.Path, err)
+			failed++
+			continue
+		}
+		logger.Printf("Indexed %s (%d files)", e.Path, n)
+		built++
+	}
+	fmt.Printf("[NOTIFY] Built %d file indexes (%d failed).\n", built, failed)
+}
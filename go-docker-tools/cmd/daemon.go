@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// DaemonCommand runs in the foreground, keeping the state file and JSON inventory
+// current from Docker events until it receives SIGINT or SIGTERM. Unless --no-heal is
+// given it also heals containers that opted in with heal.* labels. Container state
+// and health are sampled into the health history for report uptime.
+func DaemonCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	if conf.StateFile == "" {
+		fmt.Println("[ERROR] STATE_FILE must be set to run the daemon.")
+		os.Exit(1)
+	}
+	lock := internal.NewLockfileHelper(filepath.Join(conf.StateDir, "daemon.lock"))
+	if !lock.TryLock() {
+		fmt.Println("[ERROR] Another daemon is already running.")
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	msg := fmt.Sprintf("[NOTIFY] Daemon started; maintaining %s (debounce %s).", conf.StateFile, conf.EventDebounce)
+	logger.Print(msg)
+	fmt.Println(msg)
+	internal.RunHook(conf.HookScript, "daemon_start")
+	watcher := internal.NewInventoryWatcher(conf, dockerHelper, logger)
+	healErr := make(chan error, 1)
+	if hasFlag(args, "--no-heal") {
+		healErr <- nil
+	} else {
+		healer := internal.NewHealer(conf, dockerHelper, logger, func(a internal.HealAction) {
+			reportHealAction(conf, a)
+		})
+		go func() { healErr <- healer.Run(ctx) }()
+	}
+	collector := internal.NewHealthCollector(conf, dockerHelper, logger)
+	collectErr := make(chan error, 1)
+	go func() { collectErr <- collector.Run(ctx) }()
+	err := watcher.Run(ctx)
+	for _, ch := range []chan error{healErr, collectErr} {
+		if e := <-ch; err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		logger.Println("Daemon stopped with error:", err)
+		internal.SendSlackNotification("[ERROR] Daemon stopped: " + err.Error())
+		os.Exit(1)
+	}
+	logger.Println("Daemon stopped.")
+	fmt.Println("[NOTIFY] Daemon stopped.")
+	internal.RunHook(conf.HookScript, "daemon_stop")
+}
+
+// reportHealAction prints, notifies and fires the heal hooks for one detection
+func reportHealAction(conf *config.Config, a internal.HealAction) {
+	trigger := map[string]string{
+		internal.TriggerUnhealthy: "unhealthy",
+		internal.TriggerCrashLoop: "crash-looping",
+		internal.TriggerOOM:       "OOM-killed",
+	}[a.Trigger]
+	var msg string
+	switch {
+	case a.Err != nil:
+		msg = fmt.Sprintf("[ERROR] %s is %s; heal %s failed: %v", a.Container, trigger, a.Policy, a.Err)
+		internal.RunHook(conf.HookScript, "heal_failed")
+	case a.Suppressed:
+		msg = fmt.Sprintf("[WARN] %s is %s; heal %s suppressed (%s)", a.Container, trigger, a.Policy, a.Detail)
+	default:
+		msg = fmt.Sprintf("[NOTIFY] %s was %s; %s", a.Container, trigger, a.Detail)
+		internal.RunHook(conf.HookScript, "heal_action")
+	}
+	fmt.Println(msg)
+	internal.SendSlackNotification(msg)
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// DriftCommand compares the saved state, or the declared manifest, with the live daemon.
+// Usage: drift [--state <snapshot> | --manifest [file]] [--json]
+// Exits 41 when drift is found so scheduled runs can alert on it.
+func DriftCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	var baseline *internal.SavedState
+	var baselinePath string
+	var err error
+	compare := internal.DiffEntries
+	if hasFlag(args, "--manifest") || flagValue(args, "--manifest") != "" {
+		var m *internal.Manifest
+		m, baselinePath = manifestFromArgs(conf, args)
+		baseline, err = m.DesiredState()
+		compare = internal.CompareManifestEntry
+	} else {
+		baseline, baselinePath, err = loadStateRef(conf, logger, flagValue(args, "--state"))
+	}
+	if err != nil {
+		logger.Println("Failed to load baseline state:", err)
+		fmt.Println("[ERROR] Failed to load baseline state:", err)
+		os.Exit(1)
+	}
+	live, err := internal.CaptureLiveState(dockerHelper, logger)
+	if err != nil {
+		logger.Println("Failed to list containers:", err)
+		internal.SendSlackNotification("[ERROR] Drift check failed: " + err.Error())
+		os.Exit(1)
+	}
+	report := internal.DetectDriftWith(baseline, live, baselinePath, compare)
+	printDriftReport(report, hasFlag(args, "--json"))
+
+	if internal.DriftChangedSinceLast(conf, report) {
+		if len(report.Items) > 0 {
+			msg := fmt.Sprintf("[WARN] Drift from %s: %s", baselinePath, report.Summary())
+			logger.Print(msg)
+			internal.SendSlackNotification(msg)
+			internal.RunHook(conf.HookScript, "drift_detected")
+		} else {
+			msg := "[NOTIFY] Drift resolved; the daemon matches " + baselinePath
+			logger.Print(msg)
+			internal.SendSlackNotification(msg)
+			internal.RunHook(conf.HookScript, "drift_resolved")
+		}
+	}
+	if len(report.Items) > 0 {
+		os.Exit(41)
+	}
+}
+
+func printDriftReport(report *internal.DriftReport, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	if len(report.Items) == 0 {
+		fmt.Println("No drift: the daemon matches", report.Baseline)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tDRIFT\tSTATE\tDETAILS")
+	for _, item := range report.Items {
+		details := make([]string, 0, len(item.Fields))
+		for _, f := range item.Fields {
+			details = append(details, f.String())
+		}
+		state := item.State
+		if state == "" {
+			state = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", item.Container, item.Kind, state, strings.Join(details, "; "))
+	}
+	w.Flush()
+}
@@ -4,12 +4,17 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/FabulaNox/go-docker-tools/config"
 	"github.com/FabulaNox/go-docker-tools/internal"
+	"github.com/docker/docker/api/types"
 )
 
-// ExitCommand stops all running containers marked for autostop in config or by label.
+// ExitCommand stops all running containers marked for autostop in config or by label,
+// or every container of a compose project with --project. The running containers are
+// saved first (unless --no-save); then dependents stop before their dependencies,
+// independent containers in parallel, using the autostop.signal and autostop.timeout labels.
 func ExitCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
 	dryRun := false
 	for _, arg := range args {
@@ -26,30 +31,118 @@ func ExitCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logge
 		internal.RunHook(conf.HookScript, "exit_failed")
 		os.Exit(31)
 	}
-	count := 0
-	for _, c := range containers {
-		if c.Labels["autostop"] == "true" && c.State == "running" {
-			if dryRun {
-				logger.Printf("[DRY-RUN] Would stop container: %s", c.Names[0])
-				fmt.Printf("[DRY-RUN] Would stop container: %s\n", c.Names[0])
-				count++
-				continue
-			}
-			err := dockerHelper.StopContainerByID(c.ID)
-			if err != nil {
-				logger.Printf("Failed to stop container %s: %v", c.Names[0], err)
-				internal.SendSlackNotification("[ERROR] Failed to stop container " + c.Names[0] + ": " + err.Error())
-				continue
-			}
-			logger.Printf("Stopped container: %s", c.Names[0])
-			msg := fmt.Sprintf("[NOTIFY] Stopped container: %s", c.Names[0])
-			fmt.Println(msg)
-			internal.SendSlackNotification(msg)
-			count++
+	// --project stops a whole compose project; otherwise the autostop label selects
+	project := flagValue(args, "--project")
+	var selected []internal.StateEntry
+	for _, e := range internal.EntriesFromContainers(containers) {
+		if e.State != "running" {
+			continue
+		}
+		if (project != "" && internal.InProject(e, project)) || (project == "" && e.Labels["autostop"] == "true") {
+			selected = append(selected, e)
+		}
+	}
+	deps := internal.StartupDeps(selected)
+	ordered, err := internal.StartupOrder(selected)
+	if err != nil {
+		// Shutting down must not hang on a bad label: stop everything at once instead
+		msg := "[WARN] Stopping without ordering: " + err.Error()
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+		ordered, deps = selected, nil
+	}
+	if dryRun {
+		for i := len(ordered) - 1; i >= 0; i-- {
+			e := ordered[i]
+			logger.Printf("[DRY-RUN] Would stop container: %s", e.Name())
+			fmt.Printf("[DRY-RUN] Would stop container: %s%s\n", e.Name(), describeStop(e))
 		}
+		fmt.Printf("[NOTIFY] Exit would stop %d containers.\n", len(ordered))
+		internal.RunHook(conf.HookScript, "post_exit")
+		return
 	}
+
+	// Record what ran so a later restore brings back exactly this. The lock is held
+	// until everything stopped, and the marker keeps a running daemon from dropping
+	// the stopped containers from the saved state afterwards.
+	if conf.StateFile != "" && !hasFlag(args, "--no-save") {
+		lock := internal.NewLockfileHelper(conf.StateFile + ".lock")
+		if lock.TryLock() {
+			defer lock.Unlock()
+			saveBeforeExit(conf, dockerHelper, logger, containers, project, ordered)
+		} else {
+			logger.Println("State not saved before exit: another save or restore is in progress.")
+			fmt.Println("[WARN] State not saved before exit: another save or restore is in progress.")
+		}
+	}
+
+	count := 0
+	internal.StopInReverseOrder(dockerHelper, ordered, deps, logger, func(r internal.StopResult) {
+		if r.Err != nil {
+			logger.Printf("Failed to stop container %s: %v", r.Container, r.Err)
+			internal.SendSlackNotification("[ERROR] Failed to stop container " + r.Container + ": " + r.Err.Error())
+			return
+		}
+		logger.Printf("Stopped container: %s (%s)", r.Container, r.Took)
+		msg := fmt.Sprintf("[NOTIFY] Stopped container: %s", r.Container)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+		count++
+	})
 	msg := fmt.Sprintf("[NOTIFY] Autostopped %d containers.", count)
 	fmt.Println(msg)
 	internal.SendSlackNotification(msg)
 	internal.RunHook(conf.HookScript, "post_exit")
 }
+
+// saveBeforeExit saves the running containers and marks the ones about to stop;
+// a failure is reported but does not stop the exit. The caller holds the state lock.
+func saveBeforeExit(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, containers []types.Container, project string, stopping []internal.StateEntry) {
+	var running []types.Container
+	for _, c := range containers {
+		if c.State == "running" {
+			running = append(running, c)
+		}
+	}
+	var err error
+	if project != "" {
+		err = internal.SaveProjectStateHelper(conf, dockerHelper, running, project, logger)
+	} else {
+		err = internal.SaveStateHelper(conf, dockerHelper, running, logger)
+	}
+	if err != nil {
+		msg := "[WARN] State not saved before exit: " + err.Error()
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+		return
+	}
+	names := make([]string, 0, len(stopping))
+	for _, e := range stopping {
+		names = append(names, e.Name())
+	}
+	if err := internal.MarkStoppedByExit(conf, names); err != nil {
+		logger.Println("Failed to mark the containers stopped by exit:", err)
+	}
+	fmt.Println("[NOTIFY] State saved before exit.")
+}
+
+// describeStop shows non-default stop settings for dry runs
+func describeStop(e internal.StateEntry) string {
+	opts, err := internal.StopOptionsFor(e)
+	if err != nil {
+		return " (" + err.Error() + ")"
+	}
+	var parts []string
+	if opts.Signal != "" {
+		parts = append(parts, "signal "+opts.Signal)
+	}
+	if opts.Timeout != nil {
+		parts = append(parts, fmt.Sprintf("timeout %ds", *opts.Timeout))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+	"github.com/docker/docker/api/types/container"
+	"gopkg.in/yaml.v3"
+)
+
+// ExportCommand converts the saved state into other formats, or writes a
+// container or compose project to a migration bundle.
+// Usage: export compose [--state <snapshot> | --live] [--project <name>] [--output <file-or-dir>]
+// or: export <container|project> -o <bundle.tar> [--digests-only] [--consistency none|pause|stop]
+func ExportCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	pos := positionalArgs(args, "--state", "--project", "--output", "-o", "--consistency")
+	if len(pos) != 1 {
+		fmt.Println("Usage: go-docker-tools export compose [--state <snapshot> | --live] [--project <name>] [--output <file-or-dir>]")
+		fmt.Println("       go-docker-tools export <container|project> -o <bundle.tar> [--digests-only] [--consistency none|pause|stop]")
+		os.Exit(1)
+	}
+	if pos[0] == "compose" {
+		exportCompose(conf, dockerHelper, logger, args)
+		return
+	}
+	exportBundle(dockerHelper, logger, pos[0], args)
+}
+
+func exportCompose(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	var state *internal.SavedState
+	var err error
+	if hasFlag(args, "--live") {
+		state, err = internal.CaptureLiveState(dockerHelper, logger)
+	} else {
+		state, _, err = loadStateRef(conf, logger, flagValue(args, "--state"))
+	}
+	if err != nil {
+		fmt.Println("[ERROR] Failed to load state:", err)
+		os.Exit(1)
+	}
+	files := internal.ExportCompose(state, func(image string) *container.Config {
+		img, err := dockerHelper.InspectImage(image)
+		if err != nil {
+			return nil
+		}
+		return img.Config
+	})
+	if project := flagValue(args, "--project"); project != "" {
+		f, ok := files[project]
+		if !ok {
+			fmt.Println("[ERROR] No containers in compose project", project)
+			os.Exit(1)
+		}
+		files = map[string]*internal.ComposeFile{project: f}
+	}
+	if len(files) == 0 {
+		fmt.Println("[ERROR] No containers to export.")
+		os.Exit(1)
+	}
+	projects := make([]string, 0, len(files))
+	for p := range files {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+
+	output := flagValue(args, "--output")
+	if output == "" {
+		for i, p := range projects {
+			if i > 0 {
+				fmt.Println("---")
+			}
+			os.Stdout.Write(encodeCompose(files[p]))
+		}
+		return
+	}
+	// A single file when there is one project and output is not a directory;
+	// otherwise <output>/<project>/compose.yaml per project
+	if fi, err := os.Stat(output); len(projects) == 1 && (err != nil || !fi.IsDir()) {
+		writeComposeFile(output, files[projects[0]])
+		return
+	}
+	for _, p := range projects {
+		dir := p
+		if dir == "" {
+			dir = "standalone"
+		}
+		writeComposeFile(filepath.Join(output, dir, "compose.yaml"), files[p])
+	}
+}
+
+// exportBundle writes the named container, or the containers of the named compose
+// project, to a single file that import re-creates on another host
+func exportBundle(dockerHelper *internal.DockerHelper, logger *log.Logger, target string, args []string) {
+	output := flagValue(args, "-o")
+	if output == "" {
+		output = flagValue(args, "--output")
+	}
+	if output == "" {
+		fmt.Println("[ERROR] export needs -o <bundle.tar>")
+		os.Exit(1)
+	}
+	containers, err := dockerHelper.ListAllContainers()
+	if err != nil {
+		fmt.Println("[ERROR] Failed to list containers:", err)
+		os.Exit(1)
+	}
+	selected := internal.SelectService(containers, target)
+	if len(selected) == 0 {
+		fmt.Printf("[ERROR] No container or compose project named %s\n", target)
+		os.Exit(1)
+	}
+	state := internal.CaptureState(dockerHelper, selected, logger)
+	internal.CaptureNetworks(dockerHelper, state, logger)
+	m, err := internal.ExportBundle(dockerHelper, logger, state, output, internal.BundleOptions{
+		DigestsOnly: hasFlag(args, "--digests-only"),
+		Consistency: flagValue(args, "--consistency"),
+	})
+	if err != nil {
+		logger.Printf("Export of %s failed: %v", target, err)
+		fmt.Printf("[ERROR] Export of %s failed: %v\n", target, err)
+		os.Exit(1)
+	}
+	for _, s := range m.Skipped {
+		fmt.Println("[WARN] Data not included:", s)
+	}
+	images := "images included"
+	if !m.ImagesIncluded {
+		images = "images by digest"
+	}
+	msg := fmt.Sprintf("Exported %s to %s: %d containers, %d images (%s), %d volumes, %d networks.",
+		target, output, len(m.Containers), len(m.Images), images, len(m.Volumes), len(m.Networks))
+	logger.Print(msg)
+	fmt.Println("[NOTIFY]", msg)
+}
+
+func encodeCompose(f *internal.ComposeFile) []byte {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(f); err != nil {
+		fmt.Println("[ERROR] Failed to encode compose file:", err)
+		os.Exit(1)
+	}
+	enc.Close()
+	return buf.Bytes()
+}
+
+func writeComposeFile(path string, f *internal.ComposeFile) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Println("[ERROR]", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(path, encodeCompose(f), 0644); err != nil {
+		fmt.Println("[ERROR] Failed to write compose file:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("[NOTIFY] Wrote %d services to %s\n", len(f.Services), path)
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+	"github.com/docker/docker/api/types"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// parseDelay accepts a Go duration or a plain number of seconds, as the Bash -all-delay did
+func parseDelay(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseByteRate parses sizes such as 500K, 20M or 1G (per second)
+func parseByteRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n * mult, nil
+}
+
+// ImagesCommand exports the images of saved containers to IMAGE_BACKUP_DIR and lists exports
+func ImagesCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: go-docker-tools images save [--delay 5s] [--throttle 20M] [--keep N] [--live] [--oci] [--dry-run] | list | load <image> | gc [--keep N]")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "save":
+		imagesSave(conf, dockerHelper, logger, args[1:])
+	case "list":
+		index, err := internal.LoadImageBackupIndex(conf.ImageBackupDir)
+		if err != nil {
+			fmt.Println("[ERROR] Failed to read image index:", err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "IMAGE\tID\tSAVED\tSIZE\tCONTAINERS\tFILE")
+		for _, img := range index.Images {
+			tags := strings.Join(img.RepoTags, ",")
+			if tags == "" {
+				tags = "<untagged>"
+			}
+			fmt.Fprintf(w, "%s\t%.19s\t%s\t%d\t%s\t%s\n", tags, img.ID, img.SavedAt.Format("2006-01-02 15:04:05"),
+				img.Size, strings.Join(img.Containers, ","), img.File)
+		}
+		w.Flush()
+		if store, err := openOCIStoreIfPresent(conf); err == nil && store != nil {
+			if index, err := store.ReadIndex(); err == nil && len(index.Manifests) > 0 {
+				fmt.Printf("\nOCI store %s:\n", store.Dir)
+				w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "IMAGE\tID\tSAVED\tMANIFEST")
+				for _, d := range index.Manifests {
+					fmt.Fprintf(w, "%s\t%.19s\t%s\t%s\n", d.Annotations[ocispec.AnnotationRefName],
+						d.Annotations[internal.AnnotationImageID], d.Annotations[ocispec.AnnotationCreated], d.Digest)
+				}
+				w.Flush()
+			}
+		}
+	case "load":
+		if len(args) < 2 {
+			fmt.Println("Usage: go-docker-tools images load <image|id>")
+			os.Exit(1)
+		}
+		store, err := openOCIStoreIfPresent(conf)
+		if err != nil || store == nil {
+			fmt.Println("[ERROR] No OCI image store at", internal.OCIStoreDir(conf))
+			os.Exit(3)
+		}
+		if err := store.LoadImage(dockerHelper, args[1], logger); err != nil {
+			logger.Println("Image load failed:", err)
+			fmt.Println("[ERROR] Image load failed:", err)
+			internal.SendSlackNotification("[ERROR] Image load failed: " + err.Error())
+			os.Exit(3)
+		}
+		fmt.Println("[NOTIFY] Loaded image", args[1])
+	case "gc":
+		keep := conf.BackupRotationCount
+		if v := flagValue(args, "--keep"); v != "" {
+			var err error
+			if keep, err = strconv.Atoi(v); err != nil {
+				fmt.Println("[ERROR] Invalid --keep:", v)
+				os.Exit(1)
+			}
+		}
+		store, err := openOCIStoreIfPresent(conf)
+		if err != nil || store == nil {
+			fmt.Println("[ERROR] No OCI image store at", internal.OCIStoreDir(conf))
+			os.Exit(3)
+		}
+		lock := store.Lock()
+		if !lock.TryLock() {
+			fmt.Println("[ERROR] OCI store is in use.")
+			os.Exit(4)
+		}
+		defer lock.Unlock()
+		entries, blobs, err := store.GC(keep, logger)
+		if err != nil {
+			fmt.Println("[ERROR] Garbage collection failed:", err)
+			os.Exit(4)
+		}
+		msg := fmt.Sprintf("[NOTIFY] OCI store GC removed %d old entries and %d unreferenced blobs.", entries, blobs)
+		logger.Println(msg)
+		fmt.Println(msg)
+	default:
+		fmt.Println("Unknown images action:", args[0])
+		os.Exit(1)
+	}
+}
+
+// openOCIStoreIfPresent opens the OCI store, returning nil if none has been created yet
+func openOCIStoreIfPresent(conf *config.Config) (*internal.OCIStore, error) {
+	if _, err := os.Stat(filepath.Join(internal.OCIStoreDir(conf), ocispec.ImageIndexFile)); err != nil {
+		return nil, nil
+	}
+	return internal.OpenOCIStore(internal.OCIStoreDir(conf))
+}
+
+func imagesSave(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	delay, err := parseDelay(flagValue(args, "--delay"))
+	if err != nil {
+		fmt.Println("[ERROR] Invalid --delay:", err)
+		os.Exit(1)
+	}
+	throttle, err := parseByteRate(flagValue(args, "--throttle"))
+	if err != nil {
+		fmt.Println("[ERROR] Invalid --throttle:", err)
+		os.Exit(1)
+	}
+	keep := conf.BackupRotationCount
+	if v := flagValue(args, "--keep"); v != "" {
+		if keep, err = strconv.Atoi(v); err != nil {
+			fmt.Println("[ERROR] Invalid --keep:", v)
+			os.Exit(1)
+		}
+	}
+	opts := internal.ImageSaveOptions{
+		Delay:    delay,
+		Throttle: throttle,
+		Keep:     keep,
+		DryRun:   hasFlag(args, "--dry-run"),
+		OCI:      hasFlag(args, "--oci") || conf.ImageStoreFormat == "oci",
+	}
+
+	var containers []types.Container
+	if !hasFlag(args, "--live") {
+		containers, err = internal.LoadStateContainers(conf.StateFile)
+		if err != nil {
+			logger.Println("No saved state, using running containers:", err)
+		}
+	}
+	if containers == nil {
+		if containers, err = dockerHelper.ListRunningContainers(); err != nil {
+			logger.Println("Failed to list running containers:", err)
+			internal.SendSlackNotification("[ERROR] Failed to list running containers: " + err.Error())
+			os.Exit(1)
+		}
+	}
+	internal.RunHook(conf.HookScript, "pre_image_save")
+	msg := fmt.Sprintf("[NOTIFY] Exporting images for %d containers to %s... (dry-run: %v)", len(containers), conf.ImageBackupDir, opts.DryRun)
+	fmt.Println(msg)
+	internal.SendSlackNotification(msg)
+	saved, err := internal.SaveContainerImages(conf, dockerHelper, logger, containers, opts)
+	for _, img := range saved {
+		prefix := "[NOTIFY] Exported"
+		if opts.DryRun {
+			prefix = "[DRY-RUN] Would export"
+		}
+		fmt.Printf("%s %s -> %s\n", prefix, strings.Join(img.RepoTags, ","), img.File)
+	}
+	if err != nil {
+		logger.Println("Image export failed:", err)
+		internal.SendSlackNotification("[ERROR] Image export failed: " + err.Error())
+		internal.RunHook(conf.HookScript, "image_save_failed")
+		os.Exit(2)
+	}
+	msg = fmt.Sprintf("[NOTIFY] Image export complete: %d new images.", len(saved))
+	logger.Println(msg)
+	fmt.Println(msg)
+	internal.SendSlackNotification(msg)
+	internal.RunHook(conf.HookScript, "post_image_save")
+}
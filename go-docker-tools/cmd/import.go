@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// ImportCommand re-creates the containers, images, volumes and networks of a
+// migration bundle written by export.
+// Usage: import <bundle.tar> [--rename <old>=<new>]... [--rename-volume <old>=<new>]...
+// [--port <old>=<new>]... [--volume-driver [<volume>=]<driver>]... [--port-policy fail|skip|remap]
+// [--replace] [--use-existing-volumes] [--dry-run]
+func ImportCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	pos := positionalArgs(args, "--rename", "--rename-volume", "--port", "--volume-driver", "--port-policy")
+	if len(pos) != 1 {
+		fmt.Println("Usage: go-docker-tools import <bundle.tar> [--rename <old>=<new>]... [--rename-volume <old>=<new>]... [--port <old>=<new>]... [--volume-driver [<volume>=]<driver>]... [--port-policy fail|skip|remap] [--replace] [--use-existing-volumes] [--dry-run]")
+		os.Exit(1)
+	}
+	bundle := pos[0]
+	opts := importOptions(conf, args)
+
+	if hasFlag(args, "--dry-run") {
+		m, state, err := internal.ReadBundle(bundle)
+		if err == nil {
+			err = internal.PrepareImport(m, state, opts)
+		}
+		if err != nil {
+			fmt.Println("[ERROR]", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Bundle %s, exported from %s at %s\n", bundle, dash(m.Source), m.CreatedAt.Format("2006-01-02 15:04:05"))
+		printBundle(m, state, opts.RenameVolumes)
+		return
+	}
+
+	lock := internal.NewLockfileHelper(conf.StateFile + ".lock")
+	if !lock.TryLock() {
+		logger.Println("Another restore is in progress.")
+		fmt.Println("[ERROR] Another save or restore is in progress.")
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	result, err := internal.ImportBundle(conf, dockerHelper, logger, bundle, opts)
+	if result != nil {
+		for _, v := range result.Volumes {
+			if v.Existing {
+				fmt.Printf("[WARN] Volume %s already exists; its data was kept and not replaced from the bundle\n", v.Name)
+			}
+		}
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[ERROR] Import of %s failed: %v", bundle, err)
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+		os.Exit(1)
+	}
+	for _, s := range result.Manifest.Skipped {
+		fmt.Println("[WARN] Not in the bundle, recreate by hand:", s)
+	}
+	res := result.Restore
+	for _, n := range res.Networks {
+		if n.Err != nil {
+			fmt.Println("[WARN]", n.Err)
+		}
+	}
+	for _, r := range res.PortRemaps {
+		fmt.Printf("[WARN] Remapped container %s port %s\n", r.Container, r)
+	}
+	msg := fmt.Sprintf("Imported %s. Containers: %d, Failed: %d, Skipped: %d, Volumes: %d, Ports remapped: %d.",
+		bundle, res.Restored, res.Failed, res.Skipped, len(result.Volumes), len(res.PortRemaps))
+	logger.Print(msg)
+	fmt.Println(msg)
+	internal.SendSlackNotification("[NOTIFY] " + msg)
+	if res.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// importOptions reads the rename, port and volume driver flags shared by import and migrate
+func importOptions(conf *config.Config, args []string) internal.ImportOptions {
+	opts := internal.ImportOptions{
+		Rename:             parsePairs("--rename", flagValues(args, "--rename")),
+		RenameVolumes:      parsePairs("--rename-volume", flagValues(args, "--rename-volume")),
+		Ports:              parsePairs("--port", flagValues(args, "--port")),
+		VolumeDrivers:      map[string]string{},
+		PortPolicy:         flagValue(args, "--port-policy"),
+		Replace:            hasFlag(args, "--replace"),
+		UseExistingVolumes: hasFlag(args, "--use-existing-volumes"),
+	}
+	for old, port := range opts.Ports {
+		for _, p := range []string{old, port} {
+			if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+				fmt.Println("[ERROR] Invalid host port in --port:", p)
+				os.Exit(1)
+			}
+		}
+	}
+	for _, v := range flagValues(args, "--volume-driver") {
+		if name, driver, ok := strings.Cut(v, "="); ok {
+			opts.VolumeDrivers[name] = driver
+		} else {
+			opts.VolumeDriver = v
+		}
+	}
+	if opts.PortPolicy == "" {
+		opts.PortPolicy = conf.PortConflictPolicy
+	}
+	return opts
+}
+
+// parsePairs splits repeated old=new flag values into a map
+func parsePairs(flag string, values []string) map[string]string {
+	pairs := map[string]string{}
+	for _, v := range values {
+		old, repl, ok := strings.Cut(v, "=")
+		if !ok || old == "" || repl == "" {
+			fmt.Printf("[ERROR] %s wants <old>=<new>, got %q\n", flag, v)
+			os.Exit(1)
+		}
+		pairs[old] = repl
+	}
+	return pairs
+}
+
+// printBundle shows what an import or migration would create, after renames and port changes
+func printBundle(m *internal.BundleManifest, state *internal.SavedState, renameVolumes map[string]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tIMAGE\tSTATE\tPORTS")
+	for _, e := range state.Containers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Name(), e.ImageRef(), dash(e.State), dash(strings.Join(internal.EntryPorts(e), ", ")))
+	}
+	w.Flush()
+	images := "included"
+	if !m.ImagesIncluded {
+		images = "pulled by digest"
+	}
+	fmt.Printf("Images: %d (%s)\n", len(m.Images), images)
+	for _, v := range m.Volumes {
+		name := v.Name
+		if n := renameVolumes[v.Name]; n != "" {
+			name += " as " + n
+		}
+		fmt.Printf("Volume: %s (%s driver)\n", name, dash(v.Driver))
+	}
+	for _, n := range m.Networks {
+		fmt.Println("Network:", n)
+	}
+	for _, s := range m.Skipped {
+		fmt.Println("Not included:", s)
+	}
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// ImportLegacyCommand converts the Bash tooling's container_details.json and
+// running containers list into the Go state format.
+// Usage: import-legacy [--json file] [--list file] [--no-backup] [--output file] [--force] [--dry-run]
+func ImportLegacyCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	state, sources, err := loadLegacyState(conf, logger, args)
+	if err != nil {
+		logger.Println("Legacy import failed:", err)
+		fmt.Println("[ERROR] Legacy import failed:", err)
+		os.Exit(1)
+	}
+	output := flagValue(args, "--output")
+	if output == "" {
+		output = conf.StateFile
+	}
+	if output == "" {
+		fmt.Println("[ERROR] STATE_FILE is not set; pass --output <file>")
+		os.Exit(1)
+	}
+	for _, e := range state.Containers {
+		fmt.Printf("  %-30s %s\n", e.Name(), e.ImageRef())
+	}
+	if hasFlag(args, "--dry-run") {
+		fmt.Printf("[DRY-RUN] Would import %d containers from %v into %s\n", len(state.Containers), sources, output)
+		return
+	}
+	if _, err := os.Stat(output); err == nil && !hasFlag(args, "--force") {
+		fmt.Printf("[ERROR] %s already exists; pass --force to replace it\n", output)
+		os.Exit(1)
+	}
+	lock := internal.NewLockfileHelper(output + ".lock")
+	if !lock.TryLock() {
+		fmt.Println("[ERROR] Another save or restore is in progress.")
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+	if err := internal.WriteState(output, state); err != nil {
+		logger.Println("Failed to write state:", err)
+		fmt.Println("[ERROR] Failed to write state:", err)
+		os.Exit(1)
+	}
+	msg := fmt.Sprintf("[NOTIFY] Imported %d containers from %v into %s", len(state.Containers), sources, output)
+	logger.Print(msg)
+	fmt.Println(msg)
+	internal.SendSlackNotification(msg)
+}
+
+// loadLegacyState reads the legacy JSON inventory (or its newest .bak when it is
+// empty) and the socket,name list, merging them with the JSON taking precedence
+func loadLegacyState(conf *config.Config, logger *log.Logger, args []string) (*internal.SavedState, []string, error) {
+	jsonPath := flagValue(args, "--json")
+	if jsonPath == "" {
+		jsonPath = conf.JSONBackupFile
+	}
+	listPath := flagValue(args, "--list")
+	if listPath == "" {
+		listPath = conf.ContainerList
+	}
+	hosts := internal.LegacyDaemonHosts(conf)
+	state := &internal.SavedState{Version: internal.StateFormatVersion}
+	var sources []string
+	if jsonPath != "" {
+		active := internal.ActiveLegacyJSON(jsonPath, hasFlag(args, "--no-backup"))
+		if _, err := os.Stat(active); err == nil {
+			s, err := internal.LoadAnyState(active, hosts, logger)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", active, err)
+			}
+			if active != jsonPath {
+				logger.Printf("%s is empty, using backup %s", jsonPath, active)
+			}
+			state = internal.MergeStates(state, s)
+			sources = append(sources, active)
+		}
+	}
+	if listPath != "" {
+		if _, err := os.Stat(listPath); err == nil {
+			s, err := internal.LoadAnyState(listPath, hosts, logger)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", listPath, err)
+			}
+			state = internal.MergeStates(state, s)
+			sources = append(sources, listPath)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, nil, fmt.Errorf("no legacy inventory found; set JSON_BACKUP_FILE or CONTAINER_LIST, or pass --json/--list")
+	}
+	return state, sources, nil
+}
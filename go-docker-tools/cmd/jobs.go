@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// JobsCommand lists the named backup jobs defined in saver.yaml with their last results
+func JobsCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	if len(args) < 1 || args[0] != "list" {
+		fmt.Println("Usage: go-docker-tools jobs list")
+		os.Exit(1)
+	}
+	if len(conf.BackupJobs) == 0 {
+		fmt.Println("No backup jobs defined. Add a BACKUP_JOBS section to saver.yaml.")
+		return
+	}
+	results, err := internal.LoadBackupJobResults(conf)
+	if err != nil {
+		logger.Println("Failed to read job results:", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tSELECTOR\tDESTINATION\tCOMPRESSION\tENCRYPTED\tRETENTION\tCONSISTENCY\tLAST RUN\tSTATUS")
+	for _, job := range conf.BackupJobs {
+		selector := strings.Join(append(append([]string{}, job.Containers...), job.Volumes...), ",")
+		if selector == "" {
+			selector = "(all volumes)"
+		}
+		dest := job.Destination
+		if dest == "" {
+			dest = "(default)"
+		}
+		compression := job.Compression
+		if compression == "" {
+			compression = "gzip"
+		}
+		consistency := job.Consistency
+		if consistency == "" {
+			consistency = "none"
+		}
+		lastRun, status := "never", "-"
+		if r, ok := results[job.Name]; ok {
+			lastRun = r.FinishedAt.Format("2006-01-02 15:04:05")
+			status = r.Status
+			if r.Error != "" {
+				status += ": " + r.Error
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%d\t%s\t%s\t%s\n", job.Name, selector, dest, compression,
+			job.EncryptionKeyFile != "", job.Retention, consistency, lastRun, status)
+	}
+	w.Flush()
+}
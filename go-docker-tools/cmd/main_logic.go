@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/FabulaNox/go-docker-tools/config"
 	"github.com/FabulaNox/go-docker-tools/internal"
@@ -20,11 +21,32 @@ func MainLogic() {
 		logger.Println("Failed to initialize Docker client:", err)
 		os.Exit(1)
 	}
+	// --no-wait is handled here so every command accepts it
+	args := make([]string, 0, len(os.Args))
+	noWait := false
+	for _, arg := range os.Args {
+		if arg == "--no-wait" {
+			noWait = true
+			continue
+		}
+		args = append(args, arg)
+	}
+	os.Args = args
 	// Command dispatch
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: docker-tools <command> [flags]")
 		os.Exit(1)
 	}
+	if !noWait && needsDocker(os.Args[1:]) {
+		err := internal.WaitForDocker(dockerHelper, conf.DockerWaitTimeout, logger, func(attempt int, next time.Duration, err error) {
+			fmt.Fprintf(os.Stderr, "[NOTIFY] Waiting for Docker daemon (attempt %d, retry in %s)...\n", attempt, next.Round(100*time.Millisecond))
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]", err)
+			internal.SendSlackNotification("[ERROR] " + err.Error())
+			os.Exit(4)
+		}
+	}
 	switch os.Args[1] {
 	case "manual-restore":
 		ManualRestoreCommand(conf, dockerHelper, logger, os.Args[2:])
@@ -40,8 +62,38 @@ func MainLogic() {
 		SaveCommand(conf, dockerHelper, logger, os.Args[2:])
 	case "restore":
 		RestoreCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "import-legacy":
+		ImportLegacyCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "state":
+		StateCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "drift":
+		DriftCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "export":
+		ExportCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "import":
+		ImportCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "migrate":
+		MigrateCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "plan":
+		PlanCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "apply":
+		ApplyCommand(conf, dockerHelper, logger, os.Args[2:])
 	case "backup":
 		BackupCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "jobs":
+		JobsCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "snapshots":
+		SnapshotsCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "images":
+		ImagesCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "report":
+		ReportCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "update":
+		UpdateCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "restart":
+		RestartCommand(conf, dockerHelper, logger, os.Args[2:])
+	case "daemon":
+		DaemonCommand(conf, dockerHelper, logger, os.Args[2:])
 	case "autostart":
 		AutostartCommand(conf, dockerHelper, logger, os.Args[2:])
 	case "exit":
@@ -53,3 +105,23 @@ func MainLogic() {
 		os.Exit(1)
 	}
 }
+
+// needsDocker reports whether a command talks to the daemon; the others run
+// without waiting for it
+func needsDocker(args []string) bool {
+	switch args[0] {
+	case "bootstrap", "fixsocket", "deploy", "setup", "state", "import-legacy", "report":
+		return false
+	case "restart":
+		// Repairs the daemon connection itself
+		return false
+	case "backup":
+		if len(args) > 1 {
+			switch args[1] {
+			case "ls", "cat", "extract", "find", "index":
+				return false
+			}
+		}
+	}
+	return true
+}
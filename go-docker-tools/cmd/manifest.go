@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// manifestFromArgs loads the manifest named by --file (or --manifest), falling back to MANIFEST_FILE
+func manifestFromArgs(conf *config.Config, args []string) (*internal.Manifest, string) {
+	path := flagValue(args, "--file")
+	if path == "" {
+		path = flagValue(args, "--manifest")
+	}
+	if path == "" || strings.HasPrefix(path, "-") {
+		path = internal.ManifestPath(conf)
+	}
+	m, err := internal.LoadManifest(path)
+	if err != nil {
+		fmt.Println("[ERROR] Invalid manifest:", err)
+		os.Exit(1)
+	}
+	return m, path
+}
+
+// PlanCommand shows what apply would change to make the daemon match the manifest.
+// Usage: plan [--file manifest.yaml] [--json]
+func PlanCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	m, path := manifestFromArgs(conf, args)
+	plan, err := internal.PlanManifest(m, dockerHelper, logger)
+	if err != nil {
+		logger.Println("Failed to plan manifest:", err)
+		fmt.Println("[ERROR] Failed to plan manifest:", err)
+		os.Exit(1)
+	}
+	if hasFlag(args, "--json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(plan)
+		return
+	}
+	printPlan(path, plan)
+}
+
+// ApplyCommand converges the daemon on the manifest.
+// Usage: apply [--file manifest.yaml] [--dry-run]
+func ApplyCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	m, path := manifestFromArgs(conf, args)
+	lock := internal.NewLockfileHelper(conf.StateFile + ".lock")
+	if !lock.TryLock() {
+		fmt.Println("[ERROR] Another save, restore or apply is in progress.")
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	plan, err := internal.PlanManifest(m, dockerHelper, logger)
+	if err != nil {
+		logger.Println("Failed to plan manifest:", err)
+		fmt.Println("[ERROR] Failed to plan manifest:", err)
+		os.Exit(1)
+	}
+	printPlan(path, plan)
+	if plan.Changes() == 0 || hasFlag(args, "--dry-run") {
+		return
+	}
+	internal.RunHook(conf.HookScript, "pre_apply")
+	done, err := internal.ApplyManifest(conf, m, plan, dockerHelper, logger)
+	if err != nil {
+		msg := fmt.Sprintf("[ERROR] Apply stopped after %d of %d changes: %v", done, plan.Changes(), err)
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+		internal.RunHook(conf.HookScript, "apply_failed")
+		os.Exit(1)
+	}
+	msg := fmt.Sprintf("[NOTIFY] Applied %d changes from %s.", done, path)
+	logger.Print(msg)
+	fmt.Println(msg)
+	internal.SendSlackNotification(msg)
+	internal.RunHook(conf.HookScript, "post_apply")
+}
+
+func printPlan(path string, plan *internal.ManifestPlan) {
+	fmt.Println("Manifest:", path)
+	for _, a := range plan.Actions {
+		if a.Kind == internal.PlanUnchanged {
+			continue
+		}
+		fmt.Printf("  %-15s %s\n", a.Kind, a.Name)
+		for _, f := range a.Fields {
+			fmt.Printf("      %s\n", f)
+		}
+	}
+	for _, name := range plan.Unmanaged {
+		fmt.Printf("  %-15s %s (not in manifest, left alone)\n", "unmanaged", name)
+	}
+	fmt.Printf("%d to change, %d unchanged.\n", plan.Changes(), len(plan.Actions)-plan.Changes())
+}
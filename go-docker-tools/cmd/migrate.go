@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// MigrateCommand moves a container or compose project to another host's daemon,
+// streaming images, volumes and specs with no intermediate file.
+// Usage: migrate <container|project> --to ssh://[user@]host | tcp://host:2376 [--cert-path <dir>]
+// [--rename <old>=<new>]... [--rename-volume <old>=<new>]... [--port <old>=<new>]...
+// [--volume-driver [<volume>=]<driver>]... [--port-policy fail|skip|remap] [--replace]
+// [--use-existing-volumes] [--digests-only] [--keep-source] [--timeout <duration>] [--dry-run]
+// Exits 71 when the migration failed.
+func MigrateCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	pos := positionalArgs(args, "--to", "--cert-path", "--rename", "--rename-volume", "--port", "--volume-driver", "--port-policy", "--timeout")
+	to := flagValue(args, "--to")
+	if len(pos) != 1 || to == "" {
+		fmt.Println("Usage: go-docker-tools migrate <container|project> --to ssh://[user@]host | tcp://host:2376 [--cert-path <dir>] [--rename <old>=<new>]... [--rename-volume <old>=<new>]... [--port <old>=<new>]... [--volume-driver [<volume>=]<driver>]... [--port-policy fail|skip|remap] [--replace] [--use-existing-volumes] [--digests-only] [--keep-source] [--timeout <duration>] [--dry-run]")
+		os.Exit(1)
+	}
+	name := pos[0]
+	opts := internal.MigrateOptions{
+		Import:      importOptions(conf, args),
+		DigestsOnly: hasFlag(args, "--digests-only"),
+		Timeout:     internal.DefaultMigrateTimeout,
+		KeepSource:  hasFlag(args, "--keep-source"),
+	}
+	if v := flagValue(args, "--timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			fmt.Println("[ERROR] Invalid --timeout:", v)
+			os.Exit(1)
+		}
+		opts.Timeout = d
+	}
+
+	target, err := internal.NewDockerHelperForRemote(to, flagValue(args, "--cert-path"))
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = target.Ping(ctx)
+		cancel()
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Cannot reach the Docker daemon at %s: %v\n", to, err)
+		os.Exit(1)
+	}
+
+	dryRun := hasFlag(args, "--dry-run")
+	lock := internal.NewLockfileHelper(conf.StateFile + ".lock")
+	if !dryRun {
+		if !lock.TryLock() {
+			logger.Println("Another save is in progress.")
+			fmt.Println("[ERROR] Another save or restore is in progress.")
+			os.Exit(1)
+		}
+		defer lock.Unlock()
+	}
+
+	containers, err := dockerHelper.ListAllContainers()
+	if err != nil {
+		fmt.Println("[ERROR] Failed to list containers:", err)
+		os.Exit(1)
+	}
+	selected := internal.SelectService(containers, name)
+	if len(selected) == 0 {
+		fmt.Printf("[ERROR] No container or compose project named %s\n", name)
+		os.Exit(1)
+	}
+	state := internal.CaptureState(dockerHelper, selected, logger)
+	internal.CaptureNetworks(dockerHelper, state, logger)
+
+	if dryRun {
+		m, spec, err := internal.PlanMigration(dockerHelper, target, state, opts)
+		if err != nil {
+			fmt.Println("[ERROR]", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Would migrate %s to %s\n", name, to)
+		printBundle(m, spec, opts.Import.RenameVolumes)
+		return
+	}
+
+	logger.Printf("Migrating %s to %s", name, to)
+	result, err := internal.Migrate(conf, dockerHelper, target, logger, state, opts)
+	if err != nil {
+		var msg string
+		if result != nil && result.RolledBack {
+			msg = fmt.Sprintf("[ERROR] Migration of %s to %s failed and was rolled back: %v", name, to, err)
+			internal.RunHook(conf.HookScript, "migrate_rolled_back")
+		} else {
+			msg = fmt.Sprintf("[ERROR] Migration of %s to %s failed: %v", name, to, err)
+			internal.RunHook(conf.HookScript, "migrate_failed")
+		}
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+		if result != nil && len(result.SourceDown) > 0 {
+			msg = "[ERROR] Still down on the source after the rollback: " + strings.Join(result.SourceDown, ", ")
+			logger.Print(msg)
+			fmt.Println(msg)
+			internal.SendSlackNotification(msg)
+		}
+		if result != nil && len(result.TargetDown) > 0 {
+			msg = fmt.Sprintf("[ERROR] Replaced containers not put back on %s, left renamed aside: %s", to, strings.Join(result.TargetDown, ", "))
+			logger.Print(msg)
+			fmt.Println(msg)
+			internal.SendSlackNotification(msg)
+		}
+		os.Exit(71)
+	}
+
+	for _, v := range result.Volumes {
+		if v.Existing {
+			fmt.Printf("[WARN] Volume %s already existed on %s; its data was kept\n", v.Name, to)
+		}
+	}
+	for _, s := range result.Manifest.Skipped {
+		fmt.Println("[WARN] Not migrated, recreate by hand:", s)
+	}
+	for _, r := range result.Restore.PortRemaps {
+		fmt.Printf("[WARN] Remapped container %s port %s\n", r.Container, r)
+	}
+	source := "removed"
+	if result.SourceKept {
+		source = "left stopped with restart policy \"no\""
+	}
+	msg := fmt.Sprintf("[NOTIFY] Migrated %s to %s: %d containers, %d images sent, %d volumes. Source containers %s.",
+		name, to, len(result.Manifest.Containers), result.ImagesSent, len(result.Volumes), source)
+	logger.Print(msg)
+	fmt.Println(msg)
+	internal.SendSlackNotification(msg)
+	internal.RunHook(conf.HookScript, "migrate_completed")
+
+	// Keep restore and autostart from bringing the migrated containers back here
+	if running, err := dockerHelper.ListRunningContainers(); err == nil {
+		if err := internal.SaveStateHelper(conf, dockerHelper, running, logger); err != nil {
+			logger.Println("Failed to save state after migration:", err)
+			fmt.Println("[WARN] Failed to save state after migration:", err)
+		}
+	}
+}
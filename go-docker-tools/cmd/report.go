@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// ReportCommand summarises the health history recorded by the daemon.
+// Usage: report uptime [--since 30d] [--container <name>] [--json]
+func ReportCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	if len(args) < 1 || args[0] != "uptime" {
+		fmt.Println("Usage: go-docker-tools report uptime [--since 30d] [--container <name>] [--json]")
+		os.Exit(1)
+	}
+	now := time.Now()
+	sinceArg := flagValue(args, "--since")
+	if sinceArg == "" {
+		sinceArg = "30d"
+	}
+	since, err := internal.ParseSince(sinceArg, now)
+	if err != nil {
+		fmt.Println("[ERROR]", err)
+		os.Exit(1)
+	}
+	path := internal.HealthHistoryPath(conf)
+	records, err := internal.ReadHealthHistory(path)
+	if err != nil {
+		fmt.Println("[ERROR] Failed to read health history:", err)
+		if os.IsNotExist(err) {
+			fmt.Println("The health history is written by the daemon command.")
+		}
+		os.Exit(1)
+	}
+	report := internal.BuildUptimeReport(records, since, now, internal.HealthStaleAfter(conf))
+	if name := flagValue(args, "--container"); name != "" {
+		var only []internal.UptimeStats
+		for _, s := range report.Containers {
+			if s.Container == strings.TrimPrefix(name, "/") {
+				only = append(only, s)
+			}
+		}
+		report.Containers = only
+	}
+	if hasFlag(args, "--json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	printUptimeReport(report)
+}
+
+func printUptimeReport(report *internal.UptimeReport) {
+	fmt.Printf("Uptime from %s to %s\n", report.Since.Local().Format("2006-01-02 15:04"), report.Until.Local().Format("2006-01-02 15:04"))
+	if len(report.Containers) == 0 {
+		fmt.Println("No containers in the health history for this period.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tAVAILABILITY\tDOWNTIME\tOUTAGES\tRESTARTS\tOBSERVED\tSTATE")
+	for _, s := range report.Containers {
+		fmt.Fprintf(w, "%s\t%.3f%%\t%s\t%d\t%d\t%s\t%s\n", s.Container, s.Availability, seconds(s.DowntimeSeconds), s.Outages, s.Restarts, seconds(s.ObservedSeconds), s.State)
+	}
+	w.Flush()
+	for _, s := range report.Containers {
+		if len(s.LongestOutages) == 0 {
+			continue
+		}
+		fmt.Printf("\nLongest outages of %s:\n", s.Container)
+		for _, o := range s.LongestOutages {
+			end := "ongoing"
+			if o.End != nil {
+				end = o.End.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("  %s  %s -> %s\n", seconds(o.Seconds), o.Start.Local().Format("2006-01-02 15:04:05"), end)
+		}
+	}
+}
+
+// seconds formats a duration in seconds for tables, such as 3h12m0s
+func seconds(s float64) string {
+	return (time.Duration(s) * time.Second).Round(time.Second).String()
+}
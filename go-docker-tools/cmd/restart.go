@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// RestartCommand restarts stopped containers, or one container, escalating through
+// the Desktop socket, a socket repair, starting dockerd and finally a restore from
+// the saved state until one works.
+// Usage: restart --all | <name> [--max-escalation <0-4|name>]
+func RestartCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	names := positionalArgs(args, "--max-escalation")
+	all := hasFlag(args, "--all")
+	if all == (len(names) == 1) || len(names) > 1 {
+		fmt.Println("Usage: go-docker-tools restart --all | <name> [--max-escalation <0-4|none|desktop|socket-fix|daemon-start|restore>]")
+		os.Exit(1)
+	}
+	maxLevel := internal.EscalateRestore
+	if v := flagValue(args, "--max-escalation"); v != "" {
+		var err error
+		if maxLevel, err = internal.ParseEscalation(v); err != nil {
+			fmt.Println("[ERROR]", err)
+			os.Exit(1)
+		}
+	}
+
+	chain := &internal.RestartChain{
+		Conf:         conf,
+		DockerHelper: dockerHelper,
+		Logger:       logger,
+		MaxLevel:     maxLevel,
+		Report: func(step internal.EscalationStep) {
+			if step.Err != nil {
+				fmt.Printf("[WARN] Step %d/%d %s failed: %v\n", step.Level, maxLevel, step.Name, step.Err)
+				return
+			}
+			fmt.Printf("[NOTIFY] Step %d/%d %s succeeded (%s)\n", step.Level, maxLevel, step.Name, step.Detail)
+		},
+	}
+	var action, restore func(*internal.DockerHelper) error
+	target := "all stopped containers"
+	if all {
+		action = func(dh *internal.DockerHelper) error { return restartStopped(dh, logger) }
+		restore = func(dh *internal.DockerHelper) error { return restoreForRestart(conf, dh, logger, "") }
+	} else {
+		target = names[0]
+		action = func(dh *internal.DockerHelper) error {
+			if err := dh.RestartContainer(names[0]); err != nil {
+				return err
+			}
+			fmt.Printf("[NOTIFY] Container %s restarted.\n", names[0])
+			return nil
+		}
+		restore = func(dh *internal.DockerHelper) error { return restoreForRestart(conf, dh, logger, names[0]) }
+	}
+
+	if err := chain.Run(action, restore); err != nil {
+		msg := fmt.Sprintf("[ERROR] Failed to restart %s: %v", target, err)
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+		internal.RunHook(conf.HookScript, "restart_failed")
+		os.Exit(51)
+	}
+	msg := fmt.Sprintf("[NOTIFY] Restarted %s.", target)
+	logger.Print(msg)
+	internal.SendSlackNotification(msg)
+}
+
+// restartStopped restarts every exited container; individual failures are reported
+// but do not escalate, since the daemon is evidently reachable
+func restartStopped(dh *internal.DockerHelper, logger *log.Logger) error {
+	containers, err := dh.ListAllContainers()
+	if err != nil {
+		return err
+	}
+	restarted, failed := 0, 0
+	for _, c := range containers {
+		if c.State != "exited" {
+			continue
+		}
+		name := internal.ContainerName(c)
+		if err := dh.RestartContainer(c.ID); err != nil {
+			logger.Printf("Failed to restart container %s: %v", name, err)
+			fmt.Printf("[ERROR] Failed to restart container %s: %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("[NOTIFY] Container %s restarted.\n", name)
+		restarted++
+	}
+	if restarted+failed == 0 {
+		fmt.Println("No stopped containers to restart.")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d containers failed to restart", failed, restarted+failed)
+	}
+	return nil
+}
+
+// restoreForRestart re-creates the saved containers, or just the named one
+func restoreForRestart(conf *config.Config, dh *internal.DockerHelper, logger *log.Logger, name string) error {
+	state, err := internal.LoadAnyState(conf.StateFile, internal.LegacyDaemonHosts(conf), logger)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		entry := state.Find(name)
+		if entry == nil {
+			return fmt.Errorf("%s is not in %s", name, conf.StateFile)
+		}
+		state = &internal.SavedState{Version: state.Version, SavedAt: state.SavedAt, Containers: []internal.StateEntry{*entry}}
+	}
+	result, err := internal.RestoreState(conf, dh, logger, state, internal.RestoreOptions{PortPolicy: conf.PortConflictPolicy})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[NOTIFY] Restored %d containers from %s (%d failed).\n", result.Restored, conf.StateFile, result.Failed)
+	if result.Failed > 0 {
+		return fmt.Errorf("%d containers could not be restored", result.Failed)
+	}
+	return nil
+}
@@ -18,13 +18,70 @@ func RestoreCommand(conf *config.Config, dockerHelper *internal.DockerHelper, lo
 	}
 	defer lock.Unlock()
 
-	restored, failed, err := internal.RestoreStateHelper(conf.StateFile, dockerHelper, logger)
+	opts := internal.RestoreOptions{ImagePolicy: flagValue(args, "--image-policy"), Project: flagValue(args, "--project"), PortPolicy: flagValue(args, "--port-policy")}
+	if opts.PortPolicy == "" {
+		opts.PortPolicy = conf.PortConflictPolicy
+	}
+	var result *internal.RestoreResult
+	var err error
+	switch {
+	case hasFlag(args, "--legacy"):
+		// Restore straight from the Bash tooling's inventory without importing it
+		var state *internal.SavedState
+		var sources []string
+		if state, sources, err = loadLegacyState(conf, logger, args); err == nil {
+			logger.Printf("Restoring from legacy inventory %v", sources)
+			result, err = internal.RestoreState(conf, dockerHelper, logger, state, opts)
+		}
+	case flagValue(args, "--rollback") != "":
+		// Restore an earlier snapshot from the state history, like the Bash --rollback <file>
+		var state *internal.SavedState
+		var path string
+		if state, path, err = loadStateRef(conf, logger, flagValue(args, "--rollback")); err == nil {
+			logger.Printf("Rolling back to %s", path)
+			fmt.Println("[NOTIFY] Rolling back to", path)
+			result, err = internal.RestoreState(conf, dockerHelper, logger, state, opts)
+		}
+	case flagValue(args, "--from") != "":
+		from := internal.ActiveLegacyJSON(flagValue(args, "--from"), hasFlag(args, "--no-backup"))
+		var state *internal.SavedState
+		if state, err = internal.LoadAnyState(from, internal.LegacyDaemonHosts(conf), logger); err == nil {
+			logger.Printf("Restoring from %s", from)
+			result, err = internal.RestoreState(conf, dockerHelper, logger, state, opts)
+		}
+	default:
+		result, err = internal.RestoreStateHelper(conf, dockerHelper, logger, opts)
+	}
 	if err != nil {
 		logger.Println("Failed to restore state:", err)
 		internal.SendSlackNotification("[ERROR] Failed to restore state: " + err.Error())
 		os.Exit(1)
 	}
-	msg := fmt.Sprintf("Restore complete. Started: %d, Failed: %d.", restored, failed)
+	created := 0
+	for _, n := range result.Networks {
+		if n.Err != nil {
+			msg := "[WARN] " + n.Err.Error()
+			fmt.Println(msg)
+			internal.SendSlackNotification(msg)
+			continue
+		}
+		created++
+		fmt.Println("[NOTIFY] Created network", n.Name)
+	}
+	for _, c := range result.ImageChanges {
+		msg := fmt.Sprintf("[WARN] %s came back on a different image: %s was %s, now %s", c.Container, c.Image, internal.ShortImageID(c.SavedImageID), internal.ShortImageID(c.NewImageID))
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+	}
+	for _, r := range result.PortRemaps {
+		msg := fmt.Sprintf("[WARN] Remapped container %s port %s", r.Container, r)
+		logger.Print(msg)
+		fmt.Println(msg)
+		internal.SendSlackNotification(msg)
+	}
+	msg := fmt.Sprintf("Restore complete. Networks created: %d, Started: %d, Failed: %d, Skipped: %d, Image changes: %d, Ports remapped: %d.",
+		created, result.Restored, result.Failed, result.Skipped, len(result.ImageChanges), len(result.PortRemaps))
 	logger.Print(msg)
 	fmt.Println(msg)
 	internal.SendSlackNotification("[NOTIFY] " + msg)
@@ -9,6 +9,8 @@ import (
 	"github.com/FabulaNox/go-docker-tools/internal"
 )
 
+// SaveCommand records the running containers in the state file.
+// Usage: save [--project <name>]; with --project only that compose project is re-saved.
 func SaveCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
 	lock := internal.NewLockfileHelper(conf.StateFile + ".lock")
 	if !lock.TryLock() {
@@ -24,7 +26,12 @@ func SaveCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logge
 		internal.SendSlackNotification("[ERROR] Failed to list running containers: " + err.Error())
 		os.Exit(1)
 	}
-	if err := internal.SaveStateHelper(containers, conf.StateFile, logger); err != nil {
+	if project := flagValue(args, "--project"); project != "" {
+		err = internal.SaveProjectStateHelper(conf, dockerHelper, containers, project, logger)
+	} else {
+		err = internal.SaveStateHelper(conf, dockerHelper, containers, logger)
+	}
+	if err != nil {
 		logger.Println("Failed to save state:", err)
 		internal.SendSlackNotification("[ERROR] Failed to save state: " + err.Error())
 		os.Exit(1)
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// snapshotTimeFormats are accepted by --at
+var snapshotTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseSnapshotTime(s string) (time.Time, error) {
+	for _, layout := range snapshotTimeFormats {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q (use e.g. 2026-10-07T03:00)", s)
+}
+
+// SnapshotsCommand indexes all backup archives and picks snapshots by volume, container and time
+func SnapshotsCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	rebuild := len(args) > 0 && args[0] == "index"
+	catalog, err := internal.RefreshSnapshotCatalog(conf, logger, rebuild)
+	if err != nil {
+		logger.Println("Failed to index backups:", err)
+		fmt.Println("[ERROR] Failed to index backups:", err)
+		os.Exit(1)
+	}
+	if rebuild {
+		fmt.Printf("[NOTIFY] Indexed %d archives under %s.\n", len(catalog.Entries), conf.BackupDir)
+		return
+	}
+	volumeFilter := flagValue(args, "--volume")
+	containerFilter := strings.TrimPrefix(flagValue(args, "--container"), "/")
+	wanted := map[string]bool{}
+	if volumeFilter != "" {
+		wanted[volumeFilter] = true
+	}
+	if containerFilter != "" {
+		for _, v := range containerVolumes(catalog, dockerHelper, containerFilter) {
+			wanted[v] = true
+		}
+		if len(wanted) == 0 {
+			fmt.Println("[ERROR] No volumes found for container:", containerFilter)
+			os.Exit(2)
+		}
+	}
+	filtered := len(wanted) > 0
+
+	if at := flagValue(args, "--at"); at != "" {
+		t, err := parseSnapshotTime(at)
+		if err != nil {
+			fmt.Println("[ERROR]", err)
+			os.Exit(2)
+		}
+		picks := catalog.SnapshotsAt(t)
+		volumes := make([]string, 0, len(picks))
+		for v := range picks {
+			if !filtered || wanted[v] {
+				volumes = append(volumes, v)
+			}
+		}
+		sort.Strings(volumes)
+		if len(volumes) == 0 {
+			fmt.Println("No snapshots found at or before", t.Format("2006-01-02 15:04:05"))
+			os.Exit(3)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VOLUME\tTIMESTAMP\tKIND\tARCHIVE")
+		for _, v := range volumes {
+			e := picks[v]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v, e.Timestamp.Format("2006-01-02 15:04:05"), e.Kind, e.Path)
+		}
+		w.Flush()
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIMESTAMP\tKIND\tVOLUMES\tSIZE\tARCHIVE")
+	for _, e := range catalog.Entries {
+		var vols []string
+		for _, v := range e.Volumes {
+			if !filtered || wanted[v] {
+				vols = append(vols, v)
+			}
+		}
+		if filtered && len(vols) == 0 {
+			continue
+		}
+		volText := strings.Join(vols, ",")
+		if e.Error != "" {
+			volText = "(unreadable: " + e.Error + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", e.Timestamp.Format("2006-01-02 15:04:05"), e.Kind, volText, e.Size, e.Path)
+	}
+	w.Flush()
+}
+
+// containerVolumes finds a container's volumes from archive manifests, then the live daemon
+func containerVolumes(catalog *internal.SnapshotCatalog, dockerHelper *internal.DockerHelper, name string) []string {
+	seen := map[string]bool{}
+	var vols []string
+	for _, e := range catalog.Entries {
+		for v, containers := range e.VolumeContainers {
+			for _, c := range containers {
+				if c == name && !seen[v] {
+					seen[v] = true
+					vols = append(vols, v)
+				}
+			}
+		}
+	}
+	containers, err := dockerHelper.ListAllContainers()
+	if err != nil {
+		return vols
+	}
+	for _, c := range containers {
+		if internal.ContainerName(c) != name {
+			continue
+		}
+		for _, m := range c.Mounts {
+			if m.Type == "volume" && m.Name != "" && !seen[m.Name] {
+				seen[m.Name] = true
+				vols = append(vols, m.Name)
+			}
+		}
+	}
+	return vols
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// StateCommand lists and compares saved state snapshots.
+// Usage: state list | state diff <a> [b] [--json]
+func StateCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: go-docker-tools state list | state diff <a> [b] [--json]")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "list":
+		stateList(conf)
+	case "diff":
+		refs := positionalArgs(args[1:])
+		if len(refs) < 1 || len(refs) > 2 {
+			fmt.Println("Usage: go-docker-tools state diff <a> [b] [--json]  (b defaults to current)")
+			os.Exit(1)
+		}
+		if len(refs) == 1 {
+			refs = append(refs, "current")
+		}
+		stateDiff(conf, logger, refs[0], refs[1], hasFlag(args, "--json"))
+	default:
+		fmt.Println("Unknown state action:", args[0])
+		os.Exit(1)
+	}
+}
+
+func stateList(conf *config.Config) {
+	snapshots, err := internal.ListStateSnapshots(conf)
+	if err != nil {
+		fmt.Println("[ERROR] Failed to read state history:", err)
+		os.Exit(1)
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("No state snapshots in", internal.StateHistoryDir(conf))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSNAPSHOT\tSAVED\tCONTAINERS\tBY")
+	for i, s := range snapshots {
+		count := fmt.Sprint(s.Containers)
+		if s.Containers < 0 {
+			count = "unreadable"
+		}
+		by := "save"
+		if s.Auto {
+			by = "daemon"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", i+1, s.Name, s.SavedAt.Local().Format("2006-01-02 15:04:05"), count, by)
+	}
+	w.Flush()
+}
+
+// loadStateRef resolves and reads a snapshot reference as accepted by state diff
+func loadStateRef(conf *config.Config, logger *log.Logger, ref string) (*internal.SavedState, string, error) {
+	path, err := internal.ResolveStateSnapshot(conf, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	state, err := internal.LoadAnyState(path, internal.LegacyDaemonHosts(conf), logger)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	return state, path, nil
+}
+
+func stateDiff(conf *config.Config, logger *log.Logger, a, b string, asJSON bool) {
+	from, fromPath, err := loadStateRef(conf, logger, a)
+	if err != nil {
+		fmt.Println("[ERROR]", err)
+		os.Exit(1)
+	}
+	to, toPath, err := loadStateRef(conf, logger, b)
+	if err != nil {
+		fmt.Println("[ERROR]", err)
+		os.Exit(1)
+	}
+	changes := internal.DiffStates(from, to)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(changes)
+		return
+	}
+	fmt.Printf("--- %s\n+++ %s\n", fromPath, toPath)
+	if len(changes) == 0 {
+		fmt.Println("No differences.")
+		return
+	}
+	for _, c := range changes {
+		switch c.Kind {
+		case internal.ChangeAdded:
+			fmt.Printf("+ %s\n", c.Container)
+		case internal.ChangeRemoved:
+			fmt.Printf("- %s\n", c.Container)
+		default:
+			fmt.Printf("~ %s\n", c.Container)
+			for _, f := range c.Fields {
+				fmt.Printf("    %s\n", f)
+			}
+		}
+	}
+}
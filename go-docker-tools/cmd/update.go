@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/FabulaNox/go-docker-tools/internal"
+)
+
+// UpdateCommand moves running containers labelled update.enable=true to the newest
+// image of their tag, rolling back any that do not become ready.
+// Usage: update [<name>...] [--dry-run] [--timeout <duration>] [--json]
+// Exits 61 when an update failed or was rolled back.
+func UpdateCommand(conf *config.Config, dockerHelper *internal.DockerHelper, logger *log.Logger, args []string) {
+	names := positionalArgs(args, "--timeout")
+	dryRun := hasFlag(args, "--dry-run")
+	updater := &internal.Updater{DockerHelper: dockerHelper, Logger: logger, Timeout: internal.DefaultUpdateTimeout}
+	if v := flagValue(args, "--timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			fmt.Println("[ERROR] Invalid --timeout:", v)
+			os.Exit(1)
+		}
+		updater.Timeout = d
+	}
+
+	lock := internal.NewLockfileHelper(conf.StateFile + ".lock")
+	if !dryRun {
+		if !lock.TryLock() {
+			logger.Println("Another save is in progress.")
+			fmt.Println("[ERROR] Another save or restore is in progress.")
+			os.Exit(1)
+		}
+		defer lock.Unlock()
+	}
+
+	containers, err := dockerHelper.ListRunningContainers()
+	if err != nil {
+		logger.Println("Failed to list running containers:", err)
+		internal.SendSlackNotification("[ERROR] Update check failed: " + err.Error())
+		os.Exit(1)
+	}
+	live := internal.CaptureState(dockerHelper, containers, logger)
+	wanted := map[string]bool{}
+	for _, n := range names {
+		wanted[strings.TrimPrefix(n, "/")] = true
+	}
+
+	var results []internal.UpdateResult
+	for _, entry := range live.Containers {
+		if len(wanted) > 0 && !wanted[entry.Name()] {
+			continue
+		}
+		delete(wanted, entry.Name())
+		if entry.Config == nil || !internal.UpdateEnabled(entry.Config.Labels) {
+			if len(names) > 0 {
+				results = append(results, internal.UpdateResult{Container: entry.Name(), Image: entry.ImageRef(),
+					Status: internal.UpdateSkipped, Detail: "not labelled " + internal.UpdateEnableLabel + "=true"})
+			}
+			continue
+		}
+		r := internal.CheckUpdate(dockerHelper, entry)
+		if r.Status == internal.UpdateAvailable && !dryRun {
+			r = updater.Update(entry, r)
+		}
+		if r.Err != nil {
+			r.Error = r.Err.Error()
+		}
+		results = append(results, r)
+	}
+	for _, n := range names {
+		if wanted[strings.TrimPrefix(n, "/")] {
+			results = append(results, internal.UpdateResult{Container: n, Status: internal.UpdateSkipped, Detail: "not running"})
+		}
+	}
+	printUpdateResults(results, hasFlag(args, "--json"))
+
+	updated, failed := notifyUpdates(conf, logger, results, dryRun)
+	if updated > 0 {
+		// Keep restore from putting the old images back
+		if running, err := dockerHelper.ListRunningContainers(); err == nil {
+			if err := internal.SaveStateHelper(conf, dockerHelper, running, logger); err != nil {
+				logger.Println("Failed to save state after update:", err)
+				fmt.Println("[WARN] Failed to save state after update:", err)
+			}
+		}
+	}
+	if failed > 0 {
+		os.Exit(61)
+	}
+}
+
+// notifyUpdates sends one notification per applied, rolled back or failed update,
+// or a single summary of the available ones on a dry run
+func notifyUpdates(conf *config.Config, logger *log.Logger, results []internal.UpdateResult, dryRun bool) (int, int) {
+	updated, failed := 0, 0
+	var available []string
+	for _, r := range results {
+		var msg string
+		switch r.Status {
+		case internal.UpdateAvailable:
+			available = append(available, r.Container)
+			continue
+		case internal.UpdateApplied:
+			updated++
+			msg = fmt.Sprintf("[NOTIFY] Updated %s to the latest %s (%s).", r.Container, r.Image, r.Detail)
+			internal.RunHook(conf.HookScript, "update_applied")
+		case internal.UpdateRolledBack:
+			failed++
+			msg = fmt.Sprintf("[WARN] Update of %s to %s failed and was rolled back: %v", r.Container, r.Image, r.Err)
+			internal.RunHook(conf.HookScript, "update_rolled_back")
+		case internal.UpdateFailed:
+			failed++
+			msg = fmt.Sprintf("[ERROR] Update of %s failed: %v", r.Container, r.Err)
+			if r.Detail != "" {
+				msg += " (" + r.Detail + ")"
+			}
+			internal.RunHook(conf.HookScript, "update_failed")
+		default:
+			continue
+		}
+		logger.Print(msg)
+		internal.SendSlackNotification(msg)
+	}
+	if dryRun && len(available) > 0 {
+		msg := "[NOTIFY] Image updates available for " + strings.Join(available, ", ")
+		logger.Print(msg)
+		internal.SendSlackNotification(msg)
+	}
+	return updated, failed
+}
+
+func printUpdateResults(results []internal.UpdateResult, asJSON bool) {
+	if asJSON {
+		if results == nil {
+			results = []internal.UpdateResult{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return
+	}
+	if len(results) == 0 {
+		fmt.Printf("No running containers are labelled %s=true.\n", internal.UpdateEnableLabel)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tIMAGE\tSTATUS\tFROM\tTO\tDETAILS")
+	for _, r := range results {
+		details := r.Detail
+		if r.Err != nil {
+			details = strings.TrimPrefix(details+"; "+r.Err.Error(), "; ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Container, dash(r.Image), r.Status,
+			dash(internal.ShortImageID(r.From)), dash(internal.ShortImageID(r.To)), details)
+	}
+	w.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -42,25 +44,79 @@ type Config struct {
 	DockerDesktopSocketTemplate string
 
 	// Additional fields for full config parity
-	DockerHost      string
-	ServiceFile     string
-	AutoscriptDir   string
-	ContainerList   string
-	ErrorLog        string
-	HealthLog       string
-	Lockfile        string
-	ImageBackupDir  string
-	ConfigBackupDir string
-	JSONBackupFile  string
-	RestoreLog      string
-	SystemdService  string
-	BinPath         string
-	LockfileScript  string
-	DeployScript    string
-	AutostartScript string
+	DockerHost     string
+	ServiceFile    string
+	AutoscriptDir  string
+	ContainerList  string
+	ErrorLog       string
+	HealthLog      string
+	Lockfile       string
+	ImageBackupDir string
+	// ImageStoreFormat is "tar" (one docker-save file per image) or "oci"
+	ImageStoreFormat string
+	ConfigBackupDir  string
+	JSONBackupFile   string
+	RestoreLog       string
+	SystemdService   string
+	BinPath          string
+	LockfileScript   string
+	DeployScript     string
+	AutostartScript  string
 
 	// Path to a hook script for pre/post/notify events
 	HookScript string
+
+	// Number of timestamped state snapshots kept in StateDir/history
+	StateHistoryCount int
+	// Quiet period after a Docker event before the daemon rewrites the inventory
+	EventDebounce time.Duration
+
+	// How often the daemon samples container state and health into the health history
+	HealthCheckInterval time.Duration
+	// Days of health history kept in StateDir/health.jsonl; 0 keeps everything
+	HealthHistoryDays int
+
+	// How long commands wait for the Docker daemon to answer before giving up
+	DockerWaitTimeout time.Duration
+
+	// What restore and autostart do when a saved host port is taken: fail, skip or remap
+	PortConflictPolicy string
+
+	// Declarative manifest used by plan and apply (default STATE_DIR/manifest.yaml)
+	ManifestFile string
+
+	// Named backup jobs from the BACKUP_JOBS section
+	BackupJobs []BackupJob
+}
+
+// BackupJob is a named backup definition from saver.yaml
+type BackupJob struct {
+	Name string `mapstructure:"name"`
+	// Container names (or "label:key=value" selectors) whose volumes are backed up
+	Containers []string `mapstructure:"containers"`
+	// Extra volume names backed up regardless of containers
+	Volumes     []string `mapstructure:"volumes"`
+	Destination string   `mapstructure:"destination"`
+	// Compression is "gzip" (default) or "none"
+	Compression string `mapstructure:"compression"`
+	// Path to a key file; when set the archive is encrypted
+	EncryptionKeyFile string `mapstructure:"encryption_key_file"`
+	// Number of archives to keep for this job (0 keeps all)
+	Retention int `mapstructure:"retention"`
+	// Consistency is "none" (default), "pause" or "stop"
+	Consistency string `mapstructure:"consistency"`
+	PreHook     string `mapstructure:"pre_hook"`
+	PostHook    string `mapstructure:"post_hook"`
+}
+
+// FindBackupJob returns the job with the given name, or nil
+func (c *Config) FindBackupJob(name string) *BackupJob {
+	for i := range c.BackupJobs {
+		if c.BackupJobs[i].Name == name {
+			return &c.BackupJobs[i]
+		}
+	}
+	return nil
 }
 
 func LoadConfig() (*Config, error) {
@@ -93,6 +149,34 @@ func LoadConfig() (*Config, error) {
 	if dockerHost == "" {
 		dockerHost = GetDefaultDockerSocket()
 	}
+	imageBackupDir := viper.GetString("IMAGE_BACKUP_DIR")
+	if imageBackupDir == "" {
+		imageBackupDir = filepath.Join(backupDir, "images")
+	}
+	stateHistoryCount := 20
+	if viper.IsSet("STATE_HISTORY_COUNT") {
+		stateHistoryCount = viper.GetInt("STATE_HISTORY_COUNT")
+	}
+	eventDebounce := viper.GetDuration("EVENT_DEBOUNCE")
+	if eventDebounce <= 0 {
+		eventDebounce = 2 * time.Second
+	}
+	healthCheckInterval := viper.GetDuration("HEALTH_CHECK_INTERVAL")
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = time.Minute
+	}
+	healthHistoryDays := 90
+	if viper.IsSet("HEALTH_HISTORY_DAYS") {
+		healthHistoryDays = viper.GetInt("HEALTH_HISTORY_DAYS")
+	}
+	dockerWaitTimeout := viper.GetDuration("DOCKER_WAIT_TIMEOUT")
+	if dockerWaitTimeout <= 0 {
+		dockerWaitTimeout = 5 * time.Minute
+	}
+	var backupJobs []BackupJob
+	if err := viper.UnmarshalKey("BACKUP_JOBS", &backupJobs); err != nil {
+		return nil, err
+	}
 	return &Config{
 		StateDir:                    stateDir,
 		StateFile:                   viper.GetString("STATE_FILE"),
@@ -103,23 +187,37 @@ func LoadConfig() (*Config, error) {
 		SystemDockerSocket:          viper.GetString("SYSTEM_DOCKER_SOCKET"),
 		DockerDesktopSocketTemplate: viper.GetString("DOCKER_DESKTOP_SOCKET_TEMPLATE"),
 
-		DockerHost:      dockerHost,
-		ServiceFile:     viper.GetString("SERVICE_FILE"),
-		AutoscriptDir:   viper.GetString("AUTOSCRIPT_DIR"),
-		ContainerList:   viper.GetString("CONTAINER_LIST"),
-		ErrorLog:        viper.GetString("ERROR_LOG"),
-		HealthLog:       viper.GetString("HEALTH_LOG"),
-		Lockfile:        viper.GetString("LOCKFILE"),
-		ImageBackupDir:  viper.GetString("IMAGE_BACKUP_DIR"),
-		ConfigBackupDir: viper.GetString("CONFIG_BACKUP_DIR"),
-		JSONBackupFile:  viper.GetString("JSON_BACKUP_FILE"),
-		RestoreLog:      viper.GetString("RESTORE_LOG"),
-		SystemdService:  viper.GetString("SYSTEMD_SERVICE"),
-		BinPath:         viper.GetString("BIN_PATH"),
-		LockfileScript:  viper.GetString("LOCKFILE_SCRIPT"),
-		DeployScript:    viper.GetString("DEPLOY_SCRIPT"),
-		AutostartScript: viper.GetString("AUTOSTART_SCRIPT"),
+		DockerHost:       dockerHost,
+		ServiceFile:      viper.GetString("SERVICE_FILE"),
+		AutoscriptDir:    viper.GetString("AUTOSCRIPT_DIR"),
+		ContainerList:    viper.GetString("CONTAINER_LIST"),
+		ErrorLog:         viper.GetString("ERROR_LOG"),
+		HealthLog:        viper.GetString("HEALTH_LOG"),
+		Lockfile:         viper.GetString("LOCKFILE"),
+		ImageBackupDir:   imageBackupDir,
+		ImageStoreFormat: viper.GetString("IMAGE_STORE_FORMAT"),
+		ConfigBackupDir:  viper.GetString("CONFIG_BACKUP_DIR"),
+		JSONBackupFile:   viper.GetString("JSON_BACKUP_FILE"),
+		RestoreLog:       viper.GetString("RESTORE_LOG"),
+		SystemdService:   viper.GetString("SYSTEMD_SERVICE"),
+		BinPath:          viper.GetString("BIN_PATH"),
+		LockfileScript:   viper.GetString("LOCKFILE_SCRIPT"),
+		DeployScript:     viper.GetString("DEPLOY_SCRIPT"),
+		AutostartScript:  viper.GetString("AUTOSTART_SCRIPT"),
 
 		HookScript: viper.GetString("HOOK_SCRIPT"),
+
+		PortConflictPolicy: viper.GetString("PORT_CONFLICT_POLICY"),
+
+		ManifestFile: viper.GetString("MANIFEST_FILE"),
+
+		StateHistoryCount: stateHistoryCount,
+		EventDebounce:     eventDebounce,
+		DockerWaitTimeout: dockerWaitTimeout,
+
+		HealthCheckInterval: healthCheckInterval,
+		HealthHistoryDays:   healthHistoryDays,
+
+		BackupJobs: backupJobs,
 	}, nil
 }
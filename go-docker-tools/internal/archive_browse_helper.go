@@ -0,0 +1,284 @@
+package internal
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveFile is one entry of a backup archive, addressed as <volume>/<path>
+type ArchiveFile struct {
+	Volume   string      `json:"volume"`
+	Path     string      `json:"path"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	ModTime  time.Time   `json:"mtime"`
+	Type     string      `json:"type"`
+	LinkName string      `json:"link,omitempty"`
+}
+
+// DisplayPath joins volume and in-volume path the way users address files
+func (f ArchiveFile) DisplayPath() string {
+	if f.Path == "." || f.Path == "" {
+		return f.Volume
+	}
+	return f.Volume + "/" + f.Path
+}
+
+func archiveFileFromHeader(archivePath string, hdr *tar.Header) ArchiveFile {
+	vol, rel := SplitArchiveEntry(archivePath, hdr.Name)
+	f := ArchiveFile{
+		Volume:   vol,
+		Path:     rel,
+		Size:     hdr.Size,
+		Mode:     hdr.FileInfo().Mode(),
+		ModTime:  hdr.ModTime,
+		LinkName: hdr.Linkname,
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		f.Type = "dir"
+	case tar.TypeSymlink:
+		f.Type = "symlink"
+	case tar.TypeLink:
+		f.Type = "hardlink"
+	case tar.TypeReg:
+		f.Type = "file"
+	default:
+		f.Type = "other"
+	}
+	return f
+}
+
+// normalizeArchivePath cleans a user-supplied path for matching
+func normalizeArchivePath(p string) string {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "./"), "/")
+	if p == "" {
+		return ""
+	}
+	return path.Clean(p)
+}
+
+// matchesArchivePath reports whether f is p itself or lies beneath it
+func matchesArchivePath(f ArchiveFile, p string) bool {
+	if p == "" {
+		return true
+	}
+	d := f.DisplayPath()
+	return d == p || strings.HasPrefix(d, p+"/")
+}
+
+// WalkArchive calls fn for each non-manifest entry; fn may read the entry's data from r
+func WalkArchive(archivePath string, key *EncryptionKey, fn func(f ArchiveFile, r io.Reader) error) error {
+	a, err := OpenBackupArchive(archivePath, key)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	_, hdr, err := ReadArchiveManifest(a)
+	if err != nil {
+		return err
+	}
+	for hdr != nil {
+		if err := fn(archiveFileFromHeader(archivePath, hdr), a.Reader); err != nil {
+			return err
+		}
+		hdr, err = a.Reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return a.Drain()
+}
+
+// ListArchive returns entries at or below prefix ("" lists everything)
+func ListArchive(archivePath string, key *EncryptionKey, prefix string) ([]ArchiveFile, error) {
+	prefix = normalizeArchivePath(prefix)
+	var files []ArchiveFile
+	err := WalkArchive(archivePath, key, func(f ArchiveFile, _ io.Reader) error {
+		if matchesArchivePath(f, prefix) {
+			files = append(files, f)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// CatArchiveFile copies one regular file from the archive to w. The data is
+// streamed, so an archive that fails verification afterwards is reported as
+// unauthenticated output that must not be trusted.
+func CatArchiveFile(archivePath string, key *EncryptionKey, file string, w io.Writer) error {
+	file = normalizeArchivePath(file)
+	found := false
+	err := WalkArchive(archivePath, key, func(f ArchiveFile, r io.Reader) error {
+		if found || f.DisplayPath() != file {
+			return nil
+		}
+		if f.Type != "file" {
+			return fmt.Errorf("%s is a %s, not a regular file", file, f.Type)
+		}
+		found = true
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil && found {
+		return fmt.Errorf("unauthenticated output: %s was written before the archive failed verification: %w", file, err)
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s not found in %s", file, archivePath)
+	}
+	return nil
+}
+
+// ExtractArchivePath writes the entries at or below p into destDir as <volume>/<path>.
+// It never touches live volumes and refuses entries that would escape destDir.
+// Entries are staged in a temporary directory and only moved into destDir once
+// the whole archive, including its checksum or MAC, has been verified.
+func ExtractArchivePath(archivePath string, key *EncryptionKey, p, destDir string) (int, error) {
+	p = normalizeArchivePath(p)
+	destDir, err := filepath.Abs(destDir)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return 0, err
+	}
+	staging, err := os.MkdirTemp(destDir, ".extract-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(staging)
+	count := 0
+	err = WalkArchive(archivePath, key, func(f ArchiveFile, r io.Reader) error {
+		if !matchesArchivePath(f, p) {
+			return nil
+		}
+		target := filepath.Join(staging, filepath.FromSlash(f.DisplayPath()))
+		if target != staging && !strings.HasPrefix(target, staging+string(os.PathSeparator)) {
+			return fmt.Errorf("refusing to extract %s outside %s", f.DisplayPath(), destDir)
+		}
+		if err := checkNoSymlinkParents(staging, target); err != nil {
+			return err
+		}
+		switch f.Type {
+		case "dir":
+			if err := os.MkdirAll(target, f.Mode.Perm()|0700); err != nil {
+				return err
+			}
+		case "file":
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				os.Remove(target)
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode.Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, r); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+			os.Chtimes(target, f.ModTime, f.ModTime)
+		case "symlink":
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(f.LinkName, target); err != nil {
+				return err
+			}
+		default:
+			// Devices, fifos and hard links are skipped; they cannot be safely recreated here
+			return nil
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if err := moveStagedTree(filepath.Join(staging, e.Name()), filepath.Join(destDir, e.Name())); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// moveStagedTree moves src to dst, merging into directories that already exist.
+// Existing symlinks are never followed, so they cannot redirect the move.
+func moveStagedTree(src, dst string) error {
+	dfi, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	}
+	if err != nil {
+		return err
+	}
+	sfi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sfi.IsDir() && dfi.IsDir():
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := moveStagedTree(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	case sfi.IsDir() && dfi.Mode()&os.ModeSymlink != 0:
+		return fmt.Errorf("refusing to extract through symlink %s", dst)
+	case dfi.IsDir():
+		return fmt.Errorf("refusing to replace directory %s", dst)
+	}
+	return os.Rename(src, dst)
+}
+
+// checkNoSymlinkParents rejects targets whose parent directories are symlinks,
+// so an archived link cannot redirect later entries outside destDir
+func checkNoSymlinkParents(destDir, target string) error {
+	rel, err := filepath.Rel(destDir, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	cur := destDir
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to extract through symlink %s", cur)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeTestArchive writes a single-volume archive named after vol, encrypted when key is set
+func writeTestArchive(t *testing.T, vol string, key *EncryptionKey, entries []tarEntry) string {
+	t.Helper()
+	data := buildTar(t, entries)
+	name := vol + "_20240301T000000.tar"
+	if key != nil {
+		data = encryptForTest(t, key, data)
+		name += EncryptedSuffix
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// treeFiles lists every path under dir, symlinks included, relative to it
+func treeFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir {
+			rel, _ := filepath.Rel(dir, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestExtractArchivePath(t *testing.T) {
+	key := &EncryptionKey{raw: bytes.Repeat([]byte{1}, 32)}
+	tests := []struct {
+		name    string
+		key     *EncryptionKey
+		entries []tarEntry
+		// prepare sets up destDir and outside before extraction
+		prepare func(t *testing.T, destDir, outside string)
+		mangle  func(path string)
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "files and links",
+			entries: []tarEntry{{name: "conf/app.ini", data: "x"}, {name: "current", link: "conf"}},
+			want:    []string{"data", "data/conf", "data/conf/app.ini", "data/current"},
+		},
+		{
+			name:    "merges into an existing tree",
+			entries: []tarEntry{{name: "conf/app.ini", data: "new"}},
+			prepare: func(t *testing.T, destDir, outside string) {
+				os.MkdirAll(filepath.Join(destDir, "data", "conf"), 0755)
+				os.WriteFile(filepath.Join(destDir, "data", "conf", "app.ini"), []byte("old"), 0644)
+				os.WriteFile(filepath.Join(destDir, "data", "keep"), nil, 0644)
+			},
+			want: []string{"data", "data/conf", "data/conf/app.ini", "data/keep"},
+		},
+		{
+			name:    "parent directory entry",
+			entries: []tarEntry{{name: "ok", data: "x"}, {name: "../../escape", data: "x"}},
+			wantErr: "outside",
+		},
+		{
+			name:    "parent directory as volume",
+			entries: []tarEntry{{name: "../_data/escape", data: "x"}},
+			wantErr: "outside",
+		},
+		{
+			name:    "archived symlink as parent",
+			entries: []tarEntry{{name: "link", link: "/"}, {name: "link/escape", data: "x"}},
+			wantErr: "through symlink",
+		},
+		{
+			name:    "existing symlink in the destination",
+			entries: []tarEntry{{name: "link/escape", data: "x"}},
+			prepare: func(t *testing.T, destDir, outside string) {
+				os.MkdirAll(filepath.Join(destDir, "data"), 0755)
+				if err := os.Symlink(outside, filepath.Join(destDir, "data", "link")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    []string{"data", "data/link"},
+			wantErr: "through symlink",
+		},
+		{
+			name:    "encrypted",
+			key:     key,
+			entries: []tarEntry{{name: "secret", data: "x"}},
+			want:    []string{"data", "data/secret"},
+		},
+		{
+			name:    "encrypted with a bad MAC",
+			key:     key,
+			entries: []tarEntry{{name: "secret", data: "x"}},
+			mangle: func(path string) {
+				data, _ := os.ReadFile(path)
+				data[len(data)-1] ^= 1
+				os.WriteFile(path, data, 0644)
+			},
+			wantErr: "failed authentication",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := writeTestArchive(t, "data", tt.key, tt.entries)
+			if tt.mangle != nil {
+				tt.mangle(archive)
+			}
+			root := t.TempDir()
+			destDir, outside := filepath.Join(root, "dest"), filepath.Join(root, "outside")
+			os.MkdirAll(destDir, 0755)
+			os.MkdirAll(outside, 0755)
+			if tt.prepare != nil {
+				tt.prepare(t, destDir, outside)
+			}
+			_, err := ExtractArchivePath(archive, tt.key, "", destDir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ExtractArchivePath() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("ExtractArchivePath() error = %v", err)
+			}
+			if got := treeFiles(t, destDir); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("destination holds %v, want %v", got, tt.want)
+			}
+			if got := treeFiles(t, root); len(got) != len(treeFiles(t, destDir))+2 {
+				t.Errorf("files written outside the destination: %v", got)
+			}
+		})
+	}
+}
+
+func TestCatArchiveFile(t *testing.T) {
+	key := &EncryptionKey{raw: bytes.Repeat([]byte{1}, 32)}
+	big := strings.Repeat("log line\n", 20000)
+	tests := []struct {
+		name    string
+		file    string
+		badMAC  bool
+		want    string
+		wantErr string
+	}{
+		{name: "file", file: "data/app.log", want: big},
+		{name: "symlink", file: "data/current", wantErr: "not a regular file"},
+		{name: "missing", file: "data/nope", wantErr: "not found"},
+		{name: "bad MAC", file: "data/app.log", badMAC: true, wantErr: "unauthenticated output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := writeTestArchive(t, "data", key, []tarEntry{{name: "app.log", data: big}, {name: "current", link: "app.log"}})
+			if tt.badMAC {
+				data, _ := os.ReadFile(archive)
+				data[len(data)-1] ^= 1
+				os.WriteFile(archive, data, 0644)
+			}
+			var out bytes.Buffer
+			err := CatArchiveFile(archive, key, tt.file, &out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("CatArchiveFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CatArchiveFile() error = %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("CatArchiveFile() wrote %d bytes, want %d", out.Len(), len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+// ArchiveIndexSuffix is appended to an archive path to name its file index
+const ArchiveIndexSuffix = ".index.json"
+
+// ArchiveIndex lists every file in an archive so searches need not decompress it
+type ArchiveIndex struct {
+	Archive     string        `json:"archive"`
+	ArchiveSize int64         `json:"archive_size"`
+	ArchiveTime time.Time     `json:"archive_mtime"`
+	IndexedAt   time.Time     `json:"indexed_at"`
+	Files       []ArchiveFile `json:"files"`
+}
+
+// WriteArchiveIndex stores files as the index of archivePath. The index of an
+// encrypted archive is encrypted with the same key, so file names do not leak.
+func WriteArchiveIndex(archivePath string, files []ArchiveFile, key *EncryptionKey) error {
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	index := ArchiveIndex{
+		Archive:     archivePath,
+		ArchiveSize: fi.Size(),
+		ArchiveTime: fi.ModTime(),
+		IndexedAt:   time.Now(),
+		Files:       files,
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		var buf bytes.Buffer
+		ew, err := NewEncryptWriter(&buf, key)
+		if err != nil {
+			return err
+		}
+		if _, err := ew.Write(data); err != nil {
+			return err
+		}
+		if err := ew.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	return os.WriteFile(archivePath+ArchiveIndexSuffix, data, 0600)
+}
+
+// LoadArchiveIndex reads an archive's index; it returns nil if the index is
+// missing, encrypted without a key given, or no longer matches the archive on disk
+func LoadArchiveIndex(archivePath string, key *EncryptionKey) (*ArchiveIndex, error) {
+	data, err := os.ReadFile(archivePath + ArchiveIndexSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isEncryptionHeader(data) {
+		if key == nil {
+			return nil, nil
+		}
+		dr, err := NewDecryptReader(bytes.NewReader(data), key)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(dr); err != nil {
+			return nil, fmt.Errorf("index of %s: %w", archivePath, err)
+		}
+	}
+	var index ArchiveIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != index.ArchiveSize || !fi.ModTime().Equal(index.ArchiveTime) {
+		return nil, nil
+	}
+	return &index, nil
+}
+
+// BuildArchiveIndex reads an existing (e.g. legacy) archive and writes its index
+func BuildArchiveIndex(archivePath string, key *EncryptionKey) (int, error) {
+	var files []ArchiveFile
+	err := WalkArchive(archivePath, key, func(f ArchiveFile, _ io.Reader) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(files), WriteArchiveIndex(archivePath, files, key)
+}
+
+// ArchiveFileMatch is a file found in an archive index
+type ArchiveFileMatch struct {
+	File    ArchiveFile
+	Archive *SnapshotEntry
+}
+
+// MatchArchiveGlob matches a glob against the full <volume>/<path>, or against
+// the base name when the pattern has no slash
+func MatchArchiveGlob(pattern string, f ArchiveFile) bool {
+	target := f.DisplayPath()
+	if !strings.Contains(pattern, "/") {
+		target = path.Base(target)
+	}
+	ok, _ := path.Match(pattern, target)
+	return ok
+}
+
+// FindInArchives searches the indexes of all catalogued archives, decrypting those
+// of encrypted archives with their job's key. Archives without a current, readable
+// index are logged and returned separately; they never stop the search.
+func FindInArchives(conf *config.Config, catalog *SnapshotCatalog, pattern string, logger *log.Logger) ([]ArchiveFileMatch, []string) {
+	var matches []ArchiveFileMatch
+	var unindexed []string
+	for _, e := range catalog.Entries {
+		index, err := LoadArchiveIndex(e.Path, ArchiveKey(conf, e.Path))
+		if err != nil {
+			logger.Printf("[WARN] Skipping unreadable index of %s: %v", e.Path, err)
+		}
+		if index == nil {
+			unindexed = append(unindexed, e.Path)
+			continue
+		}
+		for _, f := range index.Files {
+			if MatchArchiveGlob(pattern, f) {
+				matches = append(matches, ArchiveFileMatch{File: f, Archive: e})
+			}
+		}
+	}
+	return matches, unindexed
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+func TestFindInArchives(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC)
+	dbKey := filepath.Join(dir, "db.key")
+	otherKey := filepath.Join(dir, "other.key")
+	os.WriteFile(dbKey, []byte(strings.Repeat("ab", 32)), 0600)
+	os.WriteFile(otherKey, []byte("other passphrase"), 0600)
+	conf := &config.Config{BackupJobs: []config.BackupJob{
+		{Name: "db", EncryptionKeyFile: dbKey, Compression: "none"},
+		{Name: "other", EncryptionKeyFile: otherKey, Compression: "none"},
+	}}
+	wrongKey := &EncryptionKey{raw: bytes.Repeat([]byte{9}, 32)}
+
+	// Every archive holds app.log; index sets up its file index, if any
+	archives := []struct {
+		name  string
+		index func(t *testing.T, path string, key *EncryptionKey)
+	}{
+		{name: "plain_20240301T000000.tar", index: buildIndex},
+		{name: BackupJobArchiveName(conf.BackupJobs[0], at), index: buildIndex},
+		{name: "unindexed_20240301T000000.tar"},
+		{
+			name: "corrupt_20240301T000000.tar",
+			index: func(t *testing.T, path string, _ *EncryptionKey) {
+				os.WriteFile(path+ArchiveIndexSuffix, []byte("{not json"), 0600)
+			},
+		},
+		{
+			name: "stale_20240301T000000.tar",
+			index: func(t *testing.T, path string, key *EncryptionKey) {
+				buildIndex(t, path, key)
+				later := time.Now().Add(time.Hour)
+				os.Chtimes(path, later, later)
+			},
+		},
+		{
+			name: BackupJobArchiveName(conf.BackupJobs[1], at),
+			index: func(t *testing.T, path string, _ *EncryptionKey) {
+				if err := WriteArchiveIndex(path, []ArchiveFile{{Volume: "other", Path: "app.log"}}, wrongKey); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	catalog := &SnapshotCatalog{}
+	for _, a := range archives {
+		path := filepath.Join(dir, a.name)
+		key := ArchiveKey(conf, path)
+		data := buildTar(t, []tarEntry{{name: "app.log", data: "x"}})
+		if key != nil {
+			data = encryptForTest(t, key, data)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if a.index != nil {
+			a.index(t, path, key)
+		}
+		catalog.Entries = append(catalog.Entries, &SnapshotEntry{Path: path})
+	}
+
+	matches, unindexed := FindInArchives(conf, catalog, "*.log", testLogger)
+	var found []string
+	for _, m := range matches {
+		found = append(found, filepath.Base(m.Archive.Path)+":"+m.File.DisplayPath())
+	}
+	sort.Strings(found)
+	wantFound := []string{"db_20240301T020000.tar.enc:db/app.log", "plain_20240301T000000.tar:plain/app.log"}
+	if !reflect.DeepEqual(found, wantFound) {
+		t.Errorf("matches = %v, want %v", found, wantFound)
+	}
+	wantUnindexed := []string{
+		"corrupt_20240301T000000.tar", "other_20240301T020000.tar.enc",
+		"stale_20240301T000000.tar", "unindexed_20240301T000000.tar",
+	}
+	got := entryBases(unindexed)
+	if !reflect.DeepEqual(got, wantUnindexed) {
+		t.Errorf("unindexed = %v, want %v", got, wantUnindexed)
+	}
+
+	if matches, _ := FindInArchives(conf, catalog, "db/*", testLogger); len(matches) != 1 {
+		t.Errorf("path glob matched %d files, want 1", len(matches))
+	}
+}
+
+func buildIndex(t *testing.T, path string, key *EncryptionKey) {
+	t.Helper()
+	if _, err := BuildArchiveIndex(path, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func entryBases(paths []string) []string {
+	var out []string
+	for _, p := range paths {
+		out = append(out, filepath.Base(p))
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BackupArchive is an open backup archive positioned at its first tar entry
+type BackupArchive struct {
+	Path   string
+	Reader *tar.Reader
+	file   *os.File
+	gz     *gzip.Reader
+	stream io.Reader
+}
+
+// Drain reads the rest of the stream so gzip checksums and the encryption MAC are verified
+func (a *BackupArchive) Drain() error {
+	_, err := io.Copy(io.Discard, a.stream)
+	return err
+}
+
+// Close releases the underlying file
+func (a *BackupArchive) Close() error {
+	if a.gz != nil {
+		a.gz.Close()
+	}
+	return a.file.Close()
+}
+
+// OpenBackupArchive opens a plain, gzipped or encrypted backup archive for reading.
+// key is only needed for encrypted archives.
+func OpenBackupArchive(archivePath string, key *EncryptionKey) (*BackupArchive, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	archive := &BackupArchive{Path: archivePath, file: f}
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if head, _ := br.Peek(len(encryptionMagic)); isEncryptionHeader(head) {
+		if key == nil {
+			f.Close()
+			return nil, fmt.Errorf("%s is encrypted; a key is required", archivePath)
+		}
+		dr, err := NewDecryptReader(br, key)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = bufio.NewReader(dr)
+	}
+	peeker, ok := r.(*bufio.Reader)
+	if !ok {
+		peeker = bufio.NewReader(r)
+	}
+	if head, _ := peeker.Peek(2); len(head) == 2 && head[0] == 0x1f && head[1] == 0x8b {
+		gz, err := gzip.NewReader(peeker)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		archive.gz = gz
+		archive.stream = gz
+	} else {
+		archive.stream = peeker
+	}
+	archive.Reader = tar.NewReader(archive.stream)
+	return archive, nil
+}
+
+// IsBackupArchiveName reports whether a file name looks like a backup archive
+func IsBackupArchiveName(name string) bool {
+	name = strings.TrimSuffix(name, EncryptedSuffix)
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".tar")
+}
+
+// SingleVolumeName derives the volume name from a single-volume archive file name
+// such as vol_20060102T150405.tar.gz, mirroring RestoreVolumesFromFile.
+func SingleVolumeName(archivePath string) string {
+	name := filepath.Base(archivePath)
+	name = strings.TrimSuffix(name, EncryptedSuffix)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	if i := len(name) - 16; i > 0 && name[i] == '_' {
+		name = name[:i]
+	}
+	return name
+}
+
+// SplitArchiveEntry maps a tar entry name to a volume and a path inside it.
+// Multi-volume archives store <volume>/_data/<path>; single-volume archives
+// store paths relative to the volume root and take the volume from the file name.
+func SplitArchiveEntry(archivePath, entryName string) (volumeName, rel string) {
+	clean := path.Clean(strings.TrimPrefix(entryName, "./"))
+	parts := strings.SplitN(clean, "/", 3)
+	if len(parts) >= 2 && parts[1] == "_data" {
+		if len(parts) == 3 {
+			return parts[0], parts[2]
+		}
+		return parts[0], "."
+	}
+	return SingleVolumeName(archivePath), clean
+}
+
+// ReadArchiveManifest returns the job manifest if the archive starts with one.
+// The second return value is the first non-manifest header, if already consumed.
+func ReadArchiveManifest(a *BackupArchive) (*ArchiveManifest, *tar.Header, error) {
+	hdr, err := a.Reader.Next()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.Name != ArchiveManifestName {
+		return nil, hdr, nil
+	}
+	var m ArchiveManifest
+	if err := json.NewDecoder(a.Reader).Decode(&m); err != nil {
+		return nil, nil, fmt.Errorf("invalid archive manifest: %w", err)
+	}
+	return &m, nil, nil
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// StartResult is the outcome of starting one container
+type StartResult struct {
+	Container string
+	Gate      *ReadinessGate
+	// Waited is how long the readiness gate took to pass or fail
+	Waited time.Duration
+	Err    error
+}
+
+type startProgress struct {
+	done chan struct{}
+	err  error
+}
+
+// StartInOrder starts entries, each as soon as the readiness gates of its
+// dependencies earlier in the list have passed; while a gate is pending, containers
+// that do not depend on it keep starting. Dependents of a container that failed to
+// start or become ready are not started. ports, if set, checks each container's host
+// ports first; containers are never re-created, so a remap policy counts as a conflict.
+// report, if set, is called once per container as its outcome is known.
+func StartInOrder(ctx context.Context, dockerHelper *DockerHelper, entries []StateEntry, deps map[string][]string, ports *PortGuard, logger *log.Logger, report func(StartResult)) []StartResult {
+	var mu sync.Mutex
+	results := make([]StartResult, len(entries))
+	finish := func(i int, r StartResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results[i] = r
+		if report != nil {
+			report(r)
+		}
+	}
+
+	// Only dependencies earlier in the list are waited for, so a cycle cannot deadlock
+	progress := map[string]*startProgress{}
+	index := map[string]int{}
+	for i, e := range entries {
+		progress[e.Name()] = &startProgress{done: make(chan struct{})}
+		index[e.Name()] = i
+	}
+	// Port checks and starts are serialised; only the waits run side by side
+	var startMu sync.Mutex
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		wg.Add(1)
+		go func(i int, e StateEntry) {
+			defer wg.Done()
+			p := progress[e.Name()]
+			r := StartResult{Container: e.Name()}
+			defer func() {
+				p.err = r.Err
+				close(p.done)
+				finish(i, r)
+			}()
+
+			for _, d := range deps[e.Name()] {
+				j, ok := index[d]
+				if !ok || j >= i {
+					// Not part of this run, such as a container that is already running
+					continue
+				}
+				dp := progress[d]
+				<-dp.done
+				if dp.err != nil {
+					r.Err = fmt.Errorf("dependency %s is not ready", d)
+					return
+				}
+			}
+			if r.Gate, r.Err = ParseReadinessGate(e); r.Err != nil {
+				return
+			}
+			if r.Err = startChecked(dockerHelper, e, ports, &startMu); r.Err != nil || r.Gate == nil {
+				return
+			}
+
+			logger.Printf("Started container %s, waiting up to %s for %s", e.Name(), r.Gate.Timeout, r.Gate)
+			began := time.Now()
+			r.Err = r.Gate.Wait(ctx, dockerHelper, e.ID)
+			r.Waited = time.Since(began).Round(time.Second)
+		}(i, e)
+	}
+	wg.Wait()
+	return results
+}
+
+// startChecked checks the entry's host ports, when ports is set, and starts it
+func startChecked(dockerHelper *DockerHelper, e StateEntry, ports *PortGuard, startMu *sync.Mutex) error {
+	startMu.Lock()
+	defer startMu.Unlock()
+	if ports != nil {
+		if conflicts := ports.Conflicts(e); len(conflicts) > 0 {
+			// Remapping would mean re-creating a container that may hold data in its
+			// writable layer or anonymous volumes; that is left to restore
+			return &PortConflictError{Container: e.Name(), Conflicts: conflicts, Skipped: ports.Policy == PortPolicySkip}
+		}
+	}
+	if err := dockerHelper.StartContainerByID(e.ID); err != nil {
+		return err
+	}
+	if ports != nil {
+		ports.Claim(e)
+	}
+	return nil
+}
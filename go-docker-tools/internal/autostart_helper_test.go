@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestStartInOrder(t *testing.T) {
+	f := newFakeDocker()
+	f.addImage(appImage)
+	add := func(name string, labels map[string]string, ports nat.PortMap) {
+		f.addContainer(name, appImage, &container.Config{Image: "app:1", Labels: labels}, &container.HostConfig{PortBindings: ports}, false)
+	}
+	add("db", nil, nil)
+	add("api", map[string]string{AutostartAfterLabel: "db"}, nil)
+	add("broken", nil, nil)
+	add("needs-broken", map[string]string{AutostartAfterLabel: "broken"}, nil)
+	add("web", map[string]string{AutostartAfterLabel: "api"}, nat.PortMap{"80/tcp": {{HostPort: "8080"}}})
+	// clash starts once web holds the port it also asks for
+	add("clash", map[string]string{AutostartAfterLabel: "web"}, nat.PortMap{"80/tcp": {{HostPort: "8080"}}})
+	f.failStart = func(c *fakeContainer) error {
+		if c.Name == "/broken" {
+			return errors.New("exec format error")
+		}
+		return nil
+	}
+	d := f.helper(t)
+	containers, err := d.ListAllContainers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := CaptureState(d, containers, testLogger)
+	entries, err := StartupOrder(state.Containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := &PortGuard{Policy: PortPolicyRemap, claims: map[string][]portClaim{}}
+	var mu sync.Mutex
+	reported := 0
+	results := StartInOrder(context.Background(), d, entries, StartupDeps(entries), ports, testLogger, func(StartResult) {
+		mu.Lock()
+		reported++
+		mu.Unlock()
+	})
+	if reported != len(entries) {
+		t.Errorf("reported %d results, want %d", reported, len(entries))
+	}
+
+	tests := []struct {
+		name    string
+		wantErr string
+		running bool
+	}{
+		{name: "db", running: true},
+		{name: "api", running: true},
+		{name: "web", running: true},
+		{name: "broken", wantErr: "exec format error"},
+		{name: "needs-broken", wantErr: "dependency broken is not ready"},
+		{name: "clash", wantErr: "in use by container web"},
+	}
+	byName := map[string]StartResult{}
+	for _, r := range results {
+		byName[r.Container] = r
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := byName[tt.name]
+			switch {
+			case tt.wantErr == "" && r.Err != nil:
+				t.Errorf("error = %v", r.Err)
+			case tt.wantErr != "" && (r.Err == nil || !strings.Contains(r.Err.Error(), tt.wantErr)):
+				t.Errorf("error = %v, want %q", r.Err, tt.wantErr)
+			}
+			if c := f.byName(tt.name); c.State.Running != tt.running {
+				t.Errorf("running = %v, want %v", c.State.Running, tt.running)
+			}
+		})
+	}
+	if c := f.byName("clash"); c.HostConfig.PortBindings["80/tcp"][0].HostPort != "8080" {
+		t.Error("clash was re-created on another port")
+	}
+}
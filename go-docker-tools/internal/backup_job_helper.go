@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+)
+
+// ArchiveManifestName is the first entry of archives written by backup jobs
+const ArchiveManifestName = "manifest.json"
+
+// ArchiveManifest describes the contents of a job archive
+type ArchiveManifest struct {
+	Job        string    `json:"job"`
+	CreatedAt  time.Time `json:"created_at"`
+	Volumes    []string  `json:"volumes"`
+	Containers []string  `json:"containers"`
+	// VolumeContainers maps each volume to the containers that mount it
+	VolumeContainers map[string][]string `json:"volume_containers,omitempty"`
+	Compression      string              `json:"compression"`
+	Encrypted        bool                `json:"encrypted"`
+}
+
+// BackupJobResult records the outcome of one job run
+type BackupJobResult struct {
+	Job        string    `json:"job"`
+	Archive    string    `json:"archive"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Volumes    []string  `json:"volumes"`
+	Size       int64     `json:"size"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// BackupJobPlan is the resolved set of containers and volumes for a job
+type BackupJobPlan struct {
+	Containers       []types.Container
+	Volumes          []string
+	VolumeContainers map[string][]string
+}
+
+// matchesSelector reports whether a container matches a name or "label:key=value" selector
+func matchesSelector(c types.Container, selector string) bool {
+	if strings.HasPrefix(selector, "label:") {
+		kv := strings.SplitN(strings.TrimPrefix(selector, "label:"), "=", 2)
+		val, ok := c.Labels[kv[0]]
+		if !ok {
+			return false
+		}
+		return len(kv) == 1 || val == kv[1]
+	}
+	for _, n := range c.Names {
+		if strings.TrimPrefix(n, "/") == strings.TrimPrefix(selector, "/") {
+			return true
+		}
+	}
+	return c.ID == selector || (len(selector) >= 12 && strings.HasPrefix(c.ID, selector))
+}
+
+// ContainerName returns the container's primary name without the leading slash
+func ContainerName(c types.Container) string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// PlanBackupJob resolves a job's selectors against the daemon
+func PlanBackupJob(job config.BackupJob, dockerHelper *DockerHelper) (*BackupJobPlan, error) {
+	plan := &BackupJobPlan{VolumeContainers: map[string][]string{}}
+	seen := map[string]bool{}
+	addVolume := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			plan.Volumes = append(plan.Volumes, name)
+		}
+	}
+	if len(job.Containers) > 0 {
+		containers, err := dockerHelper.ListAllContainers()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range containers {
+			for _, sel := range job.Containers {
+				if !matchesSelector(c, sel) {
+					continue
+				}
+				plan.Containers = append(plan.Containers, c)
+				for _, m := range c.Mounts {
+					if m.Type == "volume" && m.Name != "" {
+						addVolume(m.Name)
+						plan.VolumeContainers[m.Name] = append(plan.VolumeContainers[m.Name], ContainerName(c))
+					}
+				}
+				break
+			}
+		}
+	}
+	for _, v := range job.Volumes {
+		addVolume(v)
+	}
+	if len(job.Containers) == 0 && len(job.Volumes) == 0 {
+		names, err := dockerHelper.ListVolumeNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			addVolume(n)
+		}
+	}
+	sort.Strings(plan.Volumes)
+	return plan, nil
+}
+
+// BackupJobArchiveName builds the archive file name for a job run
+func BackupJobArchiveName(job config.BackupJob, t time.Time) string {
+	name := fmt.Sprintf("%s_%s.tar", job.Name, t.Format("20060102T150405"))
+	if job.Compression != "none" {
+		name += ".gz"
+	}
+	if job.EncryptionKeyFile != "" {
+		name += EncryptedSuffix
+	}
+	return name
+}
+
+// IsBackupJobArchive reports whether the file name is an archive of the named job.
+// The timestamp anchors the match, so db_extra's archives are not db's.
+func IsBackupJobArchive(jobName, fileName string) bool {
+	ok, _ := filepath.Match(backupJobArchivePattern(jobName), fileName)
+	return ok && !strings.HasSuffix(fileName, ArchiveIndexSuffix)
+}
+
+// backupJobArchivePattern globs the archives BackupJobArchiveName writes for a job
+func backupJobArchivePattern(jobName string) string {
+	return jobName + "_[0-9]*T[0-9]*.tar*"
+}
+
+// backupJobDestination returns the job's destination, defaulting to BackupDir/jobs/<name>
+func backupJobDestination(conf *config.Config, job config.BackupJob) string {
+	if job.Destination != "" {
+		return job.Destination
+	}
+	return filepath.Join(conf.BackupDir, "jobs", job.Name)
+}
+
+// quiesceContainers pauses or stops running containers and returns a function that undoes it
+func quiesceContainers(mode string, containers []types.Container, dockerHelper *DockerHelper, logger *log.Logger) (func(), error) {
+	var touched []types.Container
+	undo := func() {
+		for _, c := range touched {
+			var err error
+			if mode == "pause" {
+				err = dockerHelper.UnpauseContainerByID(c.ID)
+			} else {
+				err = dockerHelper.StartContainerByID(c.ID)
+			}
+			if err != nil {
+				logger.Printf("[ERROR] Failed to resume container %s after backup: %v", ContainerName(c), err)
+			}
+		}
+	}
+	if mode == "" || mode == "none" {
+		return undo, nil
+	}
+	if mode != "pause" && mode != "stop" {
+		return undo, fmt.Errorf("unknown consistency mode %q", mode)
+	}
+	for _, c := range containers {
+		if c.State != "running" {
+			continue
+		}
+		var err error
+		if mode == "pause" {
+			err = dockerHelper.PauseContainerByID(c.ID)
+		} else {
+			err = dockerHelper.StopContainerByID(c.ID)
+		}
+		if err != nil {
+			undo()
+			return func() {}, fmt.Errorf("failed to %s container %s: %w", mode, ContainerName(c), err)
+		}
+		logger.Printf("Consistency %s: %s", mode, ContainerName(c))
+		touched = append(touched, c)
+	}
+	return undo, nil
+}
+
+// RunBackupJob runs a named backup job and records its result
+func RunBackupJob(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, job config.BackupJob) (*BackupJobResult, error) {
+	result := &BackupJobResult{Job: job.Name, StartedAt: time.Now()}
+	err := runBackupJob(conf, dockerHelper, logger, job, result)
+	result.FinishedAt = time.Now()
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+	} else {
+		result.Status = "ok"
+	}
+	if serr := SaveBackupJobResult(conf, result); serr != nil {
+		logger.Printf("[ERROR] Failed to record result of job %s: %v", job.Name, serr)
+	}
+	return result, err
+}
+
+func runBackupJob(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, job config.BackupJob, result *BackupJobResult) error {
+	plan, err := PlanBackupJob(job, dockerHelper)
+	if err != nil {
+		return err
+	}
+	if len(plan.Volumes) == 0 {
+		return fmt.Errorf("job %s selects no volumes", job.Name)
+	}
+	result.Volumes = plan.Volumes
+	var key *EncryptionKey
+	if job.EncryptionKeyFile != "" {
+		if key, err = LoadEncryptionKey(job.EncryptionKeyFile); err != nil {
+			return err
+		}
+	}
+	dest := backupJobDestination(conf, job)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	RunHook(job.PreHook, "pre_job")
+	resume, err := quiesceContainers(job.Consistency, plan.Containers, dockerHelper, logger)
+	if err != nil {
+		return err
+	}
+	archive := filepath.Join(dest, BackupJobArchiveName(job, result.StartedAt))
+	werr := writeJobArchive(archive, job, plan, key, result.StartedAt)
+	resume()
+	if werr != nil {
+		os.Remove(archive)
+		os.Remove(archive + ArchiveIndexSuffix)
+		return werr
+	}
+	RunHook(job.PostHook, "post_job")
+	result.Archive = archive
+	if fi, err := os.Stat(archive); err == nil {
+		result.Size = fi.Size()
+	}
+	logger.Printf("Backup job %s wrote %s (%d volumes)", job.Name, archive, len(plan.Volumes))
+	if job.Retention > 0 {
+		RotateBackups(dest, backupJobArchivePattern(job.Name), job.Retention, logger)
+	}
+	return nil
+}
+
+// writeJobArchive writes manifest and volumes into a (compressed, encrypted) tar
+func writeJobArchive(archive string, job config.BackupJob, plan *BackupJobPlan, key *EncryptionKey, created time.Time) error {
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Writers are closed innermost first so every layer flushes its trailer
+	var closers []io.Closer
+	var w io.Writer = f
+	if key != nil {
+		ew, err := NewEncryptWriter(f, key)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, ew)
+		w = ew
+	}
+	compression := "gzip"
+	if job.Compression == "none" {
+		compression = "none"
+	} else {
+		gz := gzip.NewWriter(w)
+		closers = append(closers, gz)
+		w = gz
+	}
+	tarWriter := tar.NewWriter(w)
+	closers = append(closers, tarWriter)
+
+	manifest := ArchiveManifest{
+		Job:              job.Name,
+		CreatedAt:        created,
+		Volumes:          plan.Volumes,
+		VolumeContainers: plan.VolumeContainers,
+		Compression:      compression,
+		Encrypted:        key != nil,
+	}
+	for _, c := range plan.Containers {
+		manifest.Containers = append(manifest.Containers, ContainerName(c))
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tarWriter.WriteHeader(&tar.Header{Name: ArchiveManifestName, Mode: 0644, Size: int64(len(data)), ModTime: created}); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(data); err != nil {
+		return err
+	}
+	var index []ArchiveFile
+	for _, v := range plan.Volumes {
+		if err := addVolumeToTar(tarWriter, v, &index); err != nil {
+			return fmt.Errorf("failed to tar volume %s: %w", v, err)
+		}
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return WriteArchiveIndex(archive, index, key)
+}
+
+// backupJobResultsFile is where the last result of each job is kept
+func backupJobResultsFile(conf *config.Config) string {
+	return filepath.Join(conf.StateDir, "backup_jobs.json")
+}
+
+// LoadBackupJobResults returns the last recorded result per job name
+func LoadBackupJobResults(conf *config.Config) (map[string]*BackupJobResult, error) {
+	results := map[string]*BackupJobResult{}
+	data, err := os.ReadFile(backupJobResultsFile(conf))
+	if os.IsNotExist(err) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SaveBackupJobResult stores a job result as that job's latest
+func SaveBackupJobResult(conf *config.Config, result *BackupJobResult) error {
+	results, err := LoadBackupJobResults(conf)
+	if err != nil {
+		results = map[string]*BackupJobResult{}
+	}
+	results[result.Job] = result
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(conf.StateDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(backupJobResultsFile(conf), data, 0600)
+}
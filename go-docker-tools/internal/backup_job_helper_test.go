@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+func TestIsBackupJobArchive(t *testing.T) {
+	at := time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC)
+	tests := []struct {
+		job, file string
+		want      bool
+	}{
+		{job: "db", file: BackupJobArchiveName(config.BackupJob{Name: "db", Compression: "gzip"}, at), want: true},
+		{job: "db", file: BackupJobArchiveName(config.BackupJob{Name: "db", Compression: "none", EncryptionKeyFile: "k"}, at), want: true},
+		{job: "db", file: BackupJobArchiveName(config.BackupJob{Name: "db_extra"}, at)},
+		{job: "db_extra", file: BackupJobArchiveName(config.BackupJob{Name: "db"}, at)},
+		{job: "db", file: "db_20240301T020000.tar.gz" + ArchiveIndexSuffix},
+		{job: "db", file: "manual_20240301T020000.tar.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.job+"/"+tt.file, func(t *testing.T) {
+			if got := IsBackupJobArchive(tt.job, tt.file); got != tt.want {
+				t.Errorf("IsBackupJobArchive(%q, %q) = %v, want %v", tt.job, tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// Three db runs with indexes, one run of a job sharing the prefix and one unrelated file
+	files := []string{"db_extra_20240301T000000.tar.gz", "notes.txt"}
+	for i := 0; i < 3; i++ {
+		name := BackupJobArchiveName(config.BackupJob{Name: "db", Compression: "gzip"}, start.Add(time.Duration(i)*time.Hour))
+		files = append(files, name, name+ArchiveIndexSuffix)
+	}
+	for i, f := range files {
+		path := filepath.Join(dir, f)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	RotateBackups(dir, backupJobArchivePattern("db"), 2, testLogger)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	sort.Strings(got)
+	want := []string{
+		"db_20240301T010000.tar.gz", "db_20240301T010000.tar.gz" + ArchiveIndexSuffix,
+		"db_20240301T020000.tar.gz", "db_20240301T020000.tar.gz" + ArchiveIndexSuffix,
+		"db_extra_20240301T000000.tar.gz", "notes.txt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after rotation:\n got %v\nwant %v", got, want)
+	}
+}
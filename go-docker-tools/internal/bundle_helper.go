@@ -0,0 +1,635 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// BundleFormat identifies migration bundles in their manifest
+const BundleFormat = "go-docker-tools-bundle"
+
+// BundleVersion is the bundle layout written by ExportBundle
+const BundleVersion = 1
+
+// Entries of a bundle, written in this order so import can stream it once
+const (
+	bundleManifestName = "manifest.json"
+	bundleStateName    = "state.json"
+	bundleImagesName   = "images.tar"
+	bundleVolumeDir    = "volumes/"
+)
+
+// volumeCopyPath is where the copy container mounts a volume
+const volumeCopyPath = "/volume"
+
+// volumeCopyLabel marks the short-lived containers used to copy volume data
+const volumeCopyLabel = "go-docker-tools.volume-copy"
+
+// BundleManifest describes what a migration bundle holds
+type BundleManifest struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+	Source     string    `json:"source,omitempty"`
+	Containers []string  `json:"containers"`
+	// ImagesIncluded is false when only digests were recorded and import pulls the images
+	ImagesIncluded bool           `json:"images_included"`
+	Images         []BundleImage  `json:"images"`
+	Volumes        []BundleVolume `json:"volumes,omitempty"`
+	Networks       []string       `json:"networks,omitempty"`
+	// Skipped lists mounts whose data is not in the bundle, such as bind mounts
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// BundleImage is an image the bundled containers run on
+type BundleImage struct {
+	Ref        string `json:"ref"`
+	ID         string `json:"id"`
+	RepoDigest string `json:"repo_digest,omitempty"`
+}
+
+// BundleVolume is a named volume whose data is archived in the bundle
+type BundleVolume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver,omitempty"`
+	DriverOpts map[string]string `json:"driver_opts,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	File       string            `json:"file"`
+	// Image is the ID of an image of a container using the volume; the data is copied
+	// through a container created from it, so no extra image is needed on either side
+	Image string `json:"image"`
+}
+
+// BundleOptions controls ExportBundle
+type BundleOptions struct {
+	// DigestsOnly records the images by repo digest instead of including them
+	DigestsOnly bool
+	// Consistency is "none", "pause" or "stop", as for backup jobs
+	Consistency string
+}
+
+// SelectService returns the container named target or, when there is none, the
+// containers of the compose project called target
+func SelectService(containers []types.Container, target string) []types.Container {
+	target = strings.TrimPrefix(target, "/")
+	for _, c := range containers {
+		if ContainerName(c) == target {
+			return []types.Container{c}
+		}
+	}
+	var out []types.Container
+	for _, c := range containers {
+		if c.Labels[ComposeProjectLabel] == target {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// NewBundleManifest lists the images, volumes and networks of the containers in
+// state. Bind mounts and anonymous volumes are recorded as skipped.
+func NewBundleManifest(dockerHelper *DockerHelper, state *SavedState, digestsOnly bool) (*BundleManifest, error) {
+	m := &BundleManifest{Format: BundleFormat, Version: BundleVersion, CreatedAt: time.Now(), ImagesIncluded: !digestsOnly}
+	m.Source, _ = os.Hostname()
+	images := map[string]bool{}
+	volumes := map[string]bool{}
+	for _, e := range state.Containers {
+		if e.Config == nil {
+			return nil, fmt.Errorf("could not inspect container %s", e.Name())
+		}
+		m.Containers = append(m.Containers, e.Name())
+		if e.ImageID != "" && !images[e.ImageID] {
+			images[e.ImageID] = true
+			if digestsOnly && e.RepoDigest == "" {
+				return nil, fmt.Errorf("image %s of %s has no registry digest; include the images instead", e.ImageRef(), e.Name())
+			}
+			m.Images = append(m.Images, BundleImage{Ref: CurrentImageRef(dockerHelper, e), ID: e.ImageID, RepoDigest: e.RepoDigest})
+		}
+		for _, mp := range e.Mounts {
+			if mp.Type != mount.TypeVolume || mp.Name == "" || anonymousVolume.MatchString(mp.Name) {
+				src := mp.Source
+				if mp.Type == mount.TypeVolume {
+					src = "anonymous volume"
+				}
+				m.Skipped = append(m.Skipped, fmt.Sprintf("%s: %s %s -> %s", e.Name(), mp.Type, src, mp.Destination))
+				continue
+			}
+			if volumes[mp.Name] {
+				continue
+			}
+			volumes[mp.Name] = true
+			v, err := dockerHelper.InspectVolume(mp.Name)
+			if err != nil {
+				return nil, fmt.Errorf("inspect volume %s: %w", mp.Name, err)
+			}
+			m.Volumes = append(m.Volumes, BundleVolume{
+				Name:       v.Name,
+				Driver:     v.Driver,
+				DriverOpts: v.Options,
+				Labels:     v.Labels,
+				File:       bundleVolumeDir + v.Name + ".tar.gz",
+				Image:      e.ImageID,
+			})
+		}
+	}
+	for _, n := range state.Networks {
+		m.Networks = append(m.Networks, n.Name)
+	}
+	sort.Slice(m.Volumes, func(i, j int) bool { return m.Volumes[i].Name < m.Volumes[j].Name })
+	return m, nil
+}
+
+// ExportBundle writes the containers of state, with their images, volume data and
+// networks, to a single tar file at output
+func ExportBundle(dockerHelper *DockerHelper, logger *log.Logger, state *SavedState, output string, opts BundleOptions) (*BundleManifest, error) {
+	m, err := NewBundleManifest(dockerHelper, state, opts.DigestsOnly)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]types.Container, 0, len(state.Containers))
+	for _, e := range state.Containers {
+		containers = append(containers, e.Container)
+	}
+	resume, err := quiesceContainers(opts.Consistency, containers, dockerHelper, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer resume()
+
+	dir := filepath.Dir(output)
+	tmp, err := os.CreateTemp(dir, filepath.Base(output)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	done := false
+	defer func() {
+		if !done {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	tw := tar.NewWriter(tmp)
+	if err := writeBundleJSON(tw, bundleManifestName, m); err != nil {
+		return nil, err
+	}
+	if err := writeBundleJSON(tw, bundleStateName, state); err != nil {
+		return nil, err
+	}
+	if m.ImagesIncluded && len(m.Images) > 0 {
+		refs := make([]string, 0, len(m.Images))
+		for _, img := range m.Images {
+			refs = append(refs, img.Ref)
+		}
+		err := writeBundleStream(tw, bundleImagesName, dir, func(w io.Writer) error {
+			rc, err := dockerHelper.SaveImages(refs)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			_, err = io.Copy(w, rc)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("save images: %w", err)
+		}
+		logger.Printf("Added %d images to %s", len(refs), output)
+	}
+	for _, v := range m.Volumes {
+		err := writeBundleStream(tw, v.File, dir, func(w io.Writer) error {
+			gz := gzip.NewWriter(w)
+			if err := ExportVolumeData(dockerHelper, v.Name, v.Image, gz); err != nil {
+				return err
+			}
+			return gz.Close()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("archive volume %s: %w", v.Name, err)
+		}
+		logger.Printf("Added volume %s to %s", v.Name, output)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), output); err != nil {
+		return nil, err
+	}
+	done = true
+	return m, nil
+}
+
+func writeBundleJSON(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// writeBundleStream spools what produce writes to a file in dir first, since a tar
+// header needs the size of its entry
+func writeBundleStream(tw *tar.Writer, name, dir string, produce func(io.Writer) error) error {
+	spool, err := os.CreateTemp(dir, ".bundle-spool*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	if err := produce(spool); err != nil {
+		return err
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, spool)
+	return err
+}
+
+// withVolumeContainer creates, but never starts, a container from image with the
+// volume mounted, so the daemon can copy its data through the archive API even
+// when it runs on another host
+func withVolumeContainer(dockerHelper *DockerHelper, volumeName, image string, fn func(id string) error) error {
+	id, err := dockerHelper.CreateContainer("", &container.Config{
+		Image:           image,
+		Entrypoint:      []string{"true"},
+		NetworkDisabled: true,
+		Labels:          map[string]string{volumeCopyLabel: volumeName},
+	}, &container.HostConfig{
+		NetworkMode: "none",
+		Mounts:      []mount.Mount{{Type: mount.TypeVolume, Source: volumeName, Target: volumeCopyPath}},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("create copy container for volume %s: %w", volumeName, err)
+	}
+	defer dockerHelper.RemoveContainerAndVolumes(id)
+	return fn(id)
+}
+
+// ExportVolumeData writes a tar of the volume's content, with its entries under "volume/"
+func ExportVolumeData(dockerHelper *DockerHelper, volumeName, image string, w io.Writer) error {
+	return withVolumeContainer(dockerHelper, volumeName, image, func(id string) error {
+		rc, err := dockerHelper.CopyFromContainer(id, volumeCopyPath)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(w, rc)
+		return err
+	})
+}
+
+// ImportVolumeData extracts a tar written by ExportVolumeData into the volume
+func ImportVolumeData(dockerHelper *DockerHelper, volumeName, image string, r io.Reader) error {
+	return withVolumeContainer(dockerHelper, volumeName, image, func(id string) error {
+		return dockerHelper.CopyToContainer(id, "/", r)
+	})
+}
+
+// ReadBundle returns the manifest and saved containers of a bundle
+func ReadBundle(path string) (*BundleManifest, *SavedState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	var m *BundleManifest
+	var state *SavedState
+	for m == nil || state == nil {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a migration bundle: %w", path, err)
+		}
+		switch hdr.Name {
+		case bundleManifestName:
+			m = &BundleManifest{}
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, nil, fmt.Errorf("bad bundle manifest: %w", err)
+			}
+		case bundleStateName:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			if state, err = ParseState(data, path); err != nil {
+				return nil, nil, fmt.Errorf("bad bundle state: %w", err)
+			}
+		}
+	}
+	switch {
+	case m == nil || m.Format != BundleFormat:
+		return nil, nil, fmt.Errorf("%s is not a migration bundle", path)
+	case m.Version > BundleVersion:
+		return nil, nil, fmt.Errorf("%s is a version %d bundle; this build reads up to version %d", path, m.Version, BundleVersion)
+	case state == nil:
+		return nil, nil, fmt.Errorf("%s has no container state", path)
+	}
+	return m, state, nil
+}
+
+// ImportOptions controls ImportBundle
+type ImportOptions struct {
+	// Rename maps bundled container names to new ones
+	Rename map[string]string
+	// RenameVolumes maps bundled volume names to new ones
+	RenameVolumes map[string]string
+	// Ports maps saved host ports to the ones to publish instead
+	Ports map[string]string
+	// VolumeDriver replaces the saved driver of every volume; VolumeDrivers sets it per volume
+	VolumeDriver  string
+	VolumeDrivers map[string]string
+	PortPolicy    string
+	// Replace removes containers with the same names instead of refusing to import
+	Replace bool
+	// UseExistingVolumes mounts volumes that already exist as they are instead of
+	// refusing to import; their data is not replaced
+	UseExistingVolumes bool
+}
+
+// VolumeImport reports one volume of an import
+type VolumeImport struct {
+	Name   string
+	Driver string
+	// Existing volumes were there before; they are never filled from the bundle or removed
+	Existing bool
+	Err      error
+}
+
+// ImportResult summarises ImportBundle
+type ImportResult struct {
+	Manifest *BundleManifest
+	Volumes  []VolumeImport
+	Restore  *RestoreResult
+}
+
+// PrepareImport applies renames and port changes to the bundled state and clears
+// what only made sense on the source daemon, such as container IDs
+func PrepareImport(m *BundleManifest, state *SavedState, opts ImportOptions) error {
+	for old := range opts.Rename {
+		if state.Find(old) == nil {
+			return fmt.Errorf("no container %s in the bundle", old)
+		}
+	}
+	bundled := map[string]bool{}
+	for _, v := range m.Volumes {
+		bundled[v.Name] = true
+	}
+	for old := range opts.RenameVolumes {
+		if !bundled[old] {
+			return fmt.Errorf("no volume %s in the bundle", old)
+		}
+	}
+	for i := range state.Containers {
+		e := &state.Containers[i]
+		newName := opts.Rename[e.Name()]
+		if e.NetworkSettings != nil {
+			networks := map[string]*network.EndpointSettings{}
+			for name, ep := range e.NetworkSettings.Networks {
+				networks[name] = endpointForCreate(*e, ep)
+			}
+			e.NetworkSettings = &types.SummaryNetworkSettings{Networks: networks}
+		}
+		if newName != "" {
+			e.Names = []string{"/" + newName}
+		}
+		e.ID = ""
+		e.PortRemaps = nil
+		for j := range e.Mounts {
+			if n := opts.RenameVolumes[e.Mounts[j].Name]; n != "" && e.Mounts[j].Type == mount.TypeVolume {
+				e.Mounts[j].Name = n
+			}
+		}
+		hc := e.HostConfig
+		if hc == nil {
+			continue
+		}
+		if target := strings.TrimPrefix(string(hc.NetworkMode), "container:"); target != string(hc.NetworkMode) {
+			if n := opts.Rename[target]; n != "" {
+				hc.NetworkMode = container.NetworkMode("container:" + n)
+			}
+		}
+		for j, from := range hc.VolumesFrom {
+			name, mode, _ := strings.Cut(from, ":")
+			if n := opts.Rename[name]; n != "" {
+				hc.VolumesFrom[j] = strings.TrimSuffix(n+":"+mode, ":")
+			}
+		}
+		for j, b := range hc.Binds {
+			src, rest, ok := strings.Cut(b, ":")
+			if n := opts.RenameVolumes[src]; n != "" && ok {
+				hc.Binds[j] = n + ":" + rest
+			}
+		}
+		for j := range hc.Mounts {
+			if n := opts.RenameVolumes[hc.Mounts[j].Source]; n != "" && hc.Mounts[j].Type == mount.TypeVolume {
+				hc.Mounts[j].Source = n
+			}
+		}
+		for port, bindings := range hc.PortBindings {
+			for j, b := range bindings {
+				if to := opts.Ports[b.HostPort]; to != "" {
+					hc.PortBindings[port][j].HostPort = to
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkNameConflicts refuses to import over existing containers unless replace is set
+func checkNameConflicts(dockerHelper *DockerHelper, state *SavedState, replace bool) error {
+	for _, e := range state.Containers {
+		_, err := dockerHelper.InspectContainer(e.Name())
+		if err == nil && !replace {
+			return fmt.Errorf("container %s already exists; rename or replace it", e.Name())
+		}
+		if err != nil && !client.IsErrNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVolumeConflicts refuses to import into volumes that already exist unless
+// they are to be used as they are
+func checkVolumeConflicts(dockerHelper *DockerHelper, m *BundleManifest, opts ImportOptions) error {
+	if opts.UseExistingVolumes {
+		return nil
+	}
+	for _, v := range m.Volumes {
+		name := importVolumeName(v, opts)
+		_, err := dockerHelper.InspectVolume(name)
+		if err == nil {
+			return existingVolumeError(name)
+		}
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func existingVolumeError(name string) error {
+	return fmt.Errorf("volume %s already exists; rename it with --rename-volume or pass --use-existing-volumes to keep its data", name)
+}
+
+// importVolumeName is the name a bundled volume gets on the target
+func importVolumeName(v BundleVolume, opts ImportOptions) string {
+	if n := opts.RenameVolumes[v.Name]; n != "" {
+		return n
+	}
+	return v.Name
+}
+
+// ImportBundle loads the images of a bundle, creates and fills its volumes and
+// networks, then re-creates its containers, starting the ones that were running
+func ImportBundle(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, path string, opts ImportOptions) (*ImportResult, error) {
+	m, state, err := ReadBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := PrepareImport(m, state, opts); err != nil {
+		return nil, err
+	}
+	if err := checkNameConflicts(dockerHelper, state, opts.Replace); err != nil {
+		return nil, err
+	}
+	if err := checkVolumeConflicts(dockerHelper, m, opts); err != nil {
+		return nil, err
+	}
+	result := &ImportResult{Manifest: m}
+	if !m.ImagesIncluded {
+		for _, img := range m.Images {
+			if err := EnsureImage(conf, dockerHelper, logger, img.RepoDigest, img.ID); err != nil {
+				return result, fmt.Errorf("image %s: %w", img.Ref, err)
+			}
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	byFile := map[string]BundleVolume{}
+	for _, v := range m.Volumes {
+		byFile[v.File] = v
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		if hdr.Name == bundleImagesName {
+			if err := dockerHelper.LoadImage(tr); err != nil {
+				return result, fmt.Errorf("load images: %w", err)
+			}
+			logger.Printf("Loaded %d images from %s", len(m.Images), path)
+			continue
+		}
+		if v, ok := byFile[hdr.Name]; ok {
+			gz, err := gzip.NewReader(tr)
+			if err != nil {
+				return result, fmt.Errorf("volume %s: %w", v.Name, err)
+			}
+			result.Volumes = append(result.Volumes, importBundleVolume(dockerHelper, logger, v, gz, opts))
+		}
+	}
+	for _, v := range result.Volumes {
+		if v.Err != nil {
+			// Containers would come up on empty volumes
+			return result, fmt.Errorf("volume data not imported, no containers created: %w", v.Err)
+		}
+	}
+
+	// Replaced containers take the bundled spec, not just a start with their own
+	result.Restore, err = RestoreState(conf, dockerHelper, logger, state, RestoreOptions{
+		ImagePolicy: ImagePolicyExact,
+		PortPolicy:  opts.PortPolicy,
+		KeepStopped: true,
+		Recreate:    opts.Replace,
+	})
+	return result, err
+}
+
+// importBundleVolume creates a volume of the bundle and fills it from r, a tar written
+// by ExportVolumeData. A volume that already exists is an error unless opts allow
+// using it as it is.
+func importBundleVolume(dockerHelper *DockerHelper, logger *log.Logger, v BundleVolume, r io.Reader, opts ImportOptions) VolumeImport {
+	name := importVolumeName(v, opts)
+	driver, driverOpts := v.Driver, v.DriverOpts
+	if d := opts.VolumeDrivers[v.Name]; d != "" {
+		driver = d
+	} else if opts.VolumeDriver != "" {
+		driver = opts.VolumeDriver
+	}
+	if driver != v.Driver {
+		// Options are specific to the driver they were given to
+		driverOpts = nil
+	}
+	res := VolumeImport{Name: name, Driver: driver}
+	if _, err := dockerHelper.InspectVolume(name); err == nil {
+		res.Existing = true
+		if !opts.UseExistingVolumes {
+			res.Err = existingVolumeError(name)
+			return res
+		}
+		logger.Printf("Volume %s already exists; keeping its data", name)
+		return res
+	} else if !client.IsErrNotFound(err) {
+		res.Err = err
+		return res
+	}
+	if err := dockerHelper.CreateVolume(volume.CreateOptions{Name: name, Driver: driver, DriverOpts: driverOpts, Labels: v.Labels}); err != nil {
+		res.Err = fmt.Errorf("create volume %s: %w", name, err)
+		return res
+	}
+	if err := ImportVolumeData(dockerHelper, name, v.Image, r); err != nil {
+		res.Err = fmt.Errorf("fill volume %s: %w", name, err)
+		return res
+	}
+	logger.Printf("Imported volume %s (%s driver)", name, driver)
+	return res
+}
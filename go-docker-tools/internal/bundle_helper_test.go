@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+)
+
+// bundledState is a web container that shares the network namespace and volumes
+// of app and stores its data in the volume web-data
+func bundledState() (*BundleManifest, *SavedState) {
+	m := &BundleManifest{Volumes: []BundleVolume{{Name: "web-data"}}}
+	app := StateEntry{
+		Container:  types.Container{ID: "app-id", Names: []string{"/app"}},
+		Config:     &container.Config{Image: "app"},
+		HostConfig: &container.HostConfig{},
+	}
+	web := StateEntry{
+		Container: types.Container{
+			ID:    "0123456789abcdef",
+			Names: []string{"/web"},
+			Mounts: []types.MountPoint{
+				{Type: mount.TypeVolume, Name: "web-data", Destination: "/data"},
+				{Type: mount.TypeBind, Source: "/srv", Destination: "/srv"},
+			},
+			NetworkSettings: &types.SummaryNetworkSettings{Networks: map[string]*network.EndpointSettings{
+				"front": {Aliases: []string{"0123456789ab", "www"}, IPAddress: "172.20.0.5", EndpointID: "ep"},
+			}},
+		},
+		Config: &container.Config{Image: "nginx"},
+		HostConfig: &container.HostConfig{
+			NetworkMode:  "container:app",
+			VolumesFrom:  []string{"app:ro", "other"},
+			Binds:        []string{"web-data:/data:rw", "/srv:/srv"},
+			Mounts:       []mount.Mount{{Type: mount.TypeVolume, Source: "web-data", Target: "/cache"}},
+			PortBindings: nat.PortMap{"80/tcp": {{HostPort: "8080"}}, "443/tcp": {{HostPort: "8443"}}},
+		},
+		PortRemaps: []PortRemap{{ContainerPort: "80/tcp", From: "80", To: "8080"}},
+	}
+	return m, &SavedState{Containers: []StateEntry{app, web}}
+}
+
+func TestPrepareImport(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ImportOptions
+		wantErr bool
+		check   func(t *testing.T, web StateEntry)
+	}{
+		{
+			name: "no options clears source IDs and runtime endpoint data",
+			check: func(t *testing.T, web StateEntry) {
+				if web.ID != "" || web.PortRemaps != nil {
+					t.Errorf("ID %q and remaps %v were kept", web.ID, web.PortRemaps)
+				}
+				ep := web.NetworkSettings.Networks["front"]
+				if ep.IPAddress != "" || ep.EndpointID != "" || !reflect.DeepEqual(ep.Aliases, []string{"www"}) {
+					t.Errorf("endpoint = %+v, want only the www alias", ep)
+				}
+				if web.HostConfig.NetworkMode != "container:app" {
+					t.Errorf("network mode = %s", web.HostConfig.NetworkMode)
+				}
+			},
+		},
+		{
+			name: "renames follow references",
+			opts: ImportOptions{Rename: map[string]string{"web": "web2", "app": "app2"}},
+			check: func(t *testing.T, web StateEntry) {
+				if web.Name() != "web2" {
+					t.Errorf("name = %s, want web2", web.Name())
+				}
+				if web.HostConfig.NetworkMode != "container:app2" {
+					t.Errorf("network mode = %s, want container:app2", web.HostConfig.NetworkMode)
+				}
+				if want := []string{"app2:ro", "other"}; !reflect.DeepEqual(web.HostConfig.VolumesFrom, want) {
+					t.Errorf("volumes from = %v, want %v", web.HostConfig.VolumesFrom, want)
+				}
+			},
+		},
+		{
+			name: "volume renames",
+			opts: ImportOptions{RenameVolumes: map[string]string{"web-data": "web-data2"}},
+			check: func(t *testing.T, web StateEntry) {
+				if want := []string{"web-data2:/data:rw", "/srv:/srv"}; !reflect.DeepEqual(web.HostConfig.Binds, want) {
+					t.Errorf("binds = %v, want %v", web.HostConfig.Binds, want)
+				}
+				if web.HostConfig.Mounts[0].Source != "web-data2" || web.Mounts[0].Name != "web-data2" {
+					t.Errorf("mounts = %v / %v, want web-data2", web.HostConfig.Mounts, web.Mounts)
+				}
+			},
+		},
+		{
+			name: "port changes",
+			opts: ImportOptions{Ports: map[string]string{"8080": "9080"}},
+			check: func(t *testing.T, web StateEntry) {
+				want := nat.PortMap{"80/tcp": {{HostPort: "9080"}}, "443/tcp": {{HostPort: "8443"}}}
+				if !reflect.DeepEqual(web.HostConfig.PortBindings, want) {
+					t.Errorf("port bindings = %v, want %v", web.HostConfig.PortBindings, want)
+				}
+			},
+		},
+		{name: "unknown container", opts: ImportOptions{Rename: map[string]string{"db": "db2"}}, wantErr: true},
+		{name: "unknown volume", opts: ImportOptions{RenameVolumes: map[string]string{"other": "x"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, state := bundledState()
+			err := PrepareImport(m, state, tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("PrepareImport() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PrepareImport() error = %v", err)
+			}
+			tt.check(t, state.Containers[1])
+		})
+	}
+}
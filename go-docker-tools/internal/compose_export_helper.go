@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+// Labels Docker Compose puts on the containers it manages
+const (
+	ComposeProjectLabel = "com.docker.compose.project"
+	ComposeServiceLabel = "com.docker.compose.service"
+)
+
+// ComposeFile is the subset of the compose specification that export writes
+type ComposeFile struct {
+	Name     string                      `yaml:"name,omitempty"`
+	Services map[string]*ComposeService  `yaml:"services"`
+	Networks map[string]*ComposeResource `yaml:"networks,omitempty"`
+	Volumes  map[string]*ComposeResource `yaml:"volumes,omitempty"`
+}
+
+// ComposeService is one service of a compose file
+type ComposeService struct {
+	Image         string              `yaml:"image"`
+	ContainerName string              `yaml:"container_name,omitempty"`
+	Scale         int                 `yaml:"scale,omitempty"`
+	Entrypoint    []string            `yaml:"entrypoint,omitempty"`
+	Command       []string            `yaml:"command,omitempty"`
+	Environment   map[string]string   `yaml:"environment,omitempty"`
+	Ports         []string            `yaml:"ports,omitempty"`
+	Volumes       []string            `yaml:"volumes,omitempty"`
+	NetworkMode   string              `yaml:"network_mode,omitempty"`
+	Networks      []string            `yaml:"networks,omitempty"`
+	Labels        map[string]string   `yaml:"labels,omitempty"`
+	Restart       string              `yaml:"restart,omitempty"`
+	Healthcheck   *ComposeHealthcheck `yaml:"healthcheck,omitempty"`
+	DependsOn     []string            `yaml:"depends_on,omitempty"`
+}
+
+// ComposeHealthcheck mirrors the container health check in compose syntax
+type ComposeHealthcheck struct {
+	Disable     bool     `yaml:"disable,omitempty"`
+	Test        []string `yaml:"test,omitempty"`
+	Interval    string   `yaml:"interval,omitempty"`
+	Timeout     string   `yaml:"timeout,omitempty"`
+	StartPeriod string   `yaml:"start_period,omitempty"`
+	Retries     int      `yaml:"retries,omitempty"`
+}
+
+// ComposeResource is a top-level network or volume. Resources that already exist
+// outside the project are marked external so compose reuses them as they are.
+type ComposeResource struct {
+	Name     string `yaml:"name,omitempty"`
+	External bool   `yaml:"external,omitempty"`
+}
+
+// ImageDefaults looks up the config baked into an image, or returns nil if unknown.
+// Export uses it to leave out env, command, labels and health checks the image already sets.
+type ImageDefaults func(image string) *container.Config
+
+var anonymousVolume = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ComposeProject returns the compose project of an entry, or "" for containers started by hand
+func ComposeProject(e StateEntry) string {
+	return entryLabels(e)[ComposeProjectLabel]
+}
+
+// ComposeServiceName returns the compose service of an entry, falling back to the container name
+func ComposeServiceName(e StateEntry) string {
+	if s := entryLabels(e)[ComposeServiceLabel]; s != "" {
+		return s
+	}
+	return e.Name()
+}
+
+func entryLabels(e StateEntry) map[string]string {
+	if e.Config != nil && e.Config.Labels != nil {
+		return e.Config.Labels
+	}
+	return e.Labels
+}
+
+// ExportCompose converts state into compose files keyed by compose project.
+// Containers without a project label are collected under the "" key.
+func ExportCompose(state *SavedState, defaults ImageDefaults) map[string]*ComposeFile {
+	files := map[string]*ComposeFile{}
+	for _, e := range state.Containers {
+		project := ComposeProject(e)
+		f := files[project]
+		if f == nil {
+			f = &ComposeFile{Name: project, Services: map[string]*ComposeService{}}
+			files[project] = f
+		}
+		name := ComposeServiceName(e)
+		if svc := f.Services[name]; svc != nil {
+			// Another replica of a scaled service
+			if svc.Scale == 0 {
+				svc.Scale = 1
+			}
+			svc.Scale++
+			svc.ContainerName = ""
+			continue
+		}
+		var image *container.Config
+		if defaults != nil {
+			image = defaults(e.ImageRef())
+		}
+		f.Services[name] = composeService(f, project, name, e, image, state)
+	}
+	return files
+}
+
+func composeService(f *ComposeFile, project, service string, e StateEntry, image *container.Config, state *SavedState) *ComposeService {
+	svc := &ComposeService{Image: e.ImageRef()}
+	if project == "" || (e.Name() != project+"-"+service+"-1" && e.Name() != project+"_"+service+"_1") {
+		svc.ContainerName = e.Name()
+	}
+	if c := e.Config; c != nil {
+		sameEntrypoint := image != nil && reflect.DeepEqual([]string(c.Entrypoint), []string(image.Entrypoint))
+		if !sameEntrypoint {
+			svc.Entrypoint = composeEscapeAll(c.Entrypoint)
+		}
+		if !sameEntrypoint || !reflect.DeepEqual([]string(c.Cmd), []string(image.Cmd)) {
+			svc.Command = composeEscapeAll(c.Cmd)
+		}
+		svc.Environment = composeEnv(c.Env, image)
+		svc.Healthcheck = composeHealthcheck(c.Healthcheck, image)
+	}
+	svc.Labels = composeLabels(entryLabels(e), image)
+	if project != "" {
+		svc.DependsOn = ComposeDependsOn(e)
+	}
+	svc.Ports = composePorts(e)
+	svc.Volumes = composeVolumes(f, project, e)
+	svc.NetworkMode, svc.Networks = composeNetworks(f, project, e, state)
+	if e.HostConfig != nil {
+		switch p := e.HostConfig.RestartPolicy; {
+		case p.Name == "on-failure" && p.MaximumRetryCount > 0:
+			svc.Restart = fmt.Sprintf("on-failure:%d", p.MaximumRetryCount)
+		case p.Name != "" && p.Name != "no":
+			svc.Restart = p.Name
+		}
+	}
+	return svc
+}
+
+// composeEscape protects literal dollar signs from compose variable interpolation
+func composeEscape(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+func composeEscapeAll(list []string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = composeEscape(s)
+	}
+	return out
+}
+
+func composeEnv(env []string, image *container.Config) map[string]string {
+	inherited := map[string]bool{}
+	if image != nil {
+		for _, kv := range image.Env {
+			inherited[kv] = true
+		}
+	}
+	out := map[string]string{}
+	for _, kv := range env {
+		if inherited[kv] {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		out[k] = composeEscape(v)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func composeLabels(labels map[string]string, image *container.Config) map[string]string {
+	out := map[string]string{}
+	for k, v := range labels {
+		if strings.HasPrefix(k, "com.docker.compose.") {
+			continue
+		}
+		if image != nil && image.Labels != nil && image.Labels[k] == v {
+			continue
+		}
+		out[k] = composeEscape(v)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func composeHealthcheck(hc *container.HealthConfig, image *container.Config) *ComposeHealthcheck {
+	if hc == nil || len(hc.Test) == 0 {
+		return nil
+	}
+	if image != nil && reflect.DeepEqual(hc, image.Healthcheck) {
+		return nil
+	}
+	if hc.Test[0] == "NONE" {
+		return &ComposeHealthcheck{Disable: true}
+	}
+	out := &ComposeHealthcheck{Test: composeEscapeAll(hc.Test), Retries: hc.Retries}
+	if hc.Interval > 0 {
+		out.Interval = hc.Interval.String()
+	}
+	if hc.Timeout > 0 {
+		out.Timeout = hc.Timeout.String()
+	}
+	if hc.StartPeriod > 0 {
+		out.StartPeriod = hc.StartPeriod.String()
+	}
+	return out
+}
+
+// composePorts writes published ports in short syntax: [ip:]host:container[/udp]
+func composePorts(e StateEntry) []string {
+	var ports []string
+	add := func(ip, host string, port nat.Port) {
+		p := port.Port()
+		if host != "" {
+			p = host + ":" + p
+			if strings.Contains(ip, ":") && ip != "::" {
+				p = "[" + ip + "]:" + p
+			} else if ip != "" && ip != "0.0.0.0" && ip != "::" {
+				p = ip + ":" + p
+			}
+		}
+		if port.Proto() != "tcp" {
+			p += "/" + port.Proto()
+		}
+		ports = append(ports, p)
+	}
+	if e.HostConfig != nil && len(e.HostConfig.PortBindings) > 0 {
+		for port, bindings := range e.HostConfig.PortBindings {
+			for _, b := range bindings {
+				add(b.HostIP, b.HostPort, port)
+			}
+		}
+	} else {
+		for _, p := range e.Ports {
+			if p.PublicPort != 0 {
+				add(p.IP, fmt.Sprint(p.PublicPort), nat.Port(fmt.Sprintf("%d/%s", p.PrivatePort, p.Type)))
+			}
+		}
+	}
+	sort.Strings(ports)
+	return dedupe(ports)
+}
+
+func dedupe(list []string) []string {
+	var out []string
+	for i, s := range list {
+		if i == 0 || s != list[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// composeVolumes lists mounts and declares the named volumes they use. Volumes
+// created by the project keep their short name; other volumes are external.
+func composeVolumes(f *ComposeFile, project string, e StateEntry) []string {
+	var volumes []string
+	for _, m := range e.Mounts {
+		var spec string
+		switch {
+		case m.Type == "bind":
+			spec = m.Source + ":" + m.Destination
+		case m.Type == "volume" && (m.Name == "" || anonymousVolume.MatchString(m.Name)):
+			spec = m.Destination
+		case m.Type == "volume":
+			key := m.Name
+			res := &ComposeResource{Name: m.Name}
+			if project != "" && strings.HasPrefix(m.Name, project+"_") {
+				key = strings.TrimPrefix(m.Name, project+"_")
+				res = &ComposeResource{}
+			} else {
+				res.External = true
+			}
+			if f.Volumes == nil {
+				f.Volumes = map[string]*ComposeResource{}
+			}
+			f.Volumes[key] = res
+			spec = key + ":" + m.Destination
+		default:
+			continue
+		}
+		if !m.RW && m.Destination != spec {
+			spec += ":ro"
+		}
+		volumes = append(volumes, composeEscape(spec))
+	}
+	if len(e.Mounts) == 0 && e.HostConfig != nil {
+		for _, b := range e.HostConfig.Binds {
+			volumes = append(volumes, composeEscape(b))
+		}
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+// composeNetworks maps the network setup to network_mode or a list of networks.
+// The project's default network needs no declaration; other networks created
+// by the project keep their short name, and everything else is external.
+func composeNetworks(f *ComposeFile, project string, e StateEntry, state *SavedState) (string, []string) {
+	mode := ""
+	if e.HostConfig != nil {
+		mode = string(e.HostConfig.NetworkMode)
+	}
+	switch {
+	case mode == "host" || mode == "none":
+		return mode, nil
+	case strings.HasPrefix(mode, "container:"):
+		target := strings.TrimPrefix(mode, "container:")
+		if other := state.Find(target); other != nil {
+			target = other.Name()
+		}
+		return "container:" + target, nil
+	case mode == "default" || mode == "bridge":
+		return "bridge", nil
+	}
+	var names []string
+	if e.NetworkSettings != nil {
+		for name := range e.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && mode != "" {
+		names = []string{mode}
+	}
+	sort.Strings(names)
+	var networks []string
+	for _, name := range names {
+		key := name
+		res := &ComposeResource{Name: name, External: true}
+		if project != "" && strings.HasPrefix(name, project+"_") {
+			key = strings.TrimPrefix(name, project+"_")
+			res = nil
+			if key != "default" {
+				res = &ComposeResource{}
+			}
+		}
+		if res != nil {
+			if f.Networks == nil {
+				f.Networks = map[string]*ComposeResource{}
+			}
+			f.Networks[key] = res
+		}
+		networks = append(networks, key)
+	}
+	if len(networks) == 1 && networks[0] == "default" {
+		return "", nil
+	}
+	return "", networks
+}
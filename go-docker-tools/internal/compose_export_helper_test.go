@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+)
+
+// composeEntry builds a saved container; labels set the compose project and service
+func composeEntry(name string, labels map[string]string, tweak func(e *StateEntry)) StateEntry {
+	e := StateEntry{
+		Container: types.Container{ID: name + "-id", Names: []string{"/" + name}, State: "running"},
+		Config:    &container.Config{Image: "app:1", Labels: labels},
+		HostConfig: &container.HostConfig{
+			NetworkMode:   "bridge",
+			RestartPolicy: container.RestartPolicy{Name: "no"},
+		},
+	}
+	if tweak != nil {
+		tweak(&e)
+	}
+	return e
+}
+
+func networksOf(names ...string) *types.SummaryNetworkSettings {
+	s := &types.SummaryNetworkSettings{Networks: map[string]*network.EndpointSettings{}}
+	for _, n := range names {
+		s.Networks[n] = &network.EndpointSettings{}
+	}
+	return s
+}
+
+func TestExportCompose(t *testing.T) {
+	shop := func(service string) map[string]string {
+		return map[string]string{ComposeProjectLabel: "shop", ComposeServiceLabel: service}
+	}
+	state := &SavedState{Containers: []StateEntry{
+		composeEntry("shop-web-1", shop("web"), func(e *StateEntry) {
+			e.Config.Labels[ComposeDependsOnLabel] = "db:service_healthy:false"
+			e.Config.Env = []string{"PATH=/usr/bin", "GREETING=$HOME"}
+			e.HostConfig.NetworkMode = "shop_default"
+			e.HostConfig.PortBindings = nat.PortMap{
+				"80/tcp":  {{HostPort: "8080"}, {HostIP: "::", HostPort: "8080"}},
+				"53/udp":  {{HostIP: "127.0.0.1", HostPort: "5353"}},
+				"443/tcp": {{HostIP: "fe80::1", HostPort: "8443"}},
+			}
+			e.HostConfig.RestartPolicy = container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 3}
+			e.NetworkSettings = networksOf("shop_default", "proxy")
+		}),
+		composeEntry("shop-web-2", shop("web"), nil),
+		composeEntry("shop-db-1", shop("db"), func(e *StateEntry) {
+			e.Config.Image = "postgres:16"
+			e.Config.Healthcheck = &container.HealthConfig{Test: []string{"CMD", "pg_isready"}, Interval: 10 * time.Second, Retries: 3}
+			e.HostConfig.NetworkMode = "shop_backend"
+			e.Mounts = []types.MountPoint{
+				{Type: "volume", Name: "shop_pgdata", Destination: "/var/lib/postgresql/data", RW: true},
+				{Type: "volume", Name: "shared", Destination: "/shared"},
+				{Type: "volume", Name: strings.Repeat("f", 64), Destination: "/tmp/anon", RW: true},
+				{Type: "bind", Source: "/etc/pg", Destination: "/etc/postgresql", RW: true},
+			}
+			e.HostConfig.RestartPolicy.Name = "unless-stopped"
+			e.NetworkSettings = networksOf("shop_backend")
+		}),
+		composeEntry("tool", nil, func(e *StateEntry) {
+			e.Config.Cmd = []string{"serve", "--port", "9000"}
+			e.Config.Healthcheck = &container.HealthConfig{Test: []string{"NONE"}}
+			e.HostConfig.NetworkMode = "container:shop-web-1-id"
+		}),
+	}}
+	// The app image sets PATH and the serve command itself
+	defaults := func(image string) *container.Config {
+		if image != "app:1" {
+			return nil
+		}
+		return &container.Config{Env: []string{"PATH=/usr/bin"}, Cmd: []string{"serve", "--port", "9000"}}
+	}
+
+	got := ExportCompose(state, defaults)
+	want := map[string]*ComposeFile{
+		"shop": {
+			Name: "shop",
+			Services: map[string]*ComposeService{
+				"web": {
+					Image:       "app:1",
+					Scale:       2,
+					Environment: map[string]string{"GREETING": "$$HOME"},
+					Ports:       []string{"127.0.0.1:5353:53/udp", "8080:80", "[fe80::1]:8443:443"},
+					Networks:    []string{"proxy", "default"},
+					DependsOn:   []string{"db"},
+					Restart:     "on-failure:3",
+				},
+				"db": {
+					Image:       "postgres:16",
+					Healthcheck: &ComposeHealthcheck{Test: []string{"CMD", "pg_isready"}, Interval: "10s", Retries: 3},
+					Volumes: []string{
+						"/etc/pg:/etc/postgresql", "/tmp/anon",
+						"pgdata:/var/lib/postgresql/data", "shared:/shared:ro",
+					},
+					Networks: []string{"backend"},
+					Restart:  "unless-stopped",
+				},
+			},
+			Networks: map[string]*ComposeResource{"proxy": {Name: "proxy", External: true}, "backend": {}},
+			Volumes:  map[string]*ComposeResource{"pgdata": {}, "shared": {Name: "shared", External: true}},
+		},
+		"": {
+			Services: map[string]*ComposeService{
+				"tool": {
+					Image:         "app:1",
+					ContainerName: "tool",
+					Healthcheck:   &ComposeHealthcheck{Disable: true},
+					NetworkMode:   "container:shop-web-1",
+				},
+			},
+		},
+	}
+	for project, wantFile := range want {
+		gotFile := got[project]
+		if gotFile == nil {
+			t.Errorf("no compose file for project %q", project)
+			continue
+		}
+		for name, wantSvc := range wantFile.Services {
+			if !reflect.DeepEqual(gotFile.Services[name], wantSvc) {
+				t.Errorf("%s/%s =\n%+v\nwant\n%+v", project, name, gotFile.Services[name], wantSvc)
+			}
+		}
+		if len(gotFile.Services) != len(wantFile.Services) {
+			t.Errorf("%s has %d services, want %d", project, len(gotFile.Services), len(wantFile.Services))
+		}
+		if !reflect.DeepEqual(gotFile.Networks, wantFile.Networks) || !reflect.DeepEqual(gotFile.Volumes, wantFile.Volumes) {
+			t.Errorf("%s resources = %v %v, want %v %v", project, gotFile.Networks, gotFile.Volumes, wantFile.Networks, wantFile.Volumes)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d compose files, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ComposeDependsOnLabel lists a service's dependencies as service:condition[:restart],...
+const ComposeDependsOnLabel = "com.docker.compose.depends_on"
+
+// standaloneProject names the group of containers that belong to no compose project
+const standaloneProject = "standalone"
+
+// EntriesFromContainers wraps container summaries so project and ordering helpers can use them
+func EntriesFromContainers(containers []types.Container) []StateEntry {
+	entries := make([]StateEntry, 0, len(containers))
+	for _, c := range containers {
+		entries = append(entries, StateEntry{Container: c})
+	}
+	return entries
+}
+
+// ComposeDependsOn returns the services a compose container depends on
+func ComposeDependsOn(e StateEntry) []string {
+	var services []string
+	for _, dep := range strings.Split(entryLabels(e)[ComposeDependsOnLabel], ",") {
+		service, _, _ := strings.Cut(strings.TrimSpace(dep), ":")
+		if service != "" {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// InProject reports whether e belongs to the compose project; "" matches every container
+// and "standalone" matches containers outside any project
+func InProject(e StateEntry, project string) bool {
+	switch project {
+	case "":
+		return true
+	case standaloneProject:
+		return ComposeProject(e) == ""
+	}
+	return ComposeProject(e) == project
+}
+
+// SelectProject returns the entries that belong to project
+func SelectProject(entries []StateEntry, project string) []StateEntry {
+	var out []StateEntry
+	for _, e := range entries {
+		if InProject(e, project) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// ReplaceProject returns base with the containers of project replaced by captured,
+// so saving one project leaves the rest of the state alone
+func ReplaceProject(base, captured *SavedState, project string) *SavedState {
+	out := &SavedState{Version: captured.Version, SavedAt: captured.SavedAt}
+	for _, e := range base.Containers {
+		if !InProject(e, project) {
+			out.Containers = append(out.Containers, e)
+		}
+	}
+	out.Containers = append(out.Containers, captured.Containers...)
+	out.Networks = mergeNetworks(base.Networks, captured.Networks, out.Containers)
+	return out
+}
+
+// ProjectSummary describes entries per project, such as "media (3), standalone (2)"
+func ProjectSummary(entries []StateEntry) string {
+	counts := map[string]int{}
+	for _, e := range entries {
+		p := ComposeProject(e)
+		if p == "" {
+			p = standaloneProject
+		}
+		counts[p]++
+	}
+	projects := make([]string, 0, len(counts))
+	for p := range counts {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+	parts := make([]string, 0, len(projects))
+	for _, p := range projects {
+		parts = append(parts, fmt.Sprintf("%s (%d)", p, counts[p]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ComposeDeps maps each container name to the containers of the services it
+// depends on within its compose project
+func ComposeDeps(entries []StateEntry) map[string][]string {
+	services := map[string][]string{}
+	for _, e := range entries {
+		if p := ComposeProject(e); p != "" {
+			key := p + "/" + ComposeServiceName(e)
+			services[key] = append(services[key], e.Name())
+		}
+	}
+	deps := map[string][]string{}
+	for _, e := range entries {
+		p := ComposeProject(e)
+		if p == "" {
+			continue
+		}
+		for _, s := range ComposeDependsOn(e) {
+			deps[e.Name()] = append(deps[e.Name()], services[p+"/"+s]...)
+		}
+	}
+	return deps
+}
+
+// OrderEntries orders entries so every container comes after its dependencies.
+// A cycle is returned as a *CycleError.
+func OrderEntries(entries []StateEntry, deps map[string][]string) ([]StateEntry, error) {
+	names := make([]string, 0, len(entries))
+	byName := make(map[string]StateEntry, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+		byName[e.Name()] = e
+	}
+	order, err := TopoSort(names, deps)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]StateEntry, 0, len(order))
+	for _, n := range order {
+		out = append(out, byName[n])
+	}
+	return out, nil
+}
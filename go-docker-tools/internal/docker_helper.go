@@ -2,14 +2,24 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 )
 
 type DockerHelper struct {
 	cli *client.Client
+	// host is the address the helper was opened with when the client dials through a tunnel
+	host string
 }
 
 func NewDockerHelper() (*DockerHelper, error) {
@@ -20,6 +30,29 @@ func NewDockerHelper() (*DockerHelper, error) {
 	return &DockerHelper{cli: cli}, nil
 }
 
+// NewDockerHelperForHost connects to a specific daemon address such as unix:///var/run/docker.sock
+func NewDockerHelperForHost(host string) (*DockerHelper, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithHost(host))
+	if err != nil {
+		return nil, err
+	}
+	return &DockerHelper{cli: cli}, nil
+}
+
+// DaemonHost returns the address the client connects to
+func (d *DockerHelper) DaemonHost() string {
+	if d.host != "" {
+		return d.host
+	}
+	return d.cli.DaemonHost()
+}
+
+// Ping checks that the daemon answers
+func (d *DockerHelper) Ping(ctx context.Context) error {
+	_, err := d.cli.Ping(ctx)
+	return err
+}
+
 func (d *DockerHelper) ListRunningContainers() ([]types.Container, error) {
 	return d.cli.ContainerList(context.Background(), types.ContainerListOptions{All: false})
 }
@@ -38,3 +71,191 @@ func (d *DockerHelper) ListAllContainers() ([]types.Container, error) {
 func (d *DockerHelper) StopContainerByID(id string) error {
 	return d.cli.ContainerStop(context.Background(), id, container.StopOptions{})
 }
+
+// RestartContainer restarts a container by ID or name with the default timeout
+func (d *DockerHelper) RestartContainer(idOrName string) error {
+	return d.cli.ContainerRestart(context.Background(), idOrName, container.StopOptions{})
+}
+
+// StopContainer stops a container with a custom signal and timeout
+func (d *DockerHelper) StopContainer(id string, options container.StopOptions) error {
+	return d.cli.ContainerStop(context.Background(), id, options)
+}
+
+// PauseContainerByID pauses a running container by its ID
+func (d *DockerHelper) PauseContainerByID(id string) error {
+	return d.cli.ContainerPause(context.Background(), id)
+}
+
+// UnpauseContainerByID resumes a paused container by its ID
+func (d *DockerHelper) UnpauseContainerByID(id string) error {
+	return d.cli.ContainerUnpause(context.Background(), id)
+}
+
+// InspectContainer returns container details by ID or name
+func (d *DockerHelper) InspectContainer(idOrName string) (types.ContainerJSON, error) {
+	return d.cli.ContainerInspect(context.Background(), idOrName)
+}
+
+// CreateContainer creates a named container and returns its ID
+func (d *DockerHelper) CreateContainer(name string, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig) (string, error) {
+	resp, err := d.cli.ContainerCreate(context.Background(), config, hostConfig, networkingConfig, nil, name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// RenameContainer gives a container a new name
+func (d *DockerHelper) RenameContainer(id, newName string) error {
+	return d.cli.ContainerRename(context.Background(), id, newName)
+}
+
+// RemoveContainer removes a container, killing it first if force is set
+func (d *DockerHelper) RemoveContainer(id string, force bool) error {
+	return d.cli.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: force})
+}
+
+// RemoveContainerAndVolumes force-removes a container along with its anonymous volumes
+func (d *DockerHelper) RemoveContainerAndVolumes(id string) error {
+	return d.cli.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true})
+}
+
+// SetRestartPolicy changes the restart policy of an existing container
+func (d *DockerHelper) SetRestartPolicy(id string, policy container.RestartPolicy) error {
+	_, err := d.cli.ContainerUpdate(context.Background(), id, container.UpdateConfig{RestartPolicy: policy})
+	return err
+}
+
+// ConnectNetwork attaches a container to a network
+func (d *DockerHelper) ConnectNetwork(networkID, containerID string, settings *network.EndpointSettings) error {
+	return d.cli.NetworkConnect(context.Background(), networkID, containerID, settings)
+}
+
+// ContainerEvents streams container events with the given actions until ctx is done
+func (d *DockerHelper) ContainerEvents(ctx context.Context, actions []string) (<-chan events.Message, <-chan error) {
+	args := filters.NewArgs(filters.Arg("type", string(events.ContainerEventType)))
+	for _, a := range actions {
+		args.Add("event", a)
+	}
+	return d.cli.Events(ctx, types.EventsOptions{Filters: args})
+}
+
+// InspectNetwork returns network details by ID or name
+func (d *DockerHelper) InspectNetwork(idOrName string) (types.NetworkResource, error) {
+	return d.cli.NetworkInspect(context.Background(), idOrName, types.NetworkInspectOptions{})
+}
+
+// CreateNetwork creates a network and returns its ID
+func (d *DockerHelper) CreateNetwork(name string, options types.NetworkCreate) (string, error) {
+	resp, err := d.cli.NetworkCreate(context.Background(), name, options)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// RemoveNetwork removes a network
+func (d *DockerHelper) RemoveNetwork(idOrName string) error {
+	return d.cli.NetworkRemove(context.Background(), idOrName)
+}
+
+// InspectVolume returns volume details by name
+func (d *DockerHelper) InspectVolume(name string) (volume.Volume, error) {
+	return d.cli.VolumeInspect(context.Background(), name)
+}
+
+// CreateVolume creates a named volume
+func (d *DockerHelper) CreateVolume(options volume.CreateOptions) error {
+	_, err := d.cli.VolumeCreate(context.Background(), options)
+	return err
+}
+
+// RemoveVolume removes a named volume
+func (d *DockerHelper) RemoveVolume(name string) error {
+	return d.cli.VolumeRemove(context.Background(), name, false)
+}
+
+// ListVolumeNames returns the names of all Docker volumes
+func (d *DockerHelper) ListVolumeNames() ([]string, error) {
+	resp, err := d.cli.VolumeList(context.Background(), volume.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(resp.Volumes))
+	for _, v := range resp.Volumes {
+		names = append(names, v.Name)
+	}
+	return names, nil
+}
+
+// CopyFromContainer streams a tar archive of path inside a container
+func (d *DockerHelper) CopyFromContainer(id, path string) (io.ReadCloser, error) {
+	rc, _, err := d.cli.CopyFromContainer(context.Background(), id, path)
+	return rc, err
+}
+
+// CopyToContainer extracts a tar archive into dir inside a container
+func (d *DockerHelper) CopyToContainer(id, dir string, content io.Reader) error {
+	return d.cli.CopyToContainer(context.Background(), id, dir, content, types.CopyToContainerOptions{})
+}
+
+// InspectImage returns image details by ID or reference
+func (d *DockerHelper) InspectImage(ref string) (types.ImageInspect, error) {
+	img, _, err := d.cli.ImageInspectWithRaw(context.Background(), ref)
+	return img, err
+}
+
+// SaveImages streams a docker-save tarball of the given image references
+func (d *DockerHelper) SaveImages(refs []string) (io.ReadCloser, error) {
+	return d.cli.ImageSave(context.Background(), refs)
+}
+
+// LoadImage loads a docker-save tarball into the daemon
+func (d *DockerHelper) LoadImage(r io.Reader) error {
+	resp, err := d.cli.ImageLoad(context.Background(), r, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return consumeJSONStream(resp.Body)
+}
+
+// DistributionInspect asks the registry, through the daemon, which manifest ref points to
+func (d *DockerHelper) DistributionInspect(ctx context.Context, ref string) (registry.DistributionInspect, error) {
+	return d.cli.DistributionInspect(ctx, ref, "")
+}
+
+// PullImage pulls an image and waits for the pull to finish
+func (d *DockerHelper) PullImage(ref string) error {
+	body, err := d.cli.ImagePull(context.Background(), ref, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return consumeJSONStream(body)
+}
+
+// consumeJSONStream drains a Docker progress stream and returns the first error it reports
+func consumeJSONStream(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Error       string `json:"error"`
+			ErrorDetail struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if msg.ErrorDetail.Message != "" {
+			return errors.New(msg.ErrorDetail.Message)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Backoff between daemon pings: doubling from the first delay up to the cap
+const (
+	dockerWaitFirstDelay = 500 * time.Millisecond
+	dockerWaitMaxDelay   = 15 * time.Second
+	dockerPingTimeout    = 5 * time.Second
+)
+
+// WaitForDocker pings the daemon until it answers, backing off exponentially, and
+// gives up after timeout. onRetry, if set, is told about each failed attempt and
+// the delay before the next one.
+func WaitForDocker(dockerHelper *DockerHelper, timeout time.Duration, logger *log.Logger, onRetry func(attempt int, next time.Duration, err error)) error {
+	deadline := time.Now().Add(timeout)
+	delay := dockerWaitFirstDelay
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), dockerPingTimeout)
+		err := dockerHelper.Ping(ctx)
+		cancel()
+		if err == nil {
+			if attempt > 1 {
+				logger.Printf("Docker daemon is active after %d attempts.", attempt)
+			}
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			logger.Printf("Docker daemon not available after %s. Giving up.", timeout)
+			return fmt.Errorf("docker daemon not available after %s: %w", timeout, err)
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		logger.Printf("Waiting for Docker daemon to be available (attempt %d, retry in %s): %v", attempt, delay.Round(100*time.Millisecond), err)
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > dockerWaitMaxDelay {
+			delay = dockerWaitMaxDelay
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+// Kinds of DriftItem
+const (
+	DriftMissing = "missing"
+	DriftStopped = "stopped"
+	DriftChanged = "changed"
+)
+
+// DriftItem is one container that no longer matches the baseline
+type DriftItem struct {
+	Container string        `json:"container"`
+	Kind      string        `json:"kind"`
+	State     string        `json:"state,omitempty"`
+	Fields    []FieldChange `json:"fields,omitempty"`
+}
+
+// DriftReport is the result of comparing a baseline with the live daemon
+type DriftReport struct {
+	Baseline  string      `json:"baseline"`
+	CheckedAt time.Time   `json:"checked_at"`
+	Items     []DriftItem `json:"items"`
+}
+
+// CaptureLiveState inspects every container on the daemon, running or not
+func CaptureLiveState(dockerHelper *DockerHelper, logger *log.Logger) (*SavedState, error) {
+	containers, err := dockerHelper.ListAllContainers()
+	if err != nil {
+		return nil, err
+	}
+	return CaptureState(dockerHelper, containers, logger), nil
+}
+
+// DetectDrift reports baseline containers that are missing, not running, or
+// running with a different image, ports, env or mounts
+func DetectDrift(baseline, live *SavedState, baselineName string) *DriftReport {
+	return DetectDriftWith(baseline, live, baselineName, DiffEntries)
+}
+
+// DetectDriftWith is DetectDrift with a custom comparison, such as CompareManifestEntry
+func DetectDriftWith(baseline, live *SavedState, baselineName string, compare func(want, have StateEntry) []FieldChange) *DriftReport {
+	report := &DriftReport{Baseline: baselineName, CheckedAt: time.Now(), Items: []DriftItem{}}
+	for _, want := range baseline.Containers {
+		have := live.Find(want.Name())
+		if have == nil {
+			report.Items = append(report.Items, DriftItem{Container: want.Name(), Kind: DriftMissing})
+			continue
+		}
+		fields := compare(want, *have)
+		switch {
+		case have.State != "running":
+			report.Items = append(report.Items, DriftItem{Container: want.Name(), Kind: DriftStopped, State: have.State, Fields: fields})
+		case len(fields) > 0:
+			report.Items = append(report.Items, DriftItem{Container: want.Name(), Kind: DriftChanged, State: have.State, Fields: fields})
+		}
+	}
+	sort.SliceStable(report.Items, func(i, j int) bool { return report.Items[i].Container < report.Items[j].Container })
+	return report
+}
+
+// Summary returns a one-line description of the drift
+func (r *DriftReport) Summary() string {
+	parts := make([]string, 0, len(r.Items))
+	for _, item := range r.Items {
+		detail := item.Kind
+		if len(item.Fields) > 0 {
+			names := make([]string, 0, len(item.Fields))
+			for _, f := range item.Fields {
+				names = append(names, f.Field)
+			}
+			detail += " " + strings.Join(names, "/")
+		}
+		parts = append(parts, item.Container+" ("+detail+")")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// driftStatePath records the last reported drift so scheduled runs only notify on changes
+func driftStatePath(conf *config.Config) string {
+	return filepath.Join(conf.StateDir, "drift_last.json")
+}
+
+// DriftChangedSinceLast compares report with the previous run and stores it.
+// It reports true when the set of drifting containers or their kind changed.
+func DriftChangedSinceLast(conf *config.Config, report *DriftReport) bool {
+	var last DriftReport
+	if data, err := os.ReadFile(driftStatePath(conf)); err == nil {
+		json.Unmarshal(data, &last)
+	}
+	changed := last.Summary() != report.Summary()
+	if data, err := json.Marshal(report); err == nil {
+		writeFileAtomic(driftStatePath(conf), data, 0600)
+	}
+	return changed
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestDetectDrift(t *testing.T) {
+	tests := []struct {
+		name string
+		// change alters the daemon after the baseline was captured
+		change func(f *fakeDocker)
+		want   []DriftItem
+	}{
+		{name: "unchanged", change: func(f *fakeDocker) {}, want: []DriftItem{}},
+		{
+			name:   "removed",
+			change: func(f *fakeDocker) { delete(f.containers, f.byName("db").ID) },
+			want:   []DriftItem{{Container: "db", Kind: DriftMissing}},
+		},
+		{
+			name: "stopped",
+			change: func(f *fakeDocker) {
+				f.byName("web").State = &types.ContainerState{Status: "exited"}
+			},
+			want: []DriftItem{{Container: "web", Kind: DriftStopped, State: "exited"}},
+		},
+		{
+			name: "changed env and ports",
+			change: func(f *fakeDocker) {
+				web := f.byName("web")
+				web.Config.Env = append(web.Config.Env, "DEBUG=1")
+				web.HostConfig.PortBindings = nat.PortMap{"80/tcp": {{HostPort: "9090"}}}
+			},
+			want: []DriftItem{{Container: "web", Kind: DriftChanged, State: "running", Fields: []FieldChange{
+				{Field: "ports", Old: "8080->80/tcp", New: "9090->80/tcp"},
+				{Field: "env", New: "DEBUG"},
+			}}},
+		},
+		{
+			name: "new containers are not drift",
+			change: func(f *fakeDocker) {
+				f.addContainer("extra", appImage, &container.Config{Image: "app:1"}, nil, true)
+			},
+			want: []DriftItem{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeDocker()
+			f.addImage(appImage)
+			f.addContainer("web", appImage, &container.Config{Image: "app:1", Env: []string{"A=1"}},
+				&container.HostConfig{PortBindings: nat.PortMap{"80/tcp": {{HostPort: "8080"}}}}, true)
+			f.addContainer("db", appImage, &container.Config{Image: "app:1"}, nil, true)
+			dockerHelper := f.helper(t)
+
+			baseline, err := CaptureLiveState(dockerHelper, testLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(f)
+			live, err := CaptureLiveState(dockerHelper, testLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := DetectDrift(baseline, live, "state.json")
+			if !reflect.DeepEqual(report.Items, tt.want) {
+				t.Errorf("DetectDrift() =\n%+v\nwant\n%+v", report.Items, tt.want)
+			}
+		})
+	}
+}
+
+func TestDriftChangedSinceLast(t *testing.T) {
+	conf := &config.Config{StateDir: t.TempDir()}
+	missing := DriftItem{Container: "db", Kind: DriftMissing}
+	stopped := DriftItem{Container: "web", Kind: DriftStopped, State: "exited"}
+	steps := []struct {
+		items []DriftItem
+		want  bool
+	}{
+		{items: []DriftItem{missing}, want: true},
+		{items: []DriftItem{missing}, want: false},
+		{items: []DriftItem{missing, stopped}, want: true},
+		{items: []DriftItem{missing, {Container: "web", Kind: DriftChanged, State: "running"}}, want: true},
+		{items: []DriftItem{}, want: true},
+		{items: []DriftItem{}, want: false},
+	}
+	for i, s := range steps {
+		report := &DriftReport{Baseline: "state.json", Items: s.items}
+		if got := DriftChangedSinceLast(conf, report); got != s.want {
+			t.Errorf("step %d: DriftChangedSinceLast() = %v, want %v", i, got, s.want)
+		}
+	}
+}
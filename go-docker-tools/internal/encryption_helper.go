@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptionMagic prefixes encrypted archives; a salt for the passphrase KDF follows it
+const encryptionMagic = "GDTENC2\n"
+
+// EncryptedSuffix is appended to the names of encrypted archives
+const EncryptedSuffix = ".enc"
+
+// saltSize is the length of the per-archive scrypt salt
+const saltSize = 16
+
+// scrypt cost parameters for passphrases, about 32 MiB and well under a second per archive
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// EncryptionKey is either a 32-byte hex-encoded key used as-is or a passphrase that is
+// stretched with scrypt and the salt stored in each archive's header
+type EncryptionKey struct {
+	raw        []byte
+	passphrase []byte
+}
+
+// LoadEncryptionKey reads a key file: 64 hex chars are a raw key, any other text
+// is a passphrase. Binary files are refused rather than guessed at.
+func LoadEncryptionKey(path string) (*EncryptionKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := strings.TrimSpace(string(data))
+	if len(trimmed) == 64 {
+		if key, err := hex.DecodeString(trimmed); err == nil {
+			return &EncryptionKey{raw: key}, nil
+		}
+	}
+	if !isTextKey(data) {
+		return nil, fmt.Errorf("encryption key file %s is binary; write raw keys as 64 hex characters (xxd -p -c 32)", path)
+	}
+	if trimmed == "" {
+		return nil, fmt.Errorf("encryption key file %s is empty", path)
+	}
+	return &EncryptionKey{passphrase: []byte(trimmed)}, nil
+}
+
+// master returns the 32-byte key for an archive with the given salt
+func (k *EncryptionKey) master(salt []byte) ([]byte, error) {
+	if k.raw != nil {
+		return k.raw, nil
+	}
+	return scrypt.Key(k.passphrase, salt, scryptN, scryptR, scryptP, 32)
+}
+
+// isTextKey reports whether a key file is printable text, as passphrases are
+func isTextKey(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isEncryptionHeader reports whether head starts with the encryption magic
+func isEncryptionHeader(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(encryptionMagic))
+}
+
+// deriveKeys splits the master key into an encryption key and a MAC key
+func deriveKeys(key []byte) (encKey, macKey []byte) {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("encrypt"))
+	encKey = m.Sum(nil)
+	m = hmac.New(sha256.New, key)
+	m.Write([]byte("authenticate"))
+	macKey = m.Sum(nil)
+	return encKey, macKey
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	stream cipher.Stream
+	mac    hash.Hash
+	buf    []byte
+}
+
+// NewEncryptWriter returns a writer that encrypts with AES-256-CTR and appends an
+// HMAC-SHA256 of the ciphertext on Close. Close does not close w.
+func NewEncryptWriter(w io.Writer, key *EncryptionKey) (io.WriteCloser, error) {
+	header := make([]byte, saltSize+aes.BlockSize)
+	if _, err := rand.Read(header); err != nil {
+		return nil, err
+	}
+	salt, iv := header[:saltSize], header[saltSize:]
+	master, err := key.master(salt)
+	if err != nil {
+		return nil, err
+	}
+	encKey, macKey := deriveKeys(master)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encryptionMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(header)
+	return &encryptWriter{w: w, stream: cipher.NewCTR(block, iv), mac: mac}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if cap(e.buf) < len(p) {
+		e.buf = make([]byte, len(p))
+	}
+	out := e.buf[:len(p)]
+	e.stream.XORKeyStream(out, p)
+	e.mac.Write(out)
+	if _, err := e.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	_, err := e.w.Write(e.mac.Sum(nil))
+	return err
+}
+
+type decryptReader struct {
+	r      io.Reader
+	stream cipher.Stream
+	mac    hash.Hash
+	tail   []byte
+	eof    bool
+}
+
+// NewDecryptReader reverses NewEncryptWriter. The MAC is checked when the stream
+// reaches EOF, so callers must read to the end before trusting the data.
+func NewDecryptReader(r io.Reader, key *EncryptionKey) (io.Reader, error) {
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	if !isEncryptionHeader(magic) {
+		return nil, errors.New("not an encrypted archive")
+	}
+	header := make([]byte, saltSize+aes.BlockSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	master, err := key.master(header[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	iv := header[saltSize:]
+	encKey, macKey := deriveKeys(master)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(header)
+	return &decryptReader{r: r, stream: cipher.NewCTR(block, iv), mac: mac}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for !d.eof && len(d.tail) < sha256.Size+len(p) {
+		chunk := make([]byte, 32*1024)
+		n, err := d.r.Read(chunk)
+		d.tail = append(d.tail, chunk[:n]...)
+		if err == io.EOF {
+			d.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	avail := len(d.tail) - sha256.Size
+	if avail <= 0 {
+		if !d.eof {
+			return 0, nil
+		}
+		if len(d.tail) != sha256.Size || !hmac.Equal(d.tail, d.mac.Sum(nil)) {
+			return 0, errors.New("encrypted archive failed authentication (wrong key or corrupted file)")
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, d.tail[:avail])
+	d.mac.Write(d.tail[:n])
+	d.stream.XORKeyStream(p[:n], d.tail[:n])
+	d.tail = d.tail[n:]
+	return n, nil
+}
+
+// IsEncryptedFile reports whether the file starts with the encryption header
+func IsEncryptedFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return isEncryptionHeader(header)
+}
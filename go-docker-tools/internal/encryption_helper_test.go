@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backup.key")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	hexKey := strings.Repeat("0f", 32)
+	tests := []struct {
+		name     string
+		data     string
+		wantRaw  bool
+		wantPass string
+		wantErr  string
+	}{
+		{name: "hex key", data: hexKey + "\n", wantRaw: true},
+		{name: "passphrase", data: "correct horse battery staple\n", wantPass: "correct horse battery staple"},
+		{name: "32 character passphrase", data: strings.Repeat("p", 32), wantPass: strings.Repeat("p", 32)},
+		{name: "64 characters that are not hex", data: strings.Repeat("x", 64), wantPass: strings.Repeat("x", 64)},
+		{name: "binary key", data: string(bytes.Repeat([]byte{0x00, 0xff}, 16)), wantErr: "is binary"},
+		{name: "empty", data: " \n", wantErr: "is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := LoadEncryptionKey(writeKeyFile(t, tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadEncryptionKey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadEncryptionKey() error = %v", err)
+			}
+			if (key.raw != nil) != tt.wantRaw || string(key.passphrase) != tt.wantPass {
+				t.Errorf("LoadEncryptionKey() = raw %x passphrase %q", key.raw, key.passphrase)
+			}
+		})
+	}
+}
+
+func encryptForTest(t *testing.T, key *EncryptionKey, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	rawKey := &EncryptionKey{raw: bytes.Repeat([]byte{7}, 32)}
+	passKey := &EncryptionKey{passphrase: []byte("secret")}
+	plain := bytes.Repeat([]byte("container state "), 10000)
+	tests := []struct {
+		name    string
+		encrypt *EncryptionKey
+		decrypt *EncryptionKey
+		mangle  func([]byte) []byte
+		wantErr string
+	}{
+		{name: "raw key", encrypt: rawKey, decrypt: rawKey},
+		{name: "passphrase", encrypt: passKey, decrypt: &EncryptionKey{passphrase: []byte("secret")}},
+		{name: "wrong passphrase", encrypt: passKey, decrypt: &EncryptionKey{passphrase: []byte("guess")}, wantErr: "failed authentication"},
+		{name: "wrong key type", encrypt: passKey, decrypt: rawKey, wantErr: "failed authentication"},
+		{
+			name: "flipped ciphertext bit", encrypt: rawKey, decrypt: rawKey,
+			mangle:  func(b []byte) []byte { b[len(b)/2] ^= 1; return b },
+			wantErr: "failed authentication",
+		},
+		{
+			name: "truncated", encrypt: rawKey, decrypt: rawKey,
+			mangle:  func(b []byte) []byte { return b[:len(b)-10] },
+			wantErr: "failed authentication",
+		},
+		{
+			name: "legacy header", encrypt: rawKey, decrypt: rawKey,
+			mangle:  func(b []byte) []byte { return append([]byte("GDTENC1\n"), b[len(encryptionMagic):]...) },
+			wantErr: "not an encrypted archive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encryptForTest(t, tt.encrypt, plain)
+			if !isEncryptionHeader(data) {
+				t.Fatalf("encrypted data starts with %q", data[:len(encryptionMagic)])
+			}
+			if bytes.Contains(data, plain[:64]) {
+				t.Fatal("plaintext visible in the encrypted data")
+			}
+			if tt.mangle != nil {
+				data = tt.mangle(data)
+			}
+			r, err := NewDecryptReader(bytes.NewReader(data), tt.decrypt)
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(r)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decrypt error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decrypt error = %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("decrypted %d bytes that differ from the %d written", len(got), len(plain))
+			}
+		})
+	}
+}
+
+func TestEncryptionSaltsPerArchive(t *testing.T) {
+	key := &EncryptionKey{passphrase: []byte("secret")}
+	a := encryptForTest(t, key, []byte("same data"))
+	b := encryptForTest(t, key, []byte("same data"))
+	if bytes.Equal(a[:len(encryptionMagic)+saltSize], b[:len(encryptionMagic)+saltSize]) {
+		t.Error("two archives share a salt")
+	}
+}
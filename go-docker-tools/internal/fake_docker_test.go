@@ -0,0 +1,506 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var testLogger = log.New(io.Discard, "", 0)
+
+// appImage is app:1 as pulled from a registry
+var appImage = types.ImageInspect{
+	ID:          "sha256:" + strings.Repeat("a", 64),
+	RepoTags:    []string{"app:1"},
+	RepoDigests: []string{"app@sha256:" + strings.Repeat("d", 64)},
+}
+
+// fakeDocker is an in-memory stand-in for the parts of the Engine API the helpers use.
+// Images move between fakes as JSON: save writes the inspect data, load reads it back.
+type fakeDocker struct {
+	mu         sync.Mutex
+	seq        int
+	containers map[string]*fakeContainer
+	images     map[string]types.ImageInspect
+	volumes    map[string]volume.Volume
+	volData    map[string][]byte
+	networks   map[string]types.NetworkResource
+	// registry maps pullable references to images and digests
+	registry map[string]types.ImageInspect
+	// onStart decides the state a started container ends up in; nil means running
+	onStart func(c *fakeContainer) *types.ContainerState
+	// failStart, if set, fails the start of containers it returns an error for
+	failStart func(c *fakeContainer) error
+	// failCreate, if set, fails the creation of containers it returns an error for
+	failCreate func(name string, cfg *container.Config) error
+	// onStop, if set, sees each stop request with its signal and t parameters and
+	// fails those it returns an error for. It runs without the lock held.
+	onStop func(c *fakeContainer, q url.Values) error
+}
+
+type fakeContainer struct {
+	types.ContainerJSON
+	// Volume is the volume mounted by a volume copy container
+	Volume string
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		containers: map[string]*fakeContainer{},
+		images:     map[string]types.ImageInspect{},
+		volumes:    map[string]volume.Volume{},
+		volData:    map[string][]byte{},
+		networks:   map[string]types.NetworkResource{},
+		registry:   map[string]types.ImageInspect{},
+	}
+}
+
+// helper serves the fake and returns a DockerHelper talking to it
+func (f *fakeDocker) helper(t *testing.T) *DockerHelper {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DockerHelper{cli: cli}
+}
+
+// addImage registers an image under its ID, tags and repo digests
+func (f *fakeDocker) addImage(img types.ImageInspect) {
+	f.images[img.ID] = img
+	for _, ref := range append(append([]string(nil), img.RepoTags...), img.RepoDigests...) {
+		f.images[ref] = img
+	}
+}
+
+// image finds an image by ID or reference, treating nginx, nginx:latest and
+// docker.io/library/nginx:latest alike as the daemon does
+func (f *fakeDocker) image(ref string) (types.ImageInspect, bool) {
+	if img, ok := f.images[ref]; ok {
+		return img, true
+	}
+	for name, img := range f.images {
+		if normalizeImageRef(name) == normalizeImageRef(ref) {
+			return img, true
+		}
+	}
+	return types.ImageInspect{}, false
+}
+
+// addContainer registers a container created from cfg and hostConfig on image
+func (f *fakeDocker) addContainer(name string, img types.ImageInspect, cfg *container.Config, hostConfig *container.HostConfig, running bool) *fakeContainer {
+	f.seq++
+	id := fmt.Sprintf("%064d", f.seq)
+	if hostConfig == nil {
+		hostConfig = &container.HostConfig{}
+	}
+	c := &fakeContainer{ContainerJSON: types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + name,
+			Image:      img.ID,
+			State:      &types.ContainerState{Running: running, Status: statusOf(running)},
+			HostConfig: hostConfig,
+		},
+		Config:          cfg,
+		NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{}},
+	}}
+	for _, m := range hostConfig.Mounts {
+		c.Mounts = append(c.Mounts, types.MountPoint{Type: m.Type, Name: m.Source, Destination: m.Target})
+	}
+	for _, b := range hostConfig.Binds {
+		parts := strings.SplitN(b, ":", 3)
+		if len(parts) >= 2 && !strings.HasPrefix(parts[0], "/") {
+			c.Mounts = append(c.Mounts, types.MountPoint{Type: "volume", Name: parts[0], Destination: parts[1]})
+		}
+	}
+	f.containers[id] = c
+	return c
+}
+
+func statusOf(running bool) string {
+	if running {
+		return "running"
+	}
+	return "exited"
+}
+
+// byName returns the container with the given name, if any
+func (f *fakeDocker) byName(name string) *fakeContainer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.find(name)
+}
+
+func (f *fakeDocker) find(idOrName string) *fakeContainer {
+	if c := f.containers[idOrName]; c != nil {
+		return c
+	}
+	for _, c := range f.containers {
+		if c.Name == "/"+strings.TrimPrefix(idOrName, "/") || (len(idOrName) >= 12 && strings.HasPrefix(c.ID, idOrName)) {
+			return c
+		}
+	}
+	return nil
+}
+
+// names lists the containers by name
+func (f *fakeDocker) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, c := range f.containers {
+		names = append(names, strings.TrimPrefix(c.Name, "/"))
+	}
+	return names
+}
+
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := apiVersionPrefix.ReplaceAllString(r.URL.Path, "")
+	q := r.URL.Query()
+	reply := func(v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(code int, format string, args ...any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf(format, args...)})
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case path == "/_ping":
+		w.Header().Set("API-Version", "1.43")
+		io.WriteString(w, "OK")
+
+	case r.Method == http.MethodGet && path == "/containers/json":
+		var list []types.Container
+		for _, c := range f.containers {
+			if q.Get("all") == "" && !c.State.Running {
+				continue
+			}
+			list = append(list, f.summary(c))
+		}
+		reply(list)
+	case r.Method == http.MethodPost && path == "/containers/create":
+		var body struct {
+			container.Config
+			HostConfig       *container.HostConfig
+			NetworkingConfig *network.NetworkingConfig
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		name := q.Get("name")
+		if name != "" && f.find(name) != nil {
+			fail(http.StatusConflict, "container name %q is already in use", name)
+			return
+		}
+		if f.failCreate != nil {
+			if err := f.failCreate(name, &body.Config); err != nil {
+				fail(http.StatusBadRequest, "%v", err)
+				return
+			}
+		}
+		img, ok := f.image(body.Image)
+		if !ok {
+			fail(http.StatusNotFound, "No such image: %s", body.Image)
+			return
+		}
+		cfg := body.Config
+		c := f.addContainer(name, img, &cfg, body.HostConfig, false)
+		if name == "" {
+			c.Name = "/copy_" + c.ID[60:]
+		}
+		if c.HostConfig != nil && len(c.HostConfig.Mounts) > 0 {
+			c.Volume = c.HostConfig.Mounts[0].Source
+		}
+		if body.NetworkingConfig != nil {
+			for n, ep := range body.NetworkingConfig.EndpointsConfig {
+				c.NetworkSettings.Networks[n] = ep
+			}
+		}
+		reply(container.CreateResponse{ID: c.ID})
+	case parts[0] == "containers" && len(parts) >= 2:
+		c := f.find(parts[1])
+		if c == nil {
+			fail(http.StatusNotFound, "No such container: %s", parts[1])
+			return
+		}
+		action := ""
+		if len(parts) > 2 {
+			action = parts[2]
+		}
+		switch {
+		case r.Method == http.MethodGet && action == "json":
+			reply(c.ContainerJSON)
+		case r.Method == http.MethodPost && action == "start":
+			if f.failStart != nil {
+				if err := f.failStart(c); err != nil {
+					fail(http.StatusInternalServerError, "%v", err)
+					return
+				}
+			}
+			state := &types.ContainerState{Running: true, Status: "running"}
+			if f.onStart != nil {
+				if s := f.onStart(c); s != nil {
+					state = s
+				}
+			}
+			c.State = state
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && action == "stop":
+			if f.onStop != nil {
+				f.mu.Unlock()
+				err := f.onStop(c, q)
+				f.mu.Lock()
+				if err != nil {
+					fail(http.StatusInternalServerError, "%v", err)
+					return
+				}
+			}
+			c.State = &types.ContainerState{Status: "exited"}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && action == "restart":
+			c.State = &types.ContainerState{Running: true, Status: "running"}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && action == "rename":
+			name := q.Get("name")
+			if other := f.find(name); other != nil && other != c {
+				fail(http.StatusConflict, "container name %q is already in use", name)
+				return
+			}
+			c.Name = "/" + name
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && action == "update":
+			var body container.UpdateConfig
+			json.NewDecoder(r.Body).Decode(&body)
+			c.HostConfig.RestartPolicy = body.RestartPolicy
+			reply(container.ContainerUpdateOKBody{})
+		case r.Method == http.MethodDelete && action == "":
+			if c.State.Running && q.Get("force") == "" {
+				fail(http.StatusConflict, "container %s is running", c.ID)
+				return
+			}
+			delete(f.containers, c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && action == "archive":
+			stat, _ := json.Marshal(types.ContainerPathStat{Name: "volume", Mode: 0755 | 1<<31})
+			w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+			w.Header().Set("Content-Type", "application/x-tar")
+			w.Write(f.volData[c.Volume])
+		case r.Method == http.MethodPut && action == "archive":
+			data, _ := io.ReadAll(r.Body)
+			f.volData[c.Volume] = data
+			w.WriteHeader(http.StatusOK)
+		default:
+			fail(http.StatusNotFound, "unexpected %s %s", r.Method, path)
+		}
+
+	case r.Method == http.MethodPost && path == "/images/create":
+		ref := q.Get("fromImage")
+		if tag := q.Get("tag"); tag != "" {
+			if strings.HasPrefix(tag, "sha256:") {
+				ref += "@" + tag
+			} else {
+				ref += ":" + tag
+			}
+		}
+		img, ok := f.registry[ref]
+		if !ok {
+			reply(map[string]any{"errorDetail": map[string]string{"message": "manifest unknown"}, "error": "manifest unknown: " + ref})
+			return
+		}
+		f.addImage(img)
+		f.images[ref] = img
+		reply(map[string]string{"status": "Downloaded newer image for " + ref})
+	case r.Method == http.MethodGet && path == "/images/get":
+		var imgs []types.ImageInspect
+		for _, ref := range q["names"] {
+			if img, ok := f.images[ref]; ok {
+				imgs = append(imgs, img)
+			}
+		}
+		reply(imgs)
+	case r.Method == http.MethodPost && path == "/images/load":
+		var imgs []types.ImageInspect
+		if err := json.NewDecoder(r.Body).Decode(&imgs); err != nil {
+			fail(http.StatusBadRequest, "bad image archive: %v", err)
+			return
+		}
+		for _, img := range imgs {
+			f.addImage(img)
+		}
+		reply(map[string]string{"stream": fmt.Sprintf("Loaded %d images\n", len(imgs))})
+	case r.Method == http.MethodGet && parts[0] == "images" && len(parts) >= 3 && parts[len(parts)-1] == "json":
+		ref := strings.Join(parts[1:len(parts)-1], "/")
+		img, ok := f.image(ref)
+		if !ok {
+			fail(http.StatusNotFound, "No such image: %s", ref)
+			return
+		}
+		reply(img)
+	case r.Method == http.MethodGet && parts[0] == "distribution":
+		ref := strings.Join(parts[1:len(parts)-1], "/")
+		img, ok := f.registry[ref]
+		if !ok || len(img.RepoDigests) == 0 {
+			fail(http.StatusNotFound, "manifest unknown: %s", ref)
+			return
+		}
+		_, d, _ := strings.Cut(img.RepoDigests[0], "@")
+		reply(registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(d)}})
+
+	case r.Method == http.MethodGet && parts[0] == "volumes" && len(parts) == 2:
+		v, ok := f.volumes[parts[1]]
+		if !ok {
+			fail(http.StatusNotFound, "get %s: no such volume", parts[1])
+			return
+		}
+		reply(v)
+	case r.Method == http.MethodGet && path == "/volumes":
+		var list volume.ListResponse
+		for _, v := range f.volumes {
+			v := v
+			list.Volumes = append(list.Volumes, &v)
+		}
+		reply(list)
+	case r.Method == http.MethodPost && path == "/volumes/create":
+		var opts volume.CreateOptions
+		json.NewDecoder(r.Body).Decode(&opts)
+		if opts.Driver == "" {
+			opts.Driver = "local"
+		}
+		v := volume.Volume{Name: opts.Name, Driver: opts.Driver, Options: opts.DriverOpts, Labels: opts.Labels}
+		f.volumes[opts.Name] = v
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(v)
+	case r.Method == http.MethodDelete && parts[0] == "volumes" && len(parts) == 2:
+		if _, ok := f.volumes[parts[1]]; !ok {
+			fail(http.StatusNotFound, "get %s: no such volume", parts[1])
+			return
+		}
+		delete(f.volumes, parts[1])
+		delete(f.volData, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && path == "/networks/create":
+		var body struct {
+			types.NetworkCreate
+			Name string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		n := types.NetworkResource{Name: body.Name, ID: body.Name + "-id", Driver: body.Driver, Scope: "local", Labels: body.Labels,
+			EnableIPv6: body.EnableIPv6, Internal: body.Internal, Attachable: body.Attachable, Options: body.Options}
+		if body.IPAM != nil {
+			n.IPAM = *body.IPAM
+		}
+		// Like dockerd, refuse a subnet another network already has
+		for _, c := range n.IPAM.Config {
+			for _, other := range f.networks {
+				for _, oc := range other.IPAM.Config {
+					if c.Subnet != "" && c.Subnet == oc.Subnet {
+						fail(http.StatusForbidden, "Pool overlaps with other one on this address space")
+						return
+					}
+				}
+			}
+		}
+		f.networks[body.Name] = n
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(types.NetworkCreateResponse{ID: n.ID})
+	case parts[0] == "networks" && len(parts) == 3 && parts[2] == "connect":
+		var body types.NetworkConnect
+		json.NewDecoder(r.Body).Decode(&body)
+		if c := f.find(body.Container); c != nil {
+			c.NetworkSettings.Networks[parts[1]] = body.EndpointConfig
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && parts[0] == "networks" && len(parts) == 2:
+		n, ok := f.networks[parts[1]]
+		if !ok {
+			fail(http.StatusNotFound, "network %s not found", parts[1])
+			return
+		}
+		reply(n)
+	case r.Method == http.MethodDelete && parts[0] == "networks" && len(parts) == 2:
+		if _, ok := f.networks[parts[1]]; !ok {
+			fail(http.StatusNotFound, "network %s not found", parts[1])
+			return
+		}
+		delete(f.networks, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fail(http.StatusNotFound, "unexpected %s %s", r.Method, path)
+	}
+}
+
+// summary is the docker ps view of a container
+func (f *fakeDocker) summary(c *fakeContainer) types.Container {
+	s := types.Container{
+		ID:      c.ID,
+		Names:   []string{c.Name},
+		ImageID: c.Image,
+		State:   c.State.Status,
+		Labels:  map[string]string{},
+	}
+	if c.Config != nil {
+		s.Image = c.Config.Image
+		for k, v := range c.Config.Labels {
+			s.Labels[k] = v
+		}
+	}
+	if c.State.Running && c.HostConfig != nil {
+		for port, bindings := range c.HostConfig.PortBindings {
+			for _, b := range bindings {
+				public, _ := strconv.Atoi(b.HostPort)
+				s.Ports = append(s.Ports, types.Port{IP: b.HostIP, PrivatePort: uint16(port.Int()), PublicPort: uint16(public), Type: port.Proto()})
+			}
+		}
+	}
+	for _, m := range c.Mounts {
+		s.Mounts = append(s.Mounts, m)
+	}
+	return s
+}
+
+// sortedNames lists the containers of f by name
+func sortedNames(f *fakeDocker) []string {
+	names := f.names()
+	sort.Strings(names)
+	return names
+}
+
+// entryNames lists the names of entries in order
+func entryNames(entries []StateEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
@@ -0,0 +1,449 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+// Labels that opt a container into healing
+const (
+	// HealPolicyLabel is restart, recreate, stop or rollback; containers without it are left alone
+	HealPolicyLabel = "heal.policy"
+	// HealOnLabel limits the triggers, as a comma list of unhealthy, crashloop and oom
+	HealOnLabel = "heal.on"
+	// HealCrashRestartsLabel and HealCrashWindowLabel define a crash loop: N exits within the window
+	HealCrashRestartsLabel = "heal.crash_restarts"
+	HealCrashWindowLabel   = "heal.crash_window"
+	// HealCooldownLabel is the minimum time between two actions on the container
+	HealCooldownLabel = "heal.cooldown"
+)
+
+// Heal policies
+const (
+	HealRestart  = "restart"
+	HealRecreate = "recreate"
+	HealStop     = "stop"
+	HealRollback = "rollback"
+)
+
+// Heal triggers
+const (
+	TriggerUnhealthy = "unhealthy"
+	TriggerCrashLoop = "crashloop"
+	TriggerOOM       = "oom"
+)
+
+const (
+	defaultCrashRestarts = 5
+	defaultCrashWindow   = 10 * time.Minute
+	defaultHealCooldown  = 10 * time.Minute
+	// A stop event this soon after a die means the exit was requested, not a crash
+	stopAfterDieWindow = 5 * time.Second
+	// maxHealImages bounds the images remembered per container for rollback
+	maxHealImages = 10
+)
+
+// HealEvents are the container actions the healer listens to
+var HealEvents = []string{"start", "die", "stop", "oom", "health_status"}
+
+// HealAction reports a detected problem and what was done about it
+type HealAction struct {
+	Container string
+	Trigger   string
+	Policy    string
+	Detail    string
+	// Suppressed is set when the cooldown prevented the action
+	Suppressed bool
+	Err        error
+}
+
+// Healer watches for unhealthy, crash-looping and OOM-killed containers and applies
+// the policy from their heal.* labels
+type Healer struct {
+	Conf         *config.Config
+	DockerHelper *DockerHelper
+	Logger       *log.Logger
+	// OnAction, if set, is called for every detection
+	OnAction func(HealAction)
+
+	mu         sync.Mutex
+	exits      map[string][]time.Time
+	lastAction map[string]time.Time
+	suppressed map[string]bool
+}
+
+// NewHealer creates a healer that reports through onAction
+func NewHealer(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, onAction func(HealAction)) *Healer {
+	return &Healer{
+		Conf:         conf,
+		DockerHelper: dockerHelper,
+		Logger:       logger,
+		OnAction:     onAction,
+		exits:        map[string][]time.Time{},
+		lastAction:   map[string]time.Time{},
+		suppressed:   map[string]bool{},
+	}
+}
+
+// Run handles container events until ctx is done, resubscribing when the stream drops
+func (h *Healer) Run(ctx context.Context) error {
+	h.recordRunningImages()
+	for {
+		msgs, errs := h.DockerHelper.ContainerEvents(ctx, HealEvents)
+		h.Logger.Println("Watching containers for healing")
+	consume:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case m := <-msgs:
+				h.handle(m)
+			case err := <-errs:
+				if ctx.Err() != nil {
+					return nil
+				}
+				h.Logger.Println("Docker event stream ended:", err)
+				break consume
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(eventsReconnectDelay):
+		}
+	}
+}
+
+// handle turns one event into a trigger, if the container opted in and it qualifies
+func (h *Healer) handle(m events.Message) {
+	attrs := m.Actor.Attributes
+	policy := attrs[HealPolicyLabel]
+	if policy == "" {
+		return
+	}
+	name := attrs["name"]
+	action := string(m.Action)
+	now := time.Now()
+	var trigger string
+	switch {
+	case action == "oom":
+		trigger = TriggerOOM
+	case strings.HasPrefix(action, "health_status") && strings.HasSuffix(action, TriggerUnhealthy):
+		trigger = TriggerUnhealthy
+	case action == "start":
+		if policy == HealRollback {
+			h.recordImage(m.Actor.ID, name)
+		}
+		return
+	case action == "stop":
+		h.forgetRequestedExit(name, now)
+		return
+	case action == "die":
+		if attrs["exitCode"] == "0" {
+			return
+		}
+		limit, window := crashLoopLimits(attrs)
+		if h.recordExit(name, now, window) < limit {
+			return
+		}
+		trigger = TriggerCrashLoop
+	default:
+		return
+	}
+	if !healsOn(attrs[HealOnLabel], trigger) {
+		return
+	}
+	h.apply(m.Actor.ID, name, trigger, policy, healCooldown(attrs))
+}
+
+// recordExit adds a crash to the container's history and returns how many fall in the window
+func (h *Healer) recordExit(name string, now time.Time, window time.Duration) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var recent []time.Time
+	for _, t := range h.exits[name] {
+		if now.Sub(t) <= window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	h.exits[name] = recent
+	return len(recent)
+}
+
+// forgetRequestedExit drops the exit that a docker stop just caused
+func (h *Healer) forgetRequestedExit(name string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if exits := h.exits[name]; len(exits) > 0 && now.Sub(exits[len(exits)-1]) <= stopAfterDieWindow {
+		h.exits[name] = exits[:len(exits)-1]
+	}
+}
+
+// apply runs the policy unless the container is still cooling down from the last action
+func (h *Healer) apply(id, name, trigger, policy string, cooldown time.Duration) {
+	h.mu.Lock()
+	if last, ok := h.lastAction[name]; ok && time.Since(last) < cooldown {
+		// Report the first suppression per cooldown only, to keep alerts quiet
+		first := !h.suppressed[name]
+		h.suppressed[name] = true
+		h.mu.Unlock()
+		h.Logger.Printf("Heal %s for %s (%s) suppressed: last action %s ago", policy, name, trigger, time.Since(last).Round(time.Second))
+		if first {
+			h.report(HealAction{Container: name, Trigger: trigger, Policy: policy, Suppressed: true,
+				Detail: fmt.Sprintf("cooldown %s", cooldown)})
+		}
+		return
+	}
+	h.lastAction[name] = time.Now()
+	h.suppressed[name] = false
+	// The action's own exits must not count towards the next crash loop
+	delete(h.exits, name)
+	h.mu.Unlock()
+
+	a := HealAction{Container: name, Trigger: trigger, Policy: policy}
+	a.Detail, a.Err = h.run(id, name, policy)
+	h.report(a)
+}
+
+func (h *Healer) report(a HealAction) {
+	if a.Err != nil {
+		h.Logger.Printf("Heal %s for %s (%s) failed: %v", a.Policy, a.Container, a.Trigger, a.Err)
+	} else if !a.Suppressed {
+		h.Logger.Printf("Heal %s for %s (%s): %s", a.Policy, a.Container, a.Trigger, a.Detail)
+	}
+	if h.OnAction != nil {
+		h.OnAction(a)
+	}
+}
+
+func (h *Healer) run(id, name, policy string) (string, error) {
+	switch policy {
+	case HealRestart:
+		return "restarted", h.DockerHelper.RestartContainer(id)
+	case HealStop:
+		return "stopped", h.DockerHelper.StopContainerByID(id)
+	case HealRecreate:
+		state, err := LoadState(h.Conf.StateFile)
+		if err != nil {
+			return "", fmt.Errorf("no saved spec: %w", err)
+		}
+		entry := state.Find(name)
+		if entry == nil {
+			return "", fmt.Errorf("%s is not in %s", name, h.Conf.StateFile)
+		}
+		ref, _, err := resolveRestoreImage(h.Conf, h.DockerHelper, h.Logger, *entry, ImagePolicyExact)
+		if err != nil {
+			return "", err
+		}
+		if _, err := RecreateContainer(h.DockerHelper, *entry, ref, true, h.Logger); err != nil {
+			return "", err
+		}
+		return "re-created from " + h.Conf.StateFile, nil
+	case HealRollback:
+		return h.rollback(id, name)
+	}
+	return "", fmt.Errorf("unknown %s %q", HealPolicyLabel, policy)
+}
+
+// recordRunningImages notes the images of running rollback containers, so an image
+// changed while the healer was down still has its predecessor recorded
+func (h *Healer) recordRunningImages() {
+	containers, err := h.DockerHelper.ListRunningContainers()
+	if err != nil {
+		h.Logger.Println("Failed to list containers for rollback images:", err)
+		return
+	}
+	for _, c := range containers {
+		if c.Labels[HealPolicyLabel] == HealRollback {
+			h.recordImage(c.ID, ContainerName(c))
+		}
+	}
+}
+
+// recordImage remembers the image a rollback container runs on
+func (h *Healer) recordImage(id, name string) {
+	live := CaptureState(h.DockerHelper, []types.Container{{ID: id, Names: []string{"/" + name}}}, h.Logger)
+	if len(live.Containers) == 0 || live.Containers[0].ImageID == "" {
+		return
+	}
+	if err := recordHealImage(h.Conf, live.Containers[0]); err != nil {
+		h.Logger.Printf("Failed to record the image of %s: %v", name, err)
+	}
+}
+
+// rollback re-creates the container with its current spec on the image it ran
+// before, as recorded by the healer or in the state history
+func (h *Healer) rollback(id, name string) (string, error) {
+	live := CaptureState(h.DockerHelper, []types.Container{{ID: id, Names: []string{"/" + name}}}, h.Logger)
+	if len(live.Containers) == 0 || live.Containers[0].Config == nil {
+		return "", fmt.Errorf("cannot inspect %s", name)
+	}
+	current := live.Containers[0]
+	previous, err := PreviousImage(h.Conf, name, current.ImageID)
+	if err != nil {
+		return "", err
+	}
+	ref, imageID, err := resolveRestoreImage(h.Conf, h.DockerHelper, h.Logger, *previous, ImagePolicyExact)
+	if err != nil {
+		return "", err
+	}
+	if _, err := RecreateContainer(h.DockerHelper, current, ref, true, h.Logger); err != nil {
+		return "", err
+	}
+	// The history now holds the image rolled back from as the newest other image;
+	// a later rollback must not pick it again
+	if err := markBadImage(h.Conf, name, current.ImageID); err != nil {
+		h.Logger.Printf("Failed to record %s as a bad image of %s: %v", ShortImageID(current.ImageID), name, err)
+	}
+	return fmt.Sprintf("rolled back from %s to %s (%s)", ShortImageID(current.ImageID), ShortImageID(imageID), ref), nil
+}
+
+// PreviousImage finds the newest image the container ran other than imageID, skipping
+// images the healer already rolled back from. Images the healer recorded come first;
+// the state history, which rotation may have thinned out, is the fallback.
+func PreviousImage(conf *config.Config, name, imageID string) (*StateEntry, error) {
+	bad := map[string]bool{}
+	for _, id := range loadBadImages(conf)[name] {
+		bad[id] = true
+	}
+	for _, img := range loadHealImages(conf)[name] {
+		if img.ImageID != imageID && !bad[img.ImageID] {
+			return &StateEntry{Container: types.Container{Names: []string{"/" + name}, Image: img.Ref, ImageID: img.ImageID},
+				RepoDigest: img.RepoDigest}, nil
+		}
+	}
+	snapshots, err := ListStateSnapshots(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		state, err := LoadState(s.Path)
+		if err != nil {
+			continue
+		}
+		if e := state.Find(name); e != nil && e.ImageID != "" && e.ImageID != imageID && !bad[e.ImageID] {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("no earlier image of %s in the state history", name)
+}
+
+// healImage is one image a rollback container ran on
+type healImage struct {
+	ImageID    string    `json:"image_id"`
+	Ref        string    `json:"ref"`
+	RepoDigest string    `json:"repo_digest,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// healImagesPath records, per container, the images it ran on, newest first
+func healImagesPath(conf *config.Config) string {
+	return filepath.Join(conf.StateDir, "heal_images.json")
+}
+
+func loadHealImages(conf *config.Config) map[string][]healImage {
+	images := map[string][]healImage{}
+	if data, err := os.ReadFile(healImagesPath(conf)); err == nil {
+		json.Unmarshal(data, &images)
+	}
+	return images
+}
+
+// recordHealImage notes the entry's image as the container's newest, unless it already is
+func recordHealImage(conf *config.Config, entry StateEntry) error {
+	images := loadHealImages(conf)
+	name := entry.Name()
+	if list := images[name]; len(list) > 0 && list[0].ImageID == entry.ImageID {
+		return nil
+	}
+	list := []healImage{{ImageID: entry.ImageID, Ref: entry.ImageRef(), RepoDigest: entry.RepoDigest, Since: time.Now()}}
+	for _, img := range images[name] {
+		if img.ImageID != entry.ImageID && len(list) < maxHealImages {
+			list = append(list, img)
+		}
+	}
+	images[name] = list
+	data, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(conf.StateDir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(healImagesPath(conf), data, 0600)
+}
+
+// healBadImagesPath records, per container, the images rollbacks moved away from
+func healBadImagesPath(conf *config.Config) string {
+	return filepath.Join(conf.StateDir, "heal_bad_images.json")
+}
+
+func loadBadImages(conf *config.Config) map[string][]string {
+	bad := map[string][]string{}
+	if data, err := os.ReadFile(healBadImagesPath(conf)); err == nil {
+		json.Unmarshal(data, &bad)
+	}
+	return bad
+}
+
+// markBadImage notes that the container was rolled back from imageID
+func markBadImage(conf *config.Config, name, imageID string) error {
+	bad := loadBadImages(conf)
+	for _, id := range bad[name] {
+		if id == imageID {
+			return nil
+		}
+	}
+	bad[name] = append(bad[name], imageID)
+	data, err := json.Marshal(bad)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(conf.StateDir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(healBadImagesPath(conf), data, 0600)
+}
+
+func crashLoopLimits(labels map[string]string) (int, time.Duration) {
+	limit, window := defaultCrashRestarts, defaultCrashWindow
+	if n, err := strconv.Atoi(labels[HealCrashRestartsLabel]); err == nil && n > 0 {
+		limit = n
+	}
+	if d, err := time.ParseDuration(labels[HealCrashWindowLabel]); err == nil && d > 0 {
+		window = d
+	}
+	return limit, window
+}
+
+func healCooldown(labels map[string]string) time.Duration {
+	if d, err := time.ParseDuration(labels[HealCooldownLabel]); err == nil && d >= 0 {
+		return d
+	}
+	return defaultHealCooldown
+}
+
+func healsOn(spec, trigger string) bool {
+	if strings.TrimSpace(spec) == "" {
+		return true
+	}
+	for _, t := range strings.Split(spec, ",") {
+		if strings.TrimSpace(t) == trigger {
+			return true
+		}
+	}
+	return false
+}
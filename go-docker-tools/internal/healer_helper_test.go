@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+)
+
+// healEvent builds a container event for c carrying its labels, as dockerd sends them
+func healEvent(c *fakeContainer, action string, extra map[string]string) events.Message {
+	attrs := map[string]string{"name": strings.TrimPrefix(c.Name, "/")}
+	for k, v := range c.Config.Labels {
+		attrs[k] = v
+	}
+	for k, v := range extra {
+		attrs[k] = v
+	}
+	return events.Message{Type: events.ContainerEventType, Action: action, Actor: events.Actor{ID: c.ID, Attributes: attrs}}
+}
+
+func newTestHealer(t *testing.T, f *fakeDocker) (*Healer, *[]HealAction) {
+	t.Helper()
+	dir := t.TempDir()
+	conf := &config.Config{StateDir: dir, StateFile: filepath.Join(dir, "state.json")}
+	var actions []HealAction
+	return NewHealer(conf, f.helper(t), testLogger, func(a HealAction) { actions = append(actions, a) }), &actions
+}
+
+func TestHealerTriggers(t *testing.T) {
+	crash := map[string]string{"exitCode": "1"}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		// events are actions with their extra attributes, sent in order
+		events []string
+		// want lists trigger/policy per report, with "suppressed" appended when held back
+		want        []string
+		wantRunning bool
+	}{
+		{name: "not opted in", labels: nil, events: []string{"oom"}},
+		{name: "oom restarts", labels: map[string]string{HealPolicyLabel: HealRestart},
+			events: []string{"oom"}, want: []string{"oom/restart"}, wantRunning: true},
+		{name: "unhealthy", labels: map[string]string{HealPolicyLabel: HealRestart},
+			events: []string{"health_status: healthy", "health_status: unhealthy"}, want: []string{"unhealthy/restart"}, wantRunning: true},
+		{name: "clean exits are not crashes", labels: map[string]string{HealPolicyLabel: HealRestart, HealCrashRestartsLabel: "2"},
+			events: []string{"die:0", "die:0", "die:0"}},
+		{name: "crash loop", labels: map[string]string{HealPolicyLabel: HealStop, HealCrashRestartsLabel: "3"},
+			events: []string{"die", "die", "die"}, want: []string{"crashloop/stop"}},
+		{name: "docker stop is not a crash", labels: map[string]string{HealPolicyLabel: HealRestart, HealCrashRestartsLabel: "2"},
+			events: []string{"die", "stop", "die", "stop", "die", "stop"}},
+		{name: "heal.on filters triggers", labels: map[string]string{HealPolicyLabel: HealRestart, HealOnLabel: "oom"},
+			events: []string{"health_status: unhealthy"}},
+		{name: "cooldown reports the first suppression only", labels: map[string]string{HealPolicyLabel: HealRestart, HealCooldownLabel: "1h"},
+			events: []string{"oom", "oom", "oom"}, want: []string{"oom/restart", "oom/restart suppressed"}, wantRunning: true},
+		{name: "no cooldown", labels: map[string]string{HealPolicyLabel: HealRestart, HealCooldownLabel: "0s"},
+			events: []string{"oom", "oom"}, want: []string{"oom/restart", "oom/restart"}, wantRunning: true},
+		{name: "actions reset the crash count", labels: map[string]string{HealPolicyLabel: HealRestart, HealCrashRestartsLabel: "2", HealCooldownLabel: "0s"},
+			events: []string{"die", "die", "die"}, want: []string{"crashloop/restart"}, wantRunning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeDocker()
+			f.addImage(appImage)
+			c := f.addContainer("web", appImage, &container.Config{Image: "app:1", Labels: tt.labels}, nil, false)
+			h, actions := newTestHealer(t, f)
+			for _, e := range tt.events {
+				action, extra := e, map[string]string(nil)
+				if action == "die" {
+					extra = crash
+				} else if action == "die:0" {
+					action, extra = "die", map[string]string{"exitCode": "0"}
+				}
+				h.handle(healEvent(c, action, extra))
+			}
+			var got []string
+			for _, a := range *actions {
+				if a.Err != nil {
+					t.Fatalf("heal %s failed: %v", a.Policy, a.Err)
+				}
+				s := a.Trigger + "/" + a.Policy
+				if a.Suppressed {
+					s += " suppressed"
+				}
+				got = append(got, s)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("actions = %v, want %v", got, tt.want)
+			}
+			if c.State.Running != tt.wantRunning {
+				t.Errorf("running = %v, want %v", c.State.Running, tt.wantRunning)
+			}
+		})
+	}
+}
+
+func TestHealerRollback(t *testing.T) {
+	newImage := types.ImageInspect{ID: "sha256:" + strings.Repeat("b", 64), RepoTags: []string{"app:2"}}
+	f := newFakeDocker()
+	f.addImage(appImage)
+	f.addImage(newImage)
+	labels := map[string]string{HealPolicyLabel: HealRollback, HealCooldownLabel: "0s"}
+	f.addContainer("web", appImage, &container.Config{Image: "app:1", Labels: labels}, nil, true)
+	h, actions := newTestHealer(t, f)
+
+	// The healer starts while web runs app:1, then web is re-created on app:2.
+	// There is no state history at all, so only the recorded images can help.
+	h.recordRunningImages()
+	c := f.byName("web")
+	c.Image, c.Config.Image = newImage.ID, "app:2"
+	h.handle(healEvent(c, "start", nil))
+
+	h.handle(healEvent(c, "oom", nil))
+	if len(*actions) != 1 || (*actions)[0].Err != nil {
+		t.Fatalf("actions = %+v, want one successful rollback", *actions)
+	}
+	web := f.byName("web")
+	if web == nil || web.Image != appImage.ID || web.Config.Image != "app:1" {
+		t.Fatalf("web = %+v, want it re-created on app:1", web)
+	}
+	if got := loadBadImages(h.Conf)["web"]; !reflect.DeepEqual(got, []string{newImage.ID}) {
+		t.Errorf("bad images = %v, want [%s]", got, newImage.ID)
+	}
+
+	// Back on app:1, the only other recorded image is the bad one
+	h.handle(healEvent(web, "start", nil))
+	h.handle(healEvent(web, "oom", nil))
+	if a := (*actions)[1]; a.Err == nil || !strings.Contains(a.Err.Error(), "no earlier image") {
+		t.Errorf("second rollback error = %v, want no earlier image", a.Err)
+	}
+}
+
+func TestRecordHealImage(t *testing.T) {
+	conf := &config.Config{StateDir: t.TempDir()}
+	entry := func(id string) StateEntry {
+		e := testEntry("web", nil)
+		e.ImageID = id
+		return e
+	}
+	for _, id := range []string{"a", "b", "b", "a", "c"} {
+		if err := recordHealImage(conf, entry(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for _, img := range loadHealImages(conf)["web"] {
+		got = append(got, img.ImageID)
+	}
+	if want := []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded images = %v, want %v", got, want)
+	}
+	for i := 0; i < maxHealImages+5; i++ {
+		recordHealImage(conf, entry(string(rune('d'+i))))
+	}
+	if n := len(loadHealImages(conf)["web"]); n != maxHealImages {
+		t.Errorf("kept %d images, want %d", n, maxHealImages)
+	}
+}
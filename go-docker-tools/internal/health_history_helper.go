@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+// Kinds of HealthRecord
+const (
+	// RecordTransition notes a container whose state, health or restart count changed
+	RecordTransition = "transition"
+	// RecordHeartbeat shows the collector was running when nothing changed
+	RecordHeartbeat = "heartbeat"
+)
+
+// StateRemoved marks a container that disappeared from the daemon
+const StateRemoved = "removed"
+
+// healthHeartbeatInterval bounds how long the history can go without a record while
+// the collector runs; longer gaps count as unobserved time
+const healthHeartbeatInterval = 15 * time.Minute
+
+// HealthRecord is one line of the health history
+type HealthRecord struct {
+	Time      time.Time `json:"t"`
+	Kind      string    `json:"kind"`
+	Container string    `json:"container,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Health    string    `json:"health,omitempty"`
+	Restarts  int       `json:"restarts,omitempty"`
+}
+
+// HealthHistoryPath is the append-only health history under StateDir
+func HealthHistoryPath(conf *config.Config) string {
+	return filepath.Join(conf.StateDir, "health.jsonl")
+}
+
+// AppendHealthRecords adds records to the history file, one JSON object per line
+func AppendHealthRecords(path string, records []HealthRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadHealthHistory returns the records in time order, skipping lines it cannot parse
+// such as one cut short by a crash
+func ReadHealthHistory(path string) ([]HealthRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []HealthRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r HealthRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err == nil && !r.Time.IsZero() {
+			records = append(records, r)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, scanner.Err()
+}
+
+// CompactHealthHistory drops records older than cutoff, keeping the last one of each
+// container before it so the state at the cutoff is still known. It returns the
+// number of records dropped.
+func CompactHealthHistory(path string, cutoff time.Time) (int, error) {
+	records, err := ReadHealthHistory(path)
+	if err != nil {
+		return 0, err
+	}
+	baseline := map[string]int{}
+	for i, r := range records {
+		if !r.Time.Before(cutoff) {
+			break
+		}
+		if r.Kind == RecordTransition && r.Container != "" {
+			baseline[r.Container] = i
+		}
+	}
+	var kept []HealthRecord
+	for i, r := range records {
+		if r.Time.Before(cutoff) {
+			if j, ok := baseline[r.Container]; !ok || j != i || r.State == StateRemoved {
+				continue
+			}
+		}
+		kept = append(kept, r)
+	}
+	dropped := len(records) - len(kept)
+	if dropped == 0 {
+		return 0, nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range kept {
+		if err := enc.Encode(r); err != nil {
+			return 0, err
+		}
+	}
+	return dropped, writeFileAtomic(path, buf.Bytes(), 0600)
+}
+
+// HealthCollector samples every container periodically and records changes,
+// replacing the Bash check_container_health loop
+type HealthCollector struct {
+	Conf         *config.Config
+	DockerHelper *DockerHelper
+	Logger       *log.Logger
+
+	last        map[string]HealthRecord
+	lastWrite   time.Time
+	lastCompact time.Time
+}
+
+// NewHealthCollector creates a collector writing to HealthHistoryPath
+func NewHealthCollector(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger) *HealthCollector {
+	return &HealthCollector{Conf: conf, DockerHelper: dockerHelper, Logger: logger}
+}
+
+// Run samples at the configured interval until ctx is done
+func (c *HealthCollector) Run(ctx context.Context) error {
+	if err := os.MkdirAll(c.Conf.StateDir, 0700); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(c.Conf.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.compact()
+		if err := c.Sample(); err != nil {
+			c.Logger.Println("Health check failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample records every container whose state, health or restart count changed since
+// the previous sample, or a heartbeat when nothing changed for a while
+func (c *HealthCollector) Sample() error {
+	containers, err := c.DockerHelper.ListAllContainers()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	first := c.last == nil
+	if first {
+		c.last = map[string]HealthRecord{}
+	}
+	seen := map[string]bool{}
+	var records []HealthRecord
+	for _, ct := range containers {
+		name := ContainerName(ct)
+		seen[name] = true
+		r := HealthRecord{Time: now, Kind: RecordTransition, Container: name, State: ct.State}
+		if info, err := c.DockerHelper.InspectContainer(ct.ID); err == nil {
+			r.Restarts = info.RestartCount
+			if info.State != nil && info.State.Health != nil {
+				r.Health = info.State.Health.Status
+			}
+		}
+		prev, ok := c.last[name]
+		if first || !ok || prev.State != r.State || prev.Health != r.Health || prev.Restarts != r.Restarts {
+			records = append(records, r)
+			c.last[name] = r
+		}
+	}
+	for name := range c.last {
+		if !seen[name] {
+			records = append(records, HealthRecord{Time: now, Kind: RecordTransition, Container: name, State: StateRemoved})
+			delete(c.last, name)
+		}
+	}
+	if len(records) == 0 && now.Sub(c.lastWrite) >= healthHeartbeatInterval {
+		records = append(records, HealthRecord{Time: now, Kind: RecordHeartbeat})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := AppendHealthRecords(HealthHistoryPath(c.Conf), records); err != nil {
+		return err
+	}
+	c.lastWrite = now
+	c.appendHealthLog(records)
+	return nil
+}
+
+// compact trims the history to HealthHistoryDays, at most once a day
+func (c *HealthCollector) compact() {
+	if c.Conf.HealthHistoryDays <= 0 || time.Since(c.lastCompact) < 24*time.Hour {
+		return
+	}
+	c.lastCompact = time.Now()
+	cutoff := c.lastCompact.AddDate(0, 0, -c.Conf.HealthHistoryDays)
+	n, err := CompactHealthHistory(HealthHistoryPath(c.Conf), cutoff)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		c.Logger.Println("Failed to compact the health history:", err)
+	case n > 0:
+		c.Logger.Printf("Dropped %d health records older than %d days", n, c.Conf.HealthHistoryDays)
+	}
+}
+
+// appendHealthLog keeps the human-readable HEALTH_LOG of the Bash tooling, when set
+func (c *HealthCollector) appendHealthLog(records []HealthRecord) {
+	if c.Conf.HealthLog == "" {
+		return
+	}
+	f, err := os.OpenFile(c.Conf.HealthLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	for _, r := range records {
+		if r.Kind != RecordTransition {
+			continue
+		}
+		health := r.Health
+		if health == "" {
+			health = "N/A"
+		}
+		fmt.Fprintf(f, "%s: %s state: %s health: %s restarts: %d\n", r.Time.Local().Format(time.RFC3339), r.Container, r.State, health, r.Restarts)
+	}
+}
@@ -0,0 +1,413 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+)
+
+// SavedImage is one image export in IMAGE_BACKUP_DIR
+type SavedImage struct {
+	ID          string    `json:"id"`
+	RepoTags    []string  `json:"repo_tags"`
+	RepoDigests []string  `json:"repo_digests,omitempty"`
+	File        string    `json:"file"`
+	Size        int64     `json:"size"`
+	SavedAt     time.Time `json:"saved_at"`
+	Containers  []string  `json:"containers"`
+}
+
+// ImageBackupIndex records every image export kept in IMAGE_BACKUP_DIR
+type ImageBackupIndex struct {
+	Images []*SavedImage `json:"images"`
+}
+
+// ImageSaveOptions controls pacing and rotation of image exports
+type ImageSaveOptions struct {
+	// Delay waits between exports, like the Bash -all-delay mode
+	Delay time.Duration
+	// Throttle limits export speed in bytes per second (0 is unlimited)
+	Throttle int64
+	// Keep is the number of exports kept per image tag (0 keeps all)
+	Keep   int
+	DryRun bool
+	// OCI writes into the shared OCI layout instead of one tarball per image
+	OCI bool
+}
+
+func imageBackupIndexFile(dir string) string {
+	return filepath.Join(dir, "images.json")
+}
+
+// LoadImageBackupIndex reads the image export index (empty if none)
+func LoadImageBackupIndex(dir string) (*ImageBackupIndex, error) {
+	index := &ImageBackupIndex{}
+	data, err := os.ReadFile(imageBackupIndexFile(dir))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func saveImageBackupIndex(dir string, index *ImageBackupIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(imageBackupIndexFile(dir), data, 0600)
+}
+
+// findByID returns the newest export of an image ID whose file still exists
+func (idx *ImageBackupIndex) findByID(id string) *SavedImage {
+	var best *SavedImage
+	for _, img := range idx.Images {
+		if img.ID != id {
+			continue
+		}
+		if _, err := os.Stat(img.File); err != nil {
+			continue
+		}
+		if best == nil || img.SavedAt.After(best.SavedAt) {
+			best = img
+		}
+	}
+	return best
+}
+
+// findByRef returns the newest export tagged with ref
+func (idx *ImageBackupIndex) findByRef(ref string) *SavedImage {
+	var best *SavedImage
+	for _, img := range idx.Images {
+		for _, t := range img.RepoTags {
+			if t != ref && t != ref+":latest" {
+				continue
+			}
+			if _, err := os.Stat(img.File); err != nil {
+				continue
+			}
+			if best == nil || img.SavedAt.After(best.SavedAt) {
+				best = img
+			}
+		}
+	}
+	return best
+}
+
+// imageKey groups exports of the same tag for rotation
+func (img *SavedImage) imageKey() string {
+	if len(img.RepoTags) > 0 {
+		return img.RepoTags[0]
+	}
+	return img.ID
+}
+
+// sanitizeImageName turns a reference into a safe file name component
+func sanitizeImageName(ref string) string {
+	r := strings.NewReplacer("/", "_", ":", "_", "@", "_")
+	return r.Replace(ref)
+}
+
+// ShortImageID trims an image ID to the 12 characters docker shows
+func ShortImageID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// throttledReader caps read throughput at a fixed number of bytes per second
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	expected := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if elapsed := time.Since(t.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+	return n, err
+}
+
+// throttle wraps r when a rate limit is set
+func throttle(r io.Reader, rate int64) io.Reader {
+	if rate <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, rate: rate, start: time.Now()}
+}
+
+// OCIStoreDir is where the layer-deduplicated image store lives
+func OCIStoreDir(conf *config.Config) string {
+	return filepath.Join(conf.ImageBackupDir, "oci")
+}
+
+// SaveContainerImages exports the images used by containers, once per image ID
+func SaveContainerImages(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, containers []types.Container, opts ImageSaveOptions) ([]*SavedImage, error) {
+	dir := conf.ImageBackupDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	index, err := LoadImageBackupIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Group containers by image ID so shared images are exported once
+	var order []string
+	users := map[string][]string{}
+	inspected := map[string]types.ImageInspect{}
+	for _, c := range containers {
+		ref := c.ImageID
+		if ref == "" {
+			ref = c.Image
+		}
+		img, err := dockerHelper.InspectImage(ref)
+		if err != nil {
+			logger.Printf("[WARN] Skipping image %s of %s: %v", c.Image, ContainerName(c), err)
+			continue
+		}
+		if _, ok := inspected[img.ID]; !ok {
+			inspected[img.ID] = img
+			order = append(order, img.ID)
+		}
+		users[img.ID] = append(users[img.ID], ContainerName(c))
+	}
+
+	if opts.OCI {
+		return saveImagesToOCIStore(conf, dockerHelper, logger, order, inspected, users, opts)
+	}
+	var saved []*SavedImage
+	for i, id := range order {
+		img := inspected[id]
+		if existing := index.findByID(id); existing != nil {
+			logger.Printf("Image %s already exported to %s", ShortImageID(id), existing.File)
+			continue
+		}
+		refs := img.RepoTags
+		if len(refs) == 0 {
+			refs = []string{id}
+		}
+		entry := &SavedImage{
+			ID:          id,
+			RepoTags:    img.RepoTags,
+			RepoDigests: img.RepoDigests,
+			SavedAt:     time.Now(),
+			Containers:  users[id],
+		}
+		entry.File = filepath.Join(dir, fmt.Sprintf("%s_%s_%s.tar", sanitizeImageName(entry.imageKey()), ShortImageID(id), entry.SavedAt.Format("20060102T150405")))
+		if opts.DryRun {
+			logger.Printf("[DRY-RUN] Would export image %s to %s", entry.imageKey(), entry.File)
+			saved = append(saved, entry)
+			continue
+		}
+		if i > 0 && opts.Delay > 0 {
+			time.Sleep(opts.Delay)
+		}
+		if err := exportImage(dockerHelper, refs, entry.File, opts.Throttle); err != nil {
+			return saved, fmt.Errorf("failed to export image %s: %w", entry.imageKey(), err)
+		}
+		if fi, err := os.Stat(entry.File); err == nil {
+			entry.Size = fi.Size()
+		}
+		logger.Printf("Exported image %s (%s) to %s", entry.imageKey(), ShortImageID(id), entry.File)
+		index.Images = append(index.Images, entry)
+		saved = append(saved, entry)
+		if err := saveImageBackupIndex(dir, index); err != nil {
+			return saved, err
+		}
+	}
+	if opts.Keep > 0 && !opts.DryRun {
+		rotateImageBackups(index, opts.Keep, logger)
+		if err := saveImageBackupIndex(dir, index); err != nil {
+			return saved, err
+		}
+	}
+	return saved, nil
+}
+
+// exportImage writes a docker-save tarball atomically
+func exportImage(dockerHelper *DockerHelper, refs []string, file string, rate int64) error {
+	body, err := dockerHelper.SaveImages(refs)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	tmp := file + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, throttle(body, rate)); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// saveImagesToOCIStore imports each image into the OCI store, skipping image IDs it already holds
+func saveImagesToOCIStore(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, order []string, inspected map[string]types.ImageInspect, users map[string][]string, opts ImageSaveOptions) ([]*SavedImage, error) {
+	store, err := OpenOCIStore(OCIStoreDir(conf))
+	if err != nil {
+		return nil, err
+	}
+	lock := store.Lock()
+	if !lock.TryLock() {
+		return nil, fmt.Errorf("OCI store %s is in use", store.Dir)
+	}
+	defer lock.Unlock()
+	var saved []*SavedImage
+	for i, id := range order {
+		img := inspected[id]
+		if store.HasImageID(id) {
+			logger.Printf("Image %s already in OCI store", ShortImageID(id))
+			continue
+		}
+		entry := &SavedImage{ID: id, RepoTags: img.RepoTags, RepoDigests: img.RepoDigests, File: store.Dir, SavedAt: time.Now(), Containers: users[id]}
+		if opts.DryRun {
+			logger.Printf("[DRY-RUN] Would add image %s to OCI store %s", entry.imageKey(), store.Dir)
+			saved = append(saved, entry)
+			continue
+		}
+		if i > 0 && opts.Delay > 0 {
+			time.Sleep(opts.Delay)
+		}
+		refs := img.RepoTags
+		if len(refs) == 0 {
+			refs = []string{id}
+		}
+		body, err := dockerHelper.SaveImages(refs)
+		if err != nil {
+			return saved, fmt.Errorf("failed to export image %s: %w", entry.imageKey(), err)
+		}
+		_, err = store.ImportDockerArchive(throttle(body, opts.Throttle), logger)
+		body.Close()
+		if err != nil {
+			return saved, fmt.Errorf("failed to store image %s: %w", entry.imageKey(), err)
+		}
+		logger.Printf("Stored image %s (%s) in OCI store %s", entry.imageKey(), ShortImageID(id), store.Dir)
+		saved = append(saved, entry)
+	}
+	if opts.Keep > 0 && !opts.DryRun {
+		if _, _, err := store.GC(opts.Keep, logger); err != nil {
+			return saved, err
+		}
+	}
+	return saved, nil
+}
+
+// rotateImageBackups keeps the newest keep exports per tag
+func rotateImageBackups(index *ImageBackupIndex, keep int, logger *log.Logger) {
+	groups := map[string][]*SavedImage{}
+	for _, img := range index.Images {
+		groups[img.imageKey()] = append(groups[img.imageKey()], img)
+	}
+	drop := map[*SavedImage]bool{}
+	for _, imgs := range groups {
+		sort.Slice(imgs, func(i, j int) bool { return imgs[i].SavedAt.After(imgs[j].SavedAt) })
+		for _, img := range imgs[min(keep, len(imgs)):] {
+			os.Remove(img.File)
+			logger.Println("Removed old image export:", img.File)
+			drop[img] = true
+		}
+	}
+	kept := index.Images[:0]
+	for _, img := range index.Images {
+		if !drop[img] {
+			kept = append(kept, img)
+		}
+	}
+	index.Images = kept
+}
+
+// LoadImageFromBackup loads the newest export of an image by ID, falling back to its tag
+func LoadImageFromBackup(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, ref, imageID string) error {
+	index, err := LoadImageBackupIndex(conf.ImageBackupDir)
+	if err != nil {
+		return err
+	}
+	img := index.findByID(imageID)
+	if img == nil && ref != "" {
+		img = index.findByRef(ref)
+	}
+	if img == nil {
+		return loadImageFromOCIStore(conf, dockerHelper, logger, ref, imageID)
+	}
+	f, err := os.Open(img.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := dockerHelper.LoadImage(f); err != nil {
+		return err
+	}
+	logger.Printf("Loaded image %s from %s", ref, img.File)
+	return nil
+}
+
+// loadImageFromOCIStore loads an image by ID, or by tag, from the OCI store
+func loadImageFromOCIStore(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, ref, imageID string) error {
+	if _, err := os.Stat(filepath.Join(OCIStoreDir(conf), "index.json")); err != nil {
+		return fmt.Errorf("no exported copy of image %s in %s", ref, conf.ImageBackupDir)
+	}
+	store, err := OpenOCIStore(OCIStoreDir(conf))
+	if err != nil {
+		return err
+	}
+	if imageID != "" {
+		if err := store.LoadImage(dockerHelper, imageID, logger); err == nil {
+			return nil
+		}
+	}
+	return store.LoadImage(dockerHelper, ref, logger)
+}
+
+// EnsureImage makes sure an image is present: it is pulled if missing, and
+// loaded from IMAGE_BACKUP_DIR when the registry cannot be reached
+func EnsureImage(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, ref, imageID string) error {
+	if imageID != "" {
+		if _, err := dockerHelper.InspectImage(imageID); err == nil {
+			return nil
+		}
+	} else if _, err := dockerHelper.InspectImage(ref); err == nil {
+		return nil
+	}
+	if ref != "" && !strings.HasPrefix(ref, "sha256:") {
+		pullErr := dockerHelper.PullImage(ref)
+		if pullErr == nil {
+			if imageID == "" {
+				return nil
+			}
+			if _, err := dockerHelper.InspectImage(imageID); err == nil {
+				return nil
+			}
+		} else {
+			logger.Printf("Pull of %s failed, trying image backups: %v", ref, pullErr)
+		}
+	}
+	return LoadImageFromBackup(conf, dockerHelper, logger, ref, imageID)
+}
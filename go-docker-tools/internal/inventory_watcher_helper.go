@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+)
+
+// InventoryEvents are the container actions that change the inventory
+var InventoryEvents = []string{"create", "start", "stop", "die", "destroy"}
+
+// eventsReconnectDelay is how long the watcher waits before resubscribing after the event stream drops
+const eventsReconnectDelay = 5 * time.Second
+
+// InventoryWatcher keeps the state file and JSON inventory in step with Docker events
+type InventoryWatcher struct {
+	Conf         *config.Config
+	DockerHelper *DockerHelper
+	Logger       *log.Logger
+}
+
+// NewInventoryWatcher creates a watcher for the configured inventory files
+func NewInventoryWatcher(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger) *InventoryWatcher {
+	return &InventoryWatcher{Conf: conf, DockerHelper: dockerHelper, Logger: logger}
+}
+
+// Run rewrites the inventory once, then again after each burst of container
+// events has been quiet for the debounce period. It returns when ctx is done.
+func (w *InventoryWatcher) Run(ctx context.Context) error {
+	w.Refresh()
+	for {
+		msgs, errs := w.DockerHelper.ContainerEvents(ctx, InventoryEvents)
+		w.Logger.Println("Watching Docker container events")
+		if !w.consume(ctx, msgs, errs) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(eventsReconnectDelay):
+		}
+		// Events may have been missed while disconnected
+		w.Refresh()
+	}
+}
+
+// consume handles events until the stream fails (returns true) or ctx ends (returns false)
+func (w *InventoryWatcher) consume(ctx context.Context, msgs <-chan events.Message, errs <-chan error) bool {
+	var timer *time.Timer
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			// A pending update is dropped: at shutdown it would only record
+			// containers that are being stopped
+			if timer != nil {
+				timer.Stop()
+			}
+			return false
+		case m := <-msgs:
+			w.Logger.Printf("Container event: %s %s", m.Action, m.Actor.Attributes["name"])
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(w.Conf.EventDebounce)
+			fire = timer.C
+		case <-fire:
+			timer, fire = nil, nil
+			w.Refresh()
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return false
+			}
+			w.Logger.Println("Docker event stream ended:", err)
+			if timer != nil {
+				timer.Stop()
+			}
+			return true
+		}
+	}
+}
+
+// Refresh captures the running containers and writes the inventory
+func (w *InventoryWatcher) Refresh() {
+	lock := NewLockfileHelper(w.Conf.StateFile + ".lock")
+	if !lock.TryLock() {
+		w.Logger.Println("State file is locked by another save or restore; inventory update skipped")
+		return
+	}
+	defer lock.Unlock()
+	containers, err := w.DockerHelper.ListRunningContainers()
+	if err != nil {
+		w.Logger.Println("Failed to list running containers:", err)
+		return
+	}
+	state := CaptureState(w.DockerHelper, containers, w.Logger)
+	w.keepStoppedByExit(state)
+	CaptureNetworks(w.DockerHelper, state, w.Logger)
+	if err := WriteInventory(w.Conf, state, w.Logger); err != nil {
+		w.Logger.Println("Failed to write inventory:", err)
+		return
+	}
+	w.Logger.Printf("Inventory updated: %d running containers", len(state.Containers))
+}
+
+// exitMarkerFile lists the containers exit stopped, whose saved entries the
+// inventory keeps until they run again
+func exitMarkerFile(conf *config.Config) string {
+	return conf.StateFile + ".exit"
+}
+
+// MarkStoppedByExit records the containers exit is about to stop, so that the
+// daemon does not drop them from the state saved before the exit
+func MarkStoppedByExit(conf *config.Config, names []string) error {
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(exitMarkerFile(conf), data, 0600)
+}
+
+// keepStoppedByExit adds the saved entries of containers stopped by exit that
+// still exist to state. Containers that run again are taken off the marker.
+func (w *InventoryWatcher) keepStoppedByExit(state *SavedState) {
+	data, err := os.ReadFile(exitMarkerFile(w.Conf))
+	if err != nil {
+		return
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		w.Logger.Println("Ignoring unreadable exit marker:", err)
+		os.Remove(exitMarkerFile(w.Conf))
+		return
+	}
+	prev, err := LoadState(w.Conf.StateFile)
+	if err != nil {
+		return
+	}
+	var pending []string
+	for _, name := range names {
+		if state.Find(name) != nil {
+			continue
+		}
+		saved := prev.Find(name)
+		if saved == nil {
+			continue
+		}
+		if _, err := w.DockerHelper.InspectContainer(name); client.IsErrNotFound(err) {
+			continue
+		}
+		state.Containers = append(state.Containers, *saved)
+		pending = append(pending, name)
+	}
+	if len(pending) == 0 {
+		os.Remove(exitMarkerFile(w.Conf))
+	} else if len(pending) < len(names) {
+		if err := MarkStoppedByExit(w.Conf, pending); err != nil {
+			w.Logger.Println("Failed to update the exit marker:", err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+// legacyInventoryEntry is one element of container_details.json as written by
+// add_container_to_json in docker_backup_restore.sh, or by docker_backup_automated.sh,
+// which stores the raw HostConfig.PortBindings as Ports instead of PortDependencies
+type legacyInventoryEntry struct {
+	ContainerName    string
+	ID               string `json:"Id"`
+	Image            string
+	PortDependencies []legacyPort
+	Ports            nat.PortMap
+	Env              []string
+	Volumes          []legacyVolume
+	RestartPolicy    string
+	Network          string
+	LastStatus       string `json:",omitempty"`
+}
+
+type legacyPort struct {
+	ContainerPort string `json:"container_port"`
+	HostPort      string `json:"host_port"`
+	Protocol      string `json:"protocol"`
+}
+
+type legacyVolume struct {
+	HostPath      string `json:"host_path"`
+	ContainerPath string `json:"container_path"`
+}
+
+// ActiveLegacyJSON mirrors get_active_json_file: when the main inventory is
+// missing or empty the newest .bak rotation is used instead, unless noBackup is set
+func ActiveLegacyJSON(mainJSON string, noBackup bool) string {
+	if noBackup || !legacyJSONEmpty(mainJSON) {
+		return mainJSON
+	}
+	baks, _ := filepath.Glob(mainJSON + ".bak*")
+	if len(baks) == 0 {
+		return mainJSON
+	}
+	sort.Slice(baks, func(i, j int) bool {
+		fi, _ := os.Stat(baks[i])
+		fj, _ := os.Stat(baks[j])
+		if fi == nil || fj == nil {
+			return fi != nil
+		}
+		return fi.ModTime().After(fj.ModTime())
+	})
+	return baks[0]
+}
+
+// legacyJSONEmpty reports whether an inventory is missing, blank or an empty list
+func legacyJSONEmpty(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return true
+	}
+	var entries []json.RawMessage
+	if json.Unmarshal(data, &entries) != nil {
+		return len(bytes.TrimSpace(data)) == 0
+	}
+	return len(entries) == 0
+}
+
+// ParseLegacyJSON converts a container_details.json inventory into a state.
+// Both the ContainerName summary format and raw docker inspect arrays are accepted.
+func ParseLegacyJSON(data []byte) (*SavedState, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("not a container inventory: %w", err)
+	}
+	state := &SavedState{Version: StateFormatVersion}
+	for i, item := range raw {
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(item, &keys); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		var entry StateEntry
+		var err error
+		if _, ok := keys["ContainerName"]; ok {
+			entry, err = entryFromInventory(item)
+		} else {
+			entry, err = entryFromInspect(item)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		state.Containers = append(state.Containers, entry)
+	}
+	return state, nil
+}
+
+// hasPortBinding reports whether bindings already holds b
+func hasPortBinding(bindings []nat.PortBinding, b nat.PortBinding) bool {
+	for _, existing := range bindings {
+		if existing == b {
+			return true
+		}
+	}
+	return false
+}
+
+func entryFromInventory(data []byte) (StateEntry, error) {
+	var inv legacyInventoryEntry
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return StateEntry{}, err
+	}
+	name := strings.TrimPrefix(inv.ContainerName, "/")
+	cfg := &container.Config{Image: inv.Image, Env: inv.Env, ExposedPorts: nat.PortSet{}}
+	hostConfig := &container.HostConfig{
+		NetworkMode:   container.NetworkMode(inv.Network),
+		RestartPolicy: container.RestartPolicy{Name: inv.RestartPolicy},
+		PortBindings:  nat.PortMap{},
+	}
+	for _, p := range inv.PortDependencies {
+		port := nat.Port(p.ContainerPort)
+		if !strings.Contains(p.ContainerPort, "/") && p.Protocol != "" {
+			port = nat.Port(p.ContainerPort + "/" + p.Protocol)
+		}
+		cfg.ExposedPorts[port] = struct{}{}
+		if p.HostPort != "" {
+			hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], nat.PortBinding{HostPort: p.HostPort})
+		}
+	}
+	for port, bindings := range inv.Ports {
+		cfg.ExposedPorts[port] = struct{}{}
+		for _, b := range bindings {
+			if b.HostPort != "" && !hasPortBinding(hostConfig.PortBindings[port], b) {
+				hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], b)
+			}
+		}
+	}
+	for _, v := range inv.Volumes {
+		if v.HostPath != "" && v.ContainerPath != "" {
+			hostConfig.Binds = append(hostConfig.Binds, v.HostPath+":"+v.ContainerPath)
+		}
+	}
+	state := inv.LastStatus
+	if state == "" {
+		state = "running"
+	}
+	return StateEntry{
+		Container: types.Container{
+			ID:     inv.ID,
+			Names:  []string{"/" + name},
+			Image:  inv.Image,
+			State:  state,
+			Labels: map[string]string{},
+		},
+		Config:     cfg,
+		HostConfig: hostConfig,
+	}, nil
+}
+
+func entryFromInspect(data []byte) (StateEntry, error) {
+	var info types.ContainerJSON
+	if err := json.Unmarshal(data, &info); err != nil {
+		return StateEntry{}, err
+	}
+	if info.ContainerJSONBase == nil || info.Config == nil {
+		return StateEntry{}, fmt.Errorf("neither an inventory entry nor docker inspect output")
+	}
+	entry := StateEntry{
+		Container: types.Container{
+			ID:      info.ID,
+			Names:   []string{"/" + strings.TrimPrefix(info.Name, "/")},
+			Image:   info.Config.Image,
+			ImageID: info.Image,
+			Labels:  info.Config.Labels,
+		},
+		Config:     info.Config,
+		HostConfig: info.HostConfig,
+	}
+	if info.State != nil {
+		entry.State = info.State.Status
+	}
+	if info.NetworkSettings != nil {
+		entry.NetworkSettings = &types.SummaryNetworkSettings{Networks: info.NetworkSettings.Networks}
+	}
+	return entry, nil
+}
+
+// ParseLegacyList converts the "socket,name" list written by docker-state-saver.sh.
+// Only lines for one of daemonHosts are kept; the rest belong to other daemons.
+func ParseLegacyList(data []byte, daemonHosts []string, logger *log.Logger) *SavedState {
+	state := &SavedState{Version: StateFormatVersion}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		socket, name, ok := strings.Cut(line, ",")
+		if !ok {
+			// Older lists held bare names for the local daemon
+			socket, name = "", line
+		}
+		if socket != "" && !matchesDaemonHost(socket, daemonHosts) {
+			logger.Printf("Skipping %s: it belongs to daemon %s", name, socket)
+			continue
+		}
+		state.Containers = append(state.Containers, StateEntry{
+			Container: types.Container{Names: []string{"/" + strings.TrimPrefix(name, "/")}, State: "running"},
+		})
+	}
+	return state
+}
+
+func matchesDaemonHost(socket string, daemonHosts []string) bool {
+	socket = strings.TrimPrefix(socket, "unix://")
+	for _, h := range daemonHosts {
+		if h != "" && strings.TrimPrefix(h, "unix://") == socket {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAnyState reads a Go state file, a legacy JSON inventory or a legacy
+// socket,name list, detecting the format from the content
+func LoadAnyState(path string, daemonHosts []string, logger *log.Logger) (*SavedState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(trimmed) == 0:
+		return &SavedState{Version: StateFormatVersion}, nil
+	case trimmed[0] == '{':
+		return ParseState(trimmed, path)
+	case trimmed[0] == '[':
+		if isLegacyInventory(trimmed) {
+			return ParseLegacyJSON(trimmed)
+		}
+		return ParseState(trimmed, path)
+	default:
+		return ParseLegacyList(trimmed, daemonHosts, logger), nil
+	}
+}
+
+// isLegacyInventory tells container_details.json apart from a version 1 state
+// file, which is a list of docker ps summaries carrying "Names"
+func isLegacyInventory(data []byte) bool {
+	var raw []map[string]json.RawMessage
+	if json.Unmarshal(data, &raw) != nil || len(raw) == 0 {
+		return false
+	}
+	_, hasNames := raw[0]["Names"]
+	return !hasNames
+}
+
+// MergeStates appends entries from extra whose names are not already in base
+func MergeStates(base, extra *SavedState) *SavedState {
+	for _, e := range extra.Containers {
+		if base.Find(e.Name()) == nil {
+			base.Containers = append(base.Containers, e)
+		}
+	}
+	return base
+}
+
+// WriteLegacyJSON writes state as a container_details.json inventory so the
+// Bash scripts keep working against an inventory maintained by this tool
+func WriteLegacyJSON(path string, state *SavedState) error {
+	inventory := make([]legacyInventoryEntry, 0, len(state.Containers))
+	for _, e := range state.Containers {
+		inv := legacyInventoryEntry{
+			ContainerName:    e.Name(),
+			ID:               e.ID,
+			Image:            e.ImageRef(),
+			PortDependencies: []legacyPort{},
+			Env:              []string{},
+			Volumes:          []legacyVolume{},
+			LastStatus:       e.State,
+		}
+		if e.Config != nil && e.Config.Env != nil {
+			inv.Env = e.Config.Env
+		}
+		if e.HostConfig != nil {
+			inv.RestartPolicy = e.HostConfig.RestartPolicy.Name
+			inv.Network = string(e.HostConfig.NetworkMode)
+			for port, bindings := range e.HostConfig.PortBindings {
+				if len(bindings) == 0 {
+					continue
+				}
+				inv.PortDependencies = append(inv.PortDependencies, legacyPort{
+					ContainerPort: string(port),
+					HostPort:      bindings[0].HostPort,
+					Protocol:      port.Proto(),
+				})
+			}
+			sort.Slice(inv.PortDependencies, func(i, j int) bool {
+				return inv.PortDependencies[i].ContainerPort < inv.PortDependencies[j].ContainerPort
+			})
+		}
+		for _, m := range e.Mounts {
+			inv.Volumes = append(inv.Volumes, legacyVolume{HostPath: m.Source, ContainerPath: m.Destination})
+		}
+		inventory = append(inventory, inv)
+	}
+	data, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// LegacyDaemonHosts lists the sockets that address the daemon this tool talks to
+func LegacyDaemonHosts(conf *config.Config) []string {
+	return []string{conf.DockerHost, conf.SystemDockerSocket, os.Getenv("DOCKER_HOST")}
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestParseLegacyJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantErr    bool
+		wantName   string
+		wantState  string
+		wantImage  string
+		wantPorts  nat.PortMap
+		wantBinds  []string
+		wantPolicy string
+		wantNet    container.NetworkMode
+	}{
+		{
+			name: "inventory entry",
+			data: `[{"ContainerName":"/web","Id":"abc","Image":"nginx:1.25",
+				"PortDependencies":[{"container_port":"80","host_port":"8080","protocol":"tcp"},{"container_port":"53/udp","host_port":"","protocol":"udp"}],
+				"Env":["A=1"],"Volumes":[{"host_path":"/srv/www","container_path":"/usr/share/nginx/html"}],
+				"RestartPolicy":"always","Network":"frontend"}]`,
+			wantName:   "web",
+			wantState:  "running",
+			wantImage:  "nginx:1.25",
+			wantPorts:  nat.PortMap{"80/tcp": {{HostPort: "8080"}}},
+			wantBinds:  []string{"/srv/www:/usr/share/nginx/html"},
+			wantPolicy: "always",
+			wantNet:    "frontend",
+		},
+		{
+			name:       "inventory entry with last status",
+			data:       `[{"ContainerName":"worker","Image":"busybox","LastStatus":"exited","RestartPolicy":"no"}]`,
+			wantName:   "worker",
+			wantState:  "exited",
+			wantImage:  "busybox",
+			wantPorts:  nat.PortMap{},
+			wantPolicy: "no",
+		},
+		{
+			name: "automated backup entry",
+			data: `[{"ContainerName":"proxy","Image":"traefik:3","LastStatus":"running","Env":["A=1"],
+				"Ports":{"80/tcp":[{"HostIp":"","HostPort":"80"}],"443/tcp":[{"HostIp":"127.0.0.1","HostPort":"8443"}],"9000/tcp":null}}]`,
+			wantName:  "proxy",
+			wantState: "running",
+			wantImage: "traefik:3",
+			wantPorts: nat.PortMap{"80/tcp": {{HostPort: "80"}}, "443/tcp": {{HostIP: "127.0.0.1", HostPort: "8443"}}},
+		},
+		{
+			name:      "automated backup entry without bindings",
+			data:      `[{"ContainerName":"worker","Image":"busybox","Ports":null}]`,
+			wantName:  "worker",
+			wantState: "running",
+			wantImage: "busybox",
+			wantPorts: nat.PortMap{},
+		},
+		{
+			name: "both port fields",
+			data: `[{"ContainerName":"web","Image":"nginx",
+				"PortDependencies":[{"container_port":"80","host_port":"8080","protocol":"tcp"}],
+				"Ports":{"80/tcp":[{"HostIp":"","HostPort":"8080"}],"81/tcp":[{"HostIp":"","HostPort":"8081"}]}}]`,
+			wantName:  "web",
+			wantState: "running",
+			wantImage: "nginx",
+			wantPorts: nat.PortMap{"80/tcp": {{HostPort: "8080"}}, "81/tcp": {{HostPort: "8081"}}},
+		},
+		{
+			name: "docker inspect output",
+			data: `[{"Id":"def","Name":"/db","Image":"sha256:1234","State":{"Status":"running"},
+				"Config":{"Image":"postgres:16"},
+				"HostConfig":{"NetworkMode":"bridge","RestartPolicy":{"Name":"unless-stopped"},"PortBindings":{"5432/tcp":[{"HostPort":"5432"}]}}}]`,
+			wantName:   "db",
+			wantState:  "running",
+			wantImage:  "postgres:16",
+			wantPorts:  nat.PortMap{"5432/tcp": {{HostPort: "5432"}}},
+			wantPolicy: "unless-stopped",
+			wantNet:    "bridge",
+		},
+		{name: "not a list", data: `{"ContainerName":"web"}`, wantErr: true},
+		{name: "neither format", data: `[{"Name":"/x"}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := ParseLegacyJSON([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ParseLegacyJSON() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLegacyJSON() error = %v", err)
+			}
+			if len(state.Containers) != 1 {
+				t.Fatalf("got %d containers, want 1", len(state.Containers))
+			}
+			e := state.Containers[0]
+			if e.Name() != tt.wantName || e.State != tt.wantState || e.ImageRef() != tt.wantImage {
+				t.Errorf("got %s %s %s, want %s %s %s", e.Name(), e.State, e.ImageRef(), tt.wantName, tt.wantState, tt.wantImage)
+			}
+			if !reflect.DeepEqual(e.HostConfig.PortBindings, tt.wantPorts) {
+				t.Errorf("port bindings = %v, want %v", e.HostConfig.PortBindings, tt.wantPorts)
+			}
+			if !reflect.DeepEqual(e.HostConfig.Binds, tt.wantBinds) {
+				t.Errorf("binds = %v, want %v", e.HostConfig.Binds, tt.wantBinds)
+			}
+			if e.HostConfig.RestartPolicy.Name != tt.wantPolicy || e.HostConfig.NetworkMode != tt.wantNet {
+				t.Errorf("restart policy %q network %q, want %q %q", e.HostConfig.RestartPolicy.Name, e.HostConfig.NetworkMode, tt.wantPolicy, tt.wantNet)
+			}
+		})
+	}
+}
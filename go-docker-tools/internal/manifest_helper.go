@@ -0,0 +1,434 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest declares the desired containers, networks and volumes of the host
+type Manifest struct {
+	Containers []ManifestContainer `yaml:"containers"`
+	Networks   []ManifestNetwork   `yaml:"networks,omitempty"`
+	Volumes    []ManifestVolume    `yaml:"volumes,omitempty"`
+}
+
+// ManifestContainer is one desired container
+type ManifestContainer struct {
+	Name    string   `yaml:"name"`
+	Image   string   `yaml:"image"`
+	Command []string `yaml:"command,omitempty"`
+	// Ports use docker run syntax: [ip:]host:container[/proto]
+	Ports []string          `yaml:"ports,omitempty"`
+	Env   map[string]string `yaml:"env,omitempty"`
+	// Volumes use docker run syntax: volume-or-host-path:container-path[:ro]
+	Volumes  []string          `yaml:"volumes,omitempty"`
+	Networks []string          `yaml:"networks,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty"`
+	Restart  string            `yaml:"restart,omitempty"`
+	// DependsOn lists containers that must be started first
+	DependsOn []string `yaml:"depends_on,omitempty"`
+}
+
+// ManifestNetwork is a network the manifest's containers use
+type ManifestNetwork struct {
+	Name   string            `yaml:"name"`
+	Driver string            `yaml:"driver,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// ManifestVolume is a named volume the manifest's containers use
+type ManifestVolume struct {
+	Name   string            `yaml:"name"`
+	Driver string            `yaml:"driver,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// ManifestPath returns the configured manifest file
+func ManifestPath(conf *config.Config) string {
+	if conf.ManifestFile != "" {
+		return conf.ManifestFile
+	}
+	return filepath.Join(conf.StateDir, "manifest.yaml")
+}
+
+// LoadManifest reads and validates a manifest file
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// Validate checks names, images, port syntax and the dependency graph
+func (m *Manifest) Validate() error {
+	seen := map[string]bool{}
+	for _, c := range m.Containers {
+		if c.Name == "" {
+			return fmt.Errorf("a container has no name")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("container %s is declared twice", c.Name)
+		}
+		seen[c.Name] = true
+		if c.Image == "" {
+			return fmt.Errorf("container %s has no image", c.Name)
+		}
+		if _, _, err := nat.ParsePortSpecs(c.Ports); err != nil {
+			return fmt.Errorf("container %s: %w", c.Name, err)
+		}
+	}
+	names, deps := m.dependencyGraph()
+	if err := validateDeps(names, deps); err != nil {
+		return err
+	}
+	_, err := TopoSort(names, deps)
+	return err
+}
+
+func (m *Manifest) dependencyGraph() ([]string, map[string][]string) {
+	names := make([]string, 0, len(m.Containers))
+	deps := map[string][]string{}
+	for _, c := range m.Containers {
+		names = append(names, c.Name)
+		deps[c.Name] = c.DependsOn
+	}
+	return names, deps
+}
+
+// StartOrder returns the containers ordered so dependencies start first
+func (m *Manifest) StartOrder() ([]ManifestContainer, error) {
+	names, deps := m.dependencyGraph()
+	order, err := TopoSort(names, deps)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]ManifestContainer{}
+	for _, c := range m.Containers {
+		byName[c.Name] = c
+	}
+	out := make([]ManifestContainer, 0, len(order))
+	for _, n := range order {
+		out = append(out, byName[n])
+	}
+	return out, nil
+}
+
+// Entry converts the declaration into a state entry that RecreateContainer can create
+func (c ManifestContainer) Entry() (StateEntry, error) {
+	exposed, bindings, err := nat.ParsePortSpecs(c.Ports)
+	if err != nil {
+		return StateEntry{}, err
+	}
+	env := make([]string, 0, len(c.Env))
+	for k, v := range c.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	labels := map[string]string{}
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	cfg := &container.Config{
+		Image:        c.Image,
+		Env:          env,
+		Labels:       labels,
+		ExposedPorts: exposed,
+	}
+	if len(c.Command) > 0 {
+		cfg.Cmd = c.Command
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings:  bindings,
+		Binds:         c.Volumes,
+		RestartPolicy: container.RestartPolicy{Name: c.Restart},
+		NetworkMode:   "bridge",
+	}
+	entry := StateEntry{
+		Container: types.Container{
+			Names:  []string{"/" + c.Name},
+			Image:  c.Image,
+			Labels: labels,
+			State:  "running",
+		},
+		Config:     cfg,
+		HostConfig: hostConfig,
+	}
+	if len(c.Networks) > 0 {
+		hostConfig.NetworkMode = container.NetworkMode(c.Networks[0])
+		entry.NetworkSettings = &types.SummaryNetworkSettings{Networks: map[string]*network.EndpointSettings{}}
+		for _, n := range c.Networks {
+			entry.NetworkSettings.Networks[n] = &network.EndpointSettings{}
+		}
+	}
+	return entry, nil
+}
+
+// DesiredState converts the manifest into a state, e.g. as a drift baseline
+func (m *Manifest) DesiredState() (*SavedState, error) {
+	state := &SavedState{Version: StateFormatVersion}
+	for _, c := range m.Containers {
+		entry, err := c.Entry()
+		if err != nil {
+			return nil, fmt.Errorf("container %s: %w", c.Name, err)
+		}
+		state.Containers = append(state.Containers, entry)
+	}
+	return state, nil
+}
+
+// CompareManifestEntry reports how a live container differs from its declaration.
+// Env, labels, mounts and networks only need to include what is declared, since
+// images add their own.
+func CompareManifestEntry(want, have StateEntry) []FieldChange {
+	var fields []FieldChange
+	if normalizeImageRef(want.ImageRef()) != normalizeImageRef(have.ImageRef()) {
+		fields = append(fields, FieldChange{Field: "image", Old: have.ImageRef(), New: want.ImageRef()})
+	}
+	if old, cur := strings.Join(EntryPorts(have), ", "), strings.Join(EntryPorts(want), ", "); old != cur {
+		fields = append(fields, FieldChange{Field: "ports", Old: old, New: cur})
+	}
+	haveEnv := map[string]string{}
+	if have.Config != nil {
+		haveEnv = envMap(have)
+	}
+	var envKeys []string
+	for k, v := range envMap(want) {
+		if hv, ok := haveEnv[k]; !ok || hv != v {
+			envKeys = append(envKeys, k)
+		}
+	}
+	if len(envKeys) > 0 {
+		sort.Strings(envKeys)
+		fields = append(fields, FieldChange{Field: "env", Old: "", New: strings.Join(envKeys, " ")})
+	}
+	if missing := missingItems(EntryMounts(want), EntryMounts(have)); len(missing) > 0 {
+		fields = append(fields, FieldChange{Field: "mounts", Old: strings.Join(EntryMounts(have), ", "), New: strings.Join(EntryMounts(want), ", ")})
+	}
+	var labelKeys []string
+	for k, v := range want.Labels {
+		if have.Labels[k] != v {
+			labelKeys = append(labelKeys, k)
+		}
+	}
+	if len(labelKeys) > 0 {
+		sort.Strings(labelKeys)
+		fields = append(fields, FieldChange{Field: "labels", Old: "", New: strings.Join(labelKeys, " ")})
+	}
+	if missing := missingItems(entryNetworks(want), entryNetworks(have)); len(missing) > 0 {
+		fields = append(fields, FieldChange{Field: "networks", Old: strings.Join(entryNetworks(have), ", "), New: strings.Join(entryNetworks(want), ", ")})
+	}
+	if want.HostConfig != nil && want.HostConfig.RestartPolicy.Name != "" &&
+		(have.HostConfig == nil || have.HostConfig.RestartPolicy.Name != want.HostConfig.RestartPolicy.Name) {
+		old := ""
+		if have.HostConfig != nil {
+			old = have.HostConfig.RestartPolicy.Name
+		}
+		fields = append(fields, FieldChange{Field: "restart", Old: old, New: want.HostConfig.RestartPolicy.Name})
+	}
+	return fields
+}
+
+// normalizeImageRef expands a reference to its full form, so nginx, nginx:latest
+// and docker.io/library/nginx:latest compare equal
+func normalizeImageRef(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+func entryNetworks(e StateEntry) []string {
+	if e.NetworkSettings == nil {
+		return nil
+	}
+	names := make([]string, 0, len(e.NetworkSettings.Networks))
+	for n := range e.NetworkSettings.Networks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// missingItems returns the elements of want not present in have
+func missingItems(want, have []string) []string {
+	present := map[string]bool{}
+	for _, h := range have {
+		present[h] = true
+	}
+	var missing []string
+	for _, w := range want {
+		if !present[w] {
+			missing = append(missing, w)
+		}
+	}
+	return missing
+}
+
+// Kinds of PlanAction
+const (
+	PlanCreateNetwork = "create-network"
+	PlanCreateVolume  = "create-volume"
+	PlanCreate        = "create"
+	PlanRecreate      = "recreate"
+	PlanStart         = "start"
+	PlanUnchanged     = "unchanged"
+)
+
+// PlanAction is one step needed to converge the daemon on the manifest
+type PlanAction struct {
+	Kind   string        `json:"kind"`
+	Name   string        `json:"name"`
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// ManifestPlan lists the steps in the order apply runs them
+type ManifestPlan struct {
+	Actions []PlanAction `json:"actions"`
+	// Unmanaged containers exist on the daemon but not in the manifest; apply leaves them alone
+	Unmanaged []string `json:"unmanaged,omitempty"`
+}
+
+// Changes counts the actions that are not PlanUnchanged
+func (p *ManifestPlan) Changes() int {
+	n := 0
+	for _, a := range p.Actions {
+		if a.Kind != PlanUnchanged {
+			n++
+		}
+	}
+	return n
+}
+
+// PlanManifest compares the manifest with the live daemon
+func PlanManifest(m *Manifest, dockerHelper *DockerHelper, logger *log.Logger) (*ManifestPlan, error) {
+	order, err := m.StartOrder()
+	if err != nil {
+		return nil, err
+	}
+	live, err := CaptureLiveState(dockerHelper, logger)
+	if err != nil {
+		return nil, err
+	}
+	plan := &ManifestPlan{}
+	for _, n := range m.Networks {
+		if _, err := dockerHelper.InspectNetwork(n.Name); client.IsErrNotFound(err) {
+			plan.Actions = append(plan.Actions, PlanAction{Kind: PlanCreateNetwork, Name: n.Name})
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range m.Volumes {
+		if _, err := dockerHelper.InspectVolume(v.Name); client.IsErrNotFound(err) {
+			plan.Actions = append(plan.Actions, PlanAction{Kind: PlanCreateVolume, Name: v.Name})
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	declared := map[string]bool{}
+	for _, c := range order {
+		declared[c.Name] = true
+		want, err := c.Entry()
+		if err != nil {
+			return nil, fmt.Errorf("container %s: %w", c.Name, err)
+		}
+		have := live.Find(c.Name)
+		switch {
+		case have == nil:
+			plan.Actions = append(plan.Actions, PlanAction{Kind: PlanCreate, Name: c.Name})
+		default:
+			if fields := CompareManifestEntry(want, *have); len(fields) > 0 {
+				plan.Actions = append(plan.Actions, PlanAction{Kind: PlanRecreate, Name: c.Name, Fields: fields})
+			} else if have.State != "running" {
+				plan.Actions = append(plan.Actions, PlanAction{Kind: PlanStart, Name: c.Name})
+			} else {
+				plan.Actions = append(plan.Actions, PlanAction{Kind: PlanUnchanged, Name: c.Name})
+			}
+		}
+	}
+	for _, e := range live.Containers {
+		if !declared[e.Name()] {
+			plan.Unmanaged = append(plan.Unmanaged, e.Name())
+		}
+	}
+	sort.Strings(plan.Unmanaged)
+	return plan, nil
+}
+
+// ApplyManifest carries out a plan, stopping at the first failure since later
+// containers may depend on the one that failed. It returns the number of steps done.
+func ApplyManifest(conf *config.Config, m *Manifest, plan *ManifestPlan, dockerHelper *DockerHelper, logger *log.Logger) (int, error) {
+	networks := map[string]ManifestNetwork{}
+	for _, n := range m.Networks {
+		networks[n.Name] = n
+	}
+	volumes := map[string]ManifestVolume{}
+	for _, v := range m.Volumes {
+		volumes[v.Name] = v
+	}
+	containers := map[string]ManifestContainer{}
+	for _, c := range m.Containers {
+		containers[c.Name] = c
+	}
+	done := 0
+	for _, a := range plan.Actions {
+		var err error
+		switch a.Kind {
+		case PlanCreateNetwork:
+			n := networks[a.Name]
+			_, err = dockerHelper.CreateNetwork(n.Name, types.NetworkCreate{Driver: n.Driver, Labels: n.Labels, CheckDuplicate: true})
+		case PlanCreateVolume:
+			v := volumes[a.Name]
+			err = dockerHelper.CreateVolume(volume.CreateOptions{Name: v.Name, Driver: v.Driver, Labels: v.Labels})
+		case PlanCreate, PlanRecreate:
+			err = applyManifestContainer(conf, containers[a.Name], dockerHelper, logger)
+		case PlanStart:
+			err = dockerHelper.StartContainerByID(a.Name)
+		default:
+			continue
+		}
+		if err != nil {
+			return done, fmt.Errorf("%s %s: %w", a.Kind, a.Name, err)
+		}
+		logger.Printf("Applied %s %s", a.Kind, a.Name)
+		done++
+	}
+	return done, nil
+}
+
+func applyManifestContainer(conf *config.Config, c ManifestContainer, dockerHelper *DockerHelper, logger *log.Logger) error {
+	entry, err := c.Entry()
+	if err != nil {
+		return err
+	}
+	if err := EnsureImage(conf, dockerHelper, logger, c.Image, ""); err != nil {
+		return err
+	}
+	_, err = RecreateContainer(dockerHelper, entry, c.Image, true, logger)
+	return err
+}
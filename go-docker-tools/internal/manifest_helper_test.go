@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestCompareManifestEntryImage(t *testing.T) {
+	tests := []struct {
+		want, have string
+		differs    bool
+	}{
+		{want: "nginx", have: "nginx:latest"},
+		{want: "nginx:latest", have: "docker.io/library/nginx"},
+		{want: "docker.io/library/nginx:1.25", have: "nginx:1.25"},
+		{want: "example/app", have: "docker.io/example/app:latest"},
+		{want: "nginx:1.25", have: "nginx:1.27", differs: true},
+		{want: "nginx", have: "ghcr.io/nginx/nginx", differs: true},
+		{want: "localhost:5000/app", have: "localhost:5000/app:latest"},
+		{want: "nginx@sha256:" + strings.Repeat("1", 64), have: "docker.io/library/nginx@sha256:" + strings.Repeat("1", 64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want+" vs "+tt.have, func(t *testing.T) {
+			want := StateEntry{Config: &container.Config{Image: tt.want}}
+			want.Image = tt.want
+			have := StateEntry{Config: &container.Config{Image: tt.have}}
+			have.Image = tt.have
+			fields := CompareManifestEntry(want, have)
+			if differs := len(fields) > 0 && fields[0].Field == "image"; differs != tt.differs {
+				t.Errorf("CompareManifestEntry() = %v, want image difference %v", fields, tt.differs)
+			}
+		})
+	}
+}
+
+func TestPlanApplyManifest(t *testing.T) {
+	nginx := types.ImageInspect{ID: "sha256:" + strings.Repeat("b", 64), RepoTags: []string{"nginx:latest"}}
+	redis := types.ImageInspect{ID: "sha256:" + strings.Repeat("c", 64), RepoTags: []string{"redis:7"}}
+	f := newFakeDocker()
+	f.addImage(appImage)
+	f.addImage(nginx)
+	f.addImage(redis)
+	// Created by hand with short references the manifest spells out in full
+	f.addContainer("web", nginx, &container.Config{Image: "nginx"},
+		&container.HostConfig{PortBindings: nat.PortMap{"80/tcp": {{HostPort: "8080"}}}}, true)
+	f.addContainer("cache", redis, &container.Config{Image: "redis:7", Env: []string{"MODE=lru"}}, nil, true)
+	f.addContainer("worker", appImage, &container.Config{Image: "app:1"}, nil, false)
+	f.addContainer("stray", appImage, &container.Config{Image: "app:1"}, nil, true)
+	dockerHelper := f.helper(t)
+
+	m := &Manifest{
+		Networks: []ManifestNetwork{{Name: "front"}},
+		Volumes:  []ManifestVolume{{Name: "data"}},
+		Containers: []ManifestContainer{
+			{Name: "web", Image: "nginx:latest", Ports: []string{"8080:80"}, DependsOn: []string{"cache"}},
+			{Name: "cache", Image: "docker.io/library/redis:7", Env: map[string]string{"MODE": "lfu"}},
+			{Name: "worker", Image: "app:1"},
+			{Name: "api", Image: "app:1", Volumes: []string{"data:/data"}, DependsOn: []string{"web"}},
+		},
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanManifest(m, dockerHelper, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range plan.Actions {
+		got = append(got, a.Kind+" "+a.Name)
+	}
+	want := []string{
+		"create-network front", "create-volume data",
+		"recreate cache", "unchanged web", "start worker", "create api",
+	}
+	// worker has no dependencies, so only its position relative to the chain is fixed
+	if !sameItems(got, want) || indexOf(got, "recreate cache") > indexOf(got, "unchanged web") || indexOf(got, "unchanged web") > indexOf(got, "create api") {
+		t.Errorf("plan = %v, want %v in dependency order", got, want)
+	}
+	if !reflect.DeepEqual(plan.Unmanaged, []string{"stray"}) {
+		t.Errorf("unmanaged = %v, want [stray]", plan.Unmanaged)
+	}
+	if plan.Changes() != 5 {
+		t.Errorf("Changes() = %d, want 5", plan.Changes())
+	}
+
+	done, err := ApplyManifest(&config.Config{StateDir: t.TempDir()}, m, plan, dockerHelper, testLogger)
+	if err != nil || done != 5 {
+		t.Fatalf("ApplyManifest() = %d, %v, want 5 steps", done, err)
+	}
+	if env := f.byName("cache").Config.Env; !reflect.DeepEqual(env, []string{"MODE=lfu"}) {
+		t.Errorf("cache env = %v, want MODE=lfu", env)
+	}
+	if !f.byName("worker").State.Running || f.byName("stray") == nil {
+		t.Error("worker was not started or stray was touched")
+	}
+	if _, ok := f.networks["front"]; !ok {
+		t.Error("network front was not created")
+	}
+	if _, ok := f.volumes["data"]; !ok {
+		t.Error("volume data was not created")
+	}
+
+	again, err := PlanManifest(m, dockerHelper, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Changes() != 0 {
+		t.Errorf("plan after apply has changes: %+v", again.Actions)
+	}
+}
+
+func sameItems(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]int{}
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		if seen[s]--; seen[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
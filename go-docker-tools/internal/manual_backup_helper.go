@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/FabulaNox/go-docker-tools/config"
 	"github.com/docker/docker/api/types/volume"
@@ -32,49 +33,73 @@ func BackupVolumesToFile(conf *config.Config, dockerHelper *DockerHelper, logger
 	if err != nil {
 		return err
 	}
+	var index []ArchiveFile
 	for _, vol := range volumes.Volumes {
-		volumePath := filepath.Join("/var/lib/docker/volumes", vol.Name, "_data")
-		err = filepath.Walk(volumePath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			header, err := tar.FileInfoHeader(info, "")
+		if err := addVolumeToTar(tarWriter, vol.Name, &index); err != nil {
+			logger.Printf("[ERROR] Failed to tar volume %s: %v", vol.Name, err)
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := WriteArchiveIndex(backupFile, index, nil); err != nil {
+		logger.Printf("[WARN] Failed to write file index for %s: %v", backupFile, err)
+	}
+	logger.Printf("[USER] Manual backup (Go-native) completed: %s", backupFile)
+	return nil
+}
+
+// addVolumeToTar writes a volume's data into the archive as <volume>/_data/...
+// and appends each entry to index
+func addVolumeToTar(tarWriter *tar.Writer, volumeName string, index *[]ArchiveFile) error {
+	volumePath := filepath.Join("/var/lib/docker/volumes", volumeName, "_data")
+	return filepath.Walk(volumePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel("/var/lib/docker/volumes", path)
+		if err != nil {
+			return err
+		}
+		header.Name = relPath
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		*index = append(*index, archiveFileFromHeader("", header))
+		if info.Mode().IsRegular() {
+			file, err := os.Open(path)
 			if err != nil {
 				return err
 			}
-			relPath, err := filepath.Rel("/var/lib/docker/volumes", path)
+			defer file.Close()
+			_, err = io.Copy(tarWriter, file)
 			if err != nil {
 				return err
 			}
-			header.Name = relPath
-			if err := tarWriter.WriteHeader(header); err != nil {
-				return err
-			}
-			if info.Mode().IsRegular() {
-				file, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-				_, err = io.Copy(tarWriter, file)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			logger.Printf("[ERROR] Failed to tar volume %s: %v", vol.Name, err)
-			return err
 		}
-	}
-	logger.Printf("[USER] Manual backup (Go-native) completed: %s", backupFile)
-	return nil
+		return nil
+	})
 }
 
 // RotateManualBackups keeps only the most recent n manual backups
 func RotateManualBackups(dir string, keep int, logger *log.Logger) {
-	files, err := filepath.Glob(filepath.Join(dir, "manual_*.tar.gz"))
+	RotateBackups(dir, "manual_*.tar.gz", keep, logger)
+}
+
+// RotateBackups keeps only the most recent n files in dir matching pattern
+func RotateBackups(dir, pattern string, keep int, logger *log.Logger) {
+	files, err := filepath.Glob(filepath.Join(dir, pattern))
 	if err != nil || len(files) <= keep {
 		return
 	}
@@ -84,6 +109,9 @@ func RotateManualBackups(dir string, keep int, logger *log.Logger) {
 	}
 	var infos []fileInfo
 	for _, f := range files {
+		if strings.HasSuffix(f, ArchiveIndexSuffix) {
+			continue
+		}
 		fi, err := os.Stat(f)
 		if err == nil {
 			infos = append(infos, fileInfo{f, fi.ModTime().Unix()})
@@ -92,6 +120,7 @@ func RotateManualBackups(dir string, keep int, logger *log.Logger) {
 	sort.Slice(infos, func(i, j int) bool { return infos[i].time < infos[j].time })
 	for i := 0; i < len(infos)-keep; i++ {
 		os.Remove(infos[i].path)
-		logger.Println("[USER] Removed old manual backup:", infos[i].path)
+		os.Remove(infos[i].path + ArchiveIndexSuffix)
+		logger.Println("[USER] Removed old backup:", infos[i].path)
 	}
 }
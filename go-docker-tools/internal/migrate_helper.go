@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// DefaultMigrateTimeout bounds the wait for each migrated container to become ready
+const DefaultMigrateTimeout = 2 * time.Minute
+
+// MigrateOptions controls Migrate
+type MigrateOptions struct {
+	// Import holds the renames, port changes and volume drivers applied on the target
+	Import ImportOptions
+	// DigestsOnly lets the target pull the images by digest instead of receiving them
+	DigestsOnly bool
+	// Timeout applies to each container that has to become ready on the target
+	Timeout time.Duration
+	// KeepSource leaves the source containers stopped instead of removing them
+	KeepSource bool
+}
+
+// MigrateResult summarises a migration
+type MigrateResult struct {
+	Manifest   *BundleManifest
+	ImagesSent int
+	Volumes    []VolumeImport
+	Restore    *RestoreResult
+	// RolledBack is set when the target was cleaned up and the source started again
+	RolledBack bool
+	// SourceDown lists source containers that did not start again after a rollback
+	SourceDown []string
+	// SourceKept is set when the source containers were left stopped
+	SourceKept bool
+	// Replaced lists the target containers set aside for Replace until the migration succeeded
+	Replaced []ReplacedContainer
+	// TargetDown lists replaced target containers that could not be put back after a rollback
+	TargetDown []string
+}
+
+// ReplacedContainer is a target container renamed aside to make way for a migrated one
+type ReplacedContainer struct {
+	Name       string
+	ID         string
+	Aside      string
+	WasRunning bool
+}
+
+// Migrate moves the containers of state from source to target, streaming images,
+// volume data and specs between the daemons with no intermediate file. The source
+// containers are stopped before their volumes are copied. Once every container that
+// was running is ready on the target, the source containers are removed, or left
+// stopped with KeepSource. Otherwise what was created on the target is removed, the
+// target containers it replaced are put back, and the source containers are started
+// again. Volumes are never removed on the source.
+func Migrate(conf *config.Config, source, target *DockerHelper, logger *log.Logger, state *SavedState, opts MigrateOptions) (*MigrateResult, error) {
+	m, spec, err := PlanMigration(source, target, state, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultMigrateTimeout
+	}
+	// The local state file and port probes describe the source host, not the target
+	targetConf := *conf
+	targetConf.StateFile = ""
+
+	result := &MigrateResult{Manifest: m}
+	// Images go over while the source is still serving
+	if err := sendImages(&targetConf, source, target, logger, m, result); err != nil {
+		return result, err
+	}
+
+	deps := StartupDeps(state.Containers)
+	var running []StateEntry
+	for _, e := range state.Containers {
+		if e.State == "running" {
+			running = append(running, e)
+		}
+	}
+	if ordered, err := StartupOrder(running); err == nil {
+		running = ordered
+	}
+	for _, r := range StopInReverseOrder(source, running, deps, logger, nil) {
+		if r.Err != nil {
+			result.SourceDown = restartSource(source, running, deps, logger)
+			return result, fmt.Errorf("stop %s on the source: %w", r.Container, r.Err)
+		}
+	}
+
+	rollback := func(cause error) (*MigrateResult, error) {
+		logger.Printf("Migration failed, rolling back: %v", cause)
+		result.TargetDown = cleanTarget(target, result.Restore, result.Volumes, result.Replaced, logger)
+		result.SourceDown = restartSource(source, running, deps, logger)
+		result.RolledBack = true
+		return result, cause
+	}
+	for _, v := range m.Volumes {
+		vi := streamVolume(source, target, logger, v, opts.Import)
+		result.Volumes = append(result.Volumes, vi)
+		if vi.Err != nil {
+			return rollback(vi.Err)
+		}
+	}
+	if opts.Import.Replace {
+		if err := setAsideTarget(target, spec, logger, result); err != nil {
+			return rollback(err)
+		}
+	}
+	// Replaced containers are out of the way, so every container is created anew
+	result.Restore, err = RestoreState(&targetConf, target, logger, spec, RestoreOptions{
+		ImagePolicy: ImagePolicyExact,
+		PortPolicy:  opts.Import.PortPolicy,
+		KeepStopped: true,
+	})
+	if err != nil {
+		return rollback(err)
+	}
+	if n := result.Restore.Failed + result.Restore.Skipped; n > 0 {
+		return rollback(fmt.Errorf("%d containers could not be started on the target", n))
+	}
+	for _, e := range spec.Containers {
+		if e.State != "running" {
+			continue
+		}
+		info, err := target.InspectContainer(e.Name())
+		if err == nil {
+			err = waitContainerReady(target, e, info.ID, opts.Timeout)
+		}
+		if err != nil {
+			return rollback(fmt.Errorf("%s on the target: %w", e.Name(), err))
+		}
+		logger.Printf("Container %s is ready on %s", e.Name(), target.DaemonHost())
+	}
+
+	for _, r := range result.Replaced {
+		if err := target.RemoveContainer(r.ID, true); err != nil {
+			logger.Printf("Failed to remove the replaced container %s from the target: %v", r.Aside, err)
+		}
+	}
+	for _, e := range state.Containers {
+		if opts.KeepSource {
+			// A stopped container with restart=always would come back with the daemon
+			if err := source.SetRestartPolicy(e.ID, container.RestartPolicy{Name: "no"}); err != nil {
+				logger.Printf("Failed to clear the restart policy of %s on the source: %v", e.Name(), err)
+			}
+			continue
+		}
+		if err := source.RemoveContainer(e.ID, false); err != nil {
+			logger.Printf("Failed to remove %s from the source: %v", e.Name(), err)
+		}
+	}
+	result.SourceKept = opts.KeepSource
+	return result, nil
+}
+
+// PlanMigration lists what Migrate would move and returns the containers as they
+// would be created on the target. It fails when target already has containers of
+// those names, unless they are to be replaced, or volumes of those names, unless
+// they are to be used as they are.
+func PlanMigration(source, target *DockerHelper, state *SavedState, opts MigrateOptions) (*BundleManifest, *SavedState, error) {
+	m, err := NewBundleManifest(source, state, opts.DigestsOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	spec, err := cloneState(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := PrepareImport(m, spec, opts.Import); err != nil {
+		return nil, nil, err
+	}
+	if err := checkNameConflicts(target, spec, opts.Import.Replace); err != nil {
+		return nil, nil, err
+	}
+	if err := checkVolumeConflicts(target, m, opts.Import); err != nil {
+		return nil, nil, err
+	}
+	return m, spec, nil
+}
+
+// cloneState deep-copies a state so the target spec can be changed without touching
+// the entries still needed to restart the source
+func cloneState(state *SavedState) (*SavedState, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return ParseState(data, "")
+}
+
+// sendImages streams the images the target lacks from the source, or has the
+// target pull them by digest
+func sendImages(conf *config.Config, source, target *DockerHelper, logger *log.Logger, m *BundleManifest, result *MigrateResult) error {
+	var refs []string
+	for _, img := range m.Images {
+		if _, err := target.InspectImage(img.ID); err == nil {
+			continue
+		}
+		if !m.ImagesIncluded {
+			if err := EnsureImage(conf, target, logger, img.RepoDigest, img.ID); err != nil {
+				return fmt.Errorf("image %s: %w", img.Ref, err)
+			}
+			continue
+		}
+		refs = append(refs, img.Ref)
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	rc, err := source.SaveImages(refs)
+	if err != nil {
+		return fmt.Errorf("save images: %w", err)
+	}
+	defer rc.Close()
+	if err := target.LoadImage(rc); err != nil {
+		return fmt.Errorf("send images: %w", err)
+	}
+	result.ImagesSent = len(refs)
+	logger.Printf("Sent %d images to %s", len(refs), target.DaemonHost())
+	return nil
+}
+
+// streamVolume copies a volume from the source into a new volume on the target
+func streamVolume(source, target *DockerHelper, logger *log.Logger, v BundleVolume, opts ImportOptions) VolumeImport {
+	pr, pw := io.Pipe()
+	sent := make(chan error, 1)
+	go func() {
+		err := ExportVolumeData(source, v.Name, v.Image, pw)
+		pw.CloseWithError(err)
+		sent <- err
+	}()
+	res := importBundleVolume(target, logger, v, pr, opts)
+	// An existing volume is not read; closing stops the copy on the source
+	pr.Close()
+	if err := <-sent; err != nil && res.Err == nil && !res.Existing {
+		res.Err = fmt.Errorf("read volume %s: %w", v.Name, err)
+	}
+	return res
+}
+
+// setAsideTarget stops and renames the target containers that spec replaces, so a
+// rollback can put them back
+func setAsideTarget(target *DockerHelper, spec *SavedState, logger *log.Logger, result *MigrateResult) error {
+	for _, e := range spec.Containers {
+		name := e.Name()
+		existing, err := target.InspectContainer(name)
+		if client.IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r := ReplacedContainer{Name: name, ID: existing.ID, Aside: fmt.Sprintf("%s-replaced-%d", name, time.Now().Unix()),
+			WasRunning: existing.State != nil && existing.State.Running}
+		if r.WasRunning {
+			if err := target.StopContainerByID(r.ID); err != nil {
+				return fmt.Errorf("stop %s on the target: %w", name, err)
+			}
+		}
+		if err := target.RenameContainer(r.ID, r.Aside); err != nil {
+			if r.WasRunning {
+				if serr := target.StartContainerByID(r.ID); serr != nil {
+					logger.Printf("Failed to start %s again on the target: %v", name, serr)
+				}
+			}
+			return fmt.Errorf("rename %s on the target: %w", name, err)
+		}
+		result.Replaced = append(result.Replaced, r)
+		logger.Printf("Set %s aside on the target as %s", name, r.Aside)
+	}
+	return nil
+}
+
+// cleanTarget removes the containers, networks and volumes a failed migration
+// created and puts back the containers it replaced, returning those that could not
+// be. Other containers that were on the target before are left alone.
+func cleanTarget(target *DockerHelper, restore *RestoreResult, volumes []VolumeImport, replaced []ReplacedContainer, logger *log.Logger) []string {
+	if restore != nil {
+		for _, id := range restore.Created {
+			if err := target.RemoveContainer(id, true); err != nil && !client.IsErrNotFound(err) {
+				logger.Printf("Failed to remove container %s from the target: %v", ShortImageID(id), err)
+			}
+		}
+		for _, n := range restore.Networks {
+			if !n.Created {
+				continue
+			}
+			if err := target.RemoveNetwork(n.Name); err != nil && !client.IsErrNotFound(err) {
+				logger.Printf("Failed to remove network %s from the target: %v", n.Name, err)
+			}
+		}
+	}
+	for _, v := range volumes {
+		if v.Existing {
+			continue
+		}
+		if err := target.RemoveVolume(v.Name); err != nil && !client.IsErrNotFound(err) {
+			logger.Printf("Failed to remove volume %s from the target: %v", v.Name, err)
+		}
+	}
+	var down []string
+	for _, r := range replaced {
+		err := target.RenameContainer(r.ID, r.Name)
+		if err == nil && r.WasRunning {
+			err = target.StartContainerByID(r.ID)
+		}
+		if err != nil {
+			logger.Printf("Failed to put back %s (left as %s) on the target: %v", r.Name, r.Aside, err)
+			down = append(down, r.Name)
+		}
+	}
+	return down
+}
+
+// restartSource starts the source containers that were running again, in order, and
+// returns the ones that failed
+func restartSource(source *DockerHelper, running []StateEntry, deps map[string][]string, logger *log.Logger) []string {
+	var down []string
+	for _, r := range StartInOrder(context.Background(), source, running, deps, nil, logger, nil) {
+		if r.Err != nil {
+			logger.Printf("Failed to start %s again on the source: %v", r.Container, r.Err)
+			down = append(down, r.Container)
+		}
+	}
+	return down
+}
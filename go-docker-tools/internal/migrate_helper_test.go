@@ -0,0 +1,337 @@
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
+)
+
+// migrationSource is a daemon running web, on network appnet with volume data, and
+// worker, on network shared, which starts after web
+func migrationSource(t *testing.T) (*fakeDocker, *DockerHelper, *SavedState) {
+	t.Helper()
+	f := newFakeDocker()
+	f.addImage(appImage)
+	f.volumes["data"] = volume.Volume{Name: "data", Driver: "local"}
+	f.volData["data"] = []byte("volume content")
+	for _, n := range []string{"appnet", "shared"} {
+		f.networks[n] = types.NetworkResource{Name: n, ID: n + "-id", Driver: "bridge", Scope: "local"}
+	}
+	web := f.addContainer("web", appImage, &container.Config{Image: "app:1"}, &container.HostConfig{
+		NetworkMode:  "appnet",
+		Binds:        []string{"data:/data"},
+		PortBindings: nat.PortMap{"80/tcp": {{HostPort: "8080"}}},
+	}, true)
+	web.NetworkSettings.Networks["appnet"] = &network.EndpointSettings{}
+	worker := f.addContainer("worker", appImage, &container.Config{Image: "app:1", Labels: map[string]string{AutostartAfterLabel: "web"}},
+		&container.HostConfig{NetworkMode: "shared"}, true)
+	worker.NetworkSettings.Networks["shared"] = &network.EndpointSettings{}
+
+	source := f.helper(t)
+	containers, err := source.ListAllContainers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := CaptureState(source, containers, testLogger)
+	CaptureNetworks(source, state, testLogger)
+	sort.Slice(state.Containers, func(i, j int) bool { return state.Containers[i].Name() < state.Containers[j].Name() })
+	return f, source, state
+}
+
+// migrationTarget is a daemon that already runs keep and has the network shared
+func migrationTarget(t *testing.T) (*fakeDocker, *DockerHelper) {
+	t.Helper()
+	f := newFakeDocker()
+	other := types.ImageInspect{ID: "sha256:" + strings.Repeat("b", 64), RepoTags: []string{"other:1"}}
+	f.addImage(other)
+	f.addContainer("keep", other, &container.Config{Image: "other:1"}, nil, true)
+	f.networks["shared"] = types.NetworkResource{Name: "shared", ID: "shared-id", Driver: "bridge", Scope: "local"}
+	return f, f.helper(t)
+}
+
+// addOldWeb adds a running web of the target's own, on other:1, to be replaced
+func addOldWeb(target *fakeDocker) {
+	target.addContainer("web", target.images["other:1"], &container.Config{Image: "other:1"}, nil, true)
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  MigrateOptions
+		setup func(target *fakeDocker)
+		// wantErr is empty when the migration should succeed
+		wantErr          string
+		wantTarget       []string
+		wantSource       []string
+		wantNetworks     []string
+		wantVolume       bool
+		wantSourceStatus string
+		// check, if set, inspects the target afterwards
+		check func(t *testing.T, target *fakeDocker)
+	}{
+		{
+			name:         "moves containers, images and volume data",
+			wantTarget:   []string{"keep", "web", "worker"},
+			wantNetworks: []string{"appnet", "shared"},
+			wantVolume:   true,
+		},
+		{
+			name:             "keep source leaves the source stopped",
+			opts:             MigrateOptions{KeepSource: true},
+			wantTarget:       []string{"keep", "web", "worker"},
+			wantSource:       []string{"web", "worker"},
+			wantNetworks:     []string{"appnet", "shared"},
+			wantVolume:       true,
+			wantSourceStatus: "exited",
+		},
+		{
+			name: "failed create rolls back",
+			setup: func(target *fakeDocker) {
+				target.failCreate = func(name string, cfg *container.Config) error {
+					if name == "worker" {
+						return errors.New("no space left on device")
+					}
+					return nil
+				}
+			},
+			wantErr:          "could not be started on the target",
+			wantTarget:       []string{"keep"},
+			wantSource:       []string{"web", "worker"},
+			wantNetworks:     []string{"shared"},
+			wantSourceStatus: "running",
+		},
+		{
+			name: "container exiting on the target rolls back",
+			setup: func(target *fakeDocker) {
+				target.onStart = func(c *fakeContainer) *types.ContainerState {
+					if c.Name == "/worker" {
+						return &types.ContainerState{Status: "exited", ExitCode: 3}
+					}
+					return nil
+				}
+			},
+			wantErr:          "worker on the target: container exited with code 3",
+			wantTarget:       []string{"keep"},
+			wantSource:       []string{"web", "worker"},
+			wantNetworks:     []string{"shared"},
+			wantSourceStatus: "running",
+		},
+		{
+			name:         "replace removes the old container once ready",
+			opts:         MigrateOptions{Import: ImportOptions{Replace: true}},
+			setup:        addOldWeb,
+			wantTarget:   []string{"keep", "web", "worker"},
+			wantNetworks: []string{"appnet", "shared"},
+			wantVolume:   true,
+		},
+		{
+			name: "replace puts the old container back on rollback",
+			opts: MigrateOptions{Import: ImportOptions{Replace: true}},
+			setup: func(target *fakeDocker) {
+				addOldWeb(target)
+				target.onStart = func(c *fakeContainer) *types.ContainerState {
+					if c.Name == "/worker" {
+						return &types.ContainerState{Status: "exited", ExitCode: 3}
+					}
+					return nil
+				}
+			},
+			wantErr:          "worker on the target: container exited with code 3",
+			wantTarget:       []string{"keep", "web"},
+			wantSource:       []string{"web", "worker"},
+			wantNetworks:     []string{"shared"},
+			wantSourceStatus: "running",
+			check: func(t *testing.T, target *fakeDocker) {
+				web := target.byName("web")
+				if !web.State.Running || web.Image != target.images["other:1"].ID {
+					t.Errorf("web on the target = %+v, want the old container running again", web.ContainerJSON)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, source, state := migrationSource(t)
+			dst, target := migrationTarget(t)
+			if tt.setup != nil {
+				tt.setup(dst)
+			}
+			tt.opts.Timeout = 10 * time.Millisecond
+			result, err := Migrate(&config.Config{}, source, target, testLogger, state, tt.opts)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Migrate() error = %v, want %q", err, tt.wantErr)
+				}
+				if !result.RolledBack || len(result.SourceDown) > 0 {
+					t.Errorf("rolled back %v, source down %v", result.RolledBack, result.SourceDown)
+				}
+			}
+
+			if got := sortedNames(dst); !reflect.DeepEqual(got, tt.wantTarget) {
+				t.Errorf("target containers = %v, want %v", got, tt.wantTarget)
+			}
+			if got := sortedNames(src); !reflect.DeepEqual(got, tt.wantSource) {
+				t.Errorf("source containers = %v, want %v", got, tt.wantSource)
+			}
+			var networks []string
+			for n := range dst.networks {
+				networks = append(networks, n)
+			}
+			sort.Strings(networks)
+			if !reflect.DeepEqual(networks, tt.wantNetworks) {
+				t.Errorf("target networks = %v, want %v", networks, tt.wantNetworks)
+			}
+			if _, ok := dst.volumes["data"]; ok != tt.wantVolume {
+				t.Errorf("target volume data exists = %v, want %v", ok, tt.wantVolume)
+			}
+			if tt.wantVolume && string(dst.volData["data"]) != "volume content" {
+				t.Errorf("target volume data = %q", dst.volData["data"])
+			}
+			if _, ok := src.volumes["data"]; !ok {
+				t.Error("the source volume was removed")
+			}
+			for _, name := range tt.wantSource {
+				c := src.byName(name)
+				if c.State.Status != tt.wantSourceStatus {
+					t.Errorf("source %s is %s, want %s", name, c.State.Status, tt.wantSourceStatus)
+				}
+				if tt.opts.KeepSource && c.HostConfig.RestartPolicy.Name != "no" {
+					t.Errorf("source %s keeps restart policy %q", name, c.HostConfig.RestartPolicy.Name)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, dst)
+			}
+			if tt.wantErr == "" {
+				if web := dst.byName("web"); web == nil || !web.State.Running || web.Image != appImage.ID {
+					t.Errorf("web on the target = %+v", web)
+				}
+				if result.ImagesSent != 1 {
+					t.Errorf("sent %d images, want 1", result.ImagesSent)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanMigration(t *testing.T) {
+	tests := []struct {
+		name           string
+		opts           MigrateOptions
+		existingVolume bool
+		wantErr        string
+		wantNames      []string
+	}{
+		{name: "name taken on the target", wantErr: "container web already exists"},
+		{name: "volume taken on the target", existingVolume: true, opts: MigrateOptions{Import: ImportOptions{Replace: true}},
+			wantErr: "volume data already exists"},
+		{name: "use existing volumes", existingVolume: true, opts: MigrateOptions{Import: ImportOptions{Replace: true, UseExistingVolumes: true}},
+			wantNames: []string{"web", "worker"}},
+		{name: "renamed volume is free", existingVolume: true,
+			opts:      MigrateOptions{Import: ImportOptions{Replace: true, RenameVolumes: map[string]string{"data": "data2"}}},
+			wantNames: []string{"web", "worker"}},
+		{name: "replace", opts: MigrateOptions{Import: ImportOptions{Replace: true}}, wantNames: []string{"web", "worker"}},
+		{name: "rename", opts: MigrateOptions{Import: ImportOptions{Rename: map[string]string{"web": "web2"}}}, wantNames: []string{"web2", "worker"}},
+		{name: "unknown rename", opts: MigrateOptions{Import: ImportOptions{Rename: map[string]string{"db": "db2"}}}, wantErr: "no container db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, source, state := migrationSource(t)
+			dst, target := migrationTarget(t)
+			dst.addContainer("web", appImage, &container.Config{Image: "app:1"}, nil, false)
+			if tt.existingVolume {
+				dst.volumes["data"] = volume.Volume{Name: "data", Driver: "local"}
+			}
+			m, spec, err := PlanMigration(source, target, state, tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("PlanMigration() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PlanMigration() error = %v", err)
+			}
+			if names := entryNames(spec.Containers); !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("spec containers = %v, want %v", names, tt.wantNames)
+			}
+			if state.Containers[0].Name() != "web" || state.Containers[0].ID == "" {
+				t.Error("PlanMigration() changed the source state")
+			}
+			if len(m.Images) != 1 || len(m.Volumes) != 1 || m.Volumes[0].Name != "data" {
+				t.Errorf("manifest images %v volumes %v", m.Images, m.Volumes)
+			}
+			if !reflect.DeepEqual(m.Networks, []string{"appnet", "shared"}) {
+				t.Errorf("manifest networks = %v", m.Networks)
+			}
+		})
+	}
+}
+
+func TestStreamVolume(t *testing.T) {
+	v := BundleVolume{Name: "data", Driver: "local", DriverOpts: map[string]string{"type": "tmpfs"}, Image: appImage.ID}
+	tests := []struct {
+		name         string
+		opts         ImportOptions
+		existing     bool
+		wantName     string
+		wantDriver   string
+		wantOpts     map[string]string
+		wantExisting bool
+		wantData     string
+		wantErr      string
+	}{
+		{name: "new volume", wantName: "data", wantDriver: "local", wantOpts: map[string]string{"type": "tmpfs"}, wantData: "volume content"},
+		{name: "renamed", opts: ImportOptions{RenameVolumes: map[string]string{"data": "data2"}}, wantName: "data2", wantDriver: "local", wantOpts: map[string]string{"type": "tmpfs"}, wantData: "volume content"},
+		{name: "other driver drops the options", opts: ImportOptions{VolumeDriver: "nfs"}, wantName: "data", wantDriver: "nfs", wantData: "volume content"},
+		{name: "existing volume fails", existing: true, wantName: "data", wantDriver: "local", wantExisting: true, wantData: "old content",
+			wantErr: "volume data already exists"},
+		{name: "existing volume is used as it is", opts: ImportOptions{UseExistingVolumes: true}, existing: true,
+			wantName: "data", wantDriver: "local", wantExisting: true, wantData: "old content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, source, _ := migrationSource(t)
+			dst, target := migrationTarget(t)
+			dst.addImage(appImage)
+			if tt.existing {
+				dst.volumes["data"] = volume.Volume{Name: "data", Driver: "local"}
+				dst.volData["data"] = []byte("old content")
+			}
+			res := streamVolume(source, target, testLogger, v, tt.opts)
+			if tt.wantErr == "" && res.Err != nil || tt.wantErr != "" && (res.Err == nil || !strings.Contains(res.Err.Error(), tt.wantErr)) {
+				t.Fatalf("streamVolume() error = %v, want %q", res.Err, tt.wantErr)
+			}
+			if res.Name != tt.wantName || res.Driver != tt.wantDriver || res.Existing != tt.wantExisting {
+				t.Errorf("streamVolume() = %+v", res)
+			}
+			created := dst.volumes[tt.wantName]
+			if !tt.existing && !reflect.DeepEqual(created.Options, tt.wantOpts) {
+				t.Errorf("volume options = %v, want %v", created.Options, tt.wantOpts)
+			}
+			if got := string(dst.volData[tt.wantName]); got != tt.wantData {
+				t.Errorf("volume data = %q, want %q", got, tt.wantData)
+			}
+			// The copy containers are gone on both sides
+			if names := sortedNames(dst); !reflect.DeepEqual(names, []string{"keep"}) {
+				t.Errorf("target containers = %v", names)
+			}
+			if names := sortedNames(src); !reflect.DeepEqual(names, []string{"web", "worker"}) {
+				t.Errorf("source containers = %v", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// SavedNetwork is a user-defined network the saved containers are attached to
+type SavedNetwork struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver,omitempty"`
+	EnableIPv6 bool              `json:"enable_ipv6,omitempty"`
+	Internal   bool              `json:"internal,omitempty"`
+	Attachable bool              `json:"attachable,omitempty"`
+	IPAM       network.IPAM      `json:"ipam"`
+	Options    map[string]string `json:"options,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// NetworkChange reports a network that restore created or could not match
+type NetworkChange struct {
+	Name    string
+	Created bool
+	Err     error
+}
+
+// builtinNetwork reports the networks every daemon has, which are never saved
+func builtinNetwork(name string) bool {
+	switch name {
+	case "", "default", "bridge", "host", "none":
+		return true
+	}
+	return false
+}
+
+// userNetworks lists the user-defined networks an entry is attached to
+func userNetworks(e StateEntry) []string {
+	var names []string
+	if e.NetworkSettings != nil {
+		for name := range e.NetworkSettings.Networks {
+			if !builtinNetwork(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	if mode := entryNetworkMode(e); !builtinNetwork(mode) && !strings.HasPrefix(mode, "container:") {
+		names = append(names, mode)
+	}
+	return names
+}
+
+// CaptureNetworks records the definitions of the user-defined networks the state's
+// containers use; swarm networks are left to the swarm
+func CaptureNetworks(dockerHelper *DockerHelper, state *SavedState, logger *log.Logger) {
+	seen := map[string]bool{}
+	state.Networks = nil
+	for _, e := range state.Containers {
+		for _, name := range userNetworks(e) {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			n, err := dockerHelper.InspectNetwork(name)
+			if err != nil {
+				logger.Printf("Could not inspect network %s, not saving it: %v", name, err)
+				continue
+			}
+			if n.Scope == "swarm" || n.Ingress {
+				continue
+			}
+			state.Networks = append(state.Networks, savedNetwork(n))
+		}
+	}
+	sort.Slice(state.Networks, func(i, j int) bool { return state.Networks[i].Name < state.Networks[j].Name })
+}
+
+func savedNetwork(n types.NetworkResource) SavedNetwork {
+	return SavedNetwork{
+		Name:       n.Name,
+		Driver:     n.Driver,
+		EnableIPv6: n.EnableIPv6,
+		Internal:   n.Internal,
+		Attachable: n.Attachable,
+		IPAM:       n.IPAM,
+		Options:    n.Options,
+		Labels:     n.Labels,
+	}
+}
+
+// EnsureNetworks creates the saved networks used by entries that the daemon lacks,
+// with their original driver, subnets and options. Existing networks are kept, with
+// a warning when their subnets differ from the saved ones.
+func EnsureNetworks(dockerHelper *DockerHelper, networks []SavedNetwork, entries []StateEntry, logger *log.Logger) []NetworkChange {
+	used := map[string]bool{}
+	pinned := map[string]bool{}
+	for _, e := range entries {
+		for _, name := range userNetworks(e) {
+			used[name] = true
+			if e.NetworkSettings == nil {
+				continue
+			}
+			if ep := e.NetworkSettings.Networks[name]; ep != nil && ep.IPAMConfig != nil &&
+				(ep.IPAMConfig.IPv4Address != "" || ep.IPAMConfig.IPv6Address != "") {
+				pinned[name] = true
+			}
+		}
+	}
+	var changes []NetworkChange
+	for _, n := range networks {
+		if !used[n.Name] {
+			continue
+		}
+		existing, err := dockerHelper.InspectNetwork(n.Name)
+		if err == nil {
+			if want, have := networkSubnets(n.IPAM), networkSubnets(existing.IPAM); want != "" && want != have {
+				changes = append(changes, NetworkChange{Name: n.Name,
+					Err: fmt.Errorf("network %s exists with subnets %q instead of %q; static IPs may not fit", n.Name, have, want)})
+			}
+			continue
+		}
+		if !client.IsErrNotFound(err) {
+			changes = append(changes, NetworkChange{Name: n.Name, Err: err})
+			continue
+		}
+		ipam := n.IPAM
+		create := types.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         n.Driver,
+			EnableIPv6:     n.EnableIPv6,
+			IPAM:           &ipam,
+			Internal:       n.Internal,
+			Attachable:     n.Attachable,
+			Options:        n.Options,
+			Labels:         n.Labels,
+		}
+		_, err = dockerHelper.CreateNetwork(n.Name, create)
+		if err != nil && !pinned[n.Name] && len(ipam.Config) > 0 {
+			// Docker reports the subnets it picked itself too; when no container needs an
+			// address in them, let the daemon choose again rather than fail on an overlap
+			logger.Printf("Could not create network %s on %s (%v), retrying with default addressing", n.Name, networkSubnets(n.IPAM), err)
+			create.IPAM = &network.IPAM{Driver: ipam.Driver, Options: ipam.Options}
+			_, err = dockerHelper.CreateNetwork(n.Name, create)
+		}
+		if err != nil {
+			changes = append(changes, NetworkChange{Name: n.Name, Err: fmt.Errorf("create network %s: %w", n.Name, err)})
+			continue
+		}
+		subnets := networkSubnets(*create.IPAM)
+		if subnets == "" {
+			subnets = "default addressing"
+		}
+		logger.Printf("Created network %s (%s, %s)", n.Name, n.Driver, subnets)
+		changes = append(changes, NetworkChange{Name: n.Name, Created: true})
+	}
+	return changes
+}
+
+// networkSubnets lists the configured subnets, such as "172.28.0.0/16,fd00::/64"
+func networkSubnets(ipam network.IPAM) string {
+	subnets := make([]string, 0, len(ipam.Config))
+	for _, c := range ipam.Config {
+		if c.Subnet != "" {
+			subnets = append(subnets, c.Subnet)
+		}
+	}
+	sort.Strings(subnets)
+	return strings.Join(subnets, ",")
+}
+
+// mergeNetworks keeps the networks of base that captured does not redefine and
+// that containers still use
+func mergeNetworks(base, captured []SavedNetwork, containers []StateEntry) []SavedNetwork {
+	redefined := map[string]bool{}
+	for _, n := range captured {
+		redefined[n.Name] = true
+	}
+	used := map[string]bool{}
+	for _, e := range containers {
+		for _, name := range userNetworks(e) {
+			used[name] = true
+		}
+	}
+	var out []SavedNetwork
+	for _, n := range base {
+		if !redefined[n.Name] && used[n.Name] {
+			out = append(out, n)
+		}
+	}
+	out = append(out, captured...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
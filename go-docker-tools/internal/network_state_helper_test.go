@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// attach connects an entry to networks, pinning an address where one is given
+func attach(e StateEntry, addrs map[string]string) StateEntry {
+	e.NetworkSettings = &types.SummaryNetworkSettings{Networks: map[string]*network.EndpointSettings{}}
+	for name, ip := range addrs {
+		ep := &network.EndpointSettings{}
+		if ip != "" {
+			ep.IPAMConfig = &network.EndpointIPAMConfig{IPv4Address: ip}
+		}
+		e.NetworkSettings.Networks[name] = ep
+	}
+	return e
+}
+
+func subnetIPAM(subnet string) network.IPAM {
+	return network.IPAM{Driver: "default", Config: []network.IPAMConfig{{Subnet: subnet}}}
+}
+
+func TestEnsureNetworks(t *testing.T) {
+	f := newFakeDocker()
+	f.networks["existing"] = types.NetworkResource{Name: "existing", IPAM: subnetIPAM("10.9.0.0/16")}
+	f.networks["taken"] = types.NetworkResource{Name: "taken", IPAM: subnetIPAM("10.1.0.0/16")}
+	dh := f.helper(t)
+
+	saved := []SavedNetwork{
+		{Name: "app", Driver: "bridge", Internal: true, Attachable: true, IPAM: subnetIPAM("172.28.0.0/16"),
+			Options: map[string]string{"com.docker.network.bridge.name": "br-app"}, Labels: map[string]string{"tier": "back"}},
+		{Name: "unused", Driver: "bridge", IPAM: subnetIPAM("172.29.0.0/16")},
+		{Name: "existing", Driver: "bridge", IPAM: subnetIPAM("10.8.0.0/16")},
+		{Name: "floating", Driver: "bridge", IPAM: subnetIPAM("10.1.0.0/16")},
+		{Name: "pinned", Driver: "bridge", IPAM: subnetIPAM("10.1.0.0/16")},
+		{Name: "modenet", Driver: "bridge"},
+	}
+	mode := testEntry("worker", nil)
+	mode.HostConfig = &container.HostConfig{NetworkMode: "modenet"}
+	entries := []StateEntry{
+		attach(testEntry("web", nil), map[string]string{"app": "", "existing": "", "floating": "", "bridge": ""}),
+		attach(testEntry("db", nil), map[string]string{"app": "172.28.0.5", "pinned": "10.1.0.9"}),
+		mode,
+	}
+
+	changes := EnsureNetworks(dh, saved, entries, testLogger)
+	results := map[string]string{}
+	for _, c := range changes {
+		switch {
+		case c.Err != nil:
+			results[c.Name] = c.Err.Error()
+		case c.Created:
+			results[c.Name] = "created"
+		}
+	}
+	want := map[string]string{
+		"app":      "created",
+		"existing": `network existing exists with subnets "10.9.0.0/16" instead of "10.8.0.0/16"`,
+		"floating": "created",
+		"pinned":   "create network pinned",
+		"modenet":  "created",
+	}
+	if len(results) != len(want) {
+		t.Errorf("changes = %v, want %v", results, want)
+	}
+	for name, w := range want {
+		if !strings.HasPrefix(results[name], w) {
+			t.Errorf("%s: got %q, want %q", name, results[name], w)
+		}
+	}
+
+	var names []string
+	for name := range f.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"app", "existing", "floating", "modenet", "taken"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("networks = %v, want %v", names, want)
+	}
+	app := f.networks["app"]
+	if app.Driver != "bridge" || !app.Internal || !app.Attachable || networkSubnets(app.IPAM) != "172.28.0.0/16" ||
+		app.Options["com.docker.network.bridge.name"] != "br-app" || app.Labels["tier"] != "back" {
+		t.Errorf("app = %+v, want the saved definition", app)
+	}
+	// No container needs an address on floating, so the daemon picks its subnet
+	if got := networkSubnets(f.networks["floating"].IPAM); got != "" {
+		t.Errorf("floating subnets = %q, want default addressing", got)
+	}
+	if got := networkSubnets(f.networks["existing"].IPAM); got != "10.9.0.0/16" {
+		t.Errorf("existing was changed to %q", got)
+	}
+
+	// A second run finds everything in place
+	for _, c := range EnsureNetworks(dh, saved[:1], entries, testLogger) {
+		t.Errorf("second run: unexpected change %+v", c)
+	}
+}
@@ -0,0 +1,481 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AnnotationImageID records the Docker image ID (config digest) on index entries
+const AnnotationImageID = "com.godockertools.image.id"
+
+// OCIStore is an OCI image layout directory in which blobs are stored once by digest
+type OCIStore struct {
+	Dir string
+}
+
+// dockerArchiveManifest is one entry of manifest.json in a docker-save tarball
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// storedBlob is a file from a docker-save stream that was written to the blob store
+type storedBlob struct {
+	Digest    digest.Digest
+	Size      int64
+	MediaType string
+}
+
+// OpenOCIStore creates the layout skeleton if needed
+func OpenOCIStore(dir string) (*OCIStore, error) {
+	s := &OCIStore{Dir: dir}
+	if err := os.MkdirAll(filepath.Join(dir, ocispec.ImageBlobsDir, "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	layoutFile := filepath.Join(dir, ocispec.ImageLayoutFile)
+	if _, err := os.Stat(layoutFile); os.IsNotExist(err) {
+		data, _ := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+		if err := os.WriteFile(layoutFile, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ocispec.ImageIndexFile)); os.IsNotExist(err) {
+		if err := s.writeIndex(&ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageIndex}); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Lock returns the lockfile guarding writes to the store
+func (s *OCIStore) Lock() *Lockfile {
+	return NewLockfile(filepath.Join(s.Dir, ".lock"))
+}
+
+func (s *OCIStore) blobPath(d digest.Digest) string {
+	return filepath.Join(s.Dir, ocispec.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// ReadIndex returns the layout's index.json
+func (s *OCIStore) ReadIndex() (*ocispec.Index, error) {
+	data, err := os.ReadFile(filepath.Join(s.Dir, ocispec.ImageIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func (s *OCIStore) writeIndex(index *ocispec.Index) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.Dir, ocispec.ImageIndexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.Dir, ocispec.ImageIndexFile))
+}
+
+// putBlob writes r into the store, keeping an existing blob with the same digest
+func (s *OCIStore) putBlob(r io.Reader) (digest.Digest, int64, bool, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.Dir, ocispec.ImageBlobsDir), ".incoming-")
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	d := digest.NewDigestFromEncoded(digest.SHA256, hex.EncodeToString(h.Sum(nil)))
+	if _, err := os.Stat(s.blobPath(d)); err == nil {
+		return d, n, false, nil
+	}
+	return d, n, true, os.Rename(tmp.Name(), s.blobPath(d))
+}
+
+func (s *OCIStore) putJSON(v interface{}) (digest.Digest, int64, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", 0, err
+	}
+	d, n, _, err := s.putBlob(bytes.NewReader(data))
+	return d, n, err
+}
+
+// isArchiveMetadata reports docker-save files that are kept in memory rather than stored
+func isArchiveMetadata(name string) bool {
+	base := path.Base(name)
+	return name == "manifest.json" || name == "repositories" || name == ocispec.ImageIndexFile ||
+		name == ocispec.ImageLayoutFile || base == "json" || base == "VERSION"
+}
+
+// ImportDockerArchive reads a docker-save tarball and records each tagged image in the store.
+// Layers already present are not written again. It returns the new index entries.
+func (s *OCIStore) ImportDockerArchive(r io.Reader, logger *log.Logger) ([]ocispec.Descriptor, error) {
+	tr := tar.NewReader(r)
+	blobs := map[string]storedBlob{}
+	// links maps entries that point at another entry, as legacy docker save writes
+	// layers shared between images, to the entry they point at
+	links := map[string]string{}
+	var manifestJSON []byte
+	var newBytes, dedupBytes int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+			continue
+		case tar.TypeLink:
+			links[name] = path.Clean(hdr.Linkname)
+			continue
+		default:
+			continue
+		}
+		if isArchiveMetadata(name) {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			if name == "manifest.json" {
+				manifestJSON = data
+			}
+			continue
+		}
+		br := bufio.NewReader(tr)
+		mediaType := ocispec.MediaTypeImageLayer
+		if head, _ := br.Peek(2); len(head) == 2 && head[0] == 0x1f && head[1] == 0x8b {
+			mediaType = ocispec.MediaTypeImageLayerGzip
+		}
+		d, n, created, err := s.putBlob(br)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			newBytes += n
+		} else {
+			dedupBytes += n
+		}
+		blobs[name] = storedBlob{Digest: d, Size: n, MediaType: mediaType}
+	}
+	if manifestJSON == nil {
+		return nil, fmt.Errorf("archive has no manifest.json")
+	}
+	for name := range links {
+		if b, ok := resolveArchiveLink(name, links, blobs); ok {
+			blobs[name] = b
+		}
+	}
+	var entries []dockerArchiveManifest
+	if err := json.Unmarshal(manifestJSON, &entries); err != nil {
+		return nil, fmt.Errorf("invalid manifest.json: %w", err)
+	}
+
+	index, err := s.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var added []ocispec.Descriptor
+	for _, e := range entries {
+		cfg, ok := blobs[path.Clean(e.Config)]
+		if !ok {
+			return nil, fmt.Errorf("config %s missing from archive", e.Config)
+		}
+		m := ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: cfg.Digest, Size: cfg.Size},
+		}
+		for _, l := range e.Layers {
+			layer, ok := blobs[path.Clean(l)]
+			if !ok {
+				return nil, fmt.Errorf("layer %s missing from archive", l)
+			}
+			m.Layers = append(m.Layers, ocispec.Descriptor{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+		}
+		md, msize, err := s.putJSON(m)
+		if err != nil {
+			return nil, err
+		}
+		refs := e.RepoTags
+		if len(refs) == 0 {
+			refs = []string{""}
+		}
+		for _, ref := range refs {
+			desc := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    md,
+				Size:      msize,
+				Annotations: map[string]string{
+					ocispec.AnnotationCreated: now,
+					AnnotationImageID:         cfg.Digest.String(),
+				},
+			}
+			if ref != "" {
+				desc.Annotations[ocispec.AnnotationRefName] = ref
+			}
+			index.Manifests = upsertIndexEntry(index.Manifests, desc)
+			added = append(added, desc)
+		}
+	}
+	if err := s.writeIndex(index); err != nil {
+		return nil, err
+	}
+	logger.Printf("OCI store %s: %d bytes new, %d bytes already stored", s.Dir, newBytes, dedupBytes)
+	return added, nil
+}
+
+// resolveArchiveLink follows a link entry, through other links, to the stored blob
+// of the file it ends at
+func resolveArchiveLink(name string, links map[string]string, blobs map[string]storedBlob) (storedBlob, bool) {
+	for i := 0; i <= len(links); i++ {
+		target, ok := links[name]
+		if !ok {
+			b, ok := blobs[name]
+			return b, ok
+		}
+		name = target
+	}
+	// A cycle of links
+	return storedBlob{}, false
+}
+
+// upsertIndexEntry refreshes an identical ref+manifest entry instead of duplicating it
+func upsertIndexEntry(list []ocispec.Descriptor, desc ocispec.Descriptor) []ocispec.Descriptor {
+	for i, d := range list {
+		if d.Digest == desc.Digest && d.Annotations[ocispec.AnnotationRefName] == desc.Annotations[ocispec.AnnotationRefName] {
+			list[i] = desc
+			return list
+		}
+	}
+	return append(list, desc)
+}
+
+// HasImageID reports whether the store holds an image with the given Docker image ID
+func (s *OCIStore) HasImageID(id string) bool {
+	index, err := s.ReadIndex()
+	if err != nil {
+		return false
+	}
+	for _, d := range index.Manifests {
+		if d.Annotations[AnnotationImageID] == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the newest index entry matching a reference or image ID
+func (s *OCIStore) Find(refOrID string) (*ocispec.Descriptor, error) {
+	index, err := s.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	var best *ocispec.Descriptor
+	for i, d := range index.Manifests {
+		ref := d.Annotations[ocispec.AnnotationRefName]
+		id := d.Annotations[AnnotationImageID]
+		if refOrID != ref && refOrID+":latest" != ref && refOrID != id && "sha256:"+refOrID != id {
+			continue
+		}
+		if best == nil || d.Annotations[ocispec.AnnotationCreated] > best.Annotations[ocispec.AnnotationCreated] {
+			best = &index.Manifests[i]
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("image %s not found in OCI store %s", refOrID, s.Dir)
+	}
+	return best, nil
+}
+
+func (s *OCIStore) readManifest(d digest.Digest) (*ocispec.Manifest, error) {
+	data, err := os.ReadFile(s.blobPath(d))
+	if err != nil {
+		return nil, err
+	}
+	var m ocispec.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// WriteDockerArchive streams one stored image as a docker-load compatible tarball
+func (s *OCIStore) WriteDockerArchive(desc ocispec.Descriptor, w io.Writer) error {
+	m, err := s.readManifest(desc.Digest)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	addBlob := func(d digest.Digest) (string, error) {
+		name := path.Join(ocispec.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+		f, err := os.Open(s.blobPath(d))
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}); err != nil {
+			return "", err
+		}
+		_, err = io.Copy(tw, f)
+		return name, err
+	}
+	entry := dockerArchiveManifest{}
+	if ref := desc.Annotations[ocispec.AnnotationRefName]; ref != "" {
+		entry.RepoTags = []string{ref}
+	}
+	if entry.Config, err = addBlob(m.Config.Digest); err != nil {
+		return err
+	}
+	written := map[digest.Digest]string{}
+	for _, l := range m.Layers {
+		name, ok := written[l.Digest]
+		if !ok {
+			if name, err = addBlob(l.Digest); err != nil {
+				return err
+			}
+			written[l.Digest] = name
+		}
+		entry.Layers = append(entry.Layers, name)
+	}
+	data, err := json.Marshal([]dockerArchiveManifest{entry})
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// LoadImage loads a stored image into the daemon without an intermediate file
+func (s *OCIStore) LoadImage(dockerHelper *DockerHelper, refOrID string, logger *log.Logger) error {
+	desc, err := s.Find(refOrID)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.WriteDockerArchive(*desc, pw))
+	}()
+	if err := dockerHelper.LoadImage(pr); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	logger.Printf("Loaded image %s (%s) from OCI store %s", refOrID, desc.Annotations[AnnotationImageID], s.Dir)
+	return nil
+}
+
+// GC keeps the newest keep entries per reference (0 keeps all) and deletes
+// blobs no remaining manifest refers to. It returns removed entries and blobs.
+func (s *OCIStore) GC(keep int, logger *log.Logger) (int, int, error) {
+	index, err := s.ReadIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	removedEntries := 0
+	if keep > 0 {
+		groups := map[string][]int{}
+		for i, d := range index.Manifests {
+			key := d.Annotations[ocispec.AnnotationRefName]
+			if key == "" {
+				key = d.Annotations[AnnotationImageID]
+			}
+			groups[key] = append(groups[key], i)
+		}
+		drop := map[int]bool{}
+		for _, idxs := range groups {
+			sort.Slice(idxs, func(a, b int) bool {
+				return index.Manifests[idxs[a]].Annotations[ocispec.AnnotationCreated] > index.Manifests[idxs[b]].Annotations[ocispec.AnnotationCreated]
+			})
+			for _, i := range idxs[min(keep, len(idxs)):] {
+				drop[i] = true
+			}
+		}
+		var kept []ocispec.Descriptor
+		for i, d := range index.Manifests {
+			if drop[i] {
+				removedEntries++
+				continue
+			}
+			kept = append(kept, d)
+		}
+		index.Manifests = kept
+		if err := s.writeIndex(index); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	referenced := map[string]bool{}
+	for _, d := range index.Manifests {
+		referenced[d.Digest.Encoded()] = true
+		m, err := s.readManifest(d.Digest)
+		if err != nil {
+			return removedEntries, 0, fmt.Errorf("manifest %s unreadable, refusing to collect: %w", d.Digest, err)
+		}
+		referenced[m.Config.Digest.Encoded()] = true
+		for _, l := range m.Layers {
+			referenced[l.Digest.Encoded()] = true
+		}
+	}
+	blobDir := filepath.Join(s.Dir, ocispec.ImageBlobsDir, "sha256")
+	files, err := os.ReadDir(blobDir)
+	if err != nil {
+		return removedEntries, 0, err
+	}
+	removedBlobs := 0
+	for _, f := range files {
+		if referenced[f.Name()] || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(blobDir, f.Name())); err != nil {
+			return removedEntries, removedBlobs, err
+		}
+		logger.Println("Removed unreferenced blob:", f.Name())
+		removedBlobs++
+	}
+	return removedEntries, removedBlobs, nil
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tarEntry is a file, or with link set a symlink, in a test archive
+type tarEntry struct {
+	name, data, link string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func archiveManifest(t *testing.T, entries ...dockerArchiveManifest) string {
+	t.Helper()
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestOCIStoreImportDockerArchive(t *testing.T) {
+	tests := []struct {
+		name       string
+		entries    func(t *testing.T) []tarEntry
+		wantImages int
+		wantBlobs  int
+		wantErr    string
+	}{
+		{
+			name: "current layout",
+			entries: func(t *testing.T) []tarEntry {
+				return []tarEntry{
+					{name: "blobs/sha256/c1", data: `{"config":1}`},
+					{name: "blobs/sha256/base", data: "base layer"},
+					{name: "blobs/sha256/top", data: "top layer"},
+					{name: "manifest.json", data: archiveManifest(t, dockerArchiveManifest{Config: "blobs/sha256/c1", RepoTags: []string{"app:1"}, Layers: []string{"blobs/sha256/base", "blobs/sha256/top"}})},
+				}
+			},
+			wantImages: 1,
+			wantBlobs:  4,
+		},
+		{
+			name: "legacy layout with a symlinked shared layer",
+			entries: func(t *testing.T) []tarEntry {
+				return []tarEntry{
+					{name: "c1.json", data: `{"config":1}`},
+					{name: "c2.json", data: `{"config":2}`},
+					{name: "aaa/layer.tar", data: "base layer"},
+					{name: "aaa/json", data: "{}"},
+					{name: "bbb/layer.tar", link: "../aaa/layer.tar"},
+					{name: "ccc/layer.tar", link: "../bbb/layer.tar"},
+					{name: "ddd/layer.tar", data: "top layer"},
+					{name: "manifest.json", data: archiveManifest(t,
+						dockerArchiveManifest{Config: "c1.json", RepoTags: []string{"app:1"}, Layers: []string{"aaa/layer.tar"}},
+						dockerArchiveManifest{Config: "c2.json", RepoTags: []string{"tool:1"}, Layers: []string{"ccc/layer.tar", "ddd/layer.tar"}},
+					)},
+				}
+			},
+			wantImages: 2,
+			// two configs, two layers and two manifests
+			wantBlobs: 6,
+		},
+		{
+			name: "missing layer",
+			entries: func(t *testing.T) []tarEntry {
+				return []tarEntry{
+					{name: "c1.json", data: `{}`},
+					{name: "bbb/layer.tar", link: "../aaa/layer.tar"},
+					{name: "manifest.json", data: archiveManifest(t, dockerArchiveManifest{Config: "c1.json", Layers: []string{"bbb/layer.tar"}})},
+				}
+			},
+			wantErr: "layer bbb/layer.tar missing",
+		},
+		{
+			name: "symlink cycle",
+			entries: func(t *testing.T) []tarEntry {
+				return []tarEntry{
+					{name: "c1.json", data: `{}`},
+					{name: "aaa/layer.tar", link: "../bbb/layer.tar"},
+					{name: "bbb/layer.tar", link: "../aaa/layer.tar"},
+					{name: "manifest.json", data: archiveManifest(t, dockerArchiveManifest{Config: "c1.json", Layers: []string{"aaa/layer.tar"}})},
+				}
+			},
+			wantErr: "missing from archive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := OpenOCIStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			added, err := s.ImportDockerArchive(bytes.NewReader(buildTar(t, tt.entries(t))), testLogger)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ImportDockerArchive() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ImportDockerArchive() error = %v", err)
+			}
+			if len(added) != tt.wantImages {
+				t.Errorf("added %d images, want %d", len(added), tt.wantImages)
+			}
+			if n := countBlobs(t, s); n != tt.wantBlobs {
+				t.Errorf("store holds %d blobs, want %d", n, tt.wantBlobs)
+			}
+			// Every stored image reads back as a loadable archive with its layers
+			for _, desc := range added {
+				var buf bytes.Buffer
+				if err := s.WriteDockerArchive(desc, &buf); err != nil {
+					t.Fatalf("WriteDockerArchive() error = %v", err)
+				}
+				m, err := s.readManifest(desc.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, l := range m.Layers {
+					data, err := os.ReadFile(s.blobPath(l.Digest))
+					if err != nil || !strings.HasSuffix(string(data), "layer") {
+						t.Errorf("layer %s = %q, %v", l.Digest, data, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func countBlobs(t *testing.T, s *OCIStore) int {
+	t.Helper()
+	files, err := os.ReadDir(filepath.Join(s.Dir, ocispec.ImageBlobsDir, "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestOCIStoreGC(t *testing.T) {
+	version := func(t *testing.T, n string) []byte {
+		return buildTar(t, []tarEntry{
+			{name: "c" + n + ".json", data: `{"v":` + n + `}`},
+			{name: "base/layer.tar", data: "base layer"},
+			{name: "top" + n + "/layer.tar", data: "top layer " + n},
+			{name: "manifest.json", data: archiveManifest(t, dockerArchiveManifest{
+				Config: "c" + n + ".json", RepoTags: []string{"app:1"}, Layers: []string{"base/layer.tar", "top" + n + "/layer.tar"},
+			})},
+		})
+	}
+	tests := []struct {
+		name        string
+		keep        int
+		wantEntries int
+		wantBlobs   int
+	}{
+		// Each version adds a config, a top layer and a manifest; the base layer is shared
+		{name: "keep all", keep: 0, wantEntries: 0, wantBlobs: 0},
+		{name: "keep newest", keep: 1, wantEntries: 1, wantBlobs: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := OpenOCIStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range []string{"1", "2"} {
+				if _, err := s.ImportDockerArchive(bytes.NewReader(version(t, n)), testLogger); err != nil {
+					t.Fatal(err)
+				}
+				if n != "1" {
+					continue
+				}
+				// Entries are ordered by a creation time with one second
+				// resolution, so backdate the first version
+				index, err := s.ReadIndex()
+				if err != nil {
+					t.Fatal(err)
+				}
+				index.Manifests[0].Annotations[ocispec.AnnotationCreated] = "2000-01-01T00:00:00Z"
+				if err := s.writeIndex(index); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// An unreferenced blob left behind by an interrupted import
+			if err := os.WriteFile(filepath.Join(s.Dir, ocispec.ImageBlobsDir, "sha256", strings.Repeat("0", 64)), []byte("stray"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			before := countBlobs(t, s)
+			entries, blobs, err := s.GC(tt.keep, testLogger)
+			if err != nil {
+				t.Fatalf("GC() error = %v", err)
+			}
+			// the stray blob always goes
+			if entries != tt.wantEntries || blobs != tt.wantBlobs+1 {
+				t.Errorf("GC() removed %d entries and %d blobs, want %d and %d", entries, blobs, tt.wantEntries, tt.wantBlobs+1)
+			}
+			if n := countBlobs(t, s); n != before-blobs {
+				t.Errorf("store holds %d blobs, want %d", n, before-blobs)
+			}
+			desc, err := s.Find("app:1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.WriteDockerArchive(*desc, io.Discard); err != nil {
+				t.Errorf("newest image unreadable after GC: %v", err)
+			}
+		})
+	}
+}
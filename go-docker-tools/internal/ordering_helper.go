@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CycleError reports a dependency cycle, listing the containers on it
+type CycleError struct {
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.Cycle, " -> ")
+}
+
+// TopoSort orders names so every name comes after its dependencies. Names keep
+// their input order where dependencies allow; dependencies on names outside the
+// list are ignored. A cycle is returned as a *CycleError.
+func TopoSort(names []string, deps map[string][]string) ([]string, error) {
+	known := make(map[string]bool, len(names))
+	for _, n := range names {
+		known[n] = true
+	}
+	done := make(map[string]bool, len(names))
+	order := make([]string, 0, len(names))
+	for len(order) < len(names) {
+		progressed := false
+		for _, n := range names {
+			if done[n] {
+				continue
+			}
+			ready := true
+			for _, d := range deps[n] {
+				if known[d] && !done[d] && d != n {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				done[n] = true
+				order = append(order, n)
+				progressed = true
+			}
+		}
+		if !progressed {
+			return nil, &CycleError{Cycle: findCycle(names, deps, done, known)}
+		}
+	}
+	return order, nil
+}
+
+// findCycle walks the unresolved names to extract one cycle for the error message
+func findCycle(names []string, deps map[string][]string, done, known map[string]bool) []string {
+	var start string
+	for _, n := range names {
+		if !done[n] {
+			start = n
+			break
+		}
+	}
+	seen := map[string]int{}
+	var path []string
+	for cur := start; ; {
+		if i, ok := seen[cur]; ok {
+			return append(path[i:], cur)
+		}
+		seen[cur] = len(path)
+		path = append(path, cur)
+		next := ""
+		for _, d := range deps[cur] {
+			if known[d] && !done[d] {
+				next = d
+				break
+			}
+		}
+		if next == "" {
+			// Should not happen: every unresolved name has an unresolved dependency
+			return path
+		}
+		cur = next
+	}
+}
+
+// validateDeps rejects dependencies on names that are not defined
+func validateDeps(names []string, deps map[string][]string) error {
+	known := make(map[string]bool, len(names))
+	for _, n := range names {
+		known[n] = true
+	}
+	for _, n := range names {
+		for _, d := range deps[n] {
+			if !known[d] {
+				return fmt.Errorf("%s depends on unknown container %s", n, d)
+			}
+		}
+	}
+	return nil
+}
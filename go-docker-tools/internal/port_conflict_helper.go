@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+// Port conflict policies for restore and autostart
+const (
+	// PortPolicyFail reports the conflict and leaves the container down
+	PortPolicyFail = "fail"
+	// PortPolicySkip leaves the container down without counting it as a failure
+	PortPolicySkip = "skip"
+	// PortPolicyRemap publishes the port on the next free host port instead
+	PortPolicyRemap = "remap"
+)
+
+// PortRemap records a host port that was moved because the saved one was taken
+type PortRemap struct {
+	Container     string `json:"container,omitempty"`
+	ContainerPort string `json:"container_port"`
+	HostIP        string `json:"host_ip,omitempty"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+}
+
+func (r PortRemap) String() string {
+	return fmt.Sprintf("%s %s -> %s", r.ContainerPort, hostAddr(r.HostIP, r.From), hostAddr(r.HostIP, r.To))
+}
+
+// PortConflict is a requested host port that is already taken
+type PortConflict struct {
+	ContainerPort string
+	HostIP        string
+	HostPort      string
+	// By is the container holding the port, or empty for another process
+	By string
+}
+
+func (c PortConflict) String() string {
+	by := "another process"
+	if c.By != "" {
+		by = "container " + c.By
+	}
+	return fmt.Sprintf("host port %s for %s is in use by %s", hostAddr(c.HostIP, c.HostPort), c.ContainerPort, by)
+}
+
+// PortConflictError is returned when a container cannot start on its host ports
+type PortConflictError struct {
+	Container string
+	Conflicts []PortConflict
+	// Skipped is set under PortPolicySkip
+	Skipped bool
+}
+
+func (e *PortConflictError) Error() string {
+	parts := make([]string, 0, len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		parts = append(parts, c.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// IsPortSkip reports whether err means the container was skipped for a port conflict
+func IsPortSkip(err error) bool {
+	var pe *PortConflictError
+	return errors.As(err, &pe) && pe.Skipped
+}
+
+// ParsePortPolicy validates a policy, defaulting to PortPolicyFail
+func ParsePortPolicy(s string) (string, error) {
+	switch s {
+	case "":
+		return PortPolicyFail, nil
+	case PortPolicyFail, PortPolicySkip, PortPolicyRemap:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown port policy %q (want fail, skip or remap)", s)
+}
+
+type portClaim struct {
+	hostIP string
+	owner  string
+}
+
+// PortGuard checks the host ports of containers about to start against running
+// containers and, when the daemon is local, against listening sockets
+type PortGuard struct {
+	Policy string
+	// probeHost is false for remote daemons, whose host sockets cannot be checked from here
+	probeHost bool
+	claims    map[string][]portClaim
+}
+
+// NewPortGuard records the ports published by running containers
+func NewPortGuard(dockerHelper *DockerHelper, policy string) (*PortGuard, error) {
+	policy, err := ParsePortPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := dockerHelper.ListRunningContainers()
+	if err != nil {
+		return nil, err
+	}
+	host := dockerHelper.DaemonHost()
+	g := &PortGuard{
+		Policy:    policy,
+		probeHost: strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "npipe://"),
+		claims:    map[string][]portClaim{},
+	}
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.PublicPort != 0 {
+				g.claim(p.Type, strconv.Itoa(int(p.PublicPort)), p.IP, ContainerName(c))
+			}
+		}
+	}
+	return g, nil
+}
+
+func portKey(proto, port string) string {
+	return proto + "/" + port
+}
+
+func (g *PortGuard) claim(proto, port, hostIP, owner string) {
+	key := portKey(proto, port)
+	g.claims[key] = append(g.claims[key], portClaim{hostIP: hostIP, owner: owner})
+}
+
+// Conflicts lists the host ports of entry that are taken by something else
+func (g *PortGuard) Conflicts(entry StateEntry) []PortConflict {
+	var conflicts []PortConflict
+	forEachBinding(entry, func(port nat.Port, b nat.PortBinding) {
+		first, last, err := nat.ParsePortRangeToInt(b.HostPort)
+		if err != nil {
+			return
+		}
+		for p := first; p <= last; p++ {
+			if by, taken := g.taken(port.Proto(), strconv.Itoa(p), b.HostIP, entry.Name()); taken {
+				conflicts = append(conflicts, PortConflict{ContainerPort: string(port), HostIP: b.HostIP, HostPort: strconv.Itoa(p), By: by})
+			}
+		}
+	})
+	return conflicts
+}
+
+// Check applies the policy to entry. It returns the entry to start, with its port
+// bindings moved under PortPolicyRemap, and the remaps made.
+func (g *PortGuard) Check(entry StateEntry) (StateEntry, []PortRemap, error) {
+	conflicts := g.Conflicts(entry)
+	if len(conflicts) == 0 {
+		return entry, nil, nil
+	}
+	if g.Policy != PortPolicyRemap {
+		return entry, nil, &PortConflictError{Container: entry.Name(), Conflicts: conflicts, Skipped: g.Policy == PortPolicySkip}
+	}
+	hostConfig := *entry.HostConfig
+	hostConfig.PortBindings = nat.PortMap{}
+	for port, bindings := range entry.HostConfig.PortBindings {
+		hostConfig.PortBindings[port] = append([]nat.PortBinding(nil), bindings...)
+	}
+	var remaps []PortRemap
+	chosen := map[string]bool{}
+	for _, c := range conflicts {
+		port := nat.Port(c.ContainerPort)
+		if hostPortIsRange(hostConfig.PortBindings[port], c.HostIP) {
+			return entry, nil, fmt.Errorf("cannot remap host port range for %s: %s", c.ContainerPort, c)
+		}
+		next, err := g.nextFree(port.Proto(), c.HostIP, c.HostPort, entry.Name(), chosen)
+		if err != nil {
+			return entry, nil, err
+		}
+		chosen[portKey(port.Proto(), next)] = true
+		for i, b := range hostConfig.PortBindings[port] {
+			if b.HostIP == c.HostIP && b.HostPort == c.HostPort {
+				hostConfig.PortBindings[port][i].HostPort = next
+			}
+		}
+		remaps = append(remaps, PortRemap{Container: entry.Name(), ContainerPort: c.ContainerPort, HostIP: c.HostIP, From: c.HostPort, To: next})
+	}
+	entry.HostConfig = &hostConfig
+	return entry, remaps, nil
+}
+
+// Claim marks the host ports of a started container as taken
+func (g *PortGuard) Claim(entry StateEntry) {
+	forEachBinding(entry, func(port nat.Port, b nat.PortBinding) {
+		if b.HostPort != "" {
+			g.claim(port.Proto(), b.HostPort, b.HostIP, entry.Name())
+		}
+	})
+}
+
+// taken reports whether a host port is used by another container or, for a local
+// daemon, by a listening socket. Ports held by the container itself do not count.
+func (g *PortGuard) taken(proto, port, hostIP, self string) (string, bool) {
+	for _, c := range g.claims[portKey(proto, port)] {
+		if !sameHostIP(c.hostIP, hostIP) {
+			continue
+		}
+		if c.owner == self {
+			return "", false
+		}
+		return c.owner, true
+	}
+	if g.probeHost && portInUse(proto, hostIP, port) {
+		return "", true
+	}
+	return "", false
+}
+
+// nextFree searches upwards from the port after from, like the Bash find_next_available_port
+func (g *PortGuard) nextFree(proto, hostIP, from, self string, chosen map[string]bool) (string, error) {
+	start, err := strconv.Atoi(from)
+	if err != nil {
+		return "", err
+	}
+	for p := start + 1; p <= 65535; p++ {
+		port := strconv.Itoa(p)
+		if chosen[portKey(proto, port)] {
+			continue
+		}
+		if _, taken := g.taken(proto, port, hostIP, self); !taken {
+			return port, nil
+		}
+	}
+	return "", fmt.Errorf("no free host port above %s/%s", from, proto)
+}
+
+// portInUse tries to bind the port; only "address in use" counts, since other
+// errors such as a privileged port say nothing about other listeners
+func portInUse(proto, hostIP, port string) bool {
+	addr := net.JoinHostPort(hostIP, port)
+	var err error
+	if proto == "udp" {
+		var pc net.PacketConn
+		if pc, err = net.ListenPacket("udp", addr); err == nil {
+			pc.Close()
+		}
+	} else {
+		var l net.Listener
+		if l, err = net.Listen("tcp", addr); err == nil {
+			l.Close()
+		}
+	}
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// sameHostIP reports whether two bindings would collide; an unspecified address
+// binds every interface
+func sameHostIP(a, b string) bool {
+	if isAnyIP(a) || isAnyIP(b) {
+		return true
+	}
+	return a == b
+}
+
+func isAnyIP(ip string) bool {
+	return ip == "" || ip == "0.0.0.0" || ip == "::"
+}
+
+func hostPortIsRange(bindings []nat.PortBinding, hostIP string) bool {
+	for _, b := range bindings {
+		if b.HostIP == hostIP && strings.Contains(b.HostPort, "-") {
+			return true
+		}
+	}
+	return false
+}
+
+func hostAddr(hostIP, port string) string {
+	if isAnyIP(hostIP) {
+		return port
+	}
+	return net.JoinHostPort(hostIP, port)
+}
+
+// forEachBinding visits the host port bindings of entry in a stable order
+func forEachBinding(entry StateEntry, fn func(nat.Port, nat.PortBinding)) {
+	if entry.HostConfig == nil || entry.HostConfig.NetworkMode == container.NetworkMode("host") {
+		return
+	}
+	ports := make([]string, 0, len(entry.HostConfig.PortBindings))
+	for p := range entry.HostConfig.PortBindings {
+		ports = append(ports, string(p))
+	}
+	sort.Strings(ports)
+	for _, p := range ports {
+		for _, b := range entry.HostConfig.PortBindings[nat.Port(p)] {
+			if b.HostPort != "" {
+				fn(nat.Port(p), b)
+			}
+		}
+	}
+}
+
+// RecordPortRemaps notes remaps on the matching entries of the state file, so the
+// ports a container asked for are not forgotten
+func RecordPortRemaps(conf *config.Config, remaps []PortRemap, logger *log.Logger) error {
+	if len(remaps) == 0 || conf.StateFile == "" {
+		return nil
+	}
+	state, err := LoadState(conf.StateFile)
+	if err != nil {
+		return err
+	}
+	for _, r := range remaps {
+		entry := state.Find(r.Container)
+		if entry == nil {
+			continue
+		}
+		entry.addPortRemap(r)
+	}
+	logger.Printf("Recorded %d port remaps in %s", len(remaps), conf.StateFile)
+	return WriteState(conf.StateFile, state)
+}
+
+// addPortRemap applies a remap to the saved bindings, keeping the originally
+// requested port when the container is remapped again
+func (e *StateEntry) addPortRemap(r PortRemap) {
+	r.Container = ""
+	if e.HostConfig != nil {
+		for i, b := range e.HostConfig.PortBindings[nat.Port(r.ContainerPort)] {
+			if b.HostIP == r.HostIP && b.HostPort == r.From {
+				e.HostConfig.PortBindings[nat.Port(r.ContainerPort)][i].HostPort = r.To
+			}
+		}
+	}
+	for i, old := range e.PortRemaps {
+		if old.ContainerPort == r.ContainerPort && old.HostIP == r.HostIP && old.To == r.From {
+			e.PortRemaps[i].To = r.To
+			return
+		}
+	}
+	e.PortRemaps = append(e.PortRemaps, r)
+}
+
+// carryPortRemaps keeps the remaps recorded in prev for entries that still publish
+// the remapped port
+func carryPortRemaps(prev, state *SavedState) {
+	for i := range state.Containers {
+		e := &state.Containers[i]
+		old := prev.Find(e.Name())
+		if old == nil || len(e.PortRemaps) > 0 || e.HostConfig == nil {
+			continue
+		}
+		for _, r := range old.PortRemaps {
+			for _, b := range e.HostConfig.PortBindings[nat.Port(r.ContainerPort)] {
+				if b.HostIP == r.HostIP && b.HostPort == r.To {
+					e.PortRemaps = append(e.PortRemaps, r)
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+func portEntry(name string, bindings nat.PortMap) StateEntry {
+	return StateEntry{
+		Container:  types.Container{Names: []string{"/" + name}},
+		HostConfig: &container.HostConfig{PortBindings: bindings},
+	}
+}
+
+func TestPortGuardCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		entry  StateEntry
+		// wantErr is "", "conflict" or "skip"
+		wantErr    string
+		wantRemaps []PortRemap
+		wantPorts  nat.PortMap
+	}{
+		{
+			name:   "free port",
+			policy: PortPolicyFail,
+			entry:  portEntry("web", nat.PortMap{"80/tcp": {{HostPort: "9000"}}}),
+		},
+		{
+			name:    "taken port fails",
+			policy:  PortPolicyFail,
+			entry:   portEntry("web", nat.PortMap{"80/tcp": {{HostPort: "8080"}}}),
+			wantErr: "conflict",
+		},
+		{
+			name:    "taken port skips",
+			policy:  PortPolicySkip,
+			entry:   portEntry("web", nat.PortMap{"80/tcp": {{HostPort: "8080"}}}),
+			wantErr: "skip",
+		},
+		{
+			name:   "other protocol is free",
+			policy: PortPolicyFail,
+			entry:  portEntry("dns", nat.PortMap{"53/udp": {{HostPort: "8080"}}}),
+		},
+		{
+			name:   "other host address is free",
+			policy: PortPolicyFail,
+			entry:  portEntry("web", nat.PortMap{"80/tcp": {{HostIP: "127.0.0.2", HostPort: "8443"}}}),
+		},
+		{
+			name:    "any address collides with a specific one",
+			policy:  PortPolicyFail,
+			entry:   portEntry("web", nat.PortMap{"443/tcp": {{HostPort: "8443"}}}),
+			wantErr: "conflict",
+		},
+		{
+			name:   "own port is not a conflict",
+			policy: PortPolicyFail,
+			entry:  portEntry("proxy", nat.PortMap{"80/tcp": {{HostPort: "8080"}}}),
+		},
+		{
+			name:       "remap skips taken ports",
+			policy:     PortPolicyRemap,
+			entry:      portEntry("web", nat.PortMap{"80/tcp": {{HostPort: "8080"}}}),
+			wantRemaps: []PortRemap{{Container: "web", ContainerPort: "80/tcp", From: "8080", To: "8082"}},
+			wantPorts:  nat.PortMap{"80/tcp": {{HostPort: "8082"}}},
+		},
+		{
+			name:    "range cannot be remapped",
+			policy:  PortPolicyRemap,
+			entry:   portEntry("web", nat.PortMap{"80/tcp": {{HostPort: "8080-8081"}}}),
+			wantErr: "conflict",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &PortGuard{Policy: tt.policy, claims: map[string][]portClaim{}}
+			g.claim("tcp", "8080", "", "proxy")
+			g.claim("tcp", "8081", "0.0.0.0", "cache")
+			g.claim("tcp", "8443", "127.0.0.1", "tls")
+			original := tt.entry.HostConfig.PortBindings
+			got, remaps, err := g.Check(tt.entry)
+			switch tt.wantErr {
+			case "":
+				if err != nil {
+					t.Fatalf("Check() error = %v", err)
+				}
+			case "skip":
+				if !IsPortSkip(err) {
+					t.Fatalf("Check() error = %v, want a skip", err)
+				}
+				return
+			default:
+				if err == nil || IsPortSkip(err) {
+					t.Fatalf("Check() error = %v, want a conflict", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(remaps, tt.wantRemaps) {
+				t.Errorf("remaps = %v, want %v", remaps, tt.wantRemaps)
+			}
+			want := tt.wantPorts
+			if want == nil {
+				want = original
+			}
+			if !reflect.DeepEqual(got.HostConfig.PortBindings, want) {
+				t.Errorf("port bindings = %v, want %v", got.HostConfig.PortBindings, want)
+			}
+			if len(remaps) > 0 && reflect.DeepEqual(original, got.HostConfig.PortBindings) {
+				t.Error("Check() changed the bindings of the entry it was given")
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+)
+
+// Labels that configure a readiness gate
+const (
+	// AutostartReadyLabel is health, tcp:<port>, tcp:<host>:<port> or an http(s) URL
+	AutostartReadyLabel = "autostart.ready"
+	// AutostartReadyTimeoutLabel bounds the wait, as a Go duration such as 90s
+	AutostartReadyTimeoutLabel = "autostart.ready_timeout"
+)
+
+// DefaultReadyTimeout applies when a gate sets no timeout
+const DefaultReadyTimeout = 60 * time.Second
+
+const readyPollInterval = time.Second
+
+// Kinds of ReadinessGate
+const (
+	GateHealth = "health"
+	GateTCP    = "tcp"
+	GateHTTP   = "http"
+)
+
+// ReadinessGate is what a container has to pass before its dependents start
+type ReadinessGate struct {
+	Kind    string
+	Target  string
+	Timeout time.Duration
+}
+
+func (g *ReadinessGate) String() string {
+	if g.Target == "" {
+		return g.Kind
+	}
+	return g.Kind + " " + g.Target
+}
+
+// ParseReadinessGate reads the gate from the container labels; nil means none
+func ParseReadinessGate(e StateEntry) (*ReadinessGate, error) {
+	labels := entryLabels(e)
+	spec := strings.TrimSpace(labels[AutostartReadyLabel])
+	if spec == "" {
+		return nil, nil
+	}
+	gate := &ReadinessGate{Timeout: DefaultReadyTimeout}
+	if t := labels[AutostartReadyTimeoutLabel]; t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", AutostartReadyTimeoutLabel, t)
+		}
+		gate.Timeout = d
+	}
+	switch {
+	case spec == GateHealth:
+		gate.Kind = GateHealth
+	case strings.HasPrefix(spec, "tcp:"):
+		gate.Kind, gate.Target = GateTCP, strings.TrimPrefix(spec, "tcp:")
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		gate.Kind, gate.Target = GateHTTP, spec
+	default:
+		return nil, fmt.Errorf("invalid %s %q (want health, tcp:<port> or an http URL)", AutostartReadyLabel, spec)
+	}
+	return gate, nil
+}
+
+// Wait polls the gate until it passes, the container stops, or the timeout expires
+func (g *ReadinessGate) Wait(ctx context.Context, dockerHelper *DockerHelper, containerID string) error {
+	ctx, cancel := context.WithTimeout(ctx, g.Timeout)
+	defer cancel()
+	var lastErr error
+	for {
+		info, err := dockerHelper.InspectContainer(containerID)
+		if err != nil {
+			return err
+		}
+		if info.State == nil || !info.State.Running {
+			return fmt.Errorf("container is not running")
+		}
+		switch g.Kind {
+		case GateHealth:
+			lastErr = checkHealth(info)
+		case GateTCP:
+			lastErr = checkTCP(ctx, tcpGateAddress(info, g.Target))
+		case GateHTTP:
+			lastErr = checkHTTP(ctx, g.Target)
+		}
+		if lastErr == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %s: %v", g.Timeout, lastErr)
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+func checkHealth(info types.ContainerJSON) error {
+	if info.State.Health == nil {
+		return fmt.Errorf("container has no health check")
+	}
+	if info.State.Health.Status != types.Healthy {
+		return fmt.Errorf("health is %s", info.State.Health.Status)
+	}
+	return nil
+}
+
+// tcpGateAddress resolves tcp:<port> to the published host port, or to the
+// container's own address when the port is not published
+func tcpGateAddress(info types.ContainerJSON, target string) string {
+	if strings.Contains(target, ":") {
+		return target
+	}
+	if info.NetworkSettings == nil {
+		return net.JoinHostPort("127.0.0.1", target)
+	}
+	for _, b := range info.NetworkSettings.Ports[nat.Port(target+"/tcp")] {
+		if b.HostPort != "" {
+			host := b.HostIP
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = "127.0.0.1"
+			}
+			return net.JoinHostPort(host, b.HostPort)
+		}
+	}
+	for _, ep := range info.NetworkSettings.Networks {
+		if ep != nil && ep.IPAddress != "" {
+			return net.JoinHostPort(ep.IPAddress, target)
+		}
+	}
+	return net.JoinHostPort("127.0.0.1", target)
+}
+
+func checkTCP(ctx context.Context, addr string) error {
+	d := net.Dialer{Timeout: 2 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkHTTP(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
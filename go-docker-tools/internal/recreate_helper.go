@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// RecreateContainer replaces the container named in entry with a new one created
+// from the saved spec on image, starting it when start is set, and returns the new
+// container ID. The old container is stopped and renamed aside first and only removed
+// once the new one was created and started; otherwise it gets its name back and is
+// started again if it was running.
+func RecreateContainer(dockerHelper *DockerHelper, entry StateEntry, image string, start bool, logger *log.Logger) (string, error) {
+	if entry.Config == nil {
+		return "", fmt.Errorf("state for %s has no container spec; run save again to enable re-creation", entry.Name())
+	}
+	name := entry.Name()
+	var oldID, aside string
+	wasRunning := false
+	if existing, err := dockerHelper.InspectContainer(name); err == nil {
+		oldID = existing.ID
+		wasRunning = existing.State != nil && existing.State.Running
+		if wasRunning {
+			if err := dockerHelper.StopContainerByID(oldID); err != nil {
+				return "", fmt.Errorf("stop old container %s: %w", name, err)
+			}
+		}
+		aside = fmt.Sprintf("%s-old-%d", name, time.Now().Unix())
+		if err := dockerHelper.RenameContainer(oldID, aside); err != nil {
+			err = fmt.Errorf("rename old container %s: %w", name, err)
+			if wasRunning {
+				if serr := dockerHelper.StartContainerByID(oldID); serr != nil {
+					err = fmt.Errorf("%w; restarting it failed: %v", err, serr)
+				}
+			}
+			return "", err
+		}
+	} else if !client.IsErrNotFound(err) {
+		return "", err
+	}
+
+	id, err := createFromEntry(dockerHelper, entry, image, logger)
+	if err == nil && start {
+		if err = dockerHelper.StartContainerByID(id); err != nil {
+			err = fmt.Errorf("start %s: %w", name, err)
+			if rerr := dockerHelper.RemoveContainer(id, true); rerr != nil {
+				logger.Printf("Failed to remove the new container %s: %v", name, rerr)
+			}
+		}
+	}
+	if err != nil {
+		if oldID != "" {
+			err = putBackContainer(dockerHelper, oldID, aside, name, wasRunning, err, logger)
+		}
+		return "", err
+	}
+	if oldID != "" {
+		if err := dockerHelper.RemoveContainer(oldID, true); err != nil {
+			logger.Printf("Failed to remove the old container of %s: %v", name, err)
+		}
+	}
+	logger.Printf("Re-created container %s on %s", name, image)
+	return id, nil
+}
+
+// createFromEntry creates a container from the saved spec and attaches its other networks
+func createFromEntry(dockerHelper *DockerHelper, entry StateEntry, image string, logger *log.Logger) (string, error) {
+	name := entry.Name()
+	cfg := *entry.Config
+	cfg.Image = image
+	hostConfig := entry.HostConfig
+	if hostConfig == nil {
+		hostConfig = &container.HostConfig{}
+	}
+	primary, extra := splitEndpoints(entry, string(hostConfig.NetworkMode))
+	netConfig := &network.NetworkingConfig{}
+	if primary != "" {
+		netConfig.EndpointsConfig = map[string]*network.EndpointSettings{
+			primary: endpointForCreate(entry, entry.NetworkSettings.Networks[primary]),
+		}
+	}
+	id, err := dockerHelper.CreateContainer(name, &cfg, hostConfig, netConfig)
+	if err != nil {
+		return "", fmt.Errorf("create %s: %w", name, err)
+	}
+	for _, netName := range extra {
+		ep := endpointForCreate(entry, entry.NetworkSettings.Networks[netName])
+		if err := dockerHelper.ConnectNetwork(netName, id, ep); err != nil {
+			logger.Printf("Failed to connect %s to network %s: %v", name, netName, err)
+		}
+	}
+	return id, nil
+}
+
+// putBackContainer gives the old container its name back after a failed re-creation
+// and starts it again if it was running
+func putBackContainer(dockerHelper *DockerHelper, oldID, aside, name string, wasRunning bool, cause error, logger *log.Logger) error {
+	if err := dockerHelper.RenameContainer(oldID, name); err != nil {
+		return fmt.Errorf("%w; the old container is left as %s: %v", cause, aside, err)
+	}
+	if wasRunning {
+		if err := dockerHelper.StartContainerByID(oldID); err != nil {
+			return fmt.Errorf("%w; the old container could not be started again: %v", cause, err)
+		}
+	}
+	logger.Printf("Re-creating %s failed; kept the old container", name)
+	return cause
+}
+
+// CurrentImageRef names the image entry runs on by its tag or repo digest while
+// they still point to that image, so docker ps keeps showing the repository
+func CurrentImageRef(dockerHelper *DockerHelper, entry StateEntry) string {
+	if entry.ImageID == "" {
+		return entry.ImageRef()
+	}
+	for _, ref := range []string{entry.ImageRef(), entry.RepoDigest} {
+		if ref == "" {
+			continue
+		}
+		if img, err := dockerHelper.InspectImage(ref); err == nil && img.ID == entry.ImageID {
+			return ref
+		}
+	}
+	return entry.ImageID
+}
+
+// splitEndpoints returns the network to join at create time and the ones to connect afterwards
+func splitEndpoints(entry StateEntry, networkMode string) (string, []string) {
+	if entry.NetworkSettings == nil || len(entry.NetworkSettings.Networks) == 0 {
+		return "", nil
+	}
+	mode := networkMode
+	if mode == "" || mode == "default" {
+		mode = "bridge"
+	}
+	if mode == "host" || mode == "none" || strings.HasPrefix(mode, "container:") {
+		return "", nil
+	}
+	primary := ""
+	var extra []string
+	for netName := range entry.NetworkSettings.Networks {
+		if netName == mode {
+			primary = netName
+		} else {
+			extra = append(extra, netName)
+		}
+	}
+	return primary, extra
+}
+
+// endpointForCreate keeps the user-set parts of a saved endpoint, dropping
+// runtime values and the alias Docker derives from the old container ID
+func endpointForCreate(entry StateEntry, saved *network.EndpointSettings) *network.EndpointSettings {
+	if saved == nil {
+		return &network.EndpointSettings{}
+	}
+	ep := &network.EndpointSettings{
+		IPAMConfig: saved.IPAMConfig,
+		Links:      saved.Links,
+		DriverOpts: saved.DriverOpts,
+	}
+	for _, alias := range saved.Aliases {
+		if len(entry.ID) >= 12 && alias == entry.ID[:12] {
+			continue
+		}
+		ep.Aliases = append(ep.Aliases, alias)
+	}
+	return ep
+}
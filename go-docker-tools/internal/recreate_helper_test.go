@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestRecreateContainer(t *testing.T) {
+	tests := []struct {
+		name       string
+		running    bool
+		start      bool
+		failCreate bool
+		failStart  bool
+		wantErr    bool
+		// wantNew is set when web should be a new container afterwards
+		wantNew     bool
+		wantRunning bool
+	}{
+		{name: "running container is replaced", running: true, start: true, wantNew: true, wantRunning: true},
+		{name: "created without starting", running: true, wantNew: true},
+		{name: "create failure puts the old one back", running: true, start: true, failCreate: true, wantErr: true, wantRunning: true},
+		{name: "start failure puts the old one back", running: true, start: true, failStart: true, wantErr: true, wantRunning: true},
+		{name: "stopped container stays stopped when put back", start: true, failCreate: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeDocker()
+			f.addImage(appImage)
+			old := f.addContainer("web", appImage, &container.Config{Image: "app:1"}, nil, tt.running)
+			if tt.failCreate {
+				f.failCreate = func(string, *container.Config) error { return errors.New("bad spec") }
+			}
+			if tt.failStart {
+				f.failStart = func(c *fakeContainer) error {
+					if c.ID != old.ID {
+						return errors.New("port is already allocated")
+					}
+					return nil
+				}
+			}
+			d := f.helper(t)
+			containers, err := d.ListAllContainers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := CaptureState(d, containers, testLogger).Containers[0]
+
+			id, err := RecreateContainer(d, entry, "app:1", tt.start, testLogger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RecreateContainer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if names := sortedNames(f); len(names) != 1 || names[0] != "web" {
+				t.Fatalf("containers = %v, want only web", names)
+			}
+			web := f.byName("web")
+			if isNew := web.ID != old.ID; isNew != tt.wantNew {
+				t.Errorf("web was replaced = %v, want %v", isNew, tt.wantNew)
+			}
+			if tt.wantNew && web.ID != id {
+				t.Errorf("RecreateContainer() = %s, want the ID of web %s", id, web.ID)
+			}
+			if web.State.Running != tt.wantRunning {
+				t.Errorf("web running = %v, want %v", web.State.Running, tt.wantRunning)
+			}
+		})
+	}
+}
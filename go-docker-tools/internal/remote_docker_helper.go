@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// NewDockerHelperForRemote connects to another host's daemon, either over ssh as
+// ssh://[user@]host[:port], which needs the docker CLI on the remote host, or over
+// tcp://host:port with TLS. certPath holds ca.pem, cert.pem and key.pem and falls
+// back to DOCKER_CERT_PATH.
+func NewDockerHelperForRemote(host, certPath string) (*DockerHelper, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid daemon address %q: %w", host, err)
+	}
+	switch u.Scheme {
+	case "ssh":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid daemon address %q: no host", host)
+		}
+		// The tunnel ignores the address; it only has to parse
+		cli, err := client.NewClientWithOpts(
+			client.WithHost("http://docker.example.com"),
+			client.WithDialContext(sshDialer(u)),
+			client.WithAPIVersionNegotiation(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &DockerHelper{cli: cli, host: host}, nil
+	case "tcp":
+		if certPath == "" {
+			certPath = os.Getenv("DOCKER_CERT_PATH")
+		}
+		if certPath == "" {
+			return nil, fmt.Errorf("tcp endpoints need TLS: give a directory with ca.pem, cert.pem and key.pem")
+		}
+		cli, err := client.NewClientWithOpts(
+			client.WithHost(host),
+			client.WithTLSClientConfig(filepath.Join(certPath, "ca.pem"), filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem")),
+			client.WithAPIVersionNegotiation(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &DockerHelper{cli: cli}, nil
+	}
+	return nil, fmt.Errorf("unsupported daemon address %q (want ssh://[user@]host or tcp://host:port)", host)
+}
+
+// sshDialer runs "docker system dial-stdio" on the remote host, like the docker CLI
+// does for ssh:// hosts, and speaks the API over the ssh session
+func sshDialer(u *url.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var args []string
+	if u.User != nil && u.User.Username() != "" {
+		args = append(args, "-l", u.User.Username())
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Not CommandContext: the session has to outlive the dial
+		return startCommandConn(exec.Command("ssh", args...))
+	}
+}
+
+// startCommandConn starts cmd and returns a connection over its stdin and stdout
+func startCommandConn(cmd *exec.Cmd) (*commandConn, error) {
+	conn := &commandConn{cmd: cmd}
+	cmd.Stderr = &conn.stderr
+	var err error
+	if conn.stdin, err = cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if conn.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ssh: %w", err)
+	}
+	return conn, nil
+}
+
+// commandConn is a net.Conn over the stdin and stdout of a command
+type commandConn struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    io.ReadCloser
+	stderr    lockedBuffer
+	closeOnce sync.Once
+}
+
+// lockedBuffer collects the command's stderr while Read may look at it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF && n == 0 {
+		if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+			return 0, fmt.Errorf("ssh: %s", msg)
+		}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		if c.cmd.Process != nil {
+			c.cmd.Process.Kill()
+		}
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr               { return commandAddr{} }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "ssh" }
+func (commandAddr) String() string  { return "ssh" }
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+)
+
+// TestDialStdioHelper stands in for "docker system dial-stdio": run as a command, it
+// relays its stdin and stdout to the address in DIAL_STDIO_ADDR
+func TestDialStdioHelper(t *testing.T) {
+	addr := os.Getenv("DIAL_STDIO_ADDR")
+	if addr == "" {
+		t.Skip("only run as a command by TestCommandConn")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Exit(1)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestCommandConn(t *testing.T) {
+	t.Run("echo", func(t *testing.T) {
+		conn, err := startCommandConn(exec.Command("cat"))
+		if err != nil {
+			t.Skip("cat not available:", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("read %q, %v; want ping", buf, err)
+		}
+	})
+
+	t.Run("stderr becomes the read error", func(t *testing.T) {
+		conn, err := startCommandConn(exec.Command("sh", "-c", "echo 'Permission denied (publickey).' >&2; sleep 0.2"))
+		if err != nil {
+			t.Skip("sh not available:", err)
+		}
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 16))
+		if err == nil || !strings.Contains(err.Error(), "Permission denied") {
+			t.Fatalf("Read() error = %v, want the command's stderr", err)
+		}
+	})
+
+	t.Run("missing command", func(t *testing.T) {
+		if _, err := startCommandConn(exec.Command("/nonexistent/ssh")); err == nil {
+			t.Fatal("startCommandConn() succeeded for a missing command")
+		}
+	})
+
+	t.Run("API over the command", func(t *testing.T) {
+		f := newFakeDocker()
+		addr := strings.TrimPrefix(strings.TrimPrefix(f.helper(t).DaemonHost(), "tcp://"), "http://")
+		cli, err := client.NewClientWithOpts(
+			client.WithHost("http://docker.example.com"),
+			client.WithDialContext(func(ctx context.Context, network, _ string) (net.Conn, error) {
+				cmd := exec.Command(os.Args[0], "-test.run=^TestDialStdioHelper$")
+				cmd.Env = append(os.Environ(), "DIAL_STDIO_ADDR="+addr)
+				return startCommandConn(cmd)
+			}),
+			client.WithAPIVersionNegotiation(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &DockerHelper{cli: cli, host: "ssh://example"}
+		if err := d.Ping(context.Background()); err != nil {
+			t.Fatalf("Ping() error = %v", err)
+		}
+		if _, err := d.ListAllContainers(); err != nil {
+			t.Fatalf("ListAllContainers() error = %v", err)
+		}
+		if d.DaemonHost() != "ssh://example" {
+			t.Errorf("DaemonHost() = %s", d.DaemonHost())
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/client"
+)
+
+// Escalation levels of the restart chain, in the order they are tried
+const (
+	EscalateNone        = iota // the configured daemon connection only
+	EscalateDesktop            // the Docker Desktop socket
+	EscalateSocketFix          // point the system socket at Desktop, or fix its permissions
+	EscalateDaemonStart        // start the native dockerd
+	EscalateRestore            // re-create from the saved state
+)
+
+// EscalationNames names the levels for --max-escalation and reports
+var EscalationNames = []string{"none", "desktop", "socket-fix", "daemon-start", "restore"}
+
+// daemonStartWait bounds the wait for a dockerd started by the chain
+const daemonStartWait = time.Minute
+
+// dockerSocketGroup is the group socket-fix gives the native socket, as dockerd does
+const dockerSocketGroup = "docker"
+
+// ParseEscalation accepts a level number or name
+func ParseEscalation(s string) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(EscalationNames) {
+		return n, nil
+	}
+	for i, name := range EscalationNames {
+		if s == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown escalation %q (want 0-%d or one of %s)", s, len(EscalationNames)-1, strings.Join(EscalationNames, ", "))
+}
+
+// EscalationStep is one attempt of the restart chain
+type EscalationStep struct {
+	Level  int
+	Name   string
+	Detail string
+	Err    error
+}
+
+// RestartChain retries an action against ever more invasive ways of reaching the
+// daemon, as the Bash restart_all_containers did
+type RestartChain struct {
+	Conf         *config.Config
+	DockerHelper *DockerHelper
+	Logger       *log.Logger
+	MaxLevel     int
+	// Report, if set, is called after every step
+	Report func(EscalationStep)
+}
+
+// Run tries action on each level up to MaxLevel until it succeeds. The chain only
+// escalates while the daemon is unreachable; an action failing because the container
+// no longer exists goes straight to restore, and any other failure ends the chain.
+// restore re-creates the containers on the daemon that was last reachable.
+func (c *RestartChain) Run(action, restore func(dockerHelper *DockerHelper) error) error {
+	var reachable *DockerHelper
+	var lastErr error
+	for level := EscalateNone; level <= c.MaxLevel && level < EscalateRestore; level++ {
+		step := EscalationStep{Level: level, Name: EscalationNames[level]}
+		dh, detail, err := c.prepare(level)
+		step.Detail = detail
+		if err == nil {
+			err = pingDaemon(dh)
+		}
+		if err != nil {
+			step.Err = err
+			lastErr = err
+			c.report(step)
+			continue
+		}
+		reachable = dh
+		err = action(dh)
+		if err == nil {
+			c.report(step)
+			return nil
+		}
+		step.Err = err
+		c.report(step)
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+		lastErr = err
+		break
+	}
+	if c.MaxLevel < EscalateRestore {
+		return fmt.Errorf("gave up after %s: %w", EscalationNames[c.MaxLevel], lastErr)
+	}
+	step := EscalationStep{Level: EscalateRestore, Name: EscalationNames[EscalateRestore]}
+	if reachable == nil {
+		step.Err = fmt.Errorf("no Docker daemon is reachable to restore into")
+		c.report(step)
+		return step.Err
+	}
+	step.Detail = "re-creating from " + c.Conf.StateFile
+	step.Err = restore(reachable)
+	c.report(step)
+	return step.Err
+}
+
+func (c *RestartChain) report(step EscalationStep) {
+	if step.Err != nil {
+		c.Logger.Printf("Restart step %s failed: %s %v", step.Name, step.Detail, step.Err)
+	} else {
+		c.Logger.Printf("Restart step %s succeeded %s", step.Name, step.Detail)
+	}
+	if c.Report != nil {
+		c.Report(step)
+	}
+}
+
+// prepare performs the repair for a level and returns the client to try
+func (c *RestartChain) prepare(level int) (*DockerHelper, string, error) {
+	desktop := DesktopSocketPath(c.Conf)
+	system := c.Conf.SystemDockerSocket
+	if system == "" {
+		system = GetDefaultDockerSocket()
+	}
+	system = strings.TrimPrefix(system, "unix://")
+	switch level {
+	case EscalateNone:
+		return c.DockerHelper, "configured daemon", nil
+	case EscalateDesktop:
+		if !isSocket(desktop) {
+			return nil, desktop, fmt.Errorf("no Docker Desktop socket")
+		}
+		dh, err := NewDockerHelperForHost("unix://" + desktop)
+		return dh, desktop, err
+	case EscalateSocketFix:
+		if runtime.GOOS == "windows" {
+			return nil, system, fmt.Errorf("socket repair is not supported on Windows")
+		}
+		detail, err := fixSystemSocket(system, desktop, dockerSocketGroup)
+		if err != nil {
+			return nil, detail, err
+		}
+		dh, err := NewDockerHelperForHost("unix://" + system)
+		return dh, detail, err
+	case EscalateDaemonStart:
+		if runtime.GOOS != "linux" {
+			return nil, "", fmt.Errorf("starting dockerd is only supported with systemd on Linux")
+		}
+		if out, err := exec.Command("systemctl", "start", "docker").CombinedOutput(); err != nil {
+			return nil, "systemctl start docker", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		dh, err := NewDockerHelperForHost("unix://" + system)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := WaitForDocker(dh, daemonStartWait, c.Logger, nil); err != nil {
+			return nil, "systemctl start docker", err
+		}
+		return dh, "systemctl start docker", nil
+	}
+	return nil, "", fmt.Errorf("unknown escalation level %d", level)
+}
+
+func pingDaemon(dh *DockerHelper) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerPingTimeout)
+	defer cancel()
+	return dh.Ping(ctx)
+}
+
+// fixSystemSocket links the system socket to the Desktop socket when Desktop runs,
+// otherwise resets the native socket to root:group 0660. Unlike fixsocket it never
+// opens the socket to every user.
+func fixSystemSocket(system, desktop, group string) (string, error) {
+	if isSocket(desktop) {
+		if fi, err := os.Lstat(system); err == nil && fi.Mode()&os.ModeSymlink == 0 && fi.Mode()&os.ModeSocket != 0 {
+			return system, fmt.Errorf("%s is a live native socket; not replacing it", system)
+		}
+		os.Remove(system)
+		if err := os.Symlink(desktop, system); err != nil {
+			return system, err
+		}
+		return "linked " + system + " to " + desktop, nil
+	}
+	if fi, err := os.Lstat(system); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if _, err := os.Stat(system); err != nil {
+			// Dangling link left behind by Docker Desktop
+			os.Remove(system)
+			return system, fmt.Errorf("removed dangling link %s; no socket to fix", system)
+		}
+	}
+	grp, err := user.LookupGroup(group)
+	if err != nil {
+		return system, fmt.Errorf("cannot give %s to group %s: %w", system, group, err)
+	}
+	gid, err := strconv.Atoi(grp.Gid)
+	if err != nil {
+		return system, fmt.Errorf("group %s has a non-numeric id %q", group, grp.Gid)
+	}
+	if err := os.Chown(system, 0, gid); err != nil {
+		return system, err
+	}
+	if err := os.Chmod(system, 0660); err != nil {
+		return system, err
+	}
+	return "reset " + system + " to root:" + group + " 0660", nil
+}
+
+// DesktopSocketPath resolves DOCKER_DESKTOP_SOCKET_TEMPLATE for DOCKER_DESKTOP_USER
+// (or the invoking user), falling back to ~/.docker/desktop/docker.sock
+func DesktopSocketPath(conf *config.Config) string {
+	name := conf.DockerDesktopUser
+	if name == "" || name == "<AUTO_DETECT>" {
+		name = os.Getenv("SUDO_USER")
+	}
+	var u *user.User
+	var err error
+	if name != "" {
+		u, err = user.Lookup(name)
+	} else {
+		u, err = user.Current()
+	}
+	if conf.DockerDesktopSocketTemplate != "" && err == nil {
+		return strings.TrimPrefix(strings.ReplaceAll(conf.DockerDesktopSocketTemplate, "{USER_ID}", u.Uid), "unix://")
+	}
+	home, _ := os.UserHomeDir()
+	if err == nil {
+		home = u.HomeDir
+	}
+	return filepath.Join(home, ".docker", "desktop", "docker.sock")
+}
+
+func isSocket(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeSocket != 0
+}
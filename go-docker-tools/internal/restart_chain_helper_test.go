@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types/container"
+)
+
+// serveUnix serves f on a unix socket at path, as Docker Desktop would
+func serveUnix(t *testing.T, f *fakeDocker, path string) {
+	t.Helper()
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(f)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+}
+
+// unreachableHelper talks to a daemon that is not there
+func unreachableHelper(t *testing.T) *DockerHelper {
+	t.Helper()
+	dh, err := NewDockerHelperForHost("unix://" + filepath.Join(t.TempDir(), "gone.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dh
+}
+
+func TestRestartChain(t *testing.T) {
+	notFound := func(dh *DockerHelper) error { return dh.StartContainerByID("missing") }
+	tests := []struct {
+		name     string
+		live     bool // whether the configured daemon answers
+		desktop  bool // whether a Desktop socket answers
+		maxLevel int
+		action   func(dh *DockerHelper) error
+		want     []string
+		wantErr  string
+		restored bool
+	}{
+		{
+			name: "configured daemon", live: true, maxLevel: EscalateRestore,
+			want: []string{"none ok"},
+		},
+		{
+			name: "falls back to Desktop", desktop: true, maxLevel: EscalateRestore,
+			want: []string{"none failed", "desktop ok"},
+		},
+		{
+			name: "capped before Desktop", desktop: true, maxLevel: EscalateNone,
+			want: []string{"none failed"}, wantErr: "gave up after none",
+		},
+		{
+			name: "missing container goes to restore", live: true, maxLevel: EscalateRestore, action: notFound,
+			want: []string{"none failed", "restore ok"}, restored: true,
+		},
+		{
+			name: "missing container without restore", live: true, maxLevel: EscalateDaemonStart, action: notFound,
+			want: []string{"none failed"}, wantErr: "gave up after daemon-start",
+		},
+		{
+			name: "other failures end the chain", live: true, maxLevel: EscalateRestore,
+			action: func(dh *DockerHelper) error { return errors.New("permission denied") },
+			want:   []string{"none failed"}, wantErr: "permission denied",
+		},
+		{
+			name: "socket fix without a socket", maxLevel: EscalateSocketFix,
+			want: []string{"none failed", "desktop failed", "socket-fix failed"}, wantErr: "gave up after socket-fix",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			f := newFakeDocker()
+			f.addImage(appImage)
+			f.addContainer("web", appImage, &container.Config{Image: "app:1"}, nil, false)
+			conf := &config.Config{
+				StateFile:                   filepath.Join(dir, "state.json"),
+				SystemDockerSocket:          filepath.Join(dir, "docker.sock"),
+				DockerDesktopSocketTemplate: filepath.Join(dir, "desktop.sock"),
+			}
+			dh := unreachableHelper(t)
+			if tt.live {
+				dh = f.helper(t)
+			}
+			if tt.desktop {
+				serveUnix(t, f, conf.DockerDesktopSocketTemplate)
+			}
+			action := tt.action
+			if action == nil {
+				action = func(dh *DockerHelper) error { return dh.StartContainerByID("web") }
+			}
+			var steps []string
+			chain := &RestartChain{Conf: conf, DockerHelper: dh, Logger: testLogger, MaxLevel: tt.maxLevel,
+				Report: func(s EscalationStep) {
+					result := " ok"
+					if s.Err != nil {
+						result = " failed"
+					}
+					steps = append(steps, s.Name+result)
+				}}
+			restored := false
+			err := chain.Run(action, func(dh *DockerHelper) error {
+				restored = true
+				return pingDaemon(dh)
+			})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(steps, tt.want) {
+				t.Errorf("steps = %v, want %v", steps, tt.want)
+			}
+			if restored != tt.restored {
+				t.Errorf("restored = %v, want %v", restored, tt.restored)
+			}
+			if tt.wantErr == "" && !tt.restored && !f.byName("web").State.Running {
+				t.Error("web was not started")
+			}
+		})
+	}
+}
+
+func TestFixSystemSocket(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup creates the system and desktop paths as the case needs
+		setup      func(t *testing.T, system, desktop string)
+		group      string
+		rootOnly   bool
+		wantDetail string
+		wantErr    string
+		wantMode   os.FileMode
+	}{
+		{
+			name: "links to a running Desktop",
+			setup: func(t *testing.T, system, desktop string) {
+				serveUnix(t, newFakeDocker(), desktop)
+				os.Symlink(filepath.Join(filepath.Dir(system), "stale"), system)
+			},
+			wantDetail: "linked",
+		},
+		{
+			name: "keeps a live native socket",
+			setup: func(t *testing.T, system, desktop string) {
+				serveUnix(t, newFakeDocker(), desktop)
+				serveUnix(t, newFakeDocker(), system)
+			},
+			wantErr: "live native socket",
+		},
+		{
+			name: "removes a dangling Desktop link",
+			setup: func(t *testing.T, system, desktop string) {
+				os.Symlink(desktop, system)
+			},
+			wantErr: "removed dangling link",
+		},
+		{
+			name: "unknown group",
+			setup: func(t *testing.T, system, desktop string) {
+				serveUnix(t, newFakeDocker(), system)
+				os.Chmod(system, 0600)
+			},
+			group:    "no-such-group-for-tests",
+			wantErr:  "cannot give",
+			wantMode: 0600,
+		},
+		{
+			name: "resets the native socket to root and the group",
+			setup: func(t *testing.T, system, desktop string) {
+				serveUnix(t, newFakeDocker(), system)
+				os.Chmod(system, 0777)
+			},
+			group:      "root",
+			rootOnly:   true,
+			wantDetail: "root:root 0660",
+			wantMode:   0660,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rootOnly && os.Geteuid() != 0 {
+				t.Skip("changing a socket's owner needs root")
+			}
+			dir := t.TempDir()
+			system, desktop := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "desktop.sock")
+			tt.setup(t, system, desktop)
+			group := tt.group
+			if group == "" {
+				group = dockerSocketGroup
+			}
+			detail, err := fixSystemSocket(system, desktop, group)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("fixSystemSocket() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil || !strings.Contains(detail, tt.wantDetail) {
+				t.Fatalf("fixSystemSocket() = %q, %v, want %q", detail, err, tt.wantDetail)
+			}
+			if tt.wantMode != 0 {
+				fi, err := os.Stat(system)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Mode().Perm() != tt.wantMode {
+					t.Errorf("socket mode = %v, want %v", fi.Mode().Perm(), tt.wantMode)
+				}
+			}
+		})
+	}
+}
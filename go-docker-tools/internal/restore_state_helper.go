@@ -1,31 +1,295 @@
 package internal
 
 import (
-	"encoding/json"
-	"github.com/docker/docker/api/types"
-	"os"
+	"fmt"
 	"log"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Image policies for restore
+const (
+	// ImagePolicyExact restores the image ID recorded at save time
+	ImagePolicyExact = "exact"
+	// ImagePolicyTag uses whatever image the saved tag currently points to
+	ImagePolicyTag = "tag"
+	// ImagePolicyNewest pulls the saved tag before restoring
+	ImagePolicyNewest = "newest"
 )
 
-func RestoreStateHelper(stateFile string, dockerHelper *DockerHelper, logger *log.Logger) (restored int, failed int, err error) {
-	f, err := os.Open(stateFile)
+// RestoreOptions controls how saved containers are brought back
+type RestoreOptions struct {
+	ImagePolicy string
+	// Project limits the restore to one compose project ("standalone" for the rest)
+	Project string
+	// PortPolicy is fail, skip or remap for host ports that are already taken
+	PortPolicy string
+	// KeepStopped creates the entries saved as not running without starting them
+	KeepStopped bool
+	// Recreate replaces existing containers from the saved spec even when they
+	// already run the saved image
+	Recreate bool
+}
+
+// ImageChange records a container that came back on a different image than it was saved with
+type ImageChange struct {
+	Container    string
+	Image        string
+	SavedImageID string
+	NewImageID   string
+}
+
+// RestoreResult summarises a restore
+type RestoreResult struct {
+	Restored     int
+	Failed       int
+	Skipped      int
+	ImageChanges []ImageChange
+	PortRemaps   []PortRemap
+	// Networks lists the networks created before the containers, and any problems
+	Networks []NetworkChange
+	// Created holds the IDs of the containers the restore created
+	Created []string
+}
+
+// LoadStateContainers reads the containers recorded in a state file
+func LoadStateContainers(stateFile string) ([]types.Container, error) {
+	state, err := LoadState(stateFile)
 	if err != nil {
-		return 0, 0, err
-	}
-	defer f.Close()
-	var containers []types.Container
-	dec := json.NewDecoder(f)
-	if err := dec.Decode(&containers); err != nil {
-		return 0, 0, err
-	}
-	for _, c := range containers {
-		if err := dockerHelper.StartContainerByID(c.ID); err != nil {
-			logger.Printf("Failed to start container %s: %v", c.ID, err)
-			failed++
+		return nil, err
+	}
+	containers := make([]types.Container, 0, len(state.Containers))
+	for _, e := range state.Containers {
+		containers = append(containers, e.Container)
+	}
+	return containers, nil
+}
+
+func RestoreStateHelper(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, opts RestoreOptions) (*RestoreResult, error) {
+	state, err := LoadAnyState(conf.StateFile, LegacyDaemonHosts(conf), logger)
+	if err != nil {
+		return nil, err
+	}
+	return RestoreState(conf, dockerHelper, logger, state, opts)
+}
+
+// RestoreState starts or re-creates every container in state according to opts
+func RestoreState(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, state *SavedState, opts RestoreOptions) (*RestoreResult, error) {
+	switch opts.ImagePolicy {
+	case "":
+		opts.ImagePolicy = ImagePolicyExact
+	case ImagePolicyExact, ImagePolicyTag, ImagePolicyNewest:
+	default:
+		return nil, fmt.Errorf("unknown image policy %q (want exact, tag or newest)", opts.ImagePolicy)
+	}
+	entries := SelectProject(state.Containers, opts.Project)
+	if len(entries) == 0 && opts.Project != "" {
+		return nil, fmt.Errorf("no containers of project %s in the state", opts.Project)
+	}
+	deps := StartupDeps(entries)
+	if ordered, err := StartupOrder(entries); err == nil {
+		entries = ordered
+	} else {
+		logger.Printf("Restoring in saved order: %v", err)
+	}
+	ports, err := NewPortGuard(dockerHelper, opts.PortPolicy)
+	if err != nil {
+		return nil, err
+	}
+	result := &RestoreResult{}
+	// Networks come first so containers can be attached with their static IPs
+	result.Networks = EnsureNetworks(dockerHelper, state.Networks, entries, logger)
+	for _, n := range result.Networks {
+		if n.Err != nil {
+			logger.Println("Network problem:", n.Err)
+		}
+	}
+	failed := map[string]bool{}
+	for _, entry := range entries {
+		var change *ImageChange
+		var remaps []PortRemap
+		var err error
+		for _, d := range deps[entry.Name()] {
+			if failed[d] {
+				// Compose projects come back as a unit: dependents of a failed service stay down
+				err = fmt.Errorf("dependency %s was not restored", d)
+				break
+			}
+		}
+		if err == nil {
+			var created string
+			change, remaps, created, err = restoreEntry(conf, dockerHelper, logger, entry, opts, ports)
+			if created != "" {
+				result.Created = append(result.Created, created)
+			}
+		}
+		if IsPortSkip(err) {
+			logger.Printf("Skipped container %s: %v", entry.Name(), err)
+			failed[entry.Name()] = true
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			logger.Printf("Failed to restore container %s: %v", entry.Name(), err)
+			failed[entry.Name()] = true
+			result.Failed++
+			continue
+		}
+		if opts.KeepStopped && entry.State != "running" {
+			logger.Printf("Created container %s", entry.Name())
 		} else {
-			logger.Printf("Started container %s", c.ID)
-			restored++
+			logger.Printf("Started container %s", entry.Name())
+		}
+		result.Restored++
+		if change != nil {
+			result.ImageChanges = append(result.ImageChanges, *change)
+		}
+		for _, r := range remaps {
+			logger.Printf("Remapped container %s port %s", entry.Name(), r)
+		}
+		result.PortRemaps = append(result.PortRemaps, remaps...)
+	}
+	if err := RecordPortRemaps(conf, result.PortRemaps, logger); err != nil {
+		logger.Println("Failed to record port remaps:", err)
+	}
+	return result, nil
+}
+
+// restoreEntry brings one container back and reports an image change, if any, the
+// host ports it had to move and the ID of the container it created, if it did
+func restoreEntry(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, entry StateEntry, opts RestoreOptions, ports *PortGuard) (*ImageChange, []PortRemap, string, error) {
+	ref, imageID, err := resolveRestoreImage(conf, dockerHelper, logger, entry, opts.ImagePolicy)
+	if err != nil {
+		logger.Printf("Image for container %s unavailable: %v", entry.Name(), err)
+	}
+
+	current, err := dockerHelper.InspectContainer(entry.ID)
+	if client.IsErrNotFound(err) {
+		current, err = dockerHelper.InspectContainer(entry.Name())
+	}
+	exists := err == nil
+	if err != nil && !client.IsErrNotFound(err) {
+		return nil, nil, "", err
+	}
+	var currentID string
+	if exists {
+		currentID = current.ID
+	}
+	running := exists && current.State != nil && current.State.Running
+	onImage := exists && !opts.Recreate && (imageID == "" || current.Image == imageID)
+	start := !opts.KeepStopped || entry.State == "running"
+
+	var remaps []PortRemap
+	if start && !(running && onImage) {
+		spec := entry
+		if spec.HostConfig == nil && exists {
+			// Name-only entries are checked against the ports of the existing container
+			spec.Config, spec.HostConfig = current.Config, current.HostConfig
+			if current.NetworkSettings != nil {
+				spec.NetworkSettings = &types.SummaryNetworkSettings{Networks: current.NetworkSettings.Networks}
+			}
 		}
+		var checked StateEntry
+		if checked, remaps, err = ports.Check(spec); err != nil {
+			return nil, nil, "", err
+		}
+		if len(remaps) > 0 {
+			// New host ports need a new container
+			entry, onImage = checked, false
+			if ref == "" {
+				ref = CurrentImageRef(dockerHelper, StateEntry{Container: types.Container{ImageID: current.Image}, Config: current.Config})
+			}
+		}
+	}
+
+	id := currentID
+	created := ""
+	switch {
+	case onImage:
+		// The container is already on the wanted image
+	case entry.Config != nil && ref != "":
+		if id, err = RecreateContainer(dockerHelper, entry, ref, start, logger); err != nil {
+			return nil, nil, "", err
+		}
+		created = id
+	case exists:
+		logger.Printf("State for %s has no container spec; starting it on its current image", entry.Name())
+	default:
+		return nil, nil, "", fmt.Errorf("container no longer exists and the state has no spec to re-create it")
+	}
+	if start && created == "" && !running {
+		if err := dockerHelper.StartContainerByID(id); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	if !start {
+		return nil, remaps, created, nil
+	}
+	if entry.HostConfig != nil {
+		ports.Claim(entry)
+	} else if exists {
+		ports.Claim(StateEntry{Container: entry.Container, HostConfig: current.HostConfig})
+	}
+
+	if entry.ImageID == "" {
+		return nil, remaps, created, nil
+	}
+	started, err := dockerHelper.InspectContainer(id)
+	if err != nil || started.Image == entry.ImageID {
+		return nil, remaps, created, nil
+	}
+	return &ImageChange{
+		Container:    entry.Name(),
+		Image:        entry.ImageRef(),
+		SavedImageID: entry.ImageID,
+		NewImageID:   started.Image,
+	}, remaps, created, nil
+}
+
+// resolveRestoreImage makes the image chosen by policy available locally and
+// returns a reference to create the container from along with its image ID
+func resolveRestoreImage(conf *config.Config, dockerHelper *DockerHelper, logger *log.Logger, entry StateEntry, policy string) (string, string, error) {
+	tag := entry.ImageRef()
+	if tag == "" && entry.ImageID == "" {
+		// Name-only entries (legacy lists) start whatever container has that name
+		return "", "", nil
+	}
+	if policy == ImagePolicyExact && entry.ImageID != "" {
+		pullRef := tag
+		if entry.RepoDigest != "" {
+			pullRef = entry.RepoDigest
+		}
+		if err := EnsureImage(conf, dockerHelper, logger, pullRef, entry.ImageID); err != nil {
+			return "", "", err
+		}
+		// Prefer a reference that keeps the repository name visible in docker ps
+		if img, err := dockerHelper.InspectImage(tag); err == nil && img.ID == entry.ImageID {
+			return tag, entry.ImageID, nil
+		}
+		if entry.RepoDigest != "" {
+			if img, err := dockerHelper.InspectImage(entry.RepoDigest); err == nil && img.ID == entry.ImageID {
+				return entry.RepoDigest, entry.ImageID, nil
+			}
+		}
+		return entry.ImageID, entry.ImageID, nil
+	}
+	if policy == ImagePolicyNewest {
+		if err := dockerHelper.PullImage(tag); err != nil {
+			logger.Printf("Pull of %s failed, using the local image: %v", tag, err)
+		}
+	}
+	if err := EnsureImage(conf, dockerHelper, logger, tag, ""); err != nil {
+		return "", "", err
+	}
+	if policy == ImagePolicyExact {
+		// Nothing was pinned, so an existing container is left on whatever it runs
+		return tag, "", nil
+	}
+	img, err := dockerHelper.InspectImage(tag)
+	if err != nil {
+		return "", "", err
 	}
-	return restored, failed, nil
+	return tag, img.ID, nil
 }
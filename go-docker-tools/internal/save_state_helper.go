@@ -1,22 +1,49 @@
 package internal
 
 import (
-	"encoding/json"
-	"github.com/docker/docker/api/types"
-	"os"
 	"log"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+	"github.com/docker/docker/api/types"
 )
 
-func SaveStateHelper(containers []types.Container, stateFile string, logger *log.Logger) error {
-	f, err := os.OpenFile(stateFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
+// SaveStateHelper records the containers, pinned to their image IDs and digests,
+// and their networks, and keeps a timestamped copy in the state history
+func SaveStateHelper(conf *config.Config, dockerHelper *DockerHelper, containers []types.Container, logger *log.Logger) error {
+	state := CaptureState(dockerHelper, containers, logger)
+	CaptureNetworks(dockerHelper, state, logger)
+	return writeSavedState(conf, state, logger)
+}
+
+// SaveProjectStateHelper records the containers of one compose project and keeps
+// the other containers already in the state file as they were
+func SaveProjectStateHelper(conf *config.Config, dockerHelper *DockerHelper, containers []types.Container, project string, logger *log.Logger) error {
+	var selected []types.Container
+	for _, c := range containers {
+		if InProject(StateEntry{Container: c}, project) {
+			selected = append(selected, c)
+		}
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	if err := enc.Encode(containers); err != nil {
+	captured := CaptureState(dockerHelper, selected, logger)
+	CaptureNetworks(dockerHelper, captured, logger)
+	state := captured
+	if base, err := LoadState(conf.StateFile); err == nil {
+		state = ReplaceProject(base, captured, project)
+	}
+	return writeSavedState(conf, state, logger)
+}
+
+func writeSavedState(conf *config.Config, state *SavedState, logger *log.Logger) error {
+	if prev, err := LoadState(conf.StateFile); err == nil {
+		carryPortRemaps(prev, state)
+	}
+	if err := WriteState(conf.StateFile, state); err != nil {
 		return err
 	}
-	logger.Printf("Saved %d containers to %s", len(containers), stateFile)
+	snapshot, err := RecordStateSnapshot(conf, state, logger)
+	if err != nil {
+		logger.Println("Failed to record state snapshot:", err)
+	}
+	logger.Printf("Saved %d containers to %s (snapshot %s): %s", len(state.Containers), conf.StateFile, snapshot, ProjectSummary(state.Containers))
 	return nil
 }
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// Labels that tune how a container is stopped
+const (
+	// AutostopTimeoutLabel is the grace period before SIGKILL, in seconds or as a duration such as 2m
+	AutostopTimeoutLabel = "autostop.timeout"
+	// AutostopSignalLabel is the signal sent first, such as SIGINT or SIGQUIT
+	AutostopSignalLabel = "autostop.signal"
+)
+
+// StopResult is the outcome of stopping one container
+type StopResult struct {
+	Container string
+	Took      time.Duration
+	Err       error
+}
+
+// StopOptionsFor reads the stop signal and timeout from the container labels
+func StopOptionsFor(e StateEntry) (container.StopOptions, error) {
+	labels := entryLabels(e)
+	opts := container.StopOptions{Signal: strings.TrimSpace(labels[AutostopSignalLabel])}
+	if t := strings.TrimSpace(labels[AutostopTimeoutLabel]); t != "" {
+		secs, err := strconv.Atoi(t)
+		if err != nil {
+			d, derr := time.ParseDuration(t)
+			if derr != nil {
+				return opts, fmt.Errorf("invalid %s %q", AutostopTimeoutLabel, t)
+			}
+			secs = int(d.Round(time.Second) / time.Second)
+		}
+		opts.Timeout = &secs
+	}
+	return opts, nil
+}
+
+// StopInReverseOrder stops entries so that each container stops only after every
+// container depending on it has stopped. Containers with nothing left depending on
+// them stop in parallel. deps must be free of cycles. report, if set, is called once
+// per container as it stops.
+func StopInReverseOrder(dockerHelper *DockerHelper, entries []StateEntry, deps map[string][]string, logger *log.Logger, report func(StopResult)) []StopResult {
+	done := make(map[string]chan struct{}, len(entries))
+	for _, e := range entries {
+		done[e.Name()] = make(chan struct{})
+	}
+	dependents := map[string][]string{}
+	for _, e := range entries {
+		for _, d := range deps[e.Name()] {
+			if _, ok := done[d]; ok && d != e.Name() {
+				dependents[d] = append(dependents[d], e.Name())
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make([]StopResult, len(entries))
+	for i, e := range entries {
+		wg.Add(1)
+		go func(i int, e StateEntry) {
+			defer wg.Done()
+			defer close(done[e.Name()])
+			for _, d := range dependents[e.Name()] {
+				<-done[d]
+			}
+			r := StopResult{Container: e.Name()}
+			began := time.Now()
+			opts, err := StopOptionsFor(e)
+			if err != nil {
+				logger.Printf("Stopping %s with the default timeout: %v", e.Name(), err)
+			}
+			r.Err = dockerHelper.StopContainer(e.ID, opts)
+			r.Took = time.Since(began).Round(100 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = r
+			if report != nil {
+				report(r)
+			}
+		}(i, e)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestStopOptionsFor(t *testing.T) {
+	tests := []struct {
+		labels      map[string]string
+		wantSignal  string
+		wantTimeout int
+		wantErr     bool
+	}{
+		{labels: nil, wantTimeout: -1},
+		{labels: map[string]string{AutostopTimeoutLabel: "30"}, wantTimeout: 30},
+		{labels: map[string]string{AutostopTimeoutLabel: "2m", AutostopSignalLabel: " SIGINT "}, wantSignal: "SIGINT", wantTimeout: 120},
+		{labels: map[string]string{AutostopTimeoutLabel: "soon"}, wantTimeout: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.labels), func(t *testing.T) {
+			opts, err := StopOptionsFor(testEntry("app", tt.labels))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StopOptionsFor() error = %v, want error %v", err, tt.wantErr)
+			}
+			timeout := -1
+			if opts.Timeout != nil {
+				timeout = *opts.Timeout
+			}
+			if opts.Signal != tt.wantSignal || timeout != tt.wantTimeout {
+				t.Errorf("StopOptionsFor() = %q %d, want %q %d", opts.Signal, timeout, tt.wantSignal, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestStopInReverseOrder(t *testing.T) {
+	f := newFakeDocker()
+	f.addImage(appImage)
+	labels := map[string]map[string]string{
+		"web":    {AutostopTimeoutLabel: "45"},
+		"worker": {AutostopSignalLabel: "SIGQUIT"},
+	}
+	var entries []StateEntry
+	for _, name := range []string{"db", "cache", "web", "worker", "lone"} {
+		c := f.addContainer(name, appImage, &container.Config{Image: "app:1", Labels: labels[name]}, nil, true)
+		e := testEntry(name, labels[name])
+		e.ID = c.ID
+		entries = append(entries, e)
+	}
+	deps := map[string][]string{
+		"web":    {"db", "cache"},
+		"worker": {"web", "gone"},
+	}
+
+	var mu sync.Mutex
+	var order, params []string
+	f.onStop = func(c *fakeContainer, q url.Values) error {
+		name := strings.TrimPrefix(c.Name, "/")
+		// Slow dependents make a wrong order show up
+		if name == "worker" || name == "web" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+		if q.Get("signal") != "" || q.Get("t") != "" {
+			params = append(params, fmt.Sprintf("%s signal=%s t=%s", name, q.Get("signal"), q.Get("t")))
+		}
+		if name == "web" {
+			return errors.New("stop timed out")
+		}
+		return nil
+	}
+	var reported []string
+	results := StopInReverseOrder(f.helper(t), entries, deps, testLogger, func(r StopResult) {
+		reported = append(reported, r.Container)
+	})
+
+	pos := map[string]int{}
+	for i, n := range order {
+		pos[n] = i
+	}
+	for dependent, ds := range deps {
+		for _, d := range ds {
+			if p, ok := pos[d]; ok && p < pos[dependent] {
+				t.Errorf("%s stopped before %s, which depends on it (order %v)", d, dependent, order)
+			}
+		}
+	}
+	if len(order) != len(entries) || len(reported) != len(entries) {
+		t.Errorf("stopped %v and reported %v, want all %d containers", order, reported, len(entries))
+	}
+	for i, r := range results {
+		if r.Container != entries[i].Name() {
+			t.Errorf("result %d is for %s, want %s", i, r.Container, entries[i].Name())
+		}
+		if (r.Err != nil) != (r.Container == "web") {
+			t.Errorf("%s: error %v", r.Container, r.Err)
+		}
+	}
+	wantParams := map[string]bool{"web signal= t=45": true, "worker signal=SIGQUIT t=": true}
+	for _, p := range params {
+		if !wantParams[p] {
+			t.Errorf("unexpected stop parameters %q", p)
+		}
+		delete(wantParams, p)
+	}
+	if len(wantParams) > 0 {
+		t.Errorf("missing stop parameters %v", wantParams)
+	}
+}
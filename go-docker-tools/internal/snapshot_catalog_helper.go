@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+// SnapshotEntry is one archive in the snapshot catalog
+type SnapshotEntry struct {
+	Path      string    `json:"path"`
+	Kind      string    `json:"kind"`
+	Job       string    `json:"job,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Volumes   []string  `json:"volumes"`
+	// VolumeContainers comes from the archive manifest when present
+	VolumeContainers map[string][]string `json:"volume_containers,omitempty"`
+	Size             int64               `json:"size"`
+	ModTime          time.Time           `json:"mod_time"`
+	Encrypted        bool                `json:"encrypted"`
+	// Error is set when the archive could not be read
+	Error string `json:"error,omitempty"`
+}
+
+// SnapshotCatalog indexes every archive under BackupDir
+type SnapshotCatalog struct {
+	UpdatedAt time.Time        `json:"updated_at"`
+	Entries   []*SnapshotEntry `json:"entries"`
+}
+
+// SnapshotCatalogFile is where the catalog is cached between runs
+func SnapshotCatalogFile(conf *config.Config) string {
+	return filepath.Join(conf.StateDir, "snapshot_catalog.json")
+}
+
+var archiveTimestampRe = regexp.MustCompile(`(\d{8}T\d{6})`)
+var archiveUnixRe = regexp.MustCompile(`_(\d{10})\.`)
+
+// archiveTimestamp parses the time encoded in an archive name, falling back to mtime
+func archiveTimestamp(name string, modTime time.Time) time.Time {
+	if m := archiveTimestampRe.FindStringSubmatch(name); m != nil {
+		if t, err := time.ParseInLocation("20060102T150405", m[1], time.Local); err == nil {
+			return t
+		}
+	}
+	if m := archiveUnixRe.FindStringSubmatch(name); m != nil {
+		if sec, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			return time.Unix(sec, 0)
+		}
+	}
+	return modTime
+}
+
+// archiveKind classifies an archive by where it lives under BackupDir
+func archiveKind(conf *config.Config, archivePath string) (kind, job string) {
+	rel, err := filepath.Rel(conf.BackupDir, archivePath)
+	if err != nil {
+		return "other", ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	base := filepath.Base(archivePath)
+	switch {
+	case len(parts) > 1 && parts[0] == "manual_backups":
+		return "manual", ""
+	case len(parts) > 1 && parts[0] == "remote":
+		return "remote", ""
+	case len(parts) > 2 && parts[0] == "jobs":
+		return "job", parts[1]
+	case strings.HasPrefix(base, "manual_slack_"):
+		return "slack", ""
+	case strings.HasPrefix(base, "manual_"):
+		return "manual", ""
+	}
+	for _, j := range conf.BackupJobs {
+		if IsBackupJobArchive(j.Name, base) {
+			return "job", j.Name
+		}
+	}
+	return "volume", ""
+}
+
+// ArchiveKey returns the encryption key for an archive written by a job, if any
+func ArchiveKey(conf *config.Config, archivePath string) *EncryptionKey {
+	base := filepath.Base(archivePath)
+	for _, j := range conf.BackupJobs {
+		if j.EncryptionKeyFile != "" && IsBackupJobArchive(j.Name, base) {
+			if key, err := LoadEncryptionKey(j.EncryptionKeyFile); err == nil {
+				return key
+			}
+		}
+	}
+	return nil
+}
+
+// indexArchive reads an archive's manifest or top-level layout
+func indexArchive(conf *config.Config, archivePath string, entry *SnapshotEntry) error {
+	entry.Encrypted = IsEncryptedFile(archivePath)
+	a, err := OpenBackupArchive(archivePath, ArchiveKey(conf, archivePath))
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	manifest, hdr, err := ReadArchiveManifest(a)
+	if err != nil {
+		return err
+	}
+	if manifest != nil {
+		entry.Volumes = manifest.Volumes
+		entry.VolumeContainers = manifest.VolumeContainers
+		if entry.Job == "" {
+			entry.Job = manifest.Job
+		}
+		if !manifest.CreatedAt.IsZero() {
+			entry.Timestamp = manifest.CreatedAt
+		}
+		return nil
+	}
+	seen := map[string]bool{}
+	for hdr != nil {
+		vol, _ := SplitArchiveEntry(archivePath, hdr.Name)
+		if !seen[vol] {
+			seen[vol] = true
+			entry.Volumes = append(entry.Volumes, vol)
+		}
+		if hdr, err = a.Reader.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	sort.Strings(entry.Volumes)
+	return nil
+}
+
+// LoadSnapshotCatalog reads the cached catalog (empty if none)
+func LoadSnapshotCatalog(conf *config.Config) (*SnapshotCatalog, error) {
+	catalog := &SnapshotCatalog{}
+	data, err := os.ReadFile(SnapshotCatalogFile(conf))
+	if os.IsNotExist(err) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// RefreshSnapshotCatalog walks BackupDir and re-indexes new or changed archives.
+// With rebuild set every archive is read again.
+func RefreshSnapshotCatalog(conf *config.Config, logger *log.Logger, rebuild bool) (*SnapshotCatalog, error) {
+	old, err := LoadSnapshotCatalog(conf)
+	if err != nil || rebuild {
+		old = &SnapshotCatalog{}
+	}
+	cached := map[string]*SnapshotEntry{}
+	for _, e := range old.Entries {
+		cached[e.Path] = e
+	}
+	catalog := &SnapshotCatalog{UpdatedAt: time.Now()}
+	walkErr := filepath.Walk(conf.BackupDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && conf.ImageBackupDir != "" && filepath.Clean(p) == filepath.Clean(conf.ImageBackupDir) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !IsBackupArchiveName(info.Name()) {
+			return nil
+		}
+		// Failed entries are retried, the cause may have been a key file since fixed
+		if e, ok := cached[p]; ok && e.Error == "" && e.Size == info.Size() && e.ModTime.Equal(info.ModTime()) {
+			catalog.Entries = append(catalog.Entries, e)
+			return nil
+		}
+		entry := &SnapshotEntry{Path: p, Size: info.Size(), ModTime: info.ModTime()}
+		entry.Kind, entry.Job = archiveKind(conf, p)
+		entry.Timestamp = archiveTimestamp(info.Name(), info.ModTime())
+		if err := indexArchive(conf, p, entry); err != nil {
+			logger.Printf("[WARN] Failed to index archive %s: %v", p, err)
+			entry.Error = err.Error()
+		}
+		catalog.Entries = append(catalog.Entries, entry)
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	sort.Slice(catalog.Entries, func(i, j int) bool {
+		return catalog.Entries[i].Timestamp.Before(catalog.Entries[j].Timestamp)
+	})
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(conf.StateDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(SnapshotCatalogFile(conf), data, 0600); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// SnapshotsAt returns, for each volume, the newest archive at or before t
+func (c *SnapshotCatalog) SnapshotsAt(t time.Time) map[string]*SnapshotEntry {
+	result := map[string]*SnapshotEntry{}
+	for _, e := range c.Entries {
+		if e.Timestamp.After(t) {
+			continue
+		}
+		for _, v := range e.Volumes {
+			if cur, ok := result[v]; !ok || !e.Timestamp.Before(cur.Timestamp) {
+				result[v] = e
+			}
+		}
+	}
+	return result
+}
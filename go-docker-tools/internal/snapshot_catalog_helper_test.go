@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+func TestRefreshSnapshotCatalogRetriesErrors(t *testing.T) {
+	conf := &config.Config{BackupDir: t.TempDir(), StateDir: t.TempDir()}
+	for _, vol := range []string{"pgdata", "cache"} {
+		data := buildTar(t, []tarEntry{{name: "file", data: vol}})
+		if err := os.WriteFile(filepath.Join(conf.BackupDir, vol+"_20240301T000000.tar"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := RefreshSnapshotCatalog(conf, testLogger, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mark pgdata as failed and give cache an entry only the cached copy would have
+	catalog, err := LoadSnapshotCatalog(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range catalog.Entries {
+		if e.Volumes[0] == "pgdata" {
+			e.Volumes, e.Error = nil, "encrypted archive failed authentication"
+		} else {
+			e.Volumes = []string{"from-cache"}
+		}
+	}
+	data, err := json.Marshal(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(SnapshotCatalogFile(conf), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err = RefreshSnapshotCatalog(conf, testLogger, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, e := range catalog.Entries {
+		if e.Error != "" {
+			t.Errorf("%s still has error %q", e.Path, e.Error)
+		}
+		got[filepath.Base(e.Path)] = e.Volumes
+	}
+	want := map[string][]string{
+		"pgdata_20240301T000000.tar": {"pgdata"},
+		"cache_20240301T000000.tar":  {"from-cache"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("catalog volumes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels that shape the start order
+const (
+	// AutostartAfterLabel lists containers, or compose services of the same project, to start first
+	AutostartAfterLabel = "autostart.after"
+	// AutostartPriorityLabel orders otherwise independent containers; lower values start first
+	AutostartPriorityLabel = "autostart.priority"
+)
+
+// StartupDeps maps each container to the containers it must start after: compose
+// depends_on, autostart.after, and the container whose network namespace it joins
+func StartupDeps(entries []StateEntry) map[string][]string {
+	deps := ComposeDeps(entries)
+	byService := map[string][]string{}
+	for _, e := range entries {
+		if p := ComposeProject(e); p != "" {
+			key := p + "/" + ComposeServiceName(e)
+			byService[key] = append(byService[key], e.Name())
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		for _, after := range strings.Split(entryLabels(e)[AutostartAfterLabel], ",") {
+			after = strings.TrimPrefix(strings.TrimSpace(after), "/")
+			if after == "" {
+				continue
+			}
+			if names, ok := byService[ComposeProject(e)+"/"+after]; ok && ComposeProject(e) != "" {
+				deps[name] = append(deps[name], names...)
+			} else {
+				deps[name] = append(deps[name], after)
+			}
+		}
+		if target, ok := strings.CutPrefix(entryNetworkMode(e), "container:"); ok {
+			deps[name] = append(deps[name], containerRef(entries, target))
+		}
+	}
+	return deps
+}
+
+// entryNetworkMode returns the network mode from the full host config or the list summary
+func entryNetworkMode(e StateEntry) string {
+	if e.HostConfig != nil {
+		return string(e.HostConfig.NetworkMode)
+	}
+	return e.Container.HostConfig.NetworkMode
+}
+
+// containerRef turns a container ID into its name when the container is among entries
+func containerRef(entries []StateEntry, idOrName string) string {
+	for _, e := range entries {
+		if e.ID == idOrName || (len(idOrName) >= 12 && strings.HasPrefix(e.ID, idOrName)) {
+			return e.Name()
+		}
+	}
+	return strings.TrimPrefix(idOrName, "/")
+}
+
+// StartupPriority returns the autostart.priority label, 0 when unset or invalid
+func StartupPriority(e StateEntry) int {
+	p, _ := strconv.Atoi(strings.TrimSpace(entryLabels(e)[AutostartPriorityLabel]))
+	return p
+}
+
+// StartupOrder orders entries by priority, then moves each container after its
+// dependencies. A cycle is returned as a *CycleError.
+func StartupOrder(entries []StateEntry) ([]StateEntry, error) {
+	sorted := append([]StateEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool { return StartupPriority(sorted[i]) < StartupPriority(sorted[j]) })
+	return OrderEntries(sorted, StartupDeps(entries))
+}
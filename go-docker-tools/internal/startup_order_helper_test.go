@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// testEntry builds a saved container with the given labels
+func testEntry(name string, labels map[string]string) StateEntry {
+	return StateEntry{
+		Container: types.Container{ID: name + "-id", Names: []string{"/" + name}, State: "running"},
+		Config:    &container.Config{Image: "busybox", Labels: labels},
+	}
+}
+
+func TestStartupOrder(t *testing.T) {
+	netJoiner := testEntry("sidecar", nil)
+	netJoiner.HostConfig = &container.HostConfig{NetworkMode: "container:vpn-id"}
+
+	tests := []struct {
+		name    string
+		entries []StateEntry
+		want    []string
+		cycle   bool
+	}{
+		{
+			name:    "saved order without dependencies",
+			entries: []StateEntry{testEntry("a", nil), testEntry("b", nil), testEntry("c", nil)},
+			want:    []string{"a", "b", "c"},
+		},
+		{
+			name: "priority first",
+			entries: []StateEntry{
+				testEntry("a", map[string]string{AutostartPriorityLabel: "10"}),
+				testEntry("b", nil),
+				testEntry("c", map[string]string{AutostartPriorityLabel: "-1"}),
+			},
+			want: []string{"c", "b", "a"},
+		},
+		{
+			name: "autostart.after overrides priority",
+			entries: []StateEntry{
+				testEntry("app", map[string]string{AutostartAfterLabel: "db, cache"}),
+				testEntry("db", map[string]string{AutostartPriorityLabel: "5"}),
+				testEntry("cache", nil),
+			},
+			want: []string{"cache", "db", "app"},
+		},
+		{
+			name: "compose services of the same project",
+			entries: []StateEntry{
+				testEntry("shop-web-1", map[string]string{ComposeProjectLabel: "shop", ComposeServiceLabel: "web", AutostartAfterLabel: "db"}),
+				testEntry("shop-db-1", map[string]string{ComposeProjectLabel: "shop", ComposeServiceLabel: "db"}),
+			},
+			want: []string{"shop-db-1", "shop-web-1"},
+		},
+		{
+			name:    "network namespace owner first",
+			entries: []StateEntry{netJoiner, testEntry("vpn", nil)},
+			want:    []string{"vpn", "sidecar"},
+		},
+		{
+			name:    "unknown dependency is ignored",
+			entries: []StateEntry{testEntry("a", map[string]string{AutostartAfterLabel: "missing"}), testEntry("b", nil)},
+			want:    []string{"a", "b"},
+		},
+		{
+			name: "cycle",
+			entries: []StateEntry{
+				testEntry("a", map[string]string{AutostartAfterLabel: "b"}),
+				testEntry("b", map[string]string{AutostartAfterLabel: "a"}),
+			},
+			cycle: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := StartupOrder(tt.entries)
+			if tt.cycle {
+				var ce *CycleError
+				if !errors.As(err, &ce) {
+					t.Fatalf("StartupOrder() error = %v, want a *CycleError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StartupOrder() error = %v", err)
+			}
+			if names := entryNames(got); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("StartupOrder() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of StateChange
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// StateChange is one container that differs between two states
+type StateChange struct {
+	Container string        `json:"container"`
+	Kind      string        `json:"kind"`
+	Fields    []FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange is one differing property of a container. Env changes list only
+// the variable names, never their values.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// String formats the change for display
+func (f FieldChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", f.Field, orNone(f.Old), orNone(f.New))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// DiffStates reports containers added, removed or changed going from one state to another
+func DiffStates(from, to *SavedState) []StateChange {
+	var changes []StateChange
+	for _, e := range from.Containers {
+		other := to.Find(e.Name())
+		if other == nil {
+			changes = append(changes, StateChange{Container: e.Name(), Kind: ChangeRemoved})
+			continue
+		}
+		if fields := DiffEntries(e, *other); len(fields) > 0 {
+			changes = append(changes, StateChange{Container: e.Name(), Kind: ChangeChanged, Fields: fields})
+		}
+	}
+	for _, e := range to.Containers {
+		if from.Find(e.Name()) == nil {
+			changes = append(changes, StateChange{Container: e.Name(), Kind: ChangeAdded})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Container < changes[j].Container })
+	return changes
+}
+
+// DiffEntries compares image, ports, env and mounts of two saved containers
+func DiffEntries(from, to StateEntry) []FieldChange {
+	var fields []FieldChange
+	if old, cur := entryImage(from), entryImage(to); imageDiffers(from, to) {
+		fields = append(fields, FieldChange{Field: "image", Old: old, New: cur})
+	}
+	if old, cur := strings.Join(EntryPorts(from), ", "), strings.Join(EntryPorts(to), ", "); old != cur {
+		fields = append(fields, FieldChange{Field: "ports", Old: old, New: cur})
+	}
+	if old, cur := diffEnvKeys(from, to); old != "" || cur != "" {
+		fields = append(fields, FieldChange{Field: "env", Old: old, New: cur})
+	}
+	if old, cur := strings.Join(EntryMounts(from), ", "), strings.Join(EntryMounts(to), ", "); old != cur {
+		fields = append(fields, FieldChange{Field: "mounts", Old: old, New: cur})
+	}
+	return fields
+}
+
+// imageDiffers compares image IDs when both sides have one, else references
+func imageDiffers(a, b StateEntry) bool {
+	if a.ImageID != "" && b.ImageID != "" {
+		return a.ImageID != b.ImageID
+	}
+	if a.ImageRef() == "" || b.ImageRef() == "" {
+		// Name-only entries say nothing about the image
+		return false
+	}
+	return a.ImageRef() != b.ImageRef()
+}
+
+func entryImage(e StateEntry) string {
+	if e.ImageID == "" {
+		return e.ImageRef()
+	}
+	return fmt.Sprintf("%s (%s)", e.ImageRef(), ShortImageID(e.ImageID))
+}
+
+// EntryPorts lists published ports as [ip:]host->container/proto, sorted
+func EntryPorts(e StateEntry) []string {
+	seen := map[string]bool{}
+	var ports []string
+	add := func(ip, host, container string) {
+		p := host + "->" + container
+		if ip != "" && ip != "0.0.0.0" && ip != "::" {
+			p = ip + ":" + p
+		}
+		if !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	if e.HostConfig != nil && len(e.HostConfig.PortBindings) > 0 {
+		for port, bindings := range e.HostConfig.PortBindings {
+			for _, b := range bindings {
+				add(b.HostIP, b.HostPort, string(port))
+			}
+		}
+	} else {
+		for _, p := range e.Ports {
+			if p.PublicPort != 0 {
+				add(p.IP, fmt.Sprint(p.PublicPort), fmt.Sprintf("%d/%s", p.PrivatePort, p.Type))
+			}
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// EntryMounts lists mounts as source->destination, using the volume name for volumes
+func EntryMounts(e StateEntry) []string {
+	var mounts []string
+	if len(e.Mounts) > 0 {
+		for _, m := range e.Mounts {
+			src := m.Source
+			if m.Type == "volume" && m.Name != "" {
+				src = m.Name
+			}
+			mounts = append(mounts, src+"->"+m.Destination)
+		}
+	} else if e.HostConfig != nil {
+		for _, b := range e.HostConfig.Binds {
+			parts := strings.SplitN(b, ":", 3)
+			if len(parts) >= 2 {
+				mounts = append(mounts, parts[0]+"->"+parts[1])
+			}
+		}
+	}
+	sort.Strings(mounts)
+	return mounts
+}
+
+// diffEnvKeys returns the names of variables that differ, as seen from each side
+func diffEnvKeys(from, to StateEntry) (string, string) {
+	if from.Config == nil || to.Config == nil {
+		// Summary-only entries carry no env to compare
+		return "", ""
+	}
+	a, b := envMap(from), envMap(to)
+	var old, cur []string
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			old = append(old, k)
+		}
+	}
+	for k, v := range b {
+		if av, ok := a[k]; !ok || av != v {
+			cur = append(cur, k)
+		}
+	}
+	sort.Strings(old)
+	sort.Strings(cur)
+	return strings.Join(old, " "), strings.Join(cur, " ")
+}
+
+func envMap(e StateEntry) map[string]string {
+	env := map[string]string{}
+	for _, kv := range e.Config.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return env
+}
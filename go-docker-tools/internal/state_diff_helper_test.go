@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestDiffStates(t *testing.T) {
+	// web builds a full entry; each case tweaks a copy
+	web := func(tweak func(e *StateEntry)) StateEntry {
+		e := testEntry("web", nil)
+		e.ImageID = "sha256:aaaa"
+		e.Config.Image = "nginx:1.25"
+		e.Config.Env = []string{"PATH=/bin", "PASSWORD=hunter2"}
+		e.HostConfig = &container.HostConfig{
+			PortBindings: nat.PortMap{"80/tcp": {{HostPort: "8080"}}},
+			Binds:        []string{"/srv/www:/usr/share/nginx/html:ro"},
+		}
+		if tweak != nil {
+			tweak(&e)
+		}
+		return e
+	}
+	state := func(entries ...StateEntry) *SavedState { return &SavedState{Containers: entries} }
+	tests := []struct {
+		name string
+		from *SavedState
+		to   *SavedState
+		want []StateChange
+	}{
+		{name: "identical", from: state(web(nil)), to: state(web(nil))},
+		{
+			name: "added and removed",
+			from: state(web(nil), testEntry("old", nil)),
+			to:   state(testEntry("new", nil), web(nil)),
+			want: []StateChange{{Container: "new", Kind: ChangeAdded}, {Container: "old", Kind: ChangeRemoved}},
+		},
+		{
+			name: "image, ports, env and mounts",
+			from: state(web(nil)),
+			to: state(web(func(e *StateEntry) {
+				e.ImageID = "sha256:bbbb"
+				e.Config.Image = "nginx:1.27"
+				e.Config.Env = []string{"PATH=/bin", "PASSWORD=swordfish", "DEBUG=1"}
+				e.HostConfig.PortBindings["443/tcp"] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8443"}}
+				e.HostConfig.Binds = nil
+			})),
+			want: []StateChange{{Container: "web", Kind: ChangeChanged, Fields: []FieldChange{
+				{Field: "image", Old: "nginx:1.25 (aaaa)", New: "nginx:1.27 (bbbb)"},
+				{Field: "ports", Old: "8080->80/tcp", New: "127.0.0.1:8443->443/tcp, 8080->80/tcp"},
+				{Field: "env", Old: "PASSWORD", New: "DEBUG PASSWORD"},
+				{Field: "mounts", Old: "/srv/www->/usr/share/nginx/html"},
+			}}},
+		},
+		{
+			name: "same tag on a new image",
+			from: state(web(nil)),
+			to:   state(web(func(e *StateEntry) { e.ImageID = "sha256:cccc" })),
+			want: []StateChange{{Container: "web", Kind: ChangeChanged, Fields: []FieldChange{
+				{Field: "image", Old: "nginx:1.25 (aaaa)", New: "nginx:1.25 (cccc)"},
+			}}},
+		},
+		{
+			name: "summary-only entry",
+			from: state(web(nil)),
+			to: state(func() StateEntry {
+				e := testEntry("web", nil)
+				e.Config = nil
+				e.Ports = []types.Port{{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}}
+				e.Mounts = []types.MountPoint{{Type: mount.TypeBind, Source: "/srv/www", Destination: "/usr/share/nginx/html"}}
+				return e
+			}()),
+		},
+		{
+			name: "volume mounts by name",
+			from: state(web(func(e *StateEntry) {
+				e.Mounts = []types.MountPoint{{Type: mount.TypeVolume, Name: "www", Source: "/var/lib/docker/volumes/www/_data", Destination: "/data"}}
+			})),
+			to: state(web(func(e *StateEntry) {
+				e.Mounts = []types.MountPoint{{Type: mount.TypeVolume, Name: "www2", Source: "/var/lib/docker/volumes/www2/_data", Destination: "/data"}}
+			})),
+			want: []StateChange{{Container: "web", Kind: ChangeChanged, Fields: []FieldChange{
+				{Field: "mounts", Old: "www->/data", New: "www2->/data"},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffStates(tt.from, tt.to)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffStates() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+			for _, c := range got {
+				for _, f := range c.Fields {
+					if strings.Contains(f.String(), "hunter2") || strings.Contains(f.String(), "swordfish") {
+						t.Errorf("env value leaked in %q", f)
+					}
+				}
+			}
+		})
+	}
+}
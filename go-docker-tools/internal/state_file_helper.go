@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// StateFormatVersion is written into state files; version 1 was a bare container list
+const StateFormatVersion = 2
+
+// StateEntry is one saved container: the list summary plus what is needed to recreate it
+type StateEntry struct {
+	types.Container
+	RepoDigest string                `json:"RepoDigest,omitempty"`
+	Config     *container.Config     `json:"Config,omitempty"`
+	HostConfig *container.HostConfig `json:"HostConfig,omitempty"`
+	// PortRemaps lists host ports moved on restore because the saved ones were taken
+	PortRemaps []PortRemap `json:"PortRemaps,omitempty"`
+}
+
+// Name returns the container name without the leading slash
+func (e StateEntry) Name() string {
+	return ContainerName(e.Container)
+}
+
+// ImageRef returns the image reference the container was created from
+func (e StateEntry) ImageRef() string {
+	if e.Config != nil && e.Config.Image != "" {
+		return e.Config.Image
+	}
+	return e.Image
+}
+
+// SavedState is the content of a state file
+type SavedState struct {
+	Version    int          `json:"version"`
+	SavedAt    time.Time    `json:"saved_at"`
+	Containers []StateEntry `json:"containers"`
+	// Networks holds the user-defined networks the containers are attached to
+	Networks []SavedNetwork `json:"networks,omitempty"`
+}
+
+// Find returns the entry with the given container name or ID
+func (s *SavedState) Find(nameOrID string) *StateEntry {
+	for i := range s.Containers {
+		e := &s.Containers[i]
+		if e.Name() == strings.TrimPrefix(nameOrID, "/") || e.ID == nameOrID {
+			return e
+		}
+	}
+	return nil
+}
+
+// LoadState reads a state file, accepting the original bare container list too
+func LoadState(stateFile string) (*SavedState, error) {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParseState(data, stateFile)
+}
+
+// ParseState decodes state file content; source is only used to date legacy lists
+func ParseState(data []byte, source string) (*SavedState, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		state := &SavedState{Version: 1}
+		if err := json.Unmarshal(data, &state.Containers); err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(source); err == nil {
+			state.SavedAt = fi.ModTime()
+		}
+		return state, nil
+	}
+	var state SavedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// WriteState writes a state file atomically so readers never see a partial file
+func WriteState(stateFile string, state *SavedState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(stateFile, data, 0600)
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// CaptureState inspects containers and their images to build a state that pins
+// each container to its image ID and repo digest
+func CaptureState(dockerHelper *DockerHelper, containers []types.Container, logger *log.Logger) *SavedState {
+	state := &SavedState{Version: StateFormatVersion, SavedAt: time.Now()}
+	for _, c := range containers {
+		entry := StateEntry{Container: c}
+		info, err := dockerHelper.InspectContainer(c.ID)
+		if err != nil {
+			logger.Printf("Could not inspect container %s, saving summary only: %v", c.ID, err)
+			state.Containers = append(state.Containers, entry)
+			continue
+		}
+		entry.Config = info.Config
+		entry.HostConfig = info.HostConfig
+		entry.ImageID = info.Image
+		if info.NetworkSettings != nil {
+			entry.NetworkSettings = &types.SummaryNetworkSettings{Networks: info.NetworkSettings.Networks}
+		}
+		if img, err := dockerHelper.InspectImage(info.Image); err == nil {
+			entry.RepoDigest = pickRepoDigest(entry.ImageRef(), img.RepoDigests)
+		}
+		state.Containers = append(state.Containers, entry)
+	}
+	return state
+}
+
+// pickRepoDigest chooses the repo digest matching the repository of ref,
+// falling back to the first one
+func pickRepoDigest(ref string, digests []string) string {
+	repo := ref
+	if i := strings.LastIndex(repo, "@"); i >= 0 {
+		repo = repo[:i]
+	}
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	for _, d := range digests {
+		if strings.HasPrefix(d, repo+"@") {
+			return d
+		}
+	}
+	if len(digests) > 0 {
+		return digests[0]
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+const (
+	stateSnapshotPrefix = "state_"
+	stateSnapshotLayout = "20060102T150405.000"
+)
+
+// StateHistoryDir is where timestamped copies of the state are kept
+func StateHistoryDir(conf *config.Config) string {
+	return filepath.Join(conf.StateDir, "history")
+}
+
+// StateAutoHistoryDir holds the snapshots the daemon records on its own. They are
+// rotated separately so frequent container changes never evict a manual save.
+func StateAutoHistoryDir(conf *config.Config) string {
+	return filepath.Join(StateHistoryDir(conf), "auto")
+}
+
+// WriteInventory writes state to the state file and, when configured, the legacy
+// JSON inventory. A history snapshot is kept whenever the set of containers changed.
+func WriteInventory(conf *config.Config, state *SavedState, logger *log.Logger) error {
+	if conf.StateFile == "" {
+		return fmt.Errorf("STATE_FILE is not set")
+	}
+	changed := true
+	if prev, err := LoadState(conf.StateFile); err == nil {
+		carryPortRemaps(prev, state)
+		changed = stateFingerprint(prev) != stateFingerprint(state)
+	}
+	if err := WriteState(conf.StateFile, state); err != nil {
+		return err
+	}
+	if conf.JSONBackupFile != "" {
+		if err := WriteLegacyJSON(conf.JSONBackupFile, state); err != nil {
+			return fmt.Errorf("write %s: %w", conf.JSONBackupFile, err)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err := recordSnapshotIn(StateAutoHistoryDir(conf), conf, state, logger)
+	return err
+}
+
+// RecordStateSnapshot stores state in the history directory and rotates old snapshots
+func RecordStateSnapshot(conf *config.Config, state *SavedState, logger *log.Logger) (string, error) {
+	return recordSnapshotIn(StateHistoryDir(conf), conf, state, logger)
+}
+
+// recordSnapshotIn writes a snapshot to dir and rotates only that directory
+func recordSnapshotIn(dir string, conf *config.Config, state *SavedState, logger *log.Logger) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, stateSnapshotPrefix+state.SavedAt.Format(stateSnapshotLayout)+".json")
+	if err := WriteState(path, state); err != nil {
+		return "", err
+	}
+	rotateStateHistory(dir, conf.StateHistoryCount, logger)
+	return path, nil
+}
+
+// rotateStateHistory keeps the newest keep snapshots; keep <= 0 keeps all
+func rotateStateHistory(dir string, keep int, logger *log.Logger) {
+	if keep <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(dir, stateSnapshotPrefix+"*.json"))
+	if err != nil || len(files) <= keep {
+		return
+	}
+	// Snapshot names sort chronologically
+	sort.Strings(files)
+	for _, f := range files[:len(files)-keep] {
+		os.Remove(f)
+		logger.Println("Removed old state snapshot:", f)
+	}
+}
+
+// stateFingerprint identifies which containers a state holds, on which image and
+// in which state, ignoring volatile fields such as the status text
+func stateFingerprint(s *SavedState) string {
+	keys := make([]string, 0, len(s.Containers))
+	for _, e := range s.Containers {
+		keys = append(keys, strings.Join([]string{e.Name(), e.ID, e.ImageID, e.State}, "|"))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\n")
+}
+
+// StateSnapshot describes one file in the state history
+type StateSnapshot struct {
+	Name       string
+	Path       string
+	SavedAt    time.Time
+	Containers int
+	// Auto is set for snapshots the daemon recorded
+	Auto bool
+}
+
+// ListStateSnapshots returns the state history, manual and daemon snapshots
+// interleaved, newest first
+func ListStateSnapshots(conf *config.Config) ([]StateSnapshot, error) {
+	var files []string
+	for _, dir := range []string{StateHistoryDir(conf), StateAutoHistoryDir(conf)} {
+		matches, err := filepath.Glob(filepath.Join(dir, stateSnapshotPrefix+"*.json"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	// Snapshot names sort chronologically whichever directory they are in
+	sort.Slice(files, func(i, j int) bool { return filepath.Base(files[i]) > filepath.Base(files[j]) })
+	snapshots := make([]StateSnapshot, 0, len(files))
+	for _, f := range files {
+		snap := StateSnapshot{
+			Name: strings.TrimSuffix(filepath.Base(f), ".json"),
+			Path: f,
+			Auto: filepath.Dir(f) == StateAutoHistoryDir(conf),
+		}
+		if state, err := LoadState(f); err == nil {
+			snap.SavedAt = state.SavedAt
+			snap.Containers = len(state.Containers)
+		} else {
+			snap.Containers = -1
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
+
+// ResolveStateSnapshot turns a user reference into a state file path. It accepts
+// "current" (the state file), a path, a snapshot name with or without the state_
+// prefix or .json suffix, a timestamp prefix such as 20261018T03, or N for the
+// Nth newest snapshot as numbered by state list.
+func ResolveStateSnapshot(conf *config.Config, ref string) (string, error) {
+	if ref == "" || ref == "current" {
+		return conf.StateFile, nil
+	}
+	if _, err := os.Stat(ref); err == nil {
+		return ref, nil
+	}
+	snapshots, err := ListStateSnapshots(conf)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 1 && n <= len(snapshots) {
+		return snapshots[n-1].Path, nil
+	}
+	name := strings.TrimPrefix(strings.TrimSuffix(ref, ".json"), stateSnapshotPrefix)
+	for _, s := range snapshots {
+		if strings.HasPrefix(strings.TrimPrefix(s.Name, stateSnapshotPrefix), name) {
+			return s.Path, nil
+		}
+	}
+	return "", fmt.Errorf("no state snapshot matches %q", ref)
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+func TestStateHistoryRotation(t *testing.T) {
+	dir := t.TempDir()
+	conf := &config.Config{StateDir: dir, StateFile: filepath.Join(dir, "state.json"), StateHistoryCount: 2}
+	at := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+	stateAt := func(minute int, names ...string) *SavedState {
+		s := &SavedState{Version: StateFormatVersion, SavedAt: at.Add(time.Duration(minute) * time.Minute)}
+		for _, n := range names {
+			s.Containers = append(s.Containers, testEntry(n, nil))
+		}
+		return s
+	}
+
+	// Two manual saves, then a busy daemon writing six inventories of which five
+	// differ from the one before
+	for _, m := range []int{0, 1} {
+		if _, err := RecordStateSnapshot(conf, stateAt(m, "web"), testLogger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, names := range [][]string{{"web"}, {"web", "a"}, {"web", "a"}, {"web"}, {"web", "b"}, {"web"}} {
+		if err := WriteInventory(conf, stateAt(10+i, names...), testLogger); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := ListStateSnapshots(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range snapshots {
+		got = append(got, fmt.Sprintf("%s auto=%v containers=%d", s.SavedAt.Format("15:04"), s.Auto, s.Containers))
+	}
+	want := []string{
+		"03:15 auto=true containers=1",
+		"03:14 auto=true containers=2",
+		"03:01 auto=false containers=1",
+		"03:00 auto=false containers=1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshots:\n got %v\nwant %v", got, want)
+	}
+
+	// Numbers and names resolve across both directories
+	for ref, wantPath := range map[string]string{
+		"1":                   snapshots[0].Path,
+		"3":                   snapshots[2].Path,
+		snapshots[3].Name:     snapshots[3].Path,
+		"current":             conf.StateFile,
+		"20261018T0314":       snapshots[1].Path,
+		"state_20261018T0300": snapshots[3].Path,
+	} {
+		if path, err := ResolveStateSnapshot(conf, ref); err != nil || path != wantPath {
+			t.Errorf("ResolveStateSnapshot(%q) = %s, %v, want %s", ref, path, err, wantPath)
+		}
+	}
+}
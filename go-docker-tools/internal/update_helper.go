@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Labels that opt a container into image updates
+const (
+	// UpdateEnableLabel set to true lets update replace the container when its tag moves
+	UpdateEnableLabel = "update.enable"
+	// UpdateTimeoutLabel bounds the wait for the updated container, as a Go duration
+	UpdateTimeoutLabel = "update.timeout"
+)
+
+// DefaultUpdateTimeout applies when neither the label nor the caller sets a timeout
+const DefaultUpdateTimeout = 2 * time.Minute
+
+// updateSettleTime is how long a container without a health check or readiness gate
+// has to keep running to count as updated
+const updateSettleTime = 10 * time.Second
+
+// Statuses of UpdateResult
+const (
+	UpdateCurrent    = "up-to-date"
+	UpdateAvailable  = "available"
+	UpdateApplied    = "updated"
+	UpdateRolledBack = "rolled-back"
+	UpdateFailed     = "failed"
+	UpdateSkipped    = "skipped"
+)
+
+// UpdateResult is the outcome of checking or updating one container
+type UpdateResult struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	// From and To are the repo digests before and after
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Err    error  `json:"-"`
+	Error  string `json:"error,omitempty"`
+}
+
+// UpdateEnabled reports whether the container opted in with update.enable
+func UpdateEnabled(labels map[string]string) bool {
+	switch strings.ToLower(strings.TrimSpace(labels[UpdateEnableLabel])) {
+	case "true", "1", "yes":
+		return true
+	}
+	return false
+}
+
+// CheckUpdate compares the digest of the container's image with the one its tag
+// points to in the registry. Containers created from a digest or a local build are skipped.
+func CheckUpdate(dockerHelper *DockerHelper, entry StateEntry) UpdateResult {
+	r := UpdateResult{Container: entry.Name(), Image: entry.ImageRef(), Status: UpdateSkipped}
+	switch {
+	case r.Image == "":
+		r.Detail = "no image reference"
+		return r
+	case strings.Contains(r.Image, "@"):
+		r.Detail = "pinned by digest"
+		return r
+	case entry.RepoDigest == "":
+		r.Detail = "image has no registry digest (built locally?)"
+		return r
+	}
+	r.From = digestOf(entry.RepoDigest)
+	remote, err := dockerHelper.DistributionInspect(context.Background(), r.Image)
+	if err != nil {
+		r.Status, r.Err = UpdateFailed, fmt.Errorf("registry lookup: %w", err)
+		return r
+	}
+	r.To = string(remote.Descriptor.Digest)
+	if r.To == r.From {
+		r.Status, r.To = UpdateCurrent, ""
+		return r
+	}
+	r.Status = UpdateAvailable
+	return r
+}
+
+// Updater replaces containers with the newest image of their tag and rolls back the
+// ones that do not come up
+type Updater struct {
+	DockerHelper *DockerHelper
+	Logger       *log.Logger
+	// Timeout applies to containers without an update.timeout label
+	Timeout time.Duration
+}
+
+// Update pulls the tag, re-creates the container on it and waits for it to become
+// ready; on failure the container is re-created on its previous image
+func (u *Updater) Update(entry StateEntry, check UpdateResult) UpdateResult {
+	r := check
+	if err := u.DockerHelper.PullImage(r.Image); err != nil {
+		r.Status, r.Err = UpdateFailed, fmt.Errorf("pull %s: %w", r.Image, err)
+		return r
+	}
+	img, err := u.DockerHelper.InspectImage(r.Image)
+	if err != nil {
+		r.Status, r.Err = UpdateFailed, err
+		return r
+	}
+	if img.ID == entry.ImageID {
+		// The registry digest differs only by platform; the pulled image is the same
+		r.Status, r.To = UpdateCurrent, ""
+		return r
+	}
+	r.To = digestOf(pickRepoDigest(r.Image, img.RepoDigests))
+
+	newID, err := RecreateContainer(u.DockerHelper, entry, r.Image, true, u.Logger)
+	if err == nil {
+		err = u.waitReady(entry, newID)
+	}
+	if err == nil {
+		r.Status = UpdateApplied
+		r.Detail = fmt.Sprintf("%s -> %s", ShortImageID(entry.ImageID), ShortImageID(img.ID))
+		u.Logger.Printf("Updated %s to %s (%s)", r.Container, r.Image, r.To)
+		return r
+	}
+
+	u.Logger.Printf("Update of %s failed, rolling back to %s: %v", r.Container, ShortImageID(entry.ImageID), err)
+	r.Err = err
+	_, rbErr := RecreateContainer(u.DockerHelper, entry, CurrentImageRef(u.DockerHelper, entry), true, u.Logger)
+	if rbErr != nil {
+		r.Status = UpdateFailed
+		r.Detail = "rollback failed: " + rbErr.Error()
+		return r
+	}
+	r.Status = UpdateRolledBack
+	r.Detail = "back on " + ShortImageID(entry.ImageID)
+	return r
+}
+
+// waitReady waits for the updated container within update.timeout or the updater's timeout
+func (u *Updater) waitReady(entry StateEntry, id string) error {
+	timeout := u.Timeout
+	if timeout <= 0 {
+		timeout = DefaultUpdateTimeout
+	}
+	if t := entryLabels(entry)[UpdateTimeoutLabel]; t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q", UpdateTimeoutLabel, t)
+		}
+		timeout = d
+	}
+	return waitContainerReady(u.DockerHelper, entry, id, timeout)
+}
+
+// waitContainerReady uses the container's readiness gate, else its health check, else
+// requires it to keep running without restarts for a short while
+func waitContainerReady(dockerHelper *DockerHelper, entry StateEntry, id string, timeout time.Duration) error {
+	gate, err := ParseReadinessGate(entry)
+	if err != nil {
+		return err
+	}
+	if gate == nil && hasHealthcheck(entry) {
+		gate = &ReadinessGate{Kind: GateHealth}
+	}
+	if gate != nil {
+		gate.Timeout = timeout
+		return gate.Wait(context.Background(), dockerHelper, id)
+	}
+	settle := updateSettleTime
+	if timeout < settle {
+		settle = timeout
+	}
+	return waitStillRunning(dockerHelper, id, settle)
+}
+
+func hasHealthcheck(entry StateEntry) bool {
+	if entry.Config == nil || entry.Config.Healthcheck == nil {
+		return false
+	}
+	test := entry.Config.Healthcheck.Test
+	return len(test) > 0 && test[0] != "NONE"
+}
+
+// waitStillRunning fails if the container stops or restarts within d
+func waitStillRunning(dockerHelper *DockerHelper, id string, d time.Duration) error {
+	deadline := time.Now().Add(d)
+	restarts := -1
+	for {
+		info, err := dockerHelper.InspectContainer(id)
+		if err != nil {
+			return err
+		}
+		if info.State == nil || !info.State.Running {
+			return fmt.Errorf("container exited%s", exitDetail(info))
+		}
+		if restarts >= 0 && info.RestartCount > restarts {
+			return fmt.Errorf("container restarted")
+		}
+		restarts = info.RestartCount
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
+
+func exitDetail(info types.ContainerJSON) string {
+	if info.State == nil {
+		return ""
+	}
+	return fmt.Sprintf(" with code %d", info.State.ExitCode)
+}
+
+// digestOf returns the sha256:... part of repo@sha256:...
+func digestOf(repoDigest string) string {
+	if i := strings.LastIndex(repoDigest, "@"); i >= 0 {
+		return repoDigest[i+1:]
+	}
+	return repoDigest
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+var appImageV2 = types.ImageInspect{
+	ID:          "sha256:" + strings.Repeat("c", 64),
+	RepoTags:    []string{"app:1"},
+	RepoDigests: []string{"app@sha256:" + strings.Repeat("e", 64)},
+}
+
+// updateFixture runs web on app:1 and lets the registry serve registryImage for app:1
+func updateFixture(t *testing.T, registryImage types.ImageInspect, image string) (*fakeDocker, *DockerHelper, StateEntry) {
+	t.Helper()
+	f := newFakeDocker()
+	f.addImage(appImage)
+	f.registry["app:1"] = registryImage
+	f.addContainer("web", appImage, &container.Config{Image: image}, nil, true)
+	d := f.helper(t)
+	containers, err := d.ListAllContainers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, d, CaptureState(d, containers, testLogger).Containers[0]
+}
+
+func TestCheckUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		registry   types.ImageInspect
+		image      string
+		noDigest   bool
+		wantStatus string
+	}{
+		{name: "up to date", registry: appImage, image: "app:1", wantStatus: UpdateCurrent},
+		{name: "new digest", registry: appImageV2, image: "app:1", wantStatus: UpdateAvailable},
+		{name: "pinned by digest", registry: appImageV2, image: appImage.RepoDigests[0], wantStatus: UpdateSkipped},
+		{name: "local build", registry: appImageV2, image: "app:1", noDigest: true, wantStatus: UpdateSkipped},
+		{name: "registry error", registry: types.ImageInspect{}, image: "app:1", wantStatus: UpdateFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, d, entry := updateFixture(t, tt.registry, tt.image)
+			if tt.noDigest {
+				entry.RepoDigest = ""
+			}
+			r := CheckUpdate(d, entry)
+			if r.Status != tt.wantStatus {
+				t.Errorf("CheckUpdate() status = %s (%s, %v), want %s", r.Status, r.Detail, r.Err, tt.wantStatus)
+			}
+			if r.Status == UpdateAvailable && r.To != digestOf(appImageV2.RepoDigests[0]) {
+				t.Errorf("CheckUpdate() to = %s", r.To)
+			}
+		})
+	}
+}
+
+func TestUpdaterUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		newExits   bool
+		wantStatus string
+		wantImage  string
+	}{
+		{name: "updated", wantStatus: UpdateApplied, wantImage: appImageV2.ID},
+		{name: "new image exits and is rolled back", newExits: true, wantStatus: UpdateRolledBack, wantImage: appImage.ID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, d, entry := updateFixture(t, appImageV2, "app:1")
+			if tt.newExits {
+				f.onStart = func(c *fakeContainer) *types.ContainerState {
+					if c.Image == appImageV2.ID {
+						return &types.ContainerState{Status: "exited", ExitCode: 1}
+					}
+					return nil
+				}
+			}
+			u := &Updater{DockerHelper: d, Logger: testLogger, Timeout: 10 * time.Millisecond}
+			r := u.Update(entry, CheckUpdate(d, entry))
+			if r.Status != tt.wantStatus {
+				t.Fatalf("Update() status = %s (%s, %v), want %s", r.Status, r.Detail, r.Err, tt.wantStatus)
+			}
+			web := f.byName("web")
+			if web == nil || !web.State.Running || web.Image != tt.wantImage {
+				t.Fatalf("web after update = %+v", web)
+			}
+			if names := sortedNames(f); len(names) != 1 {
+				t.Errorf("containers left = %v, want only web", names)
+			}
+		})
+	}
+}
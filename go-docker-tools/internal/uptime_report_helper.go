@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FabulaNox/go-docker-tools/config"
+)
+
+// longestOutagesShown is how many outages the report lists per container
+const longestOutagesShown = 3
+
+// Outage is one stretch of time a container was not running or unhealthy
+type Outage struct {
+	Start time.Time `json:"start"`
+	// End is nil while the outage lasts
+	End     *time.Time `json:"end,omitempty"`
+	Seconds float64    `json:"seconds"`
+}
+
+// UptimeStats is the availability of one container over the report window
+type UptimeStats struct {
+	Container string `json:"container"`
+	// Availability is the percentage of observed time the container was up
+	Availability    float64  `json:"availability_percent"`
+	ObservedSeconds float64  `json:"observed_seconds"`
+	DowntimeSeconds float64  `json:"downtime_seconds"`
+	Outages         int      `json:"outages"`
+	LongestOutages  []Outage `json:"longest_outages"`
+	Restarts        int      `json:"restarts"`
+	State           string   `json:"state"`
+}
+
+// UptimeReport summarises the health history between Since and Until
+type UptimeReport struct {
+	Since      time.Time     `json:"since"`
+	Until      time.Time     `json:"until"`
+	Containers []UptimeStats `json:"containers"`
+}
+
+// HealthStaleAfter is how long after a record the collector is assumed to have been
+// running; time past it without a new record is left out of the availability
+func HealthStaleAfter(conf *config.Config) time.Duration {
+	stale := 2 * healthHeartbeatInterval
+	if d := 2 * conf.HealthCheckInterval; d > stale {
+		stale = d
+	}
+	return stale
+}
+
+// ParseSince accepts a look-back such as 30d, 2w or 12h, or a date or RFC 3339 time
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); err == nil && strings.HasSuffix(s, suffix) && n >= 0 {
+			return now.Add(-time.Duration(n) * unit), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q (want e.g. 30d, 12h or 2026-09-01)", s)
+}
+
+type uptimeAcc struct {
+	stats       UptimeStats
+	current     *HealthRecord
+	wasUp       bool
+	open        *Outage
+	outages     []Outage
+	observed    time.Duration
+	down        time.Duration
+	openCounted time.Duration
+}
+
+func recordDown(r *HealthRecord) bool {
+	return r.State != "running" || r.Health == "unhealthy"
+}
+
+// BuildUptimeReport replays the health history. Only containers that have been up at
+// some point are reported, so containers that are deliberately kept stopped do not
+// show up as outages.
+func BuildUptimeReport(records []HealthRecord, since, until time.Time, staleAfter time.Duration) *UptimeReport {
+	accs := map[string]*uptimeAcc{}
+	// account adds the observed part of [from, to) to every known container
+	account := func(from, to time.Time) {
+		if to.After(from.Add(staleAfter)) {
+			to = from.Add(staleAfter)
+		}
+		if from.Before(since) {
+			from = since
+		}
+		if to.After(until) {
+			to = until
+		}
+		if !to.After(from) {
+			return
+		}
+		span := to.Sub(from)
+		for _, a := range accs {
+			if a.current == nil || a.current.State == StateRemoved {
+				continue
+			}
+			a.observed += span
+			if recordDown(a.current) {
+				a.down += span
+				if a.open != nil {
+					a.openCounted += span
+				}
+			}
+		}
+	}
+	closeOutage := func(a *uptimeAcc, at time.Time) {
+		if a.open == nil {
+			return
+		}
+		end := at
+		a.open.End = &end
+		a.open.Seconds = a.openCounted.Seconds()
+		a.outages = append(a.outages, *a.open)
+		a.open = nil
+	}
+
+	var prev time.Time
+	for i := range records {
+		r := records[i]
+		if r.Time.After(until) {
+			break
+		}
+		if !prev.IsZero() {
+			account(prev, r.Time)
+		}
+		prev = r.Time
+		if r.Kind != RecordTransition || r.Container == "" {
+			continue
+		}
+		a := accs[r.Container]
+		if a == nil {
+			a = &uptimeAcc{stats: UptimeStats{Container: r.Container}}
+			accs[r.Container] = a
+		}
+		old := a.current
+		inWindow := !r.Time.Before(since)
+		if inWindow && old != nil && old.State != StateRemoved {
+			// A restart by the restart policy bumps the count and may also be seen as
+			// exited -> running; only a start that left the count alone adds one
+			if r.Restarts > old.Restarts {
+				a.stats.Restarts += r.Restarts - old.Restarts
+			} else if r.State == "running" && (old.State == "exited" || old.State == "dead") {
+				a.stats.Restarts++
+			}
+		}
+		switch {
+		case r.State == StateRemoved:
+			closeOutage(a, r.Time)
+		case recordDown(&r) && (old == nil || old.State == StateRemoved || !recordDown(old)):
+			start := r.Time
+			if start.Before(since) {
+				start = since
+			}
+			a.open, a.openCounted = &Outage{Start: start}, 0
+		case !recordDown(&r) && a.open != nil:
+			closeOutage(a, r.Time)
+		}
+		if !recordDown(&r) {
+			a.wasUp = true
+		}
+		a.current = &r
+	}
+	if !prev.IsZero() {
+		account(prev, until)
+	}
+
+	report := &UptimeReport{Since: since, Until: until, Containers: []UptimeStats{}}
+	for _, a := range accs {
+		if !a.wasUp {
+			continue
+		}
+		if a.open != nil {
+			a.open.Seconds = a.openCounted.Seconds()
+			a.outages = append(a.outages, *a.open)
+		}
+		s := a.stats
+		s.ObservedSeconds = a.observed.Seconds()
+		s.DowntimeSeconds = a.down.Seconds()
+		if a.observed > 0 {
+			s.Availability = 100 * float64(a.observed-a.down) / float64(a.observed)
+		}
+		if a.current != nil {
+			s.State = a.current.State
+			if a.current.Health != "" && a.current.State == "running" {
+				s.State += " (" + a.current.Health + ")"
+			}
+		}
+		// Outages that ended before the window only set the state; they are not counted
+		var outages []Outage
+		for _, o := range a.outages {
+			if o.End == nil || o.End.After(since) {
+				outages = append(outages, o)
+			}
+		}
+		s.Outages = len(outages)
+		sort.SliceStable(outages, func(i, j int) bool { return outages[i].Seconds > outages[j].Seconds })
+		if len(outages) > longestOutagesShown {
+			outages = outages[:longestOutagesShown]
+		}
+		s.LongestOutages = outages
+		report.Containers = append(report.Containers, s)
+	}
+	sort.Slice(report.Containers, func(i, j int) bool { return report.Containers[i].Container < report.Containers[j].Container })
+	return report
+}
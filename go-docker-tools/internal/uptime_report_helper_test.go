@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildUptimeReport(t *testing.T) {
+	t0 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return t0.Add(time.Duration(minutes) * time.Minute) }
+	tr := func(minutes int, name, state, health string, restarts int) HealthRecord {
+		return HealthRecord{Time: at(minutes), Kind: RecordTransition, Container: name, State: state, Health: health, Restarts: restarts}
+	}
+	hb := func(minutes int) HealthRecord { return HealthRecord{Time: at(minutes), Kind: RecordHeartbeat} }
+
+	type want struct {
+		availability float64
+		downtime     float64
+		outages      int
+		restarts     int
+		state        string
+	}
+	tests := []struct {
+		name    string
+		records []HealthRecord
+		since   time.Time
+		until   time.Time
+		want    map[string]want
+	}{
+		{
+			name:    "always up",
+			records: []HealthRecord{tr(0, "web", "running", "", 0), hb(10)},
+			since:   at(0), until: at(20),
+			want: map[string]want{"web": {availability: 100, state: "running"}},
+		},
+		{
+			name: "one outage and a manual start",
+			records: []HealthRecord{
+				tr(0, "web", "running", "", 0),
+				tr(10, "web", "exited", "", 0),
+				tr(15, "web", "running", "", 0),
+			},
+			since: at(0), until: at(20),
+			want: map[string]want{"web": {availability: 75, downtime: 300, outages: 1, restarts: 1, state: "running"}},
+		},
+		{
+			name: "policy restart seen as exited is counted once",
+			records: []HealthRecord{
+				tr(0, "web", "running", "", 0),
+				tr(10, "web", "exited", "", 0),
+				tr(12, "web", "running", "", 1),
+			},
+			since: at(0), until: at(20),
+			want: map[string]want{"web": {availability: 90, downtime: 120, outages: 1, restarts: 1, state: "running"}},
+		},
+		{
+			name: "unhealthy counts as down",
+			records: []HealthRecord{
+				tr(0, "api", "running", "healthy", 0),
+				tr(5, "api", "running", "unhealthy", 0),
+				tr(10, "api", "running", "healthy", 0),
+			},
+			since: at(0), until: at(20),
+			want: map[string]want{"api": {availability: 75, downtime: 300, outages: 1, state: "running (healthy)"}},
+		},
+		{
+			name:    "never up is not reported",
+			records: []HealthRecord{tr(0, "job", "exited", "", 0), tr(0, "web", "running", "", 0)},
+			since:   at(0), until: at(20),
+			want: map[string]want{"web": {availability: 100, state: "running"}},
+		},
+		{
+			name:    "gaps past staleAfter are not observed",
+			records: []HealthRecord{tr(0, "web", "running", "", 0), tr(30, "web", "exited", "", 0), tr(40, "web", "running", "", 0)},
+			since:   at(0), until: at(40),
+			// 20 minutes observed while up, 10 down
+			want: map[string]want{"web": {availability: 200.0 / 3, downtime: 600, outages: 1, restarts: 1, state: "running"}},
+		},
+		{
+			name: "before the window only sets the state",
+			records: []HealthRecord{
+				tr(0, "web", "running", "", 0),
+				tr(5, "web", "exited", "", 0),
+				tr(8, "web", "running", "", 0),
+				hb(18),
+			},
+			since: at(10), until: at(20),
+			want: map[string]want{"web": {availability: 100, state: "running"}},
+		},
+		{
+			name:    "open outage at the end",
+			records: []HealthRecord{tr(0, "web", "running", "", 0), tr(15, "web", "exited", "", 0)},
+			since:   at(0), until: at(20),
+			want: map[string]want{"web": {availability: 75, downtime: 300, outages: 1, state: "exited"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := BuildUptimeReport(tt.records, tt.since, tt.until, 20*time.Minute)
+			if len(report.Containers) != len(tt.want) {
+				t.Fatalf("got %d containers, want %d: %+v", len(report.Containers), len(tt.want), report.Containers)
+			}
+			for _, s := range report.Containers {
+				w, ok := tt.want[s.Container]
+				if !ok {
+					t.Errorf("unexpected container %s", s.Container)
+					continue
+				}
+				if diff := s.Availability - w.availability; diff > 0.001 || diff < -0.001 {
+					t.Errorf("%s availability = %.3f, want %.3f", s.Container, s.Availability, w.availability)
+				}
+				if s.DowntimeSeconds != w.downtime || s.Outages != w.outages || s.Restarts != w.restarts || s.State != w.state {
+					t.Errorf("%s = downtime %v outages %d restarts %d state %q, want %v %d %d %q",
+						s.Container, s.DowntimeSeconds, s.Outages, s.Restarts, s.State, w.downtime, w.outages, w.restarts, w.state)
+				}
+			}
+		})
+	}
+}